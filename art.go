@@ -0,0 +1,447 @@
+package caskdb
+
+import "bytes"
+
+// OrderedIndex is an Index which keeps its keys in order, so that the range and the
+// prefix scans only visit the keys they return. KeysWithPrefix, and Range without
+// Options.SortedIndex, take advantage of it when the index implements it.
+type OrderedIndex interface {
+	Index
+	// RangeFrom calls fn for every key which is equal to or greater than start and its
+	// entry, in ascending order, until fn returns false
+	RangeFrom(start string, fn func(key string, keyEntry KeyEntry) bool)
+	// RangePrefix calls fn for every key which starts with the prefix and its entry, in
+	// ascending order, until fn returns false
+	RangePrefix(prefix string, fn func(key string, keyEntry KeyEntry) bool)
+}
+
+// The kinds of the nodes of an artIndex, by the number of children they have room for.
+const (
+	artNode4 = iota
+	artNode16
+	artNode48
+	artNode256
+)
+
+// artIndex is an OrderedIndex backed by an adaptive radix tree, as described in "The
+// Adaptive Radix Tree: ARTful Indexing for Main-Memory Databases" by Leis et al. Each
+// node branches on one byte of the key and grows from 4 to 16, 48 and 256 children as
+// needed, and the runs of bytes without any branching are collapsed into the prefix
+// of a single node. The keys are not stored anywhere; they are rebuilt from the path
+// when scanned. So the keys sharing long prefixes, like "user:1234:name", take a lot
+// less memory than in a map.
+type artIndex struct {
+	root *artNode
+	size int
+}
+
+type artNode struct {
+	kind uint8
+	// prefix is the bytes of the path compressed into the node, which all the keys
+	// below it share
+	prefix []byte
+	// the key which ends at this node, after its prefix, if hasEntry is set
+	hasEntry bool
+	entry    KeyEntry
+	// keys has the bytes of the children, sorted, in a node4 or a node16, which line
+	// up with the children. In a node48, index maps a byte to 1 + the slot of its
+	// child in children, and 0 if there is none. A node256 has the child of a byte
+	// at children[b].
+	keys     []byte
+	index    *[256]uint8
+	children []*artNode
+	// count is the number of children
+	count int
+}
+
+// NewARTIndex returns an empty OrderedIndex backed by an adaptive radix tree, to be
+// used as Options.NewIndex. It gives the prefix and the range scans which only touch
+// the matching keys, and takes less memory than the default map for the keys which
+// share prefixes, for somewhat slower lookups.
+func NewARTIndex() Index {
+	return &artIndex{}
+}
+
+func newARTLeaf(suffix string, keyEntry KeyEntry) *artNode {
+	return &artNode{prefix: []byte(suffix), hasEntry: true, entry: keyEntry}
+}
+
+func (t *artIndex) Put(key string, keyEntry KeyEntry) {
+	if t.root == nil {
+		t.root = newARTLeaf(key, keyEntry)
+		t.size++
+		return
+	}
+	t.root = t.insert(t.root, key, 0, keyEntry)
+}
+
+// insert puts the key into the subtree of n, which starts at the depth-th byte of the
+// key, and returns the node which replaces n.
+func (t *artIndex) insert(n *artNode, key string, depth int, keyEntry KeyEntry) *artNode {
+	rest := key[depth:]
+	p := commonPrefixLen(n.prefix, rest)
+	if p < len(n.prefix) {
+		// the key leaves the prefix half way; split it at that point
+		parent := &artNode{prefix: n.prefix[:p:p]}
+		b := n.prefix[p]
+		n.prefix = n.prefix[p+1:]
+		parent.addChild(b, n)
+		if p == len(rest) {
+			parent.hasEntry, parent.entry = true, keyEntry
+		} else {
+			parent.addChild(rest[p], newARTLeaf(rest[p+1:], keyEntry))
+		}
+		t.size++
+		return parent
+	}
+	if p == len(rest) {
+		if !n.hasEntry {
+			t.size++
+		}
+		n.hasEntry, n.entry = true, keyEntry
+		return n
+	}
+	b := rest[p]
+	if child := n.child(b); child != nil {
+		if replaced := t.insert(child, key, depth+p+1, keyEntry); replaced != child {
+			n.setChild(b, replaced)
+		}
+		return n
+	}
+	n.addChild(b, newARTLeaf(rest[p+1:], keyEntry))
+	t.size++
+	return n
+}
+
+func (t *artIndex) Get(key string) (KeyEntry, bool) {
+	n := t.root
+	for n != nil {
+		if len(key) < len(n.prefix) || key[:len(n.prefix)] != string(n.prefix) {
+			return KeyEntry{}, false
+		}
+		key = key[len(n.prefix):]
+		if key == "" {
+			return n.entry, n.hasEntry
+		}
+		n, key = n.child(key[0]), key[1:]
+	}
+	return KeyEntry{}, false
+}
+
+func (t *artIndex) Delete(key string) {
+	if t.root == nil {
+		return
+	}
+	if replaced, ok := t.delete(t.root, key); ok {
+		t.root = replaced
+		t.size--
+	}
+}
+
+// delete drops the rest of the key from the subtree of n, and returns the node which
+// replaces n, nil if the subtree is empty now. It reports false if the key was not in
+// the subtree.
+func (t *artIndex) delete(n *artNode, rest string) (*artNode, bool) {
+	if len(rest) < len(n.prefix) || rest[:len(n.prefix)] != string(n.prefix) {
+		return n, false
+	}
+	rest = rest[len(n.prefix):]
+	if rest == "" {
+		if !n.hasEntry {
+			return n, false
+		}
+		n.hasEntry, n.entry = false, KeyEntry{}
+		return n.compact(), true
+	}
+	b := rest[0]
+	child := n.child(b)
+	if child == nil {
+		return n, false
+	}
+	replaced, ok := t.delete(child, rest[1:])
+	if !ok {
+		return n, false
+	}
+	if replaced == nil {
+		n.removeChild(b)
+	} else if replaced != child {
+		n.setChild(b, replaced)
+	}
+	return n.compact(), true
+}
+
+func (t *artIndex) Len() int {
+	return t.size
+}
+
+func (t *artIndex) Range(fn func(key string, keyEntry KeyEntry) bool) {
+	t.RangePrefix("", fn)
+}
+
+func (t *artIndex) RangeFrom(start string, fn func(key string, keyEntry KeyEntry) bool) {
+	if t.root != nil {
+		t.root.walkFrom(nil, start, fn)
+	}
+}
+
+func (t *artIndex) RangePrefix(prefix string, fn func(key string, keyEntry KeyEntry) bool) {
+	n, depth := t.root, 0
+	var path []byte
+	for n != nil {
+		rest := prefix[depth:]
+		if len(rest) <= len(n.prefix) {
+			// the prefix ends in this node: all of its subtree matches, or none of it
+			if string(n.prefix[:len(rest)]) == rest {
+				n.walk(path, fn)
+			}
+			return
+		}
+		if string(n.prefix) != rest[:len(n.prefix)] {
+			return
+		}
+		path = append(path, n.prefix...)
+		depth += len(n.prefix)
+		path = append(path, prefix[depth])
+		n = n.child(prefix[depth])
+		depth++
+	}
+}
+
+// walk calls fn for all the keys in the subtree of n in order, path being the bytes of
+// the key before n, and reports whether fn wants more.
+func (n *artNode) walk(path []byte, fn func(key string, keyEntry KeyEntry) bool) bool {
+	path = append(path, n.prefix...)
+	if n.hasEntry && !fn(string(path), n.entry) {
+		return false
+	}
+	more := true
+	n.eachChild(0, func(b byte, child *artNode) bool {
+		more = child.walk(append(path, b), fn)
+		return more
+	})
+	return more
+}
+
+// walkFrom is walk for the keys which are equal to or greater than start only.
+func (n *artNode) walkFrom(path []byte, start string, fn func(key string, keyEntry KeyEntry) bool) bool {
+	path = append(path, n.prefix...)
+	bound := start
+	if len(bound) > len(path) {
+		bound = bound[:len(path)]
+	}
+	switch c := bytes.Compare(path, []byte(bound)); {
+	case c < 0:
+		// all the keys below n are smaller than start
+		return true
+	case c > 0 || len(path) >= len(start):
+		// and here all of them are greater or equal
+		return n.walk(path[:len(path)-len(n.prefix)], fn)
+	}
+	// path is a proper prefix of start: the entry of n is smaller than start, and so
+	// are the children before the next byte of start
+	next := start[len(path)]
+	more := true
+	n.eachChild(next, func(b byte, child *artNode) bool {
+		if b == next {
+			more = child.walkFrom(append(path, b), start, fn)
+		} else {
+			more = child.walk(append(path, b), fn)
+		}
+		return more
+	})
+	return more
+}
+
+// commonPrefixLen returns the length of the longest common prefix of a and b.
+func commonPrefixLen(a []byte, b string) int {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	return i
+}
+
+// child returns the child of n for the byte b, nil if it has none.
+func (n *artNode) child(b byte) *artNode {
+	switch n.kind {
+	case artNode4, artNode16:
+		for i := 0; i < n.count; i++ {
+			if n.keys[i] == b {
+				return n.children[i]
+			}
+		}
+	case artNode48:
+		if slot := n.index[b]; slot > 0 {
+			return n.children[slot-1]
+		}
+	case artNode256:
+		return n.children[b]
+	}
+	return nil
+}
+
+// setChild replaces the existing child of n for the byte b.
+func (n *artNode) setChild(b byte, child *artNode) {
+	switch n.kind {
+	case artNode4, artNode16:
+		for i := 0; i < n.count; i++ {
+			if n.keys[i] == b {
+				n.children[i] = child
+			}
+		}
+	case artNode48:
+		n.children[n.index[b]-1] = child
+	case artNode256:
+		n.children[b] = child
+	}
+}
+
+// addChild adds a child for the byte b, which n has none for, growing n if it is full.
+func (n *artNode) addChild(b byte, child *artNode) {
+	switch n.kind {
+	case artNode4, artNode16:
+		if n.count == artCapacity(n.kind) {
+			n.grow()
+			n.addChild(b, child)
+			return
+		}
+		i := 0
+		for i < n.count && n.keys[i] < b {
+			i++
+		}
+		n.keys = append(n.keys, 0)
+		copy(n.keys[i+1:], n.keys[i:])
+		n.keys[i] = b
+		n.children = append(n.children, nil)
+		copy(n.children[i+1:], n.children[i:])
+		n.children[i] = child
+	case artNode48:
+		if n.count == 48 {
+			n.grow()
+			n.addChild(b, child)
+			return
+		}
+		slot := 0
+		for n.children[slot] != nil {
+			slot++
+		}
+		n.children[slot] = child
+		n.index[b] = uint8(slot + 1)
+	case artNode256:
+		n.children[b] = child
+	}
+	n.count++
+}
+
+// removeChild drops the child of n for the byte b, shrinking n if it gets sparse.
+func (n *artNode) removeChild(b byte) {
+	switch n.kind {
+	case artNode4, artNode16:
+		for i := 0; i < n.count; i++ {
+			if n.keys[i] == b {
+				n.keys = append(n.keys[:i], n.keys[i+1:]...)
+				n.children = append(n.children[:i], n.children[i+1:]...)
+				break
+			}
+		}
+	case artNode48:
+		n.children[n.index[b]-1] = nil
+		n.index[b] = 0
+	case artNode256:
+		n.children[b] = nil
+	}
+	n.count--
+	if n.kind > artNode4 && n.count <= artCapacity(n.kind-1)/2 {
+		n.shrink()
+	}
+}
+
+// artCapacity returns the number of children a node of the kind has room for.
+func artCapacity(kind uint8) int {
+	switch kind {
+	case artNode4:
+		return 4
+	case artNode16:
+		return 16
+	case artNode48:
+		return 48
+	}
+	return 256
+}
+
+// eachChild calls fn for the children of n for the bytes from b up, in order, until fn
+// returns false.
+func (n *artNode) eachChild(from byte, fn func(b byte, child *artNode) bool) {
+	switch n.kind {
+	case artNode4, artNode16:
+		for i := 0; i < n.count; i++ {
+			if n.keys[i] >= from && !fn(n.keys[i], n.children[i]) {
+				return
+			}
+		}
+	case artNode48:
+		for b := int(from); b < 256; b++ {
+			if slot := n.index[b]; slot > 0 && !fn(byte(b), n.children[slot-1]) {
+				return
+			}
+		}
+	case artNode256:
+		for b := int(from); b < 256; b++ {
+			if child := n.children[b]; child != nil && !fn(byte(b), child) {
+				return
+			}
+		}
+	}
+}
+
+// grow turns n into the next larger kind of node, keeping its children.
+func (n *artNode) grow() {
+	n.rebuild(n.kind + 1)
+}
+
+// shrink turns n into the next smaller kind of node, keeping its children.
+func (n *artNode) shrink() {
+	n.rebuild(n.kind - 1)
+}
+
+func (n *artNode) rebuild(kind uint8) {
+	var keys []byte
+	var children []*artNode
+	n.eachChild(0, func(b byte, child *artNode) bool {
+		keys = append(keys, b)
+		children = append(children, child)
+		return true
+	})
+	n.kind, n.count = kind, 0
+	n.keys, n.index, n.children = nil, nil, nil
+	switch kind {
+	case artNode48:
+		n.index = new([256]uint8)
+		n.children = make([]*artNode, 48)
+	case artNode256:
+		n.children = make([]*artNode, 256)
+	}
+	for i, b := range keys {
+		n.addChild(b, children[i])
+	}
+}
+
+// compact returns the node which replaces n after a delete below it: nil if n is
+// empty, its only child with the prefix extended if n has no entry, or n itself.
+func (n *artNode) compact() *artNode {
+	if n.hasEntry || n.count > 1 {
+		return n
+	}
+	if n.count == 0 {
+		return nil
+	}
+	var only *artNode
+	n.eachChild(0, func(b byte, child *artNode) bool {
+		prefix := make([]byte, 0, len(n.prefix)+1+len(child.prefix))
+		prefix = append(append(append(prefix, n.prefix...), b), child.prefix...)
+		child.prefix = prefix
+		only = child
+		return false
+	})
+	return only
+}
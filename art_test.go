@@ -0,0 +1,142 @@
+package caskdb
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// artKeys collects the keys visited by a scan of an OrderedIndex.
+func artKeys(scan func(fn func(key string, keyEntry KeyEntry) bool)) []string {
+	var keys []string
+	scan(func(key string, _ KeyEntry) bool {
+		keys = append(keys, key)
+		return true
+	})
+	return keys
+}
+
+func TestARTIndex(t *testing.T) {
+	idx := NewARTIndex().(OrderedIndex)
+	want := make(map[string]KeyEntry)
+	r := rand.New(rand.NewSource(1))
+	// short keys from a small alphabet share a lot of prefixes and are prefixes of each
+	// other; the binary ones make the nodes grow up to 256 children
+	randomKey := func() string {
+		if r.Intn(4) == 0 {
+			return string([]byte{byte(r.Intn(256)), byte(r.Intn(256))})
+		}
+		b := make([]byte, r.Intn(6))
+		for i := range b {
+			b[i] = "abc"[r.Intn(3)]
+		}
+		return string(b)
+	}
+	for i := 0; i < 20000; i++ {
+		key := randomKey()
+		if r.Intn(3) == 0 {
+			idx.Delete(key)
+			delete(want, key)
+		} else {
+			keyEntry := KeyEntry{Offset: uint32(i)}
+			idx.Put(key, keyEntry)
+			want[key] = keyEntry
+		}
+	}
+	if idx.Len() != len(want) {
+		t.Errorf("Len() = %v, want %v", idx.Len(), len(want))
+	}
+	var sorted []string
+	for key, keyEntry := range want {
+		sorted = append(sorted, key)
+		if got, ok := idx.Get(key); !ok || got != keyEntry {
+			t.Errorf("Get(%q) = %v, %v, want %v", key, got, ok, keyEntry)
+		}
+	}
+	sort.Strings(sorted)
+	if got := artKeys(idx.Range); fmt.Sprint(got) != fmt.Sprint(sorted) {
+		t.Errorf("Range() visited %v keys out of order, want %v", len(got), len(sorted))
+	}
+	for _, start := range []string{"", "a", "ab", "abz", "b", "ca", "\xff"} {
+		var wantKeys []string
+		for _, key := range sorted {
+			if key >= start {
+				wantKeys = append(wantKeys, key)
+			}
+		}
+		got := artKeys(func(fn func(string, KeyEntry) bool) { idx.RangeFrom(start, fn) })
+		if fmt.Sprint(got) != fmt.Sprint(wantKeys) {
+			t.Errorf("RangeFrom(%q) = %v keys, want %v", start, len(got), len(wantKeys))
+		}
+	}
+	for _, prefix := range []string{"", "a", "ab", "abca", "c", "d"} {
+		var wantKeys []string
+		for _, key := range sorted {
+			if strings.HasPrefix(key, prefix) {
+				wantKeys = append(wantKeys, key)
+			}
+		}
+		got := artKeys(func(fn func(string, KeyEntry) bool) { idx.RangePrefix(prefix, fn) })
+		if fmt.Sprint(got) != fmt.Sprint(wantKeys) {
+			t.Errorf("RangePrefix(%q) = %v, want %v", prefix, got, wantKeys)
+		}
+	}
+
+	// deleting everything leaves an empty tree
+	for key := range want {
+		idx.Delete(key)
+	}
+	if idx.Len() != 0 || len(artKeys(idx.Range)) != 0 {
+		t.Errorf("Len() = %v after deleting all the keys, want 0", idx.Len())
+	}
+}
+
+func TestARTIndex_stop(t *testing.T) {
+	idx := NewARTIndex()
+	for _, key := range []string{"a", "b", "c", "d"} {
+		idx.Put(key, KeyEntry{})
+	}
+	var visited []string
+	idx.Range(func(key string, _ KeyEntry) bool {
+		visited = append(visited, key)
+		return key != "b"
+	})
+	if fmt.Sprint(visited) != "[a b]" {
+		t.Errorf("Range() visited %v after returning false, want [a b]", visited)
+	}
+}
+
+func TestDiskStore_ARTIndex(t *testing.T) {
+	store, err := NewDiskStoreWithOptions("test.db", Options{NewIndex: NewARTIndex})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	for i := 0; i < 100; i++ {
+		store.Set(fmt.Sprintf("user:%03d", i), "value")
+		store.Set(fmt.Sprintf("order:%03d", i), "value")
+	}
+	store.Delete("user:050")
+
+	if got := store.KeysWithPrefix("user:04"); len(got) != 10 {
+		t.Errorf("KeysWithPrefix(user:04) = %v, want 10 keys", got)
+	}
+	var got []string
+	it := store.Range("user:048", "user:053")
+	for it.Next() {
+		got = append(got, it.Key())
+	}
+	if want := "[user:048 user:049 user:051 user:052]"; fmt.Sprint(got) != want {
+		t.Errorf("Range(user:048, user:053) = %v, want %v", got, want)
+	}
+	if n, err := store.DeletePrefix("order:"); err != nil || n != 100 {
+		t.Errorf("DeletePrefix(order:) = %v, %v, want 100", n, err)
+	}
+	if store.Len() != 99 {
+		t.Errorf("Len() = %v, want 99", store.Len())
+	}
+}
@@ -0,0 +1,126 @@
+package caskdb
+
+// WriteBatch collects a bunch of sets and deletes, which are then written to the
+// disk together by DiskStore.Commit. Every Set or Delete on a DiskStore does its own
+// fsync, which is slow when loading a lot of data. A batch encodes all the records
+// into one buffer, appends it to the file with a single write and syncs only once.
+//
+// Typical usage example:
+//
+//	batch := NewWriteBatch()
+//	batch.Set("othello", "shakespeare")
+//	batch.Delete("hamlet")
+//	err := store.Commit(batch)
+type WriteBatch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key    string
+	value  string
+	delete bool
+}
+
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+// Set adds the key value pair to the batch.
+func (b *WriteBatch) Set(key string, value string) {
+	b.ops = append(b.ops, batchOp{key: key, value: value})
+}
+
+// Delete adds the deletion of the key to the batch.
+func (b *WriteBatch) Delete(key string) {
+	b.ops = append(b.ops, batchOp{key: key, delete: true})
+}
+
+// Len returns the number of operations in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.ops)
+}
+
+// Reset empties the batch so that it can be reused.
+func (b *WriteBatch) Reset() {
+	b.ops = b.ops[:0]
+}
+
+// Commit writes all the operations of the batch to the disk, in the order they were
+// added, with a single write and fsync. The keyDir is updated only after the write
+// succeeds, so on error none of the operations are visible. Note that a crash in the
+// middle of the write may still leave a part of the batch in the file.
+func (d *DiskStore) Commit(b *WriteBatch) error {
+	if len(b.ops) == 0 {
+		return nil
+	}
+	for _, op := range b.ops {
+		if err := checkValueSize(len(op.value)); err != nil {
+			return err
+		}
+	}
+	return d.exec(func() error {
+		return d.commit(b)
+	})
+}
+
+func (d *DiskStore) commit(b *WriteBatch) error {
+	timestamp := unixNow()
+	size := 0
+	for _, op := range b.ops {
+		size += maxHeaderSize + len(op.key) + len(op.value)
+	}
+
+	// live tracks the keys set or deleted earlier in the batch, so that we do not
+	// write tombstones for keys which do not exist
+	live := make(map[string]bool, len(b.ops))
+	entries := make([]KeyEntry, len(b.ops))
+	// the records are encoded right into the buffer which is written, so however many
+	// there are, the batch is a single write syscall and no per record allocation
+	pooled := getBuffer(size)
+	defer putBuffer(pooled)
+	buf := *pooled
+	for i, op := range b.ops {
+		exists, ok := live[op.key]
+		if !ok {
+			_, exists = d.lookup(op.key)
+		}
+		start := len(buf)
+		if op.delete {
+			if !exists {
+				continue
+			}
+			buf = d.opts.Format.appendTombstone(buf, timestamp, op.key)
+		} else if d.separating(len(op.value)) {
+			encoded, err := d.appendEntry(buf, timestamp, 0, op.key, []byte(op.value), nil)
+			if err != nil {
+				return err
+			}
+			buf = encoded
+		} else {
+			buf = d.appendKV(buf, timestamp, 0, op.key, op.value)
+		}
+		live[op.key] = !op.delete
+		// the offsets are relative to the start of the batch, until it is written
+		entries[i] = NewKeyEntry(timestamp, uint32(start), uint32(len(buf)-start))
+	}
+	*pooled = buf
+	if len(buf) == 0 {
+		return nil
+	}
+	fileID, offset, err := d.write(buf)
+	if err != nil {
+		return err
+	}
+	for i, op := range b.ops {
+		if op.delete {
+			d.deferRecord(op.key, KeyEntry{}, scanRemove)
+		} else {
+			entries[i].FileID = fileID
+			entries[i].Offset += offset
+			d.deferRecord(op.key, entries[i], scanPut)
+		}
+	}
+	// a batch is where the write buffer of Options.WriteBufferSize is flushed, even
+	// without a sync, which makes the batch visible
+	return d.flushBuffer()
+}
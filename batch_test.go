@@ -0,0 +1,101 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDiskStore_Commit(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("hamlet", "shakespeare")
+
+	batch := NewWriteBatch()
+	batch.Set("othello", "shakespeare")
+	batch.Set("dune", "frank herbert")
+	batch.Delete("hamlet")
+	batch.Delete("some key")
+	batch.Set("war and peace", "dostoevsky")
+	batch.Set("war and peace", "tolstoy")
+	batch.Set("brave new world", "huxley")
+	batch.Delete("brave new world")
+	if batch.Len() != 8 {
+		t.Errorf("Len() = %v, want 8", batch.Len())
+	}
+	sizeBefore := store.DiskSize()
+	if err := store.Commit(batch); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	wantSize := sizeBefore + int64(7*headerSize+
+		len("othello")+len("shakespeare")+len("dune")+len("frank herbert")+len("hamlet")+
+		2*len("war and peace")+len("dostoevsky")+len("tolstoy")+
+		2*len("brave new world")+len("huxley"))
+	if store.DiskSize() != wantSize {
+		t.Errorf("DiskSize() = %v, want %v", store.DiskSize(), wantSize)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	want := map[string]string{
+		"othello":       "shakespeare",
+		"dune":          "frank herbert",
+		"war and peace": "tolstoy",
+	}
+	for key, val := range want {
+		if got, err := store.Get(key); err != nil || got != val {
+			t.Errorf("Get() = %v, %v, want %v", got, err, val)
+		}
+	}
+	for _, key := range []string{"hamlet", "brave new world"} {
+		if _, err := store.Get(key); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Get(%v) error = %v, want %v", key, err, ErrKeyNotFound)
+		}
+	}
+	if store.Len() != len(want) {
+		t.Errorf("Len() = %v, want %v", store.Len(), len(want))
+	}
+	store.Close()
+}
+
+func TestDiskStore_CommitError(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Close()
+
+	batch := NewWriteBatch()
+	batch.Set("othello", "shakespeare")
+	if err := store.Commit(batch); err == nil {
+		t.Fatalf("Commit() on closed store error = nil, want error")
+	}
+	if store.Has("othello") {
+		t.Errorf("Has() after failed Commit() = true, want false")
+	}
+}
+
+func TestDiskStore_CommitAllocs(t *testing.T) {
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{SyncPolicy: SyncNever})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	b := NewWriteBatch()
+	for i := 0; i < 1000; i++ {
+		b.Set(fmt.Sprintf("key-%04d", i), "value")
+	}
+	// the records are encoded in place, so the allocations do not grow with them
+	if allocs := testing.AllocsPerRun(10, func() { store.Commit(b) }); allocs > 100 {
+		t.Errorf("Commit() of 1000 records made %v allocations", allocs)
+	}
+}
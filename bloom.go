@@ -0,0 +1,56 @@
+package caskdb
+
+import "hash/maphash"
+
+// The size of the bloom filters: with 10 bits per key and 7 probes, about 1% of the
+// lookups of the absent keys get past a filter.
+const (
+	bloomBitsPerKey = 10
+	bloomProbes     = 7
+)
+
+// bloomFilter tells whether a key may be in a set, without false negatives. diskIndex
+// keeps one per run, so that looking up a key the run does not have rarely reads the
+// disk.
+type bloomFilter struct {
+	seed maphash.Seed
+	bits []uint64
+}
+
+// newBloomFilter returns an empty filter sized for the given number of keys.
+func newBloomFilter(keys int) *bloomFilter {
+	words := (keys*bloomBitsPerKey + 63) / 64
+	if words == 0 {
+		words = 1
+	}
+	return &bloomFilter{seed: maphash.MakeSeed(), bits: make([]uint64, words)}
+}
+
+// probes calls fn with each bit of the key, derived by double hashing the two halves
+// of its hash.
+func (b *bloomFilter) probes(key string, fn func(bit uint64) bool) bool {
+	h := maphash.String(b.seed, key)
+	h1, h2 := h&0xffffffff, h>>32|1
+	n := uint64(len(b.bits) * 64)
+	for i := uint64(0); i < bloomProbes; i++ {
+		if !fn((h1 + i*h2) % n) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloomFilter) add(key string) {
+	b.probes(key, func(bit uint64) bool {
+		b.bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+}
+
+// mayContain reports whether the key may have been added; false means it surely was
+// not.
+func (b *bloomFilter) mayContain(key string) bool {
+	return b.probes(key, func(bit uint64) bool {
+		return b.bits[bit/64]&(1<<(bit%64)) != 0
+	})
+}
@@ -0,0 +1,29 @@
+package caskdb
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestBloomFilter(t *testing.T) {
+	const keys = 10000
+	b := newBloomFilter(keys)
+	for i := 0; i < keys; i++ {
+		b.add(fmt.Sprintf("key-%d", i))
+	}
+	for i := 0; i < keys; i++ {
+		if key := fmt.Sprintf("key-%d", i); !b.mayContain(key) {
+			t.Fatalf("mayContain(%v) = false for an added key", key)
+		}
+	}
+	positives := 0
+	for i := 0; i < keys; i++ {
+		if b.mayContain(fmt.Sprintf("absent-%d", i)) {
+			positives++
+		}
+	}
+	// about 1% is expected
+	if positives > keys/20 {
+		t.Errorf("mayContain() = true for %v of %v absent keys", positives, keys)
+	}
+}
@@ -0,0 +1,123 @@
+package caskdb
+
+import (
+	"container/list"
+	"sync"
+)
+
+// cacheEntryOverhead is what a cached value takes on top of the bytes of its key and
+// value: the list element, the map entry and the cacheEntry, roughly.
+const cacheEntryOverhead = 160
+
+// valueCache is the LRU cache of the values of Options.CacheSize, bounded by the bytes
+// it takes. It has its own lock, since the reads fill it while holding only the read
+// lock of the key's shard. A nil cache caches nothing.
+type valueCache struct {
+	mu       sync.Mutex
+	capacity int64
+	size     int64
+	// order has the entries from the most to the least recently used
+	order *list.List
+	items map[string]*list.Element
+}
+
+type cacheEntry struct {
+	key string
+	// keyEntry is the record the value was read from; it is checked against keyDir on
+	// every hit, so a missed invalidation can never serve a stale value
+	keyEntry KeyEntry
+	value    []byte
+}
+
+func newValueCache(capacity int64) *valueCache {
+	if capacity <= 0 {
+		return nil
+	}
+	return &valueCache{capacity: capacity, order: list.New(), items: make(map[string]*list.Element)}
+}
+
+// get returns a copy of the cached value of the key, if it was read from keyEntry.
+func (c *valueCache) get(key string, keyEntry KeyEntry) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.hit(key, keyEntry)
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), entry.value...), true
+}
+
+// peek is the same as get, but returns the value as a string, copied once.
+func (c *valueCache) peek(key string, keyEntry KeyEntry) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.hit(key, keyEntry)
+	if !ok {
+		return "", false
+	}
+	return string(entry.value), true
+}
+
+// hit returns the entry of the key if it was read from keyEntry, and marks it as the
+// most recently used. The caller must hold mu.
+func (c *valueCache) hit(key string, keyEntry KeyEntry) (*cacheEntry, bool) {
+	e, ok := c.items[key]
+	if !ok || e.Value.(*cacheEntry).keyEntry != keyEntry {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cacheEntry), true
+}
+
+// add caches a copy of the value of the key read from keyEntry, evicting the least
+// recently used values to make room. A value larger than the whole cache is not
+// cached.
+func (c *valueCache) add(key string, keyEntry KeyEntry, value []byte) {
+	if c == nil {
+		return
+	}
+	cost := entryCost(key, value)
+	if cost > c.capacity {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+	entry := &cacheEntry{key: key, keyEntry: keyEntry, value: append([]byte(nil), value...)}
+	c.items[key] = c.order.PushFront(entry)
+	c.size += cost
+	for c.size > c.capacity {
+		c.removeLocked(c.order.Back().Value.(*cacheEntry).key)
+	}
+}
+
+// remove drops the cached value of the key, if any. keyDir calls it on every change
+// of the key.
+func (c *valueCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.removeLocked(key)
+}
+
+func (c *valueCache) removeLocked(key string) {
+	e, ok := c.items[key]
+	if !ok {
+		return
+	}
+	entry := c.order.Remove(e).(*cacheEntry)
+	delete(c.items, key)
+	c.size -= entryCost(entry.key, entry.value)
+}
+
+func entryCost(key string, value []byte) int64 {
+	return int64(len(key)+len(value)) + cacheEntryOverhead
+}
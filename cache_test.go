@@ -0,0 +1,69 @@
+package caskdb
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestValueCache(t *testing.T) {
+	cost := entryCost("a", []byte("1"))
+	c := newValueCache(3 * cost)
+	for _, key := range []string{"a", "b", "c"} {
+		c.add(key, KeyEntry{}, []byte("1"))
+	}
+	// a is the most recently used now, so d evicts b
+	if _, ok := c.get("a", KeyEntry{}); !ok {
+		t.Errorf("get(a) missed")
+	}
+	c.add("d", KeyEntry{}, []byte("1"))
+	if _, ok := c.get("b", KeyEntry{}); ok {
+		t.Errorf("get(b) hit after it was evicted")
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, ok := c.get(key, KeyEntry{}); !ok {
+			t.Errorf("get(%v) missed", key)
+		}
+	}
+	if _, ok := c.get("a", KeyEntry{Offset: 1}); ok {
+		t.Errorf("get(a) hit for another record")
+	}
+	c.remove("a")
+	if _, ok := c.get("a", KeyEntry{}); ok || c.size != 2*cost {
+		t.Errorf("get(a) = _, %v after remove, size = %v", ok, c.size)
+	}
+	// a value larger than the cache is not cached
+	c.add("big", KeyEntry{}, make([]byte, 3*cost))
+	if _, ok := c.get("big", KeyEntry{}); ok {
+		t.Errorf("get(big) hit for a value larger than the cache")
+	}
+}
+
+func TestDiskStore_CacheSize(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{CacheSize: 1 << 20})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("name", "jojo")
+	if got, err := store.Get("name"); err != nil || got != "jojo" {
+		t.Fatalf("Get(name) = %v, %v, want jojo", got, err)
+	}
+	keyEntry, _ := store.keyDir.get("name")
+	if got, ok := store.cache.get("name", keyEntry); !ok || string(got) != "jojo" {
+		t.Errorf("the value is not cached after Get(): %q, %v", got, ok)
+	}
+	// the returned value is a copy
+	value, _ := store.GetBytes("name")
+	value[0] = 'x'
+	if got, _ := store.Get("name"); got != "jojo" {
+		t.Errorf("Get(name) = %v after changing a returned value, want jojo", got)
+	}
+
+	if err := store.Delete("name"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, ok := store.cache.get("name", KeyEntry{}); ok || store.cache.size != 0 {
+		t.Errorf("the value is still cached after Delete()")
+	}
+}
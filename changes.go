@@ -0,0 +1,173 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+// ChangeType is what a ChangeEvent did to its key.
+type ChangeType uint8
+
+const (
+	// ChangeSet set the key to the value
+	ChangeSet ChangeType = iota
+	// ChangeDelete deleted the key
+	ChangeDelete
+)
+
+// ChangeEvent is a change of a key, as Changes streams them.
+type ChangeEvent struct {
+	Type     ChangeType
+	Key      string
+	Value    string
+	Metadata Metadata
+	// Timestamp is when the change was written, with a granularity of one second
+	Timestamp time.Time
+	// Expiry is when the key expires; the zero time if it never expires
+	Expiry time.Time
+	// Position is the position in the log right after the change, which Changes
+	// resumes from
+	Position Position
+	// Err is set on the last event of a changefeed which fails, with the error, and
+	// nothing else is
+	Err error
+}
+
+// changesBatch is the number of records a changefeed reads from the log at a time.
+const changesBatch = 256
+
+// Changes streams the changes of the keys on the channel, as they are written, in the
+// order they were: the ones in the log after the position since first, see ReadLog,
+// and then the ones written from then on. It is a changefeed, to keep a cache or a
+// search index up to date without polling the store.
+//
+// The Position of each event is the cursor to resume from: a consumer which saves
+// it along with what it made of the event gets the changes after it from Changes
+// after a restart. The zero Position is the start of the log, which streams the
+// latest value of every key; see LogEnd to start from the changes to come instead.
+// A cursor which a compaction has removed the changes after is ErrPositionUnavailable,
+// see ReadLog; the consumer has to start over from the zero Position then.
+//
+// The merge operands come out as ChangeSet events with the value of the key when
+// they are streamed, which may have the later operands folded in already, and the
+// keys which expire do not get a ChangeDelete, but have their Expiry. The channel
+// is closed once the store is closed, or on an error, which the last event has.
+func (d *DiskStore) Changes(since Position) (<-chan ChangeEvent, error) {
+	return d.ChangesContext(context.Background(), since)
+}
+
+// ChangesContext is the same as Changes, but the channel is also closed once ctx is
+// done, which is how a consumer stops listening.
+func (d *DiskStore) ChangesContext(ctx context.Context, since Position) (<-chan ChangeEvent, error) {
+	// the position is checked before the feed starts, so that a bad one is an error
+	// of the call
+	if _, _, err := d.ReadLog(since, 1); err != nil {
+		return nil, err
+	}
+	changes := make(chan ChangeEvent)
+	go d.streamChanges(ctx, since, changes)
+	return changes, nil
+}
+
+func (d *DiskStore) streamChanges(ctx context.Context, pos Position, changes chan<- ChangeEvent) {
+	defer close(changes)
+	send := func(e ChangeEvent) bool {
+		select {
+		case changes <- e:
+			return true
+		case <-ctx.Done():
+		case <-d.closed:
+		}
+		return false
+	}
+	for {
+		// taken before the log is read, so that no write goes unnoticed in between
+		written := d.logWritten()
+		records, next, err := d.ReadLog(pos, changesBatch)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				send(ChangeEvent{Position: pos, Err: err})
+			}
+			return
+		}
+		for _, r := range records {
+			e, ok, err := d.changeEvent(r)
+			if err != nil {
+				send(ChangeEvent{Position: pos, Err: err})
+				return
+			}
+			if ok && !send(e) {
+				return
+			}
+		}
+		pos = next
+		if len(records) == changesBatch {
+			continue
+		}
+		select {
+		case <-written:
+		case <-ctx.Done():
+			return
+		case <-d.closed:
+			return
+		}
+	}
+}
+
+// changeEvent returns the event of the record of the log. A merge operand of a key
+// which is gone by now has none.
+func (d *DiskStore) changeEvent(r LogRecord) (ChangeEvent, bool, error) {
+	e := ChangeEvent{
+		Key:       r.Key,
+		Value:     string(r.Value),
+		Metadata:  r.Metadata,
+		Timestamp: r.Timestamp,
+		Expiry:    r.Expiry,
+		Position:  r.Next,
+	}
+	switch r.Op {
+	case LogDelete:
+		e.Type = ChangeDelete
+	case LogMerge:
+		value, meta, err := d.GetWithMeta(r.Key)
+		if errors.Is(err, ErrKeyNotFound) {
+			return e, false, nil
+		}
+		if err != nil {
+			return e, false, err
+		}
+		e.Value, e.Metadata, e.Expiry = value, meta.Metadata, meta.Expiry
+	}
+	return e, true, nil
+}
+
+// LogEnd returns the position at the end of the log, where the next write goes. The
+// Changes from it are the ones yet to be written.
+func (d *DiskStore) LogEnd() Position {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return Position{FileID: d.activeID, Offset: int64(d.currentOffset)}
+}
+
+// logWritten returns a channel which is closed by the next write to the log.
+func (d *DiskStore) logWritten() <-chan struct{} {
+	d.logMu.Lock()
+	defer d.logMu.Unlock()
+	if d.logWrites == nil {
+		d.logWrites = make(chan struct{})
+	}
+	return d.logWrites
+}
+
+// notifyLog wakes up the changefeeds waiting for a write, if there are any. The
+// caller must hold mu, which the changefeeds wait for before they read the write.
+func (d *DiskStore) notifyLog() {
+	d.logMu.Lock()
+	if d.logWrites != nil {
+		close(d.logWrites)
+		d.logWrites = nil
+	}
+	d.logMu.Unlock()
+}
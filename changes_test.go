@@ -0,0 +1,88 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// nextChange returns the next event of the changefeed, and fails the test if there is
+// none in a few seconds.
+func nextChange(t *testing.T, changes <-chan ChangeEvent) ChangeEvent {
+	t.Helper()
+	select {
+	case e, ok := <-changes:
+		if !ok {
+			t.Fatalf("changefeed closed, want an event")
+		}
+		return e
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for a change")
+	}
+	return ChangeEvent{}
+}
+
+func TestDiskStore_Changes(t *testing.T) {
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{MergeOperator: joinOperator})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("book", "dune")
+	store.Set("author", "herbert")
+	store.Delete("book")
+
+	changes, err := store.Changes(Position{})
+	if err != nil {
+		t.Fatalf("Changes() error = %v", err)
+	}
+	var cursor Position
+	for _, want := range []ChangeEvent{{Type: ChangeSet, Key: "book", Value: "dune"}, {Type: ChangeSet, Key: "author", Value: "herbert"}, {Type: ChangeDelete, Key: "book"}} {
+		e := nextChange(t, changes)
+		if e.Type != want.Type || e.Key != want.Key || e.Value != want.Value || e.Err != nil {
+			t.Errorf("Changes() event = %+v, want %v of %v", e, want.Type, want.Key)
+		}
+		cursor = e.Position
+	}
+	// the writes from then on are streamed as they come
+	end := store.LogEnd()
+	if end != cursor {
+		t.Errorf("LogEnd() = %v, want %v", end, cursor)
+	}
+	store.SetWithTTL("session", "jojo", time.Hour)
+	if e := nextChange(t, changes); e.Key != "session" || e.Expiry.IsZero() {
+		t.Errorf("Changes() event = %+v, want session with an expiry", e)
+	}
+	store.Merge("tags", "a")
+	if e := nextChange(t, changes); e.Type != ChangeSet || e.Key != "tags" || e.Value != "<nil>+a" {
+		t.Errorf("Changes() event of a merge = %+v, want the merged value", e)
+	}
+
+	// a feed from a cursor resumes after it
+	ctx, cancel := context.WithCancel(context.Background())
+	resumed, err := store.ChangesContext(ctx, end)
+	if err != nil {
+		t.Fatalf("ChangesContext() error = %v", err)
+	}
+	if e := nextChange(t, resumed); e.Key != "session" {
+		t.Errorf("ChangesContext() first event = %+v, want session", e)
+	}
+	cancel()
+	for range resumed {
+	}
+
+	if _, err := store.Changes(Position{FileID: 3, Offset: 10}); !errors.Is(err, ErrPositionUnavailable) {
+		t.Errorf("Changes() error = %v, want %v", err, ErrPositionUnavailable)
+	}
+	store.Close()
+	select {
+	case _, ok := <-changes:
+		if ok {
+			t.Errorf("Changes() sent an event after Close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("Changes() channel still open after Close")
+	}
+}
@@ -0,0 +1,289 @@
+package caskdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+)
+
+// checkpointMagic starts every checkpoint file, and changes with its format.
+const checkpointMagic = "CASKCKP1"
+
+// The kinds of the items of a checkpoint: the entry of a key, a merge operand of the
+// key on top of it, and the end of the items.
+const (
+	checkpointEntry   byte = 0
+	checkpointOperand byte = 1
+	checkpointEnd     byte = 2
+)
+
+// errBadCheckpoint is returned for a checkpoint file which cannot be used.
+var errBadCheckpoint = errors.New("invalid checkpoint")
+
+// checkpointName returns the path of the checkpoint file of the store at fileName.
+func checkpointName(fileName string) string {
+	return fileName + ".checkpoint"
+}
+
+// Checkpoint saves keyDir to the checkpoint file next to the data files, along with
+// the sizes of the data files at that point, so that the next open loads keyDir from
+// it and only scans the records written after it, instead of every data file from the
+// start. This makes the startup time proportional to the recent writes rather than
+// to the size of the store. See Options.CheckpointInterval to take them periodically.
+//
+// The store is locked only to sync the active file and to take a view of keyDir; the
+// checkpoint is written out alongside the reads and writes. A checkpoint which does
+// not match the data files any more, e.g. because a compaction removed some of them,
+// is ignored on open, and the data files are scanned in full.
+func (d *DiskStore) Checkpoint() error {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	d.mu.Lock()
+	if err := d.Failed(); err != nil {
+		d.mu.Unlock()
+		return err
+	}
+	// the records the checkpoint covers have to be on the disk before it, or a crash
+	// could leave the checkpoint pointing past the end of the file
+	if d.dirty {
+		if err := d.syncFile(); err != nil {
+			d.mu.Unlock()
+			return d.fail(fmt.Errorf("failed to sync to disk: %w", err))
+		}
+		d.dirty = false
+	}
+	view := d.keyDir.view()
+	activeID := d.activeID
+	sizes := make(map[uint32]int64, len(d.readers))
+	for fileID, f := range d.readers {
+		if d.retired[fileID] {
+			// nothing in keyDir points to it, and it is about to go
+			continue
+		}
+		if fileID == activeID {
+			sizes[fileID] = int64(d.currentOffset)
+			continue
+		}
+		info, err := f.Stat()
+		if err != nil {
+			d.mu.Unlock()
+			return err
+		}
+		sizes[fileID] = info.Size()
+	}
+	d.mu.Unlock()
+
+	return installFile(checkpointName(d.fileName), d.opts.FileMode, func(f *os.File) error {
+		return writeCheckpoint(f, activeID, sizes, view)
+	})
+}
+
+// writeCheckpoint writes the checkpoint to w: the magic, the active file ID, the sizes
+// of the data files, the items of all the keys and finally the CRC of all of it.
+func writeCheckpoint(w io.Writer, activeID uint32, sizes map[uint32]int64, view *keyDirView) error {
+	crc := crc32.NewIEEE()
+	bw := bufio.NewWriter(io.MultiWriter(w, crc))
+	buf := make([]byte, 0, 64)
+	buf = append(buf, checkpointMagic...)
+	buf = binary.BigEndian.AppendUint32(buf, activeID)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(sizes)))
+	bw.Write(buf)
+	for fileID, size := range sizes {
+		buf = binary.BigEndian.AppendUint32(buf[:0], fileID)
+		buf = binary.BigEndian.AppendUint64(buf, uint64(size))
+		bw.Write(buf)
+	}
+	writeItem := func(kind byte, key string, keyEntry KeyEntry) {
+		buf = append(buf[:0], kind)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(key)))
+		bw.Write(buf)
+		bw.WriteString(key)
+		bw.Write(encodeKeyEntry(buf[:0], keyEntry))
+	}
+	view.forEach(func(key string, keyEntry KeyEntry, m *pendingMerge) {
+		if m == nil {
+			writeItem(checkpointEntry, key, keyEntry)
+			return
+		}
+		if m.hasBase {
+			writeItem(checkpointEntry, key, m.base)
+		}
+		for _, operandEntry := range m.operands {
+			writeItem(checkpointOperand, key, operandEntry)
+		}
+	})
+	bw.WriteByte(checkpointEnd)
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	_, err := w.Write(binary.BigEndian.AppendUint32(nil, crc.Sum32()))
+	return err
+}
+
+// keyEntrySize is the size of an encoded KeyEntry.
+const keyEntrySize = 20
+
+func encodeKeyEntry(dst []byte, keyEntry KeyEntry) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, keyEntry.FileID)
+	dst = binary.BigEndian.AppendUint32(dst, keyEntry.Offset)
+	dst = binary.BigEndian.AppendUint32(dst, keyEntry.Size)
+	dst = binary.BigEndian.AppendUint32(dst, keyEntry.Timestamp)
+	return binary.BigEndian.AppendUint32(dst, keyEntry.Expiry)
+}
+
+func decodeKeyEntry(data []byte) KeyEntry {
+	return KeyEntry{
+		FileID:    binary.BigEndian.Uint32(data[0:4]),
+		Offset:    binary.BigEndian.Uint32(data[4:8]),
+		Size:      binary.BigEndian.Uint32(data[8:12]),
+		Timestamp: binary.BigEndian.Uint32(data[12:16]),
+		Expiry:    binary.BigEndian.Uint32(data[16:20]),
+	}
+}
+
+// loadCheckpoint loads keyDir from the checkpoint file, if there is one which matches
+// the data files, and returns the offsets to scan each of the data files from: the
+// sizes they had at the checkpoint. The files which came after it are not in there,
+// and are scanned in full. It returns nil if there is no usable checkpoint, in which
+// case keyDir is left empty.
+func (d *DiskStore) loadCheckpoint(fileIDs []uint32) map[uint32]int64 {
+	name := checkpointName(d.fileName)
+	data, err := os.ReadFile(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	var sizes map[uint32]int64
+	if err == nil {
+		sizes, err = d.applyCheckpoint(data, fileIDs)
+	}
+	if err != nil {
+		d.opts.Logger.Printf("caskdb: ignoring the checkpoint %s: %v", name, err)
+		d.keyDir = newShardedKeyDir(d.newIndex)
+		d.live = make(map[uint32]int64)
+		if !d.opts.ReadOnly {
+			os.Remove(name)
+		}
+		return nil
+	}
+	return sizes
+}
+
+// applyCheckpoint checks the checkpoint against the data files, and applies its items
+// to keyDir.
+func (d *DiskStore) applyCheckpoint(data []byte, fileIDs []uint32) (map[uint32]int64, error) {
+	if len(data) < len(checkpointMagic)+8+1+4 || string(data[:len(checkpointMagic)]) != checkpointMagic {
+		return nil, errBadCheckpoint
+	}
+	body := data[:len(data)-4]
+	if binary.BigEndian.Uint32(data[len(data)-4:]) != crc32.ChecksumIEEE(body) {
+		return nil, fmt.Errorf("%w: %v", errBadCheckpoint, ErrChecksumMismatch)
+	}
+	body = body[len(checkpointMagic):]
+	activeID := binary.BigEndian.Uint32(body[0:4])
+	count := int(binary.BigEndian.Uint32(body[4:8]))
+	body = body[8:]
+	if len(body) < count*12 {
+		return nil, errBadCheckpoint
+	}
+	sizes := make(map[uint32]int64, count)
+	for i := 0; i < count; i++ {
+		sizes[binary.BigEndian.Uint32(body[0:4])] = int64(binary.BigEndian.Uint64(body[4:12]))
+		body = body[12:]
+	}
+
+	// the data files up to the active one must be exactly the ones the checkpoint
+	// was taken of; only the active one may have grown since
+	onDisk := 0
+	for _, fileID := range fileIDs {
+		if fileID > activeID {
+			continue
+		}
+		size, ok := sizes[fileID]
+		if !ok {
+			return nil, fmt.Errorf("data file %d is not in the checkpoint", fileID)
+		}
+		info, err := os.Stat(segmentName(d.fileName, fileID))
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() < size || (fileID != activeID && info.Size() != size) {
+			return nil, fmt.Errorf("data file %d has changed since the checkpoint", fileID)
+		}
+		onDisk++
+	}
+	if onDisk != len(sizes) {
+		return nil, errors.New("a data file of the checkpoint is missing")
+	}
+
+	now := unixNow()
+	for {
+		if len(body) < 1 {
+			return nil, errBadCheckpoint
+		}
+		kind := body[0]
+		if kind == checkpointEnd {
+			return sizes, nil
+		}
+		if len(body) < 5 {
+			return nil, errBadCheckpoint
+		}
+		keySize := int(binary.BigEndian.Uint32(body[1:5]))
+		body = body[5:]
+		if len(body) < keySize+keyEntrySize {
+			return nil, errBadCheckpoint
+		}
+		key := string(body[:keySize])
+		keyEntry := decodeKeyEntry(body[keySize : keySize+keyEntrySize])
+		body = body[keySize+keyEntrySize:]
+		switch {
+		case keyEntry.isExpired(now):
+			d.removeKeyEntry(key)
+		case kind == checkpointOperand:
+			d.addMergeOperand(key, keyEntry)
+		default:
+			d.putKeyEntry(key, keyEntry)
+		}
+	}
+}
+
+// startCheckpointer starts the background goroutine of Options.CheckpointInterval,
+// which takes a checkpoint every interval. The errors are not reported; a failed
+// checkpoint is simply retried at the next tick. It keeps running until Close.
+func (d *DiskStore) startCheckpointer(interval time.Duration) {
+	stop, done := make(chan struct{}), make(chan struct{})
+	d.checkpointerStop, d.checkpointerDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				d.Checkpoint()
+			}
+		}
+	}()
+}
+
+// stopCheckpointer stops the background checkpointer and waits for it to exit, and
+// reports whether it was running.
+func (d *DiskStore) stopCheckpointer() bool {
+	d.mu.Lock()
+	stop, done := d.checkpointerStop, d.checkpointerDone
+	d.checkpointerStop, d.checkpointerDone = nil, nil
+	d.mu.Unlock()
+	if stop == nil {
+		return false
+	}
+	close(stop)
+	<-done
+	return true
+}
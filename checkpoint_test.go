@@ -0,0 +1,133 @@
+package caskdb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_Checkpoint(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{MergeOperator: joinOperator}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("stale", "old")
+	store.Set("stale", "new")
+	store.Set("name", "jojo")
+	store.Set("gone", "soon")
+	store.Delete("gone")
+	store.Merge("tags", "a")
+	if err := store.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint() error = %v", err)
+	}
+	// the writes after the checkpoint are replayed from the data file
+	store.Set("late", "comer")
+	store.Merge("tags", "b")
+	store.Close()
+
+	// damage the stale record, which the checkpoint covers: with the checkpoint, the
+	// open does not even read it, while a full scan would fail on it
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("failed to read the data file: %v", err)
+	}
+	data[headerSize+len("stale")] ^= 0xff
+	if err := os.WriteFile(fileName, data, 0644); err != nil {
+		t.Fatalf("failed to write the data file: %v", err)
+	}
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store with the checkpoint: %v", err)
+	}
+	defer store.Close()
+	for key, want := range map[string]string{"stale": "new", "name": "jojo", "late": "comer", "tags": "<nil>+a+b"} {
+		if got, err := store.Get(key); err != nil || got != want {
+			t.Errorf("Get(%v) = %v, %v, want %v", key, got, err, want)
+		}
+	}
+	if store.Has("gone") || store.Len() != 4 {
+		t.Errorf("Len() = %v, want 4 keys without gone", store.Len())
+	}
+}
+
+func TestDiskStore_CheckpointStale(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	recordSize := int64(headerSize + len("k0") + len("v0"))
+	opts := Options{MaxSegmentSize: 2 * recordSize, MergeOperator: joinOperator}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	fillSegments(t, store)
+	if err := store.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint() error = %v", err)
+	}
+	// the compaction removes the files the checkpoint points to
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	for key, want := range map[string]string{"k0": "v3", "k2": "v5", "k3": "v4", "tags": "<nil>+a+b"} {
+		if got, err := store.Get(key); err != nil || got != want {
+			t.Errorf("Get(%v) = %v, %v, want %v", key, got, err, want)
+		}
+	}
+	if _, err := os.Stat(checkpointName(fileName)); !os.IsNotExist(err) {
+		t.Errorf("the stale checkpoint was not removed: %v", err)
+	}
+}
+
+func TestDiskStore_CheckpointCorrupt(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("name", "jojo")
+	if err := store.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint() error = %v", err)
+	}
+	store.Close()
+
+	data, err := os.ReadFile(checkpointName(fileName))
+	if err != nil {
+		t.Fatalf("failed to read the checkpoint: %v", err)
+	}
+	data[len(checkpointMagic)+2] ^= 0xff
+	os.WriteFile(checkpointName(fileName), data, 0644)
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if got, err := store.Get("name"); err != nil || got != "jojo" {
+		t.Errorf("Get(name) = %v, %v, want jojo", got, err)
+	}
+}
+
+func TestDiskStore_CheckpointInterval(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{CheckpointInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("name", "jojo")
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	// Close takes the last checkpoint
+	if _, err := os.Stat(checkpointName(fileName)); err != nil {
+		t.Errorf("no checkpoint after Close(): %v", err)
+	}
+}
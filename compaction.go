@@ -0,0 +1,765 @@
+package caskdb
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// CompactionStats sums up what a compaction did.
+type CompactionStats struct {
+	// BytesReclaimed is the number of bytes freed on the disk
+	BytesReclaimed int64
+	// RecordsDropped is the number of records which were not carried over: the stale
+	// values, the expired keys, the dropped tombstones and the folded merge operands
+	RecordsDropped int
+	// Duration is how long the compaction took
+	Duration time.Duration
+}
+
+// Compact compacts all the data files of the store, including the active one, which
+// is sealed first, and returns what it did. The reads and writes carry on while it
+// runs, see compact, but only one compaction runs at a time. The value log, if there
+// is one, is collected right after, see Options.ValueLogThreshold.
+// See StartBackgroundCompaction to compact the sealed files periodically instead.
+func (d *DiskStore) Compact() (CompactionStats, error) {
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+	d.mu.Lock()
+	if d.opts.ReadOnly {
+		d.mu.Unlock()
+		return CompactionStats{}, ErrReadOnly
+	}
+	if err := d.Failed(); err != nil {
+		d.mu.Unlock()
+		return CompactionStats{}, err
+	}
+	rotatedKey := d.rotatedKey
+	var sources []uint32
+	for fileID, f := range d.readers {
+		if d.retired[fileID] {
+			continue
+		}
+		info, err := f.Stat()
+		if err != nil {
+			d.mu.Unlock()
+			return CompactionStats{}, err
+		}
+		if info.Size() > d.formats[fileID].dataOffset() {
+			sources = append(sources, fileID)
+		}
+	}
+	d.mu.Unlock()
+	stats, err := d.compact(sources)
+	if err != nil {
+		return stats, err
+	}
+	reclaimed, err := d.collectValueLogs(rotatedKey != 0)
+	stats.BytesReclaimed += reclaimed
+	if err != nil {
+		return stats, err
+	}
+	// everything has been encrypted anew, unless the key was rotated again meanwhile
+	d.mu.Lock()
+	if rotatedKey != 0 && d.rotatedKey == rotatedKey {
+		d.rotatedKey = 0
+	}
+	d.mu.Unlock()
+	return stats, nil
+}
+
+// compaction is the state of a compaction in progress, see compact.
+type compaction struct {
+	store    *DiskStore
+	sources  []uint32
+	outputID uint32
+	// oldestKept is the oldest data file which is kept and has any records
+	oldestKept uint32
+	// retainSince is the unix timestamp from which on the tombstones are kept for
+	// Options.TombstoneRetention
+	retainSince int64
+	// view is the keyDir as it was when the compaction was planned
+	view *keyDirView
+	// copies are the keys whose latest records are copied as they are, and folds the
+	// ones whose merge operands are folded, as they were when the compaction started
+	copies []snapshotEntry
+	folds  []snapshotEntry
+	// expired are the keys which expired, and are dropped
+	expired []snapshotEntry
+	// tombstones are the timestamps of the tombstones to carry over, by key
+	tombstones map[string]uint32
+	// files are the compaction's own handles of the data files it reads
+	files map[uint32]*os.File
+	// dict is the compression dictionary trained for the output, if any, and flags
+	// are the flags of its file header
+	dict  []byte
+	flags uint16
+
+	sourceSize int64
+	records    int
+}
+
+// needsTombstone reports whether a tombstone from the given source, written at the
+// given unix timestamp, has to be carried over.
+func (c *compaction) needsTombstone(fileID uint32, timestamp uint32) bool {
+	return fileID > c.oldestKept || int64(timestamp) >= c.retainSince
+}
+
+// read reads the record of the keyEntry with the compaction's own file handles, and
+// returns it along with the format of its file.
+func (c *compaction) read(keyEntry KeyEntry) ([]byte, Format, error) {
+	f, ok := c.files[keyEntry.FileID]
+	if !ok {
+		var err error
+		if f, err = os.Open(segmentName(c.store.fileName, keyEntry.FileID)); err != nil {
+			return nil, 0, err
+		}
+		c.files[keyEntry.FileID] = f
+	}
+	record := make([]byte, keyEntry.Size)
+	c.store.compactionLimiter.wait(len(record))
+	if _, err := f.ReadAt(record, int64(keyEntry.Offset)); err != nil {
+		return nil, 0, err
+	}
+	format := c.store.fileFormat(keyEntry.FileID)
+	if err := format.verifyRecord(record); err != nil {
+		return nil, 0, err
+	}
+	return record, format, nil
+}
+
+// compact rewrites the given data files, the sources, into a single new data file,
+// keeping only the latest live record of each key, and then removes the sources.
+// The stale records, the expired keys and the tombstones which are no longer needed
+// are left behind; the keys with merge operands are folded into plain values.
+//
+// The new file has to come after all the sources in the order of the file IDs, so
+// that its records win when the files are loaded, but before the active file, which
+// may have newer records of the same keys. To make room for it, the active file is
+// sealed and the new active file skips a file ID, which goes to the output.
+//
+// The lock of the store is held only to plan the compaction, and in the end to point
+// keyDir to the new file; the slow part, going over keyDir, reading the sources and
+// writing the new file, runs alongside the reads and writes, against a frozen view
+// of keyDir. The writes made in the meantime go to the new
+// active file, which comes after the output, so they win over it. The keys written
+// after the planning keep their new records: their copies in the output are garbage
+// from the start.
+//
+// A tombstone is carried over as long as a data file older than it is kept, since
+// that file may have a record the tombstone hides, and for Options.TombstoneRetention
+// after the delete in any case. For the same reason, the sources
+// are removed oldest first: if we crash half way, the sources left behind are always
+// the newer ones, which cannot bring back a key on their own. The first data file is
+// truncated instead of removed, since it carries the lock of the store.
+//
+// The caller must hold compactMu, but not mu.
+func (d *DiskStore) compact(sources []uint32) (CompactionStats, error) {
+	var result CompactionStats
+	start := time.Now()
+	if len(sources) == 0 {
+		return result, nil
+	}
+	d.mu.Lock()
+	c, err := d.planCompaction(sources)
+	d.mu.Unlock()
+	if err != nil {
+		return result, err
+	}
+	defer func() {
+		for _, f := range c.files {
+			f.Close()
+		}
+	}()
+	c.sortOut()
+
+	// the tombstones of the deleted keys have to be found in the files
+	candidates := make(map[string]uint32)
+	for _, fileID := range c.sources {
+		size, err := forEachRecord(segmentName(d.fileName, fileID), d.compactionLimiter, func(h recordHeader, record []byte) error {
+			c.records++
+			if isTombstone(h.valueSize) && c.needsTombstone(fileID, h.timestamp) {
+				candidates[string(record[h.length:h.length+int(h.keySize)])] = h.timestamp
+			}
+			return nil
+		})
+		if err != nil {
+			return result, fmt.Errorf("data file %d: %w", fileID, err)
+		}
+		c.sourceSize += size
+	}
+	// a tombstone must not hide a record in the older files of a key which is live.
+	// The keys written or deleted since the planning have their records in files
+	// newer than the output, so their tombstones do no harm either way.
+	for key, timestamp := range candidates {
+		if _, live := c.view.get(key); !live {
+			c.tombstones[key] = timestamp
+		}
+	}
+
+	entries, outputSize, err := d.writeCompaction(c)
+	if err != nil {
+		return result, err
+	}
+	outputName := segmentName(d.fileName, c.outputID)
+	reader, err := os.Open(outputName)
+	if err != nil {
+		// the output is complete on the disk; it just cannot be read until a reopen
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return result, d.fail(err)
+	}
+
+	// from here on, keyDir points to the output, and the sources can go
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.filesMu.Lock()
+	d.readers[c.outputID] = reader
+	d.formats[c.outputID] = d.opts.Format
+	d.fileFlags[c.outputID] = c.flags
+	if c.dict != nil {
+		d.dicts[c.outputID] = c.dict
+	}
+	d.filesMu.Unlock()
+	d.mapFile(c.outputID)
+	for _, e := range c.copies {
+		// the keys written since the planning keep their newer records
+		if keyEntry, ok := d.keyDir.get(e.key); ok && keyEntry == e.keyEntry {
+			d.putKeyEntry(e.key, entries[e.key])
+		}
+	}
+	for _, e := range c.folds {
+		d.rebaseMerge(e, entries[e.key])
+	}
+	for _, e := range c.expired {
+		if keyEntry, ok := d.keyDir.get(e.key); ok && keyEntry == e.keyEntry {
+			d.removeKeyEntry(e.key)
+		}
+	}
+	// the tombstones carried over are still needed, so they are counted as live, lest
+	// the output is compacted again just for them
+	for key := range c.tombstones {
+		d.live[c.outputID] += int64(d.opts.Format.headerSize(0, uint32(len(key)), tombstoneFlag) + len(key))
+	}
+	result.BytesReclaimed = c.sourceSize - outputSize
+	result.RecordsDropped = c.records - len(entries) - len(c.tombstones)
+	err = d.retireSources(c.sources)
+	result.Duration = time.Since(start)
+	return result, err
+}
+
+// rebaseMerge points a key which had its merge operands folded by the compaction to
+// the folded value. The operands appended since the planning stay pending, on top of
+// the folded value as their new base. The caller must hold mu.
+func (d *DiskStore) rebaseMerge(e snapshotEntry, folded KeyEntry) {
+	m, ok := d.keyDir.merge(e.key)
+	if !ok || len(m.operands) < len(e.merge.operands) || m.operands[len(e.merge.operands)-1] != e.keyEntry {
+		// the value has been replaced since the planning
+		return
+	}
+	if len(m.operands) == len(e.merge.operands) {
+		d.putKeyEntry(e.key, folded)
+		return
+	}
+	if m.hasBase {
+		d.live[m.base.FileID] -= int64(m.base.Size)
+	}
+	for _, operandEntry := range e.merge.operands {
+		d.live[operandEntry.FileID] -= int64(operandEntry.Size)
+	}
+	s := d.keyDir.shard(e.key)
+	s.mu.Lock()
+	s.own(d.keyDir.newIndex)
+	s.merges[e.key] = &pendingMerge{
+		base:     folded,
+		hasBase:  true,
+		operands: append([]KeyEntry(nil), m.operands[len(e.merge.operands):]...),
+	}
+	s.mu.Unlock()
+	d.trackEntry(folded)
+}
+
+// planCompaction seals the active file, to make room for the output, and takes the
+// view of keyDir to compact, see sortOut. The caller must hold mu.
+func (d *DiskStore) planCompaction(sources []uint32) (*compaction, error) {
+	sources = append([]uint32(nil), sources...)
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i] < sources[j]
+	})
+	c := &compaction{
+		store:      d,
+		sources:    sources,
+		outputID:   d.activeID + 1,
+		tombstones: make(map[string]uint32),
+		files:      make(map[uint32]*os.File),
+	}
+	for _, fileID := range sources {
+		if _, ok := d.readers[fileID]; !ok || fileID >= c.outputID {
+			return nil, fmt.Errorf("data file %d cannot be compacted", fileID)
+		}
+	}
+	if err := d.rotateTo(d.activeID + 2); err != nil {
+		return nil, err
+	}
+
+	inSources := make(map[uint32]bool, len(sources))
+	for _, fileID := range sources {
+		inSources[fileID] = true
+	}
+	c.oldestKept = c.outputID
+	c.retainSince = math.MaxInt64
+	if d.opts.TombstoneRetention > 0 {
+		c.retainSince = timeNow().Add(-d.opts.TombstoneRetention).Unix()
+	}
+	for fileID, f := range d.readers {
+		if inSources[fileID] || fileID >= c.oldestKept {
+			continue
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return nil, err
+		}
+		if info.Size() > d.formats[fileID].dataOffset() {
+			c.oldestKept = fileID
+		}
+	}
+
+	c.view = d.keyDir.view()
+	return c, nil
+}
+
+// sortOut sorts out the keys whose records are in the sources, going by the view of
+// keyDir taken by the planning. It does not need the lock.
+func (c *compaction) sortOut() {
+	inSources := make(map[uint32]bool, len(c.sources))
+	for _, fileID := range c.sources {
+		inSources[fileID] = true
+	}
+	now := unixNow()
+	c.view.forEach(func(key string, keyEntry KeyEntry, m *pendingMerge) {
+		e := snapshotEntry{key: key, keyEntry: keyEntry, merge: m}
+		inSource := inSources[keyEntry.FileID]
+		if m != nil {
+			inSource = inSource || m.hasBase && inSources[m.base.FileID]
+			for _, operandEntry := range m.operands {
+				inSource = inSource || inSources[operandEntry.FileID]
+			}
+		}
+		switch {
+		case !inSource:
+		case keyEntry.isExpired(now):
+			c.expired = append(c.expired, e)
+			if c.needsTombstone(keyEntry.FileID, keyEntry.Timestamp) {
+				c.tombstones[key] = keyEntry.Timestamp
+			}
+		case e.merge != nil:
+			c.folds = append(c.folds, e)
+		default:
+			c.copies = append(c.copies, e)
+		}
+	})
+	sort.Slice(c.copies, func(i, j int) bool {
+		return c.copies[i].keyEntry.before(c.copies[j].keyEntry)
+	})
+	sort.Slice(c.folds, func(i, j int) bool {
+		return c.folds[i].key < c.folds[j].key
+	})
+}
+
+// outputFlags returns the flags of the file header of the output. The compressed
+// values are copied over as they are, so the output may have them if any of the
+// sources may.
+func (c *compaction) outputFlags() uint16 {
+	if c.store.opts.Format == FormatV1 {
+		return 0
+	}
+	flags := c.store.fileHeaderFlags()
+	c.store.filesMu.RLock()
+	defer c.store.filesMu.RUnlock()
+	for _, fileID := range c.sources {
+		flags |= c.store.fileFlags[fileID] & fileCompressed
+	}
+	if c.dict != nil {
+		flags |= fileCompressed | fileDictionary
+	}
+	return flags
+}
+
+// writeCompaction writes the output of the compaction, and returns the new keyDir
+// entries of the keys in it, along with its size. It does not need mu.
+func (d *DiskStore) writeCompaction(c *compaction) (map[string]KeyEntry, int64, error) {
+	tombstoneKeys := make([]string, 0, len(c.tombstones))
+	for key := range c.tombstones {
+		tombstoneKeys = append(tombstoneKeys, key)
+	}
+	sort.Strings(tombstoneKeys)
+
+	// the dictionary has to be on the disk before any record compressed with it
+	var dc *dictCompressor
+	if d.trainsDictionary() {
+		dict, err := c.trainDictionary()
+		if err != nil {
+			return nil, 0, err
+		}
+		if dict != nil {
+			if err := installFile(dictionaryName(d.fileName, c.outputID), d.opts.FileMode, func(f *os.File) error {
+				_, err := f.Write(dict)
+				return err
+			}); err != nil {
+				return nil, 0, err
+			}
+			c.dict, dc = dict, newDictCompressor(d.opts.CompressionLevel, dict)
+		}
+	}
+	c.flags = c.outputFlags()
+
+	entries := make(map[string]KeyEntry, len(c.copies)+len(c.folds))
+	var outputSize int64
+	err := installFile(segmentName(d.fileName, c.outputID), d.opts.FileMode, func(f *os.File) error {
+		w := bufio.NewWriter(&throttledWriter{f, d.compactionLimiter})
+		// the output is in Options.Format, whatever the sources are in
+		header := d.opts.Format.fileHeader(c.flags)
+		if _, err := w.Write(header); err != nil {
+			return err
+		}
+		outputSize = int64(len(header))
+		put := func(key string, keyEntry KeyEntry, record []byte) error {
+			if _, err := w.Write(record); err != nil {
+				return err
+			}
+			keyEntry.FileID, keyEntry.Offset, keyEntry.Size = c.outputID, uint32(outputSize), uint32(len(record))
+			entries[key] = keyEntry
+			outputSize += int64(len(record))
+			return nil
+		}
+		for _, e := range c.copies {
+			record, format, err := c.read(e.keyEntry)
+			if err != nil {
+				return err
+			}
+			record, err = d.carryOver(format, d.dictionary(e.keyEntry.FileID), record, dc)
+			if err != nil {
+				return err
+			}
+			if err := put(e.key, e.keyEntry, record); err != nil {
+				return err
+			}
+		}
+		for _, e := range c.folds {
+			// the folded value keeps the metadata of the base value
+			var meta []byte
+			value, err := d.foldMerge(e.key, e.merge, func(keyEntry KeyEntry) ([]byte, error) {
+				record, format, err := c.read(keyEntry)
+				if err != nil {
+					return nil, err
+				}
+				if e.merge.hasBase && keyEntry == e.merge.base {
+					meta = format.metadata(record)
+				}
+				return d.recordValue(keyEntry.FileID, format, record)
+			})
+			if err != nil {
+				return err
+			}
+			record := d.appendKVWith(nil, e.keyEntry.Timestamp, e.keyEntry.Expiry, e.key, value, meta, dc)
+			if err := put(e.key, e.keyEntry, record); err != nil {
+				return err
+			}
+		}
+		for _, key := range tombstoneKeys {
+			record := d.opts.Format.appendTombstone(nil, c.tombstones[key], key)
+			if _, err := w.Write(record); err != nil {
+				return err
+			}
+			outputSize += int64(len(record))
+		}
+		return w.Flush()
+	})
+	if err != nil && c.dict != nil {
+		os.Remove(dictionaryName(d.fileName, c.outputID))
+	}
+	return entries, outputSize, err
+}
+
+// retireSources removes the compacted data files, unless an iterator may still read
+// from them, see Iterator; they are retired then, and removed along with the others
+// once the last such iterator is done, see removeRetired. A retired file is not
+// compacted again, nor copied to a checkpoint or a snapshot, but it still counts as
+// kept for the tombstones, since it comes back if we crash before it is removed.
+// The caller must hold mu.
+func (d *DiskStore) retireSources(sources []uint32) error {
+	if d.views.Load() == 0 {
+		if err := d.removeRetired(); err != nil {
+			return err
+		}
+		return d.removeSources(sources)
+	}
+	if d.retired == nil {
+		d.retired = make(map[uint32]bool)
+	}
+	for _, fileID := range sources {
+		d.retired[fileID] = true
+	}
+	return nil
+}
+
+// removeRetired removes the data files retired by retireSources, oldest first. The
+// caller must hold mu.
+func (d *DiskStore) removeRetired() error {
+	if len(d.retired) == 0 {
+		return nil
+	}
+	retired := make([]uint32, 0, len(d.retired))
+	for fileID := range d.retired {
+		retired = append(retired, fileID)
+	}
+	sort.Slice(retired, func(i, j int) bool {
+		return retired[i] < retired[j]
+	})
+	for _, fileID := range retired {
+		if err := d.removeSources([]uint32{fileID}); err != nil {
+			return err
+		}
+		delete(d.retired, fileID)
+	}
+	return nil
+}
+
+// removeSources removes the compacted data files, oldest first, see compact.
+func (d *DiskStore) removeSources(sources []uint32) error {
+	if d.removedEnds == nil {
+		d.removedEnds = make(map[uint32]int64)
+	}
+	for _, fileID := range sources {
+		name := segmentName(d.fileName, fileID)
+		if info, err := d.readers[fileID].Stat(); err == nil {
+			d.removedEnds[fileID] = info.Size()
+		}
+		if fileID == 0 {
+			// a mapping past the end of the file would fault
+			d.filesMu.Lock()
+			err := d.unmapFile(0)
+			d.filesMu.Unlock()
+			if err != nil {
+				return err
+			}
+			if err := os.Truncate(name, 0); err != nil {
+				return err
+			}
+			d.filesMu.Lock()
+			d.formats[0], d.fileFlags[0] = FormatV1, 0
+			d.filesMu.Unlock()
+			if err := d.removeDictionary(0); err != nil {
+				return err
+			}
+			continue
+		}
+		d.filesMu.Lock()
+		d.unmapFile(fileID)
+		d.readers[fileID].Close()
+		delete(d.readers, fileID)
+		delete(d.formats, fileID)
+		delete(d.fileFlags, fileID)
+		d.filesMu.Unlock()
+		delete(d.live, fileID)
+		if err := os.Remove(name); err != nil {
+			return err
+		}
+		if err := d.removeDictionary(fileID); err != nil {
+			return err
+		}
+	}
+	if err := syncDir(filepath.Dir(d.fileName)); err != nil {
+		return fmt.Errorf("failed to sync the directory: %w", err)
+	}
+	return nil
+}
+
+// forEachRecord calls fn with every record of the data file, in order, along with
+// its decoded header, and returns the size of the file. The records are verified
+// first; a sealed file is expected to be intact, so any damage is an error. The reads
+// go through the limiter.
+func forEachRecord(fileName string, limiter *rateLimiter, fn func(h recordHeader, record []byte) error) (int64, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	format, err := readFormat(f)
+	if err != nil {
+		return 0, err
+	}
+	r := bufio.NewReader(&throttledReader{f, limiter})
+	size, err := r.Discard(int(format.dataOffset()))
+	if err != nil {
+		return 0, err
+	}
+	for {
+		header, err := r.Peek(maxHeaderSize)
+		if len(header) == 0 && err == io.EOF {
+			return int64(size), nil
+		} else if err != nil && err != io.EOF {
+			return 0, err
+		}
+		h, err := format.decodeHeader(header)
+		if err != nil {
+			return 0, fmt.Errorf("record at offset %d: %w", size, err)
+		}
+		record := make([]byte, h.recordSize())
+		if _, err := io.ReadFull(r, record); err != nil {
+			return 0, err
+		}
+		if err := format.verifyRecord(record); err != nil {
+			return 0, fmt.Errorf("record at offset %d: %w", size, err)
+		}
+		if err := fn(h, record); err != nil {
+			return 0, err
+		}
+		size += len(record)
+	}
+}
+
+// deadRatio returns the share of garbage in the data file of the given size. The file
+// header, if any, is not garbage.
+func (d *DiskStore) deadRatio(fileID uint32, size int64) float64 {
+	if size == 0 {
+		return 0
+	}
+	return float64(size-d.formats[fileID].dataOffset()-d.live[fileID]) / float64(size)
+}
+
+// SetCompactionRateLimit changes Options.CompactionRateLimit, the number of bytes
+// per second the compaction may read and write, while the store is running. It takes
+// effect right away, even for a compaction which is already running. 0 removes the
+// limit.
+func (d *DiskStore) SetCompactionRateLimit(bytesPerSecond int64) {
+	d.compactionLimiter.setRate(bytesPerSecond)
+}
+
+// StartBackgroundCompaction starts a background goroutine which checks the sealed
+// data files every interval, and compacts them once the share of garbage in any of
+// them exceeds Options.CompactionDeadRatio, until StopBackgroundCompaction or Close
+// is called. The garbage is tracked as the keys are written, so the checks are cheap.
+// The checks are skipped outside of Options.CompactionWindow. The active file is
+// never compacted in the background. The errors are not reported; a failed
+// compaction is simply retried at the next tick. Starting an already running
+// compaction is a no-op.
+func (d *DiskStore) StartBackgroundCompaction(interval time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.compactorStop != nil {
+		return
+	}
+	stop, done, force := make(chan struct{}), make(chan struct{}), make(chan struct{}, 1)
+	d.compactorStop, d.compactorDone, d.compactorForce = stop, done, force
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if d.opts.CompactionWindow.contains(timeNow()) {
+					d.compactSealed()
+				}
+			case <-force:
+				d.compactSealed()
+			}
+		}
+	}()
+}
+
+// compactSealed is one run of the background compaction.
+func (d *DiskStore) compactSealed() {
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+	d.mu.Lock()
+	if d.opts.ReadOnly || d.failed.Load() != nil {
+		d.mu.Unlock()
+		return
+	}
+	sources := d.sealedToCompact()
+	d.mu.Unlock()
+	d.compact(sources)
+}
+
+// ForceBackgroundCompaction makes the background compaction check the sealed data
+// files right away, even outside of Options.CompactionWindow. It does not wait for
+// the compaction to finish, and is a no-op if the background compaction is not
+// running. See Compact to compact all the files and wait for it.
+func (d *DiskStore) ForceBackgroundCompaction() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	select {
+	case d.compactorForce <- struct{}{}:
+	default:
+		// a run is already pending, or there is no background compaction
+	}
+}
+
+// sealedToCompact picks the sealed data files to compact: the ones with more garbage
+// than Options.CompactionDeadRatio, greedily, the most garbage first, until they add
+// up to Options.CompactionMaxBytes. The files with the most garbage give back the
+// most space for the bytes copied, and the limit keeps each compaction short, so it
+// is better to compact a few files often than all of them once in a while.
+func (d *DiskStore) sealedToCompact() []uint32 {
+	type candidate struct {
+		fileID uint32
+		size   int64
+		ratio  float64
+	}
+	var candidates []candidate
+	for fileID, f := range d.readers {
+		if fileID == d.activeID || d.retired[fileID] {
+			continue
+		}
+		info, err := f.Stat()
+		if err != nil {
+			return nil
+		}
+		if ratio := d.deadRatio(fileID, info.Size()); ratio > d.opts.CompactionDeadRatio {
+			candidates = append(candidates, candidate{fileID, info.Size(), ratio})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		if candidates[i].ratio != candidates[j].ratio {
+			return candidates[i].ratio > candidates[j].ratio
+		}
+		return candidates[i].fileID < candidates[j].fileID
+	})
+	var sources []uint32
+	var total int64
+	for _, c := range candidates {
+		// the first file is taken even if it is larger than the limit on its own
+		if limit := d.opts.CompactionMaxBytes; limit > 0 && len(sources) > 0 && total+c.size > limit {
+			break
+		}
+		sources = append(sources, c.fileID)
+		total += c.size
+	}
+	sort.Slice(sources, func(i, j int) bool {
+		return sources[i] < sources[j]
+	})
+	return sources
+}
+
+// StopBackgroundCompaction stops the background compaction and waits for it to exit.
+// It is a no-op if the background compaction is not running.
+func (d *DiskStore) StopBackgroundCompaction() {
+	d.mu.Lock()
+	stop, done := d.compactorStop, d.compactorDone
+	d.compactorStop, d.compactorDone, d.compactorForce = nil, nil, nil
+	d.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
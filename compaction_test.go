@@ -0,0 +1,450 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// fillSegments writes a few overwrites, a delete and merges, so that the sealed data
+// files have garbage
+func fillSegments(t *testing.T, store *DiskStore) {
+	t.Helper()
+	for _, kv := range [][2]string{{"k0", "v0"}, {"k1", "v1"}, {"k2", "v2"}, {"k0", "v3"}, {"k3", "v4"}, {"k2", "v5"}} {
+		if err := store.Set(kv[0], kv[1]); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	if err := store.Delete("k1"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	for _, operand := range []string{"a", "b"} {
+		if err := store.Merge("tags", operand); err != nil {
+			t.Fatalf("Merge() error = %v", err)
+		}
+	}
+}
+
+func TestDiskStore_Compact(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	recordSize := int64(headerSize + len("k0") + len("v0"))
+	opts := Options{MaxSegmentSize: 2 * recordSize, MergeOperator: joinOperator}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	fillSegments(t, store)
+	want := map[string]string{"k0": "v3", "k2": "v5", "k3": "v4", "tags": "<nil>+a+b"}
+	check := func() {
+		t.Helper()
+		for key, value := range want {
+			if got, err := store.Get(key); err != nil || got != value {
+				t.Errorf("Get(%v) = %v, %v, want %v", key, got, err, value)
+			}
+		}
+		if _, err := store.Get("k1"); err != ErrKeyNotFound {
+			t.Errorf("Get(k1) error = %v, want %v", err, ErrKeyNotFound)
+		}
+	}
+
+	sizeBefore := store.DiskSize()
+	stats, err := store.Compact()
+	if err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	outputID := store.activeID - 1
+	if stats.BytesReclaimed <= 0 || stats.RecordsDropped != 5 || stats.Duration <= 0 {
+		t.Errorf("Compact() = %+v, want bytes reclaimed, 5 records dropped and a duration", stats)
+	}
+	if size := store.DiskSize(); size != sizeBefore-stats.BytesReclaimed {
+		t.Errorf("DiskSize() = %v, want %v", size, sizeBefore-stats.BytesReclaimed)
+	}
+	fileIDs, err := listSegments(fileName)
+	if err != nil {
+		t.Fatalf("listSegments() error = %v", err)
+	}
+	if want := []uint32{0, outputID, outputID + 1}; !reflect.DeepEqual(fileIDs, want) {
+		t.Errorf("listSegments() = %v, want %v", fileIDs, want)
+	}
+	if info, err := os.Stat(fileName); err != nil || info.Size() != 0 {
+		t.Errorf("the first data file is not empty: %v", err)
+	}
+	for key := range want {
+		if _, meta, _ := store.GetWithMeta(key); meta.FileID != outputID {
+			t.Errorf("GetWithMeta(%v) file ID = %v, want %v", key, meta.FileID, outputID)
+		}
+	}
+	check()
+	if err := store.Set("k4", "v6"); err != nil {
+		t.Fatalf("Set() error = %v", err)
+	}
+	want["k4"] = "v6"
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	check()
+}
+
+func TestDiskStore_CompactKeepsTombstones(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	recordSize := int64(headerSize + len("k0") + len("v0"))
+	store, err := NewDiskStoreWithOptions(fileName, Options{MaxSegmentSize: 2 * recordSize})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	// k0 lives in the first data file, which is kept, and is deleted in a later one
+	store.Set("k0", "v0")
+	store.Set("k1", "v1")
+	store.Set("k2", "v2")
+	store.Delete("k0")
+	store.Set("k3", "v3")
+
+	_, err = store.compact([]uint32{1})
+	store.mu.Lock()
+	outputID := store.activeID - 1
+	info, _ := store.readers[outputID].Stat()
+	ratio := store.deadRatio(outputID, info.Size())
+	store.mu.Unlock()
+	if err != nil {
+		t.Fatalf("compact() error = %v", err)
+	}
+	// the tombstone the output holds is not garbage yet
+	if ratio != 0 {
+		t.Errorf("deadRatio() of the output = %v, want 0", ratio)
+	}
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, Options{MaxSegmentSize: 2 * recordSize})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.Get("k0"); err != ErrKeyNotFound {
+		t.Errorf("Get(k0) error = %v, want %v", err, ErrKeyNotFound)
+	}
+	for key, value := range map[string]string{"k1": "v1", "k2": "v2", "k3": "v3"} {
+		if got, err := store.Get(key); err != nil || got != value {
+			t.Errorf("Get(%v) = %v, %v, want %v", key, got, err, value)
+		}
+	}
+}
+
+func TestDiskStore_CompactCorruptSource(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	recordSize := int64(headerSize + len("k0") + len("v0"))
+	store, err := NewDiskStoreWithOptions(fileName, Options{MaxSegmentSize: 2 * recordSize})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("k0", "v0")
+	store.Set("k0", "v1")
+	store.Set("k1", "v2")
+	// flip a byte of the stale record, which only the compaction reads
+	f, err := os.OpenFile(fileName, os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("failed to open the data file: %v", err)
+	}
+	f.WriteAt([]byte{'x'}, headerSize)
+	f.Close()
+
+	_, err = store.compact([]uint32{0})
+	if err == nil {
+		t.Fatalf("compact() error = nil, want an error")
+	}
+	if info, err := os.Stat(fileName); err != nil || info.Size() != 2*recordSize {
+		t.Errorf("the corrupt data file was changed: %v", err)
+	}
+	if got, err := store.Get("k0"); err != nil || got != "v1" {
+		t.Errorf("Get(k0) = %v, %v, want v1", got, err)
+	}
+}
+
+func TestDiskStore_BackgroundCompaction(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	recordSize := int64(headerSize + len("k0") + len("v0"))
+	store, err := NewDiskStoreWithOptions(fileName, Options{MaxSegmentSize: 2 * recordSize, MergeOperator: joinOperator})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	fillSegments(t, store)
+	sizeBefore := store.DiskSize()
+	store.StartBackgroundCompaction(time.Millisecond)
+	store.StartBackgroundCompaction(time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for store.DiskSize() == sizeBefore && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if size := store.DiskSize(); size >= sizeBefore {
+		t.Errorf("DiskSize() = %v, want less than %v", size, sizeBefore)
+	}
+	store.StopBackgroundCompaction()
+	store.StopBackgroundCompaction()
+	want := map[string]string{"k0": "v3", "k2": "v5", "k3": "v4", "tags": "<nil>+a+b"}
+	got, err := store.GetMulti([]string{"k0", "k1", "k2", "k3", "tags"})
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("GetMulti() = %v, %v, want %v", got, err, want)
+	}
+	store.StartBackgroundCompaction(time.Millisecond)
+	if err := store.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
+
+func TestDiskStore_CompactEmpty(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	stats, err := store.Compact()
+	if err != nil || stats.BytesReclaimed != 0 || stats.RecordsDropped != 0 {
+		t.Errorf("Compact() = %+v, %v, want nothing done", stats, err)
+	}
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.Compact(); err != ErrReadOnly {
+		t.Errorf("Compact() error = %v, want %v", err, ErrReadOnly)
+	}
+}
+
+func TestDiskStore_LiveBytes(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	recordSize := int64(headerSize + len("k0") + len("v0"))
+	opts := Options{MaxSegmentSize: 2 * recordSize, MergeOperator: joinOperator}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	// the live bytes are counted as the keys are written, and when they are loaded
+	check := func() {
+		t.Helper()
+		want := make(map[uint32]int64)
+		store.keyDir.forEach(func(key string, keyEntry KeyEntry) {
+			if m, ok := store.keyDir.merge(key); ok {
+				if m.hasBase {
+					want[m.base.FileID] += int64(m.base.Size)
+				}
+				for _, operandEntry := range m.operands {
+					want[operandEntry.FileID] += int64(operandEntry.Size)
+				}
+				return
+			}
+			want[keyEntry.FileID] += int64(keyEntry.Size)
+		})
+		for fileID, live := range store.live {
+			if live != want[fileID] {
+				t.Errorf("live bytes of data file %v = %v, want %v", fileID, live, want[fileID])
+			}
+		}
+	}
+	fillSegments(t, store)
+	check()
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	check()
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	check()
+}
+
+func TestDiskStore_CompactionDeadRatio(t *testing.T) {
+	recordSize := int64(headerSize + len("k0") + len("v0"))
+	tests := []struct {
+		ratio float64
+		want  []uint32
+	}{
+		// the first file has one of its two records overwritten, the second one none
+		{0.9, nil},
+		{0.4, []uint32{0}},
+		{0.5, nil},
+	}
+	for _, tt := range tests {
+		fileName := filepath.Join(t.TempDir(), "test.db")
+		store, err := NewDiskStoreWithOptions(fileName, Options{MaxSegmentSize: 2 * recordSize, CompactionDeadRatio: tt.ratio})
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		for _, kv := range [][2]string{{"k0", "v0"}, {"k1", "v1"}, {"k0", "v2"}, {"k2", "v3"}, {"k3", "v4"}} {
+			store.Set(kv[0], kv[1])
+		}
+		store.mu.Lock()
+		got := store.sealedToCompact()
+		store.mu.Unlock()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sealedToCompact() with ratio %v = %v, want %v", tt.ratio, got, tt.want)
+		}
+		store.Close()
+	}
+}
+
+func TestDiskStore_CompactionWindow(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	recordSize := int64(headerSize + len("k0") + len("v0"))
+	// a window which starts an hour from now
+	hour, min, _ := time.Now().Clock()
+	start := (time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute + time.Hour) % (24 * time.Hour)
+	window := CompactionWindow{Start: start, End: start + time.Hour}
+	store, err := NewDiskStoreWithOptions(fileName, Options{MaxSegmentSize: 2 * recordSize, MergeOperator: joinOperator, CompactionWindow: window})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	fillSegments(t, store)
+	sizeBefore := store.DiskSize()
+	store.StartBackgroundCompaction(time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if size := store.DiskSize(); size != sizeBefore {
+		t.Errorf("DiskSize() outside of the window = %v, want %v", size, sizeBefore)
+	}
+
+	store.ForceBackgroundCompaction()
+	deadline := time.Now().Add(5 * time.Second)
+	for store.DiskSize() == sizeBefore && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if size := store.DiskSize(); size >= sizeBefore {
+		t.Errorf("DiskSize() after ForceBackgroundCompaction() = %v, want less than %v", size, sizeBefore)
+	}
+}
+
+func TestDiskStore_CompactionSelection(t *testing.T) {
+	recordSize := int64(headerSize + len("k0") + len("v0"))
+	tests := []struct {
+		maxBytes int64
+		want     []uint32
+	}{
+		{0, []uint32{0, 1}},
+		{3 * recordSize, []uint32{0}},
+		// the file with the most garbage is taken, even if it is over the limit
+		{recordSize, []uint32{0}},
+	}
+	for _, tt := range tests {
+		fileName := filepath.Join(t.TempDir(), "test.db")
+		opts := Options{MaxSegmentSize: 2 * recordSize, CompactionDeadRatio: 0.4, CompactionMaxBytes: tt.maxBytes}
+		store, err := NewDiskStoreWithOptions(fileName, opts)
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		// all of the first file, and half of the second one, get overwritten
+		for i, key := range []string{"k0", "k1", "k2", "k3", "k4", "k5", "k0", "k1", "k2"} {
+			store.Set(key, fmt.Sprintf("v%v", i))
+		}
+		store.mu.Lock()
+		got := store.sealedToCompact()
+		store.mu.Unlock()
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sealedToCompact() with max bytes %v = %v, want %v", tt.maxBytes, got, tt.want)
+		}
+		store.Close()
+	}
+}
+
+func TestDiskStore_CompactConcurrentWrites(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	recordSize := int64(headerSize + len("k0") + len("v0"))
+	opts := Options{MaxSegmentSize: 2 * recordSize, MergeOperator: joinOperator}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	fillSegments(t, store)
+	// slow the compaction down, so that the writes below land in the middle of it
+	store.SetCompactionRateLimit(store.DiskSize())
+	activeID := store.activeID
+	done := make(chan error)
+	go func() {
+		_, err := store.Compact()
+		done <- err
+	}()
+	for planned := false; !planned; {
+		time.Sleep(time.Millisecond)
+		store.mu.Lock()
+		planned = store.activeID == activeID+2
+		store.mu.Unlock()
+	}
+
+	start := time.Now()
+	if got, err := store.Get("k0"); err != nil || got != "v3" {
+		t.Errorf("Get(k0) = %v, %v, want v3", got, err)
+	}
+	store.Set("k0", "v6")
+	store.Delete("k2")
+	store.Merge("tags", "c")
+	store.Set("k4", "v7")
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("the reads and writes took %v during the compaction", elapsed)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+
+	want := map[string]string{"k0": "v6", "k3": "v4", "k4": "v7", "tags": "<nil>+a+b+c"}
+	check := func() {
+		t.Helper()
+		got, err := store.GetMulti([]string{"k0", "k1", "k2", "k3", "k4", "tags"})
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("GetMulti() = %v, %v, want %v", got, err, want)
+		}
+	}
+	check()
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	check()
+}
+
+func TestDiskStore_TombstoneRetention(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{TombstoneRetention: time.Hour})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("k0", "v0")
+	store.Set("k1", "v1")
+	store.Delete("k0")
+	tombstoneSize := int64(headerSize + len("k0"))
+	recordSize := int64(headerSize + len("k1") + len("v1"))
+
+	// nothing older is left for the tombstone to hide, but it is still kept
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if size := store.DiskSize(); size != recordSize+tombstoneSize {
+		t.Errorf("DiskSize() within the retention = %v, want %v", size, recordSize+tombstoneSize)
+	}
+	defer travel(2 * time.Hour)()
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if size := store.DiskSize(); size != recordSize {
+		t.Errorf("DiskSize() after the retention = %v, want %v", size, recordSize)
+	}
+	if _, err := store.Get("k0"); err != ErrKeyNotFound {
+		t.Errorf("Get(k0) error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
@@ -0,0 +1,316 @@
+package caskdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrUnknownCompression is returned when Options.Compression is not one of the
+// supported algorithms, or Options.CompressionLevel is not one of its levels.
+var ErrUnknownCompression = errors.New("unknown compression")
+
+// Compression is the algorithm the values are compressed with, see
+// Options.Compression.
+type Compression int
+
+const (
+	// NoCompression stores the values as they are
+	NoCompression Compression = iota
+	// Snappy compresses the values with snappy, which is fast rather than thorough:
+	// good for the text and the JSON values, at little cost to the writes and reads
+	Snappy
+	// Deflate compresses the values with DEFLATE, at Options.CompressionLevel: a
+	// better ratio than Snappy, at several times its cost
+	Deflate
+	// deflateWithDictionary is Deflate with the dictionary of the data file, which the
+	// compactions train with Options.CompressionDictionary; it is not an option
+	deflateWithDictionary
+)
+
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case Snappy:
+		return "snappy"
+	case Deflate:
+		return "deflate"
+	case deflateWithDictionary:
+		return "deflate with a dictionary"
+	}
+	return fmt.Sprintf("Compression(%d)", int(c))
+}
+
+// known reports whether the records can be compressed with the Compression.
+func (c Compression) known() bool {
+	return c >= NoCompression && c <= deflateWithDictionary
+}
+
+// checkCompression returns ErrUnknownCompression if the options ask for a
+// compression, or a level of it, which there is not.
+func checkCompression(opts Options) error {
+	if !opts.Compression.known() || opts.Compression == deflateWithDictionary {
+		return fmt.Errorf("%w: %v", ErrUnknownCompression, opts.Compression)
+	}
+	if opts.Compression == Deflate && (opts.CompressionLevel < flate.HuffmanOnly || opts.CompressionLevel > flate.BestCompression) {
+		return fmt.Errorf("%w: %v level %d", ErrUnknownCompression, opts.Compression, opts.CompressionLevel)
+	}
+	return nil
+}
+
+// CompressionStats sums up how well the values written since the store was opened,
+// by the writes and the compactions alike, compressed. See Options.Compression.
+type CompressionStats struct {
+	// Compressed is the number of values stored compressed
+	Compressed int64
+	// Incompressible is the number of values which were big enough to be compressed,
+	// but were stored as they are, since they did not get any smaller
+	Incompressible int64
+	// RawBytes is the size of the values stored compressed, before the compression
+	RawBytes int64
+	// CompressedBytes is the size of the same values once compressed
+	CompressedBytes int64
+}
+
+// Ratio returns RawBytes per CompressedBytes; 1 if no value was compressed.
+func (s CompressionStats) Ratio() float64 {
+	if s.CompressedBytes == 0 {
+		return 1
+	}
+	return float64(s.RawBytes) / float64(s.CompressedBytes)
+}
+
+// compressionStats keeps the counters of CompressionStats, which are updated by the
+// concurrent compactions and writes.
+type compressionStats struct {
+	compressed      atomic.Int64
+	incompressible  atomic.Int64
+	rawBytes        atomic.Int64
+	compressedBytes atomic.Int64
+}
+
+// CompressionStats returns how well the values have compressed so far, so that
+// Options.Compression, CompressionLevel and CompressionMinSize can be tuned.
+func (d *DiskStore) CompressionStats() CompressionStats {
+	return CompressionStats{
+		Compressed:      d.compression.compressed.Load(),
+		Incompressible:  d.compression.incompressible.Load(),
+		RawBytes:        d.compression.rawBytes.Load(),
+		CompressedBytes: d.compression.compressedBytes.Load(),
+	}
+}
+
+// A compressed value starts with the size of the value once decompressed, as a
+// uvarint, so that SizeOf and GetRange can tell it without decompressing the value;
+// for Snappy, that is just the start of its block.
+
+// compressing reports whether a value of the given size is compressed when written.
+// Only FormatV2 can have the compressed values, since there is no room left for the
+// flag in the value_size of FormatV1.
+func (d *DiskStore) compressing(size int) bool {
+	return d.opts.Compression != NoCompression && d.opts.Format == FormatV2 && size >= d.opts.CompressionMinSize
+}
+
+// deflaters recycles the flate writers, which take several hundred KiB each, by
+// level; the index is the level - flate.HuffmanOnly.
+var deflaters [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+// inflaters recycles the flate readers.
+var inflaters sync.Pool
+
+// compressValue appends the value compressed with the Compression to dst. The level
+// is only used by Deflate.
+func compressValue(dst []byte, compression Compression, level int, value []byte) []byte {
+	switch compression {
+	case Snappy:
+		return snappyEncode(dst, value)
+	case Deflate:
+		buf := bytes.NewBuffer(binary.AppendUvarint(dst, uint64(len(value))))
+		pool := &deflaters[level-flate.HuffmanOnly]
+		w, _ := pool.Get().(*flate.Writer)
+		if w == nil {
+			// the level was checked on open
+			w, _ = flate.NewWriter(buf, level)
+		} else {
+			w.Reset(buf)
+		}
+		// writing to a bytes.Buffer does not fail
+		w.Write(value)
+		w.Close()
+		pool.Put(w)
+		return buf.Bytes()
+	}
+	panic("caskdb: unknown compression " + compression.String())
+}
+
+// decompressValue decompresses the value of a record, with the dictionary of its
+// data file, if it has one. A value which fails to decompress is reported as
+// ErrCorruptRecord, the same as any other damage to a record which the checksum did
+// not catch.
+func decompressValue(compression Compression, data []byte, dict []byte) ([]byte, error) {
+	switch compression {
+	case Snappy:
+		value, err := snappyDecode(data)
+		if err != nil {
+			return nil, ErrCorruptRecord
+		}
+		return value, nil
+	case Deflate:
+		return inflate(data, nil)
+	case deflateWithDictionary:
+		if dict == nil {
+			return nil, ErrCorruptRecord
+		}
+		return inflate(data, dict)
+	}
+	return nil, ErrCorruptRecord
+}
+
+func inflate(data []byte, dict []byte) ([]byte, error) {
+	size, err := decompressedSize(data)
+	if err != nil {
+		return nil, err
+	}
+	_, n := binary.Uvarint(data)
+	src := bytes.NewReader(data[n:])
+	r, _ := inflaters.Get().(io.ReadCloser)
+	if r == nil {
+		r = flate.NewReaderDict(src, dict)
+	} else if err := r.(flate.Resetter).Reset(src, dict); err != nil {
+		return nil, ErrCorruptRecord
+	}
+	defer inflaters.Put(r)
+	value := make([]byte, size)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return nil, ErrCorruptRecord
+	}
+	// the stream has to end right after the value
+	if n, err := r.Read(make([]byte, 1)); n != 0 || err != io.EOF {
+		return nil, ErrCorruptRecord
+	}
+	return value, nil
+}
+
+// decompressedSize returns the size of the compressed value once decompressed.
+func decompressedSize(data []byte) (int, error) {
+	size, n := binary.Uvarint(data)
+	if n <= 0 || size > maxValueSize {
+		return 0, ErrCorruptRecord
+	}
+	return int(size), nil
+}
+
+// appendKV encodes a record of the key value pair at the end of dst, in
+// Options.Format and with the value compressed as Options.Compression says.
+func (d *DiskStore) appendKV(dst []byte, timestamp uint32, expiry uint32, key string, value string) []byte {
+	if !d.compressing(len(value)) && !d.encrypting() {
+		return d.opts.Format.appendKV(dst, timestamp, expiry, key, value)
+	}
+	return d.appendKVBytes(dst, timestamp, expiry, key, []byte(value))
+}
+
+// appendKVBytes is the same as appendKV, but takes the value as bytes. A value which
+// does not get any smaller is stored as it is.
+func (d *DiskStore) appendKVBytes(dst []byte, timestamp uint32, expiry uint32, key string, value []byte) []byte {
+	return d.appendKVWith(dst, timestamp, expiry, key, value, nil, nil)
+}
+
+// appendKVWith is the same as appendKVBytes, but the record has the encoded Metadata
+// meta, and if dc is not nil, the value is compressed with it, and its dictionary,
+// instead of with Options.Compression. The value is encrypted once compressed, see
+// appendSealed.
+func (d *DiskStore) appendKVWith(dst []byte, timestamp uint32, expiry uint32, key string, value []byte, meta []byte, dc *dictCompressor) []byte {
+	if !d.compressing(len(value)) {
+		return d.appendSealed(dst, timestamp, expiry, key, value, NoCompression, meta)
+	}
+	// no algorithm takes more than snappy in the worst case
+	buf := getBuffer(snappyMaxEncodedLen(len(value)))
+	defer putBuffer(buf)
+	compression := d.opts.Compression
+	if dc != nil {
+		*buf, compression = dc.compress(*buf, value), deflateWithDictionary
+	} else {
+		*buf = compressValue(*buf, compression, d.opts.CompressionLevel, value)
+	}
+	if len(*buf) >= len(value) {
+		d.compression.incompressible.Add(1)
+		return d.appendSealed(dst, timestamp, expiry, key, value, NoCompression, meta)
+	}
+	d.compression.compressed.Add(1)
+	d.compression.rawBytes.Add(int64(len(value)))
+	d.compression.compressedBytes.Add(int64(len(*buf)))
+	return d.appendSealed(dst, timestamp, expiry, key, *buf, compression, meta)
+}
+
+// carryOver returns the record of a value, read from a data file of the given
+// format with the given dictionary, as a compaction writes it to its output: as it
+// is if it is in Options.Format already, and is either compressed or would not be,
+// or encoded anew otherwise. The values compressed with another Compression are left
+// alone, unless the output has a dictionary of its own, dc, which all the values are
+// compressed with. The values encrypted with a key other than the active one are
+// encrypted anew with it, see RotateEncryptionKey. The metadata is carried over along
+// with the value, unless the output is in FormatV1, which cannot have it.
+func (d *DiskStore) carryOver(format Format, dict []byte, record []byte, dc *dictCompressor) ([]byte, error) {
+	h, _ := format.decodeHeader(record)
+	if h.pointer() {
+		return d.carryPointer(format, record)
+	}
+	if dc == nil && format == d.opts.Format && (h.compression() != NoCompression || !d.compressing(int(valueLength(h.valueSize)))) && h.keyID == d.keys.Load().active {
+		return record, nil
+	}
+	value, err := format.value(record, dict, d.keys.Load())
+	if err != nil {
+		return nil, err
+	}
+	_, key, _ := format.decodeKVBytes(record)
+	return d.appendKVWith(nil, h.timestamp, h.expiry, key, value, format.metadata(record), dc), nil
+}
+
+// valueLayout returns the offset of the key's value in its data file, its size, and
+// whether the value is there as it is. If it is not, since it is compressed or in the
+// value log, the size is still of the value itself; or -1 for an encrypted value,
+// whose size cannot be told without decrypting it. For FormatV1 it is all known from
+// keyDir; since the header of FormatV2 varies in size and its flags are not in
+// keyDir, the header is read for it, along with the start of the value.
+func (d *DiskStore) valueLayout(key string, keyEntry KeyEntry) (int64, int, bool, error) {
+	format := d.fileFormat(keyEntry.FileID)
+	if format != FormatV2 {
+		offset := int64(keyEntry.Offset) + int64(headerSize) + int64(len(key))
+		return offset, int(keyEntry.Size) - headerSize - len(key), true, nil
+	}
+	n := maxHeaderSize + maxMetadataSize + len(key) + maxPointerSize
+	if n > int(keyEntry.Size) {
+		n = int(keyEntry.Size)
+	}
+	buf := make([]byte, n)
+	if err := d.readAt(keyEntry.FileID, buf, int64(keyEntry.Offset)); err != nil {
+		return 0, 0, false, err
+	}
+	h, err := format.decodeHeader(buf)
+	if err != nil || h.keySize != uint32(len(key)) || h.recordSize() != int64(keyEntry.Size) {
+		return 0, 0, false, ErrCorruptRecord
+	}
+	start := h.length + len(key)
+	offset := int64(keyEntry.Offset) + int64(start)
+	if h.pointer() {
+		p, err := decodePointer(buf[start:])
+		return offset, int(p.valueSize), false, err
+	}
+	if h.keyID != 0 {
+		return offset, -1, false, nil
+	}
+	if h.compression() == NoCompression {
+		return offset, int(valueLength(h.valueSize)), true, nil
+	}
+	size, err := decompressedSize(buf[start:])
+	if err != nil {
+		return 0, 0, false, err
+	}
+	return offset, size, false, nil
+}
@@ -0,0 +1,162 @@
+package caskdb
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_Compression(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{Format: FormatV2, Compression: Snappy}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	long := strings.Repeat(`{"name": "hamlet", "author": "shakespeare"} `, 100)
+	store.Set("long", long)
+	store.SetBytes("bytes", []byte(long))
+	store.Set("short", "shakespeare")
+	if _, meta, _ := store.GetWithMeta("long"); meta.Size >= len(long) {
+		t.Errorf("record size = %v, want less than the value size %v", meta.Size, len(long))
+	}
+	if _, meta, _ := store.GetWithMeta("short"); meta.Size != 12+len("short")+len("shakespeare") {
+		t.Errorf("record size of a short value = %v, want it stored as it is", meta.Size)
+	}
+	for _, key := range []string{"long", "bytes"} {
+		if got, err := store.Get(key); err != nil || got != long {
+			t.Errorf("Get(%v) = %d bytes, %v, want %d bytes", key, len(got), err, len(long))
+		}
+	}
+	if size, err := store.SizeOf("long"); err != nil || size != len(long) {
+		t.Errorf("SizeOf() = %v, %v, want %v", size, err, len(long))
+	}
+	if got, err := store.GetRange("long", 10, 6); err != nil || string(got) != "hamlet" {
+		t.Errorf("GetRange() = %q, %v, want hamlet", got, err)
+	}
+	if got, err := store.GetMulti([]string{"long", "short"}); err != nil || got["long"] != long || got["short"] != "shakespeare" {
+		t.Errorf("GetMulti() = %v, %v, want both values", len(got), err)
+	}
+	store.Close()
+
+	// the values stay compressed whatever the store is opened with
+	store, err = NewDiskStoreWithOptions(fileName, Options{Format: FormatV2})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if got, err := store.Get("long"); err != nil || got != long {
+		t.Errorf("Get(long) after reopen = %d bytes, %v, want %d bytes", len(got), err, len(long))
+	}
+}
+
+func TestDiskStore_CompressionCompaction(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	long := strings.Repeat("to be, or not to be, that is the question. ", 50)
+	store, err := NewDiskStoreWithOptions(fileName, Options{MaxSegmentSize: 4096})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	for _, key := range []string{"k0", "k1", "k2", "k3"} {
+		store.Set(key, long)
+	}
+	store.Close()
+
+	// a compaction compresses the values it copies over
+	store, err = NewDiskStoreWithOptions(fileName, Options{MaxSegmentSize: 4096, Format: FormatV2, Compression: Snappy})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	for _, key := range []string{"k0", "k1", "k2", "k3"} {
+		got, meta, err := store.GetWithMeta(key)
+		if err != nil || got != long {
+			t.Errorf("Get(%v) = %d bytes, %v, want %d bytes", key, len(got), err, len(long))
+		}
+		if meta.Size >= len(long) {
+			t.Errorf("record size of %v = %v, want it compressed", key, meta.Size)
+		}
+	}
+}
+
+func TestDiskStore_CompressionCorrupt(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{Format: FormatV2, Compression: Snappy})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	// a record whose checksum holds, but whose value is not valid snappy
+	value := []byte{0x80, 0x01, 0x00}
+	record := FormatV2.appendValue(nil, unixNow(), 0, "bad", value, Snappy, 0, nil)
+	if err := store.writeKV("bad", unixNow(), 0, record); err != nil {
+		t.Fatalf("writeKV() error = %v", err)
+	}
+	if _, err := store.Get("bad"); err != ErrCorruptRecord {
+		t.Errorf("Get() error = %v, want %v", err, ErrCorruptRecord)
+	}
+	if _, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{Compression: 9}); !errors.Is(err, ErrUnknownCompression) {
+		t.Errorf("NewDiskStoreWithOptions() with compression 9 error = %v, want %v", err, ErrUnknownCompression)
+	}
+}
+
+func TestDiskStore_CompressionPolicy(t *testing.T) {
+	opts := Options{Format: FormatV2, Compression: Deflate, CompressionLevel: 9, CompressionMinSize: 32}
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if stats := store.CompressionStats(); stats != (CompressionStats{}) || stats.Ratio() != 1 {
+		t.Errorf("CompressionStats() of a new store = %+v, ratio %v, want none", stats, stats.Ratio())
+	}
+	value := strings.Repeat("abcd", 16)
+	random := make([]byte, 64)
+	rand.New(rand.NewSource(1)).Read(random)
+	store.Set("short", "abcdabcdabcd")
+	store.Set("long", value)
+	store.SetBytes("random", random)
+	if got, err := store.Get("long"); err != nil || got != value {
+		t.Errorf("Get(long) = %q, %v, want %q", got, err, value)
+	}
+	if got, err := store.GetBytes("random"); err != nil || !bytes.Equal(got, random) {
+		t.Errorf("GetBytes(random) = %v, %v, want %v", got, err, random)
+	}
+	if got, err := store.GetRange("long", 60, 10); err != nil || string(got) != "abcd" {
+		t.Errorf("GetRange() = %q, %v, want abcd", got, err)
+	}
+	stats := store.CompressionStats()
+	if stats.Compressed != 1 || stats.Incompressible != 1 || stats.RawBytes != int64(len(value)) {
+		t.Errorf("CompressionStats() = %+v, want 1 compressed value of %v bytes and 1 incompressible", stats, len(value))
+	}
+	if stats.Ratio() <= 2 {
+		t.Errorf("CompressionStats().Ratio() = %v, want more than 2", stats.Ratio())
+	}
+
+	opts.CompressionLevel = 12
+	if _, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), opts); !errors.Is(err, ErrUnknownCompression) {
+		t.Errorf("NewDiskStoreWithOptions() with level 12 error = %v, want %v", err, ErrUnknownCompression)
+	}
+}
+
+func TestInflate_corrupt(t *testing.T) {
+	data := compressValue(nil, Deflate, 6, []byte(strings.Repeat("hello world ", 20)))
+	if value, err := inflate(data, nil); err != nil || string(value) != strings.Repeat("hello world ", 20) {
+		t.Fatalf("inflate() = %q, %v, want the value", value, err)
+	}
+	tests := [][]byte{
+		data[:len(data)-2],
+		append([]byte{0x05}, data[2:]...),
+	}
+	for _, tt := range tests {
+		if _, err := inflate(tt, nil); err != ErrCorruptRecord {
+			t.Errorf("inflate(%v) error = %v, want %v", tt, err, ErrCorruptRecord)
+		}
+	}
+}
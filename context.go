@@ -0,0 +1,70 @@
+package caskdb
+
+import "context"
+
+// runContext runs fn in its own goroutine and waits for it to return or for ctx to
+// be done, whichever happens first. This gives the callers an escape hatch from a
+// stuck disk or a long wait for the store's lock or its writer. Note that fn is not
+// interrupted; it keeps running in the background after ctx is done.
+func runContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// GetContext is the same as Get, but gives up and returns ctx.Err() once ctx is done.
+func (d *DiskStore) GetContext(ctx context.Context, key string) (string, error) {
+	var value []byte
+	err := runContext(ctx, func() error {
+		s := d.keyDir.shard(key)
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var err error
+		value, err = d.get(key)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(value), nil
+}
+
+// SetContext is the same as Set, but gives up and returns ctx.Err() once ctx is done.
+// If ctx is done while waiting for the writer goroutine, the write is not performed. If
+// it is done while the write is in progress, the write may still complete.
+func (d *DiskStore) SetContext(ctx context.Context, key string, value string) error {
+	return runContext(ctx, func() error {
+		return d.execKeys(nil, func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return d.set(key, value, 0)
+		})
+	})
+}
+
+// DeleteContext is the same as Delete, with the same cancellation semantics as
+// SetContext.
+func (d *DiskStore) DeleteContext(ctx context.Context, key string) error {
+	return runContext(ctx, func() error {
+		return d.execKeys([]string{key}, func() error {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			return d.delete(key)
+		})
+	})
+}
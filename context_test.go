@@ -0,0 +1,68 @@
+package caskdb
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_Context(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	ctx := context.Background()
+
+	if err := store.SetContext(ctx, "name", "jojo"); err != nil {
+		t.Fatalf("SetContext() error = %v", err)
+	}
+	if got, err := store.GetContext(ctx, "name"); err != nil || got != "jojo" {
+		t.Errorf("GetContext() = %v, %v, want %v", got, err, "jojo")
+	}
+	if err := store.DeleteContext(ctx, "name"); err != nil {
+		t.Fatalf("DeleteContext() error = %v", err)
+	}
+	if _, err := store.GetContext(ctx, "name"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetContext() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	store.Close()
+}
+
+func TestDiskStore_ContextCanceled(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("name", "jojo")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := store.SetContext(ctx, "name", "dio"); !errors.Is(err, context.Canceled) {
+		t.Errorf("SetContext() error = %v, want %v", err, context.Canceled)
+	}
+	if _, err := store.GetContext(ctx, "name"); !errors.Is(err, context.Canceled) {
+		t.Errorf("GetContext() error = %v, want %v", err, context.Canceled)
+	}
+
+	// hold the lock, so that the calls below are stuck until their deadline
+	store.mu.Lock()
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := store.SetContext(ctx, "name", "dio"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("SetContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := store.DeleteContext(ctx, "name"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("DeleteContext() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	store.mu.Unlock()
+
+	// the abandoned calls must not have written anything
+	if got, err := store.Get("name"); err != nil || got != "jojo" {
+		t.Errorf("Get() = %v, %v, want %v", got, err, "jojo")
+	}
+	store.Close()
+}
@@ -0,0 +1,232 @@
+package caskdb
+
+import (
+	"bytes"
+	"compress/flate"
+	"container/heap"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// The compression dictionaries are trained by the compactions, with
+// Options.CompressionDictionary, out of a sample of the values they copy, and are
+// written next to their output: for books.db.000003, the dictionary is
+// books.db.000003.dict. A dictionary has the strings which are common to the values,
+// so that even a small value compressed on its own can refer to them, as if it was
+// compressed along with the others; it is the preset dictionary of DEFLATE, which
+// only sees the last 32 KiB.
+const (
+	dictionarySize = 32 << 10
+	// dictionarySampleSize is about how much of the values is sampled to train one
+	dictionarySampleSize = 256 << 10
+	// the dictionary is made of the best segments of the samples, scored by how
+	// many of the other samples have their d-mers
+	dictionarySegment = 64
+	dictionaryDmer    = 8
+)
+
+// dictionaryName returns the path of the compression dictionary of the data file.
+func dictionaryName(fileName string, fileID uint32) string {
+	return segmentName(fileName, fileID) + ".dict"
+}
+
+// loadDictionary loads the compression dictionary of the data file, which its file
+// header says it has.
+func (d *DiskStore) loadDictionary(fileID uint32) error {
+	dict, err := os.ReadFile(dictionaryName(d.fileName, fileID))
+	if err != nil {
+		return err
+	}
+	d.dicts[fileID] = dict
+	return nil
+}
+
+// dictionary returns the compression dictionary of the data file; nil if it has none.
+func (d *DiskStore) dictionary(fileID uint32) []byte {
+	d.filesMu.RLock()
+	defer d.filesMu.RUnlock()
+	return d.dicts[fileID]
+}
+
+// removeDictionary removes the compression dictionary of a data file which is gone,
+// if it had one.
+func (d *DiskStore) removeDictionary(fileID uint32) error {
+	d.filesMu.Lock()
+	delete(d.dicts, fileID)
+	d.filesMu.Unlock()
+	if err := os.Remove(dictionaryName(d.fileName, fileID)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// trainsDictionary reports whether the compactions train a dictionary for their
+// output.
+func (d *DiskStore) trainsDictionary() bool {
+	return d.opts.CompressionDictionary && d.opts.Compression == Deflate && d.opts.Format == FormatV2
+}
+
+// trainDictionary samples the values the compaction copies, evenly, and trains a
+// dictionary out of them. It returns nil if the values have nothing in common.
+func (c *compaction) trainDictionary() ([]byte, error) {
+	var total int64
+	for _, e := range c.copies {
+		total += int64(e.keyEntry.Size)
+	}
+	stride := int(total/dictionarySampleSize) + 1
+	var samples [][]byte
+	for i := 0; i < len(c.copies); i += stride {
+		keyEntry := c.copies[i].keyEntry
+		record, format, err := c.read(keyEntry)
+		if err != nil {
+			return nil, err
+		}
+		if h, _ := format.decodeHeader(record); h.pointer() {
+			// the values in the value log stay there, and are not compressed with it
+			continue
+		}
+		value, err := format.value(record, c.store.dictionary(keyEntry.FileID), c.store.keys.Load())
+		if err != nil {
+			return nil, err
+		}
+		samples = append(samples, value)
+	}
+	return trainDictionary(samples, dictionarySize), nil
+}
+
+// trainDictionary builds a dictionary of at most size bytes out of the samples, in
+// the way of the cover algorithm of zstd, simplified: the samples are cut into
+// segments, which are scored by the number of the other samples each of their
+// d-mers occurs in, and the best segments are taken, each scored without the d-mers
+// taken before it. The best ones go at the end of the dictionary, which is the closest to the
+// data, and so the cheapest to refer to.
+func trainDictionary(samples [][]byte, size int) []byte {
+	type dmer struct {
+		samples int
+		last    int
+	}
+	dmers := make(map[uint64]*dmer)
+	for i, sample := range samples {
+		for j := 0; j+dictionaryDmer <= len(sample); j++ {
+			m := dmers[binary.LittleEndian.Uint64(sample[j:])]
+			if m == nil {
+				m = &dmer{last: -1}
+				dmers[binary.LittleEndian.Uint64(sample[j:])] = m
+			}
+			if m.last != i {
+				m.samples++
+				m.last = i
+			}
+		}
+	}
+	// a d-mer only one sample has is of no use to the others
+	score := func(segment []byte) int {
+		total := 0
+		for j := 0; j+dictionaryDmer <= len(segment); j++ {
+			if m := dmers[binary.LittleEndian.Uint64(segment[j:])]; m.samples > 1 {
+				total += m.samples - 1
+			}
+		}
+		return total
+	}
+	candidates := &segmentHeap{}
+	for _, sample := range samples {
+		for j := 0; j+dictionaryDmer <= len(sample); j += dictionarySegment / 4 {
+			segment := sample[j:]
+			if len(segment) > dictionarySegment {
+				segment = segment[:dictionarySegment]
+			}
+			if s := score(segment); s > 0 {
+				candidates.segments = append(candidates.segments, segment)
+				candidates.scores = append(candidates.scores, s)
+			}
+		}
+	}
+	heap.Init(candidates)
+
+	// the scores only go down as the d-mers are taken, so the best segment is the top
+	// one if it is still at least as good as the next, once scored anew
+	var taken [][]byte
+	length := 0
+	for candidates.Len() > 0 && length < size {
+		segment := candidates.segments[0]
+		s := score(segment)
+		if s == 0 {
+			heap.Pop(candidates)
+			continue
+		}
+		if s < candidates.scores[0] {
+			candidates.scores[0] = s
+			heap.Fix(candidates, 0)
+			continue
+		}
+		heap.Pop(candidates)
+		if length+len(segment) > size {
+			segment = segment[:size-length]
+		}
+		for j := 0; j+dictionaryDmer <= len(segment); j++ {
+			dmers[binary.LittleEndian.Uint64(segment[j:])].samples = 0
+		}
+		taken = append(taken, segment)
+		length += len(segment)
+	}
+	if len(taken) == 0 {
+		return nil
+	}
+	dict := make([]byte, 0, length)
+	for i := len(taken) - 1; i >= 0; i-- {
+		dict = append(dict, taken[i]...)
+	}
+	return dict
+}
+
+// segmentHeap is a max heap of the segments of the samples by their scores.
+type segmentHeap struct {
+	segments [][]byte
+	scores   []int
+}
+
+func (h *segmentHeap) Len() int           { return len(h.segments) }
+func (h *segmentHeap) Less(i, j int) bool { return h.scores[i] > h.scores[j] }
+func (h *segmentHeap) Swap(i, j int) {
+	h.segments[i], h.segments[j] = h.segments[j], h.segments[i]
+	h.scores[i], h.scores[j] = h.scores[j], h.scores[i]
+}
+func (h *segmentHeap) Push(x any) { panic("caskdb: segmentHeap is only popped") }
+func (h *segmentHeap) Pop() any {
+	n := len(h.segments) - 1
+	segment := h.segments[n]
+	h.segments, h.scores = h.segments[:n], h.scores[:n]
+	return segment
+}
+
+// dictCompressor compresses the values with Deflate and a dictionary, reusing its
+// flate writer, which keeps the dictionary. It is not safe for concurrent use.
+type dictCompressor struct {
+	w *flate.Writer
+}
+
+// dictionaryMinLevel is the lowest level the values are compressed at with a
+// dictionary: below it, compress/flate does not look for the matches in the small
+// inputs, which are the values a dictionary is for.
+const dictionaryMinLevel = 7
+
+func newDictCompressor(level int, dict []byte) *dictCompressor {
+	if level < dictionaryMinLevel {
+		level = dictionaryMinLevel
+	}
+	// the level was checked on open
+	w, _ := flate.NewWriterDict(io.Discard, level, dict)
+	return &dictCompressor{w}
+}
+
+// compress appends the value compressed to dst, in the layout of compressValue.
+func (c *dictCompressor) compress(dst []byte, value []byte) []byte {
+	buf := bytes.NewBuffer(binary.AppendUvarint(dst, uint64(len(value))))
+	c.w.Reset(buf)
+	// writing to a bytes.Buffer does not fail
+	c.w.Write(value)
+	c.w.Close()
+	return buf.Bytes()
+}
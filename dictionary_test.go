@@ -0,0 +1,87 @@
+package caskdb
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func jsonValue(i int) string {
+	return fmt.Sprintf(`{"id": %d, "title": "book %d", "author": "author %d", "language": "english", "available": true}`, i, i*7, i%13)
+}
+
+func TestTrainDictionary(t *testing.T) {
+	var samples [][]byte
+	for i := 0; i < 100; i++ {
+		samples = append(samples, []byte(jsonValue(i)))
+	}
+	dict := trainDictionary(samples, 1024)
+	if len(dict) == 0 || len(dict) > 1024 {
+		t.Fatalf("trainDictionary() = %d bytes, want between 1 and 1024", len(dict))
+	}
+	if !bytes.Contains(dict, []byte(`"language": "english"`)) {
+		t.Errorf("trainDictionary() = %q, want the common strings in it", dict)
+	}
+
+	random := rand.New(rand.NewSource(1))
+	samples = nil
+	for i := 0; i < 10; i++ {
+		sample := make([]byte, 100)
+		random.Read(sample)
+		samples = append(samples, sample)
+	}
+	if dict := trainDictionary(samples, 1024); dict != nil {
+		t.Errorf("trainDictionary() of random samples = %d bytes, want nil", len(dict))
+	}
+}
+
+func TestDiskStore_CompressionDictionary(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{Format: FormatV2, Compression: Deflate, CompressionMinSize: 32, CompressionDictionary: true, MaxSegmentSize: 8192}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	for i := 0; i < 200; i++ {
+		store.Set(fmt.Sprintf("book:%d", i), jsonValue(i))
+	}
+	_, before, _ := store.GetWithMeta("book:100")
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	_, after, _ := store.GetWithMeta("book:100")
+	if after.Size >= before.Size {
+		t.Errorf("record size = %v after Compact(), want less than %v", after.Size, before.Size)
+	}
+	if _, err := os.Stat(dictionaryName(fileName, after.FileID)); err != nil {
+		t.Errorf("the dictionary of the output is missing: %v", err)
+	}
+	if size, err := store.SizeOf("book:100"); err != nil || size != len(jsonValue(100)) {
+		t.Errorf("SizeOf() = %v, %v, want %v", size, err, len(jsonValue(100)))
+	}
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 200; i++ {
+		if got, err := store.Get(fmt.Sprintf("book:%d", i)); err != nil || got != jsonValue(i) {
+			t.Fatalf("Get(book:%d) = %q, %v, want %q", i, got, err, jsonValue(i))
+		}
+	}
+	// the next compaction trains a new dictionary, and the old one goes with its file
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if _, err := os.Stat(dictionaryName(fileName, after.FileID)); !os.IsNotExist(err) {
+		t.Errorf("the dictionary of a compacted file is still there: %v", err)
+	}
+	if got, err := store.Get("book:100"); err != nil || got != jsonValue(100) {
+		t.Errorf("Get(book:100) = %q, %v, want %q", got, err, jsonValue(100))
+	}
+}
@@ -0,0 +1,143 @@
+package caskdb
+
+import (
+	"os"
+	"unsafe"
+)
+
+// directAlign is the alignment of the memory, the offsets and the sizes of the direct
+// IO writes: the logical block size of about every disk.
+const directAlign = 4096
+
+func alignUp(n int64) int64 {
+	return (n + directAlign - 1) &^ (directAlign - 1)
+}
+
+// alignedBuffer returns a buffer of the given size starting at an address aligned to
+// directAlign, as direct IO requires.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directAlign)
+	skip := int(uintptr(unsafe.Pointer(&buf[0])) & (directAlign - 1))
+	if skip != 0 {
+		skip = directAlign - skip
+	}
+	return buf[skip : skip+size]
+}
+
+// directFile appends the records to the active file with direct IO, for
+// Options.DirectIO, so that they do not take room in the page cache on top of the
+// database's own buffers. Direct IO only writes whole aligned blocks, so the last,
+// partial block is kept in memory and written again, padded with zeros, along with
+// the next records. The file is a bit larger than the records in it until it is
+// closed, which truncates the padding; after a crash, the startup scan takes the
+// zeros at the end of the file for the end of the log.
+type directFile struct {
+	f *os.File
+	// buf is aligned, and starts with the tail bytes of the last block, which starts
+	// at blockStart in the file
+	buf        []byte
+	tail       int
+	blockStart int64
+}
+
+// openDirectFile opens the data file for the direct IO appends after its first end
+// bytes, reading the bytes of the last partial block through reader. A probe write of
+// that block checks that the file system supports direct IO at all.
+func openDirectFile(name string, end int64, reader *os.File) (*directFile, error) {
+	f, err := openDirect(name)
+	if err != nil {
+		return nil, err
+	}
+	w := &directFile{f: f, buf: alignedBuffer(directAlign), blockStart: end &^ (directAlign - 1)}
+	w.tail = int(end - w.blockStart)
+	if w.tail > 0 {
+		if _, err := reader.ReadAt(w.buf[:w.tail], w.blockStart); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if _, err := f.WriteAt(w.buf[:directAlign], w.blockStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Truncate(end); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// append writes the data after the tail of the file, along with the tail.
+func (w *directFile) append(data []byte) error {
+	used := w.tail + len(data)
+	size := int(alignUp(int64(used)))
+	if cap(w.buf) < size {
+		buf := alignedBuffer(size)
+		copy(buf, w.buf[:w.tail])
+		w.buf = buf
+	}
+	buf := w.buf[:size]
+	copy(buf[w.tail:], data)
+	for i := used; i < size; i++ {
+		buf[i] = 0
+	}
+	if _, err := w.f.WriteAt(buf, w.blockStart); err != nil {
+		return err
+	}
+	full := used &^ (directAlign - 1)
+	w.tail = copy(buf, buf[full:used])
+	w.blockStart += int64(full)
+	return nil
+}
+
+// close truncates the padding after the records, which end at end, and closes the
+// file.
+func (w *directFile) close(end int64) error {
+	err := w.f.Truncate(end)
+	if cerr := w.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// openDirect opens the active data file for direct IO, if Options.DirectIO asks for it.
+// If the platform or the file system does not support direct IO, the store logs it
+// and keeps writing through the page cache.
+func (d *DiskStore) openDirect() {
+	if !d.opts.DirectIO {
+		return
+	}
+	w, err := openDirectFile(segmentName(d.fileName, d.activeID), int64(d.currentOffset), d.readers[d.activeID])
+	if err != nil {
+		d.opts.Logger.Printf("caskdb: writing data file %d without direct IO: %v", d.activeID, err)
+		return
+	}
+	d.direct = w
+}
+
+// closeDirect closes the direct IO handle of the active file, if any, truncating the
+// padding after the records flushed to it.
+func (d *DiskStore) closeDirect() error {
+	if d.direct == nil {
+		return nil
+	}
+	err := d.direct.close(int64(d.currentOffset) - int64(len(d.wbuf)))
+	d.direct = nil
+	return err
+}
+
+// appendFile appends the data to the active file, with direct IO if it is open, or at
+// the end of the records if the file is preallocated.
+func (d *DiskStore) appendFile(data []byte) (int, error) {
+	switch {
+	case d.direct != nil:
+		if err := d.direct.append(data); err != nil {
+			return 0, err
+		}
+		return len(data), nil
+	case d.preallocating():
+		return d.writeFileHandle.WriteAt(data, int64(d.currentOffset)-int64(len(d.wbuf)))
+	default:
+		return d.writeFileHandle.Write(data)
+	}
+}
@@ -0,0 +1,10 @@
+package caskdb
+
+import (
+	"os"
+	"syscall"
+)
+
+func openDirect(name string) (*os.File, error) {
+	return os.OpenFile(name, os.O_WRONLY|syscall.O_DIRECT, 0)
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package caskdb
+
+import (
+	"errors"
+	"os"
+)
+
+// openDirect is only supported on Linux; the other platforms write through the page
+// cache, even with Options.DirectIO.
+func openDirect(name string) (*os.File, error) {
+	return nil, errors.New("direct IO is not supported on this platform")
+}
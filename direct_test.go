@@ -0,0 +1,90 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_DirectIO(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{DirectIO: true, MaxSegmentSize: 3 * directAlign}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if store.direct == nil {
+		t.Skip("direct IO is not supported here")
+	}
+	// the records of all sizes straddle the blocks
+	want := make(map[string]string)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%03d", i)
+		want[key] = strings.Repeat("v", i*37)
+		if err := store.Set(key, want[key]); err != nil {
+			t.Fatalf("Set(%v) error = %v", key, err)
+		}
+	}
+	for key, value := range want {
+		if got, err := store.Get(key); err != nil || got != value {
+			t.Errorf("Get(%v) = %v bytes, %v, want %v", key, len(got), err, len(value))
+		}
+	}
+	if info, _ := os.Stat(segmentName(fileName, store.activeID)); info.Size()%directAlign != 0 {
+		t.Errorf("the active file is %v bytes, want it padded to a block", info.Size())
+	}
+	store.Close()
+
+	// every file ends with its last record once closed
+	fileIDs, _ := listSegments(fileName)
+	for _, fileID := range fileIDs {
+		data, _ := os.ReadFile(segmentName(fileName, fileID))
+		if len(data) > 0 && data[len(data)-1] != 'v' {
+			t.Errorf("data file %d ends with %q", fileID, data[len(data)-1])
+		}
+	}
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	for key, value := range want {
+		if got, err := store.Get(key); err != nil || got != value {
+			t.Errorf("Get(%v) = %v bytes, %v after reopening, want %v", key, len(got), err, len(value))
+		}
+	}
+	if len(store.Quarantine()) != 0 {
+		t.Errorf("Quarantine() = %v, want none", store.Quarantine())
+	}
+}
+
+func TestDiskStore_ZeroPadding(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("name", "jojo")
+	store.Close()
+	// a crash leaves the padding of the direct IO writes at the end of the file
+	f, _ := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+	f.Write(make([]byte, 1000))
+	f.Close()
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store with the padding: %v", err)
+	}
+	defer store.Close()
+	if got, err := store.Get("name"); err != nil || got != "jojo" {
+		t.Errorf("Get(name) = %v, %v, want jojo", got, err)
+	}
+	if len(store.Quarantine()) != 0 {
+		t.Errorf("Quarantine() = %v, want the padding ignored", store.Quarantine())
+	}
+	if err := store.Set("next", "one"); err != nil {
+		t.Errorf("Set() after the padding error = %v", err)
+	}
+}
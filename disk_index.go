@@ -0,0 +1,512 @@
+package caskdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+// Cloner is implemented by the indexes which can copy themselves much cheaper than
+// one key at a time, e.g. by sharing their immutable parts between the copies. keyDir
+// copies an index whenever it is changed while a view of it is around, see
+// keyDirShard.own.
+type Cloner interface {
+	// Clone returns a copy of the index, which can be changed without affecting the
+	// original
+	Clone() Index
+}
+
+// diskBlockRecords is the number of records in a block of a diskRun, the unit its
+// sparse index points to and a lookup reads.
+const diskBlockRecords = 64
+
+// diskIndex is an OrderedIndex which keeps most of its keys on the disk, so that the
+// number of keys is not limited by the RAM, much like an LSM tree. The recent changes
+// are kept in memory, in delta; once it has limit keys, it is written out as a new
+// sorted run. The runs are immutable, and the smaller, newer ones are merged into the
+// older ones as they pile up, so there are about log(n) of them. A lookup goes through
+// delta and then through the runs, newest first, until it finds the key or its
+// tombstone. Each run has a bloom filter of its keys, so that the lookups of the keys
+// it does not have, including all the new keys being put, rarely read it.
+//
+// The runs only live as long as the store is open: keyDir is loaded from the data
+// files on every open, so they are scratch files, removed once no copy of the index
+// refers to them any more, see diskIndexFiles. Since the Index interface has no room
+// for the errors, an IO error on the runs puts the store in the failed state instead.
+type diskIndex struct {
+	files *diskIndexFiles
+	limit int
+	// delta has the changes since the last flush, by key
+	delta map[string]diskDelta
+	// runs are the sorted runs on the disk, oldest first
+	runs  []*diskRun
+	count int
+}
+
+// diskIndexFiles is where the disk indexes of a store keep their runs: a directory
+// of the store's own, in the one given to NewDiskIndex, which is cleared when the
+// store is opened, and removed when it is closed. It also takes the IO errors on the
+// runs to the failed state of the store.
+type diskIndexFiles struct {
+	// root is the directory given to NewDiskIndex, and dir the one of the store in it
+	root string
+	dir  string
+	// fail is DiskStore.fail, nil for an index on its own
+	fail func(error) error
+	// failed is set once an IO error was hit; the changes are kept in memory from
+	// then on, rather than written out
+	failed atomic.Bool
+}
+
+// newIndex makes an Index for keyDir with Options.NewIndex. The indexes of
+// NewDiskIndex are given the files of the store.
+func (d *DiskStore) newIndex() Index {
+	idx := d.opts.NewIndex()
+	if x, ok := idx.(*diskIndex); ok {
+		if d.indexFiles.root == "" {
+			d.indexFiles.root = x.files.root
+		}
+		x.files = &d.indexFiles
+	}
+	return idx
+}
+
+// diskIndexDir returns the directory of the runs of the store at fileName in root.
+// It is named after the absolute path of the store, so that the stores with the same
+// name in different directories do not share it.
+func diskIndexDir(root string, fileName string) string {
+	path, err := filepath.Abs(fileName)
+	if err != nil {
+		path = fileName
+	}
+	return filepath.Join(root, fmt.Sprintf("%s-%08x.index", filepath.Base(fileName), crc32.ChecksumIEEE([]byte(path))))
+}
+
+// open sets up the directory of the runs of the store at fileName. A writable store
+// holds the lock of its files, so it clears what a previous process left behind in
+// its directory. The read-only stores do not take the lock, and several of them may
+// be open at once, so each gets a new directory of its own.
+func (f *diskIndexFiles) open(fileName string, readOnly bool) error {
+	if readOnly {
+		dir, err := os.MkdirTemp(f.root, filepath.Base(fileName)+"-*.index")
+		f.dir = dir
+		return err
+	}
+	f.dir = diskIndexDir(f.root, fileName)
+	if err := os.RemoveAll(f.dir); err != nil {
+		return err
+	}
+	return os.Mkdir(f.dir, 0o700)
+}
+
+// close removes the directory of the runs. The runs still referred to by the copies
+// of the indexes are removed along with it, and can no longer be read.
+func (f *diskIndexFiles) close() error {
+	if f.dir == "" {
+		return nil
+	}
+	return os.RemoveAll(f.dir)
+}
+
+// report puts the store in the failed state with the IO error.
+func (f *diskIndexFiles) report(err error) {
+	f.failed.Store(true)
+	if f.fail != nil {
+		f.fail(fmt.Errorf("disk index: %w", err))
+	}
+}
+
+// diskDelta is the latest change of a key, an entry or a tombstone.
+type diskDelta struct {
+	keyEntry KeyEntry
+	deleted  bool
+}
+
+// diskRun is an immutable file of the diskDelta of the keys in key order. Each record
+// is a flag byte, which is 1 for a tombstone, the size of the key, the key and the
+// encoded KeyEntry.
+type diskRun struct {
+	f    *os.File
+	size int64
+	// filter has all the keys of the run, tombstones included, so that a lookup only
+	// reads the runs which may have the key
+	filter *bloomFilter
+	// firstKeys and offsets are the sparse index: the first key of every block and the
+	// offset it starts at
+	firstKeys []string
+	offsets   []int64
+	records   int
+}
+
+// NewDiskIndex returns a constructor for Options.NewIndex, which keeps most of the keys
+// in files under dir, to open stores with more keys than fit in the RAM. Only the
+// recently changed keys, about memKeys of them over all of keyDir, a sparse index of
+// the files, one key in every 64, and a bloom filter of 10 bits per key are kept in
+// memory. The lookups of the other keys read the disk, so they are a lot slower than
+// with the default index.
+//
+// Each store keeps its files in a directory of its own in dir, which is removed by
+// Close, so dir can be shared by several stores. An IO error on the files puts the
+// store in the failed state, see DiskStore.Failed; a lookup which cannot read them
+// reports the key as missing.
+func NewDiskIndex(dir string, memKeys int) func() Index {
+	limit := memKeys / keyDirShards
+	if limit < diskBlockRecords {
+		limit = diskBlockRecords
+	}
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	return func() Index {
+		return &diskIndex{files: &diskIndexFiles{root: dir, dir: dir}, limit: limit, delta: make(map[string]diskDelta)}
+	}
+}
+
+// lookup returns the latest change of the key, and false if it has none.
+func (x *diskIndex) lookup(key string) (diskDelta, bool) {
+	if change, ok := x.delta[key]; ok {
+		return change, true
+	}
+	for i := len(x.runs) - 1; i >= 0; i-- {
+		change, ok, err := x.runs[i].get(key)
+		if err != nil {
+			x.files.report(err)
+			return diskDelta{}, false
+		}
+		if ok {
+			return change, true
+		}
+	}
+	return diskDelta{}, false
+}
+
+func (x *diskIndex) Get(key string) (KeyEntry, bool) {
+	change, ok := x.lookup(key)
+	if !ok || change.deleted {
+		return KeyEntry{}, false
+	}
+	return change.keyEntry, true
+}
+
+func (x *diskIndex) Put(key string, keyEntry KeyEntry) {
+	if _, ok := x.Get(key); !ok {
+		x.count++
+	}
+	x.delta[key] = diskDelta{keyEntry: keyEntry}
+	x.maybeFlush()
+}
+
+func (x *diskIndex) Delete(key string) {
+	if _, ok := x.Get(key); !ok {
+		return
+	}
+	x.count--
+	if len(x.runs) == 0 {
+		// there is nothing older for a tombstone to hide
+		delete(x.delta, key)
+		return
+	}
+	x.delta[key] = diskDelta{deleted: true}
+	x.maybeFlush()
+}
+
+func (x *diskIndex) Len() int {
+	return x.count
+}
+
+func (x *diskIndex) Clone() Index {
+	delta := make(map[string]diskDelta, len(x.delta))
+	for key, change := range x.delta {
+		delta[key] = change
+	}
+	runs := append([]*diskRun(nil), x.runs...)
+	return &diskIndex{files: x.files, limit: x.limit, delta: delta, runs: runs, count: x.count}
+}
+
+// maybeFlush writes delta out as a new run once it is full, and merges the runs which
+// are not much larger than the ones after them, so that each run is at least twice
+// the size of the next one. Once an IO error was hit, delta is kept in memory
+// instead, where it is still good, whatever its size.
+func (x *diskIndex) maybeFlush() {
+	if len(x.delta) < x.limit || x.files.failed.Load() {
+		return
+	}
+	keys := make([]string, 0, len(x.delta))
+	for key := range x.delta {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	i := 0
+	run, err := x.writeRun(len(keys), func() (string, diskDelta, bool) {
+		if i == len(keys) {
+			return "", diskDelta{}, false
+		}
+		key := keys[i]
+		i++
+		return key, x.delta[key], true
+	})
+	if err != nil {
+		x.files.report(err)
+		return
+	}
+	x.runs = append(x.runs, run)
+	x.delta = make(map[string]diskDelta)
+	for n := len(x.runs); n >= 2 && x.runs[n-2].records <= 2*x.runs[n-1].records; n = len(x.runs) {
+		merged, err := x.mergeRuns(x.runs[n-2], x.runs[n-1], n == 2)
+		if err != nil {
+			// the runs are still good unmerged
+			x.files.report(err)
+			return
+		}
+		x.runs = append(x.runs[:n-2], merged)
+	}
+}
+
+// mergeRuns merges the two runs into one, with the changes of newer winning. The
+// tombstones are dropped if the result is the oldest run.
+func (x *diskIndex) mergeRuns(older *diskRun, newer *diskRun, oldest bool) (*diskRun, error) {
+	a, b := older.cursor(""), newer.cursor("")
+	run, err := x.writeRun(older.records+newer.records, func() (string, diskDelta, bool) {
+		for {
+			var key string
+			var change diskDelta
+			switch {
+			case !a.ok && !b.ok:
+				return "", diskDelta{}, false
+			case !b.ok || (a.ok && a.key < b.key):
+				key, change = a.key, a.change
+				a.next()
+			default:
+				if a.ok && a.key == b.key {
+					a.next()
+				}
+				key, change = b.key, b.change
+				b.next()
+			}
+			if !(oldest && change.deleted) {
+				return key, change, true
+			}
+		}
+	})
+	if err == nil {
+		err = a.err
+	}
+	if err == nil {
+		err = b.err
+	}
+	if err != nil {
+		return nil, err
+	}
+	return run, nil
+}
+
+// writeRun writes the changes returned by next, in key order, to a new run of at most
+// the given number of records.
+func (x *diskIndex) writeRun(records int, next func() (string, diskDelta, bool)) (*diskRun, error) {
+	f, err := os.CreateTemp(x.files.dir, "caskdb-index-*.run")
+	if err != nil {
+		return nil, err
+	}
+	run := &diskRun{f: f, filter: newBloomFilter(records)}
+	w := bufio.NewWriter(f)
+	buf := make([]byte, 0, 64)
+	for key, change, ok := next(); ok; key, change, ok = next() {
+		if run.records%diskBlockRecords == 0 {
+			run.firstKeys = append(run.firstKeys, key)
+			run.offsets = append(run.offsets, run.size)
+		}
+		var flag byte
+		if change.deleted {
+			flag = 1
+		}
+		buf = append(buf[:0], flag)
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(key)))
+		buf = append(buf, key...)
+		buf = encodeKeyEntry(buf, change.keyEntry)
+		w.Write(buf)
+		run.filter.add(key)
+		run.size += int64(len(buf))
+		run.records++
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return nil, err
+	}
+	runtime.SetFinalizer(run, func(run *diskRun) {
+		run.f.Close()
+		os.Remove(run.f.Name())
+	})
+	return run, nil
+}
+
+// get returns the change of the key in the run, reading the one block it can be in,
+// if the filter lets it.
+func (r *diskRun) get(key string) (diskDelta, bool, error) {
+	if !r.filter.mayContain(key) {
+		return diskDelta{}, false, nil
+	}
+	block := sort.SearchStrings(r.firstKeys, key)
+	if block == len(r.firstKeys) || r.firstKeys[block] != key {
+		// the key sorts after the first key of the block before
+		block--
+	}
+	if block < 0 {
+		return diskDelta{}, false, nil
+	}
+	end := r.size
+	if block+1 < len(r.offsets) {
+		end = r.offsets[block+1]
+	}
+	data := make([]byte, end-r.offsets[block])
+	if _, err := r.f.ReadAt(data, r.offsets[block]); err != nil {
+		return diskDelta{}, false, err
+	}
+	for len(data) > 0 {
+		recordKey, change, size := decodeDiskRecord(data)
+		if recordKey == key {
+			return change, true, nil
+		}
+		if recordKey > key {
+			break
+		}
+		data = data[size:]
+	}
+	return diskDelta{}, false, nil
+}
+
+func decodeDiskRecord(data []byte) (string, diskDelta, int) {
+	keySize := int(binary.BigEndian.Uint32(data[1:5]))
+	key := string(data[5 : 5+keySize])
+	change := diskDelta{keyEntry: decodeKeyEntry(data[5+keySize:]), deleted: data[0] == 1}
+	return key, change, 5 + keySize + keyEntrySize
+}
+
+// diskCursor walks the records of a run in order. On an IO error, it stops as if the
+// run ended there, with the error in err.
+type diskCursor struct {
+	r      *bufio.Reader
+	buf    []byte
+	ok     bool
+	key    string
+	change diskDelta
+	err    error
+}
+
+// cursor returns a cursor at the first record of the run whose key is equal to or
+// greater than start.
+func (r *diskRun) cursor(start string) *diskCursor {
+	block := sort.SearchStrings(r.firstKeys, start)
+	if block == len(r.firstKeys) || r.firstKeys[block] != start {
+		block--
+	}
+	if block < 0 {
+		block = 0
+	}
+	var offset int64
+	if len(r.offsets) > 0 {
+		offset = r.offsets[block]
+	}
+	c := &diskCursor{r: bufio.NewReader(io.NewSectionReader(r.f, offset, r.size-offset))}
+	for c.next(); c.ok && c.key < start; c.next() {
+	}
+	return c
+}
+
+func (c *diskCursor) next() {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(c.r, header); err != nil {
+		if err != io.EOF {
+			c.err = err
+		}
+		c.ok = false
+		return
+	}
+	size := 5 + int(binary.BigEndian.Uint32(header[1:5])) + keyEntrySize
+	if cap(c.buf) < size {
+		c.buf = make([]byte, size)
+	}
+	record := c.buf[:size]
+	copy(record, header)
+	if _, err := io.ReadFull(c.r, record[5:]); err != nil {
+		c.err = err
+		c.ok = false
+		return
+	}
+	c.key, c.change, _ = decodeDiskRecord(record)
+	c.ok = true
+}
+
+func (x *diskIndex) Range(fn func(key string, keyEntry KeyEntry) bool) {
+	x.RangeFrom("", fn)
+}
+
+func (x *diskIndex) RangePrefix(prefix string, fn func(key string, keyEntry KeyEntry) bool) {
+	x.RangeFrom(prefix, func(key string, keyEntry KeyEntry) bool {
+		return strings.HasPrefix(key, prefix) && fn(key, keyEntry)
+	})
+}
+
+// RangeFrom merges delta and all the runs on the fly, with the newest change of each
+// key winning.
+func (x *diskIndex) RangeFrom(start string, fn func(key string, keyEntry KeyEntry) bool) {
+	var keys []string
+	for key := range x.delta {
+		if key >= start {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	cursors := make([]*diskCursor, len(x.runs))
+	for i, run := range x.runs {
+		if cursors[i] = run.cursor(start); cursors[i].err != nil {
+			x.files.report(cursors[i].err)
+			return
+		}
+	}
+	for {
+		// the smallest key of all the sources, from the newest source having it
+		key, found := "", false
+		if len(keys) > 0 {
+			key, found = keys[0], true
+		}
+		for _, c := range cursors {
+			if c.ok && (!found || c.key < key) {
+				key, found = c.key, true
+			}
+		}
+		if !found {
+			return
+		}
+		var change diskDelta
+		resolved := false
+		if len(keys) > 0 && keys[0] == key {
+			change, resolved = x.delta[key], true
+			keys = keys[1:]
+		}
+		for i := len(cursors) - 1; i >= 0; i-- {
+			c := cursors[i]
+			if c.ok && c.key == key {
+				if !resolved {
+					change, resolved = c.change, true
+				}
+				if c.next(); c.err != nil {
+					// the rest of the keys cannot be merged right
+					x.files.report(c.err)
+					return
+				}
+			}
+		}
+		if !change.deleted && !fn(key, change.keyEntry) {
+			return
+		}
+	}
+}
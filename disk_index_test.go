@@ -0,0 +1,180 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestDiskIndex(t *testing.T) {
+	dir := t.TempDir()
+	// a small delta makes the index flush and merge its runs all the time
+	idx := &diskIndex{files: &diskIndexFiles{root: dir, dir: dir}, limit: 8, delta: make(map[string]diskDelta)}
+	want := make(map[string]KeyEntry)
+	r := rand.New(rand.NewSource(1))
+	var clone Index
+	var cloneWant map[string]KeyEntry
+	for i := 0; i < 5000; i++ {
+		key := fmt.Sprintf("%c%d", "abc"[r.Intn(3)], r.Intn(500))
+		if r.Intn(3) == 0 {
+			idx.Delete(key)
+			delete(want, key)
+		} else {
+			keyEntry := KeyEntry{Offset: uint32(i)}
+			idx.Put(key, keyEntry)
+			want[key] = keyEntry
+		}
+		if i == 2500 {
+			clone = idx.Clone()
+			cloneWant = make(map[string]KeyEntry, len(want))
+			for key, keyEntry := range want {
+				cloneWant[key] = keyEntry
+			}
+		}
+	}
+	if len(idx.runs) < 2 {
+		t.Errorf("the index has %v runs, want a few", len(idx.runs))
+	}
+
+	for name, c := range map[string]struct {
+		idx  Index
+		want map[string]KeyEntry
+	}{"index": {idx, want}, "clone": {clone, cloneWant}} {
+		if c.idx.Len() != len(c.want) {
+			t.Errorf("%v: Len() = %v, want %v", name, c.idx.Len(), len(c.want))
+		}
+		var sorted []string
+		for key, keyEntry := range c.want {
+			sorted = append(sorted, key)
+			if got, ok := c.idx.Get(key); !ok || got != keyEntry {
+				t.Errorf("%v: Get(%q) = %v, %v, want %v", name, key, got, ok, keyEntry)
+			}
+		}
+		sort.Strings(sorted)
+		if got := artKeys(c.idx.Range); fmt.Sprint(got) != fmt.Sprint(sorted) {
+			t.Errorf("%v: Range() visited %v keys out of order, want %v", name, len(got), len(sorted))
+		}
+	}
+	if _, ok := idx.Get("d0"); ok {
+		t.Errorf("Get(d0) found a key never set")
+	}
+
+	for _, prefix := range []string{"", "a", "b1", "b10", "c499", "d"} {
+		var wantKeys []string
+		for key := range want {
+			if strings.HasPrefix(key, prefix) {
+				wantKeys = append(wantKeys, key)
+			}
+		}
+		sort.Strings(wantKeys)
+		got := artKeys(func(fn func(string, KeyEntry) bool) { idx.RangePrefix(prefix, fn) })
+		if fmt.Sprint(got) != fmt.Sprint(wantKeys) {
+			t.Errorf("RangePrefix(%q) = %v keys, want %v", prefix, len(got), len(wantKeys))
+		}
+	}
+}
+
+func TestDiskStore_DiskIndex(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{NewIndex: NewDiskIndex(t.TempDir(), 0)}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	const keys = 2000
+	for i := 0; i < keys; i++ {
+		store.Set(fmt.Sprintf("user:%04d", i), fmt.Sprint(i))
+	}
+	for i := 0; i < keys; i += 2 {
+		store.Delete(fmt.Sprintf("user:%04d", i))
+	}
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer os.Remove(fileName)
+	defer store.Close()
+	if store.Len() != keys/2 {
+		t.Errorf("Len() = %v, want %v", store.Len(), keys/2)
+	}
+	for i := 0; i < keys; i++ {
+		key := fmt.Sprintf("user:%04d", i)
+		got, err := store.Get(key)
+		if i%2 == 0 {
+			if err != ErrKeyNotFound {
+				t.Errorf("Get(%v) = %v, %v, want ErrKeyNotFound", key, got, err)
+			}
+		} else if err != nil || got != fmt.Sprint(i) {
+			t.Errorf("Get(%v) = %v, %v, want %v", key, got, err, i)
+		}
+	}
+	if got := store.KeysWithPrefix("user:010"); len(got) != 5 {
+		t.Errorf("KeysWithPrefix(user:010) = %v, want 5 keys", got)
+	}
+}
+
+func TestDiskStore_DiskIndexFiles(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	root := t.TempDir()
+	// the runs left behind by a crash are cleared on open
+	stale := filepath.Join(diskIndexDir(root, fileName), "caskdb-index-1.run")
+	os.Mkdir(filepath.Dir(stale), 0o700)
+	os.WriteFile(stale, []byte("stale"), 0o600)
+
+	store, err := NewDiskStoreWithOptions(fileName, Options{NewIndex: NewDiskIndex(root, 0)})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("the stale run is still there: %v", err)
+	}
+	for i := 0; i < 20000; i++ {
+		store.Set(fmt.Sprintf("user:%05d", i), fmt.Sprint(i))
+	}
+	runs, _ := filepath.Glob(filepath.Join(diskIndexDir(root, fileName), "*.run"))
+	if len(runs) == 0 {
+		t.Errorf("the index has no runs in the directory of the store")
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("Close() left %v entries in the index directory", len(entries))
+	}
+}
+
+func TestDiskStore_DiskIndexError(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{NewIndex: NewDiskIndex(t.TempDir(), 0)})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	// a few runs for each shard of keyDir
+	const keys = 20000
+	for i := 0; i < keys; i++ {
+		store.Set(fmt.Sprintf("user:%05d", i), fmt.Sprint(i))
+	}
+	// the reads of the runs fail from here on
+	for i := range store.keyDir.shards {
+		for _, run := range store.keyDir.shards[i].entries.(*diskIndex).runs {
+			run.f.Close()
+		}
+	}
+	for i := 0; i < keys && store.Failed() == nil; i++ {
+		store.Get(fmt.Sprintf("user:%05d", i))
+	}
+	if err := store.Failed(); !errors.Is(err, ErrStoreFailed) {
+		t.Fatalf("Failed() = %v, want ErrStoreFailed", err)
+	}
+	if err := store.Set("name", "jojo"); !errors.Is(err, ErrStoreFailed) {
+		t.Errorf("Set() = %v, want ErrStoreFailed", err)
+	}
+}
@@ -1,11 +1,17 @@
 package caskdb
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -28,32 +34,188 @@ import (
 //
 // However, there are drawbacks too:
 //   - We need to maintain an in-memory hash table KeyDir. A database with a large
-//     number of keys would require more RAM
+//     number of keys would require more RAM, unless most of it is kept on the disk
+//     with NewDiskIndex, at the cost of slower reads
 //   - Since we need to build the KeyDir at initialisation, it will affect the startup
 //     time too
 //   - Deleted keys need to be purged from the file to reduce the file size
 //
 // Read the paper for more details: https://riak.com/assets/bitcask-intro.pdf
 //
-// DiskStore provides two simple operations to get and set key value pairs. Both key
-// and value need to be of string type, and all the data is persisted to disk.
+// DiskStore provides simple operations to get, set and delete key value pairs. Both
+// key and value are strings, and all the data is persisted to disk. Keys and values
+// are treated as opaque byte sequences and need not be valid UTF-8; the *Bytes and
+// *Binary variants accept []byte for binary values and keys.
 // During startup, DiskStorage loads all the existing KV pair metadata, and it will
 // throw an error if the file is invalid or corrupt.
 //
 // Note that if the database file is large, the initialisation will take time
-// accordingly. The initialisation is also a blocking operation; till it is completed,
-// we cannot use the database.
+// accordingly, unless a checkpoint of keyDir covers most of it, see Checkpoint. The
+// initialisation is also a blocking operation; till it is completed, we cannot use
+// the database.
+//
+// A DiskStore is safe for concurrent use by multiple goroutines. The reads run in
+// parallel with each other, while the writes are serialised: they are all run by a
+// single writer goroutine, in the order they arrive, see exec. The reads of a single
+// key, like Get, only wait for the writes to the same shard of keyDir, see
+// shardedKeyDir.
 //
 // Typical usage example:
 //
 //		store, _ := NewDiskStore("books.db")
 //	   	store.Set("othello", "shakespeare")
-//	   	author := store.Get("othello")
+//	   	author, _ := store.Get("othello")
+//	   	store.Delete("othello")
 type DiskStore struct {
-	keyDir          map[string]KeyEntry
-	readFileHandle  *os.File
+	// mu guards the state of the store: the reads of many keys share it, while the
+	// writes take it exclusively, which also makes the read-modify-write operations
+	// like CompareAndSwap atomic
+	mu   sync.RWMutex
+	opts Options
+	// keyDir is split into shards, which let the reads of single keys go ahead
+	// without mu, see shardedKeyDir
+	keyDir *shardedKeyDir
+	// live is the number of bytes taken by the live records in each data file, see
+	// trackEntry
+	live map[uint32]int64
+	// removedEnds has the sizes of the data files the compactions removed, or
+	// truncated, by their file ID, so that ReadLog can go on from their ends
+	removedEnds map[uint32]int64
+	// views counts the iterators still reading from their frozen view of keyDir,
+	// which may point to the data files compacted since; those files are retired
+	// rather than removed while there are any, see retireSources
+	views atomic.Int64
+	// retired are the compacted data files kept for the views, by their file ID
+	retired map[uint32]bool
+	// indexFiles is where the indexes of NewDiskIndex keep their runs, if used
+	indexFiles diskIndexFiles
+	// sorted is the sorted view of keyDir for the range scans, if enabled
+	sorted *sortedIndex
+	// cache has the recently read values with Options.CacheSize, nil otherwise
+	cache *valueCache
+	// compression counts how well the values compress, see CompressionStats
+	compression compressionStats
+	// progress counts the bytes scanned while opening the store with
+	// Options.OpenProgress, nil otherwise
+	progress *openProgress
+	// fileName is the path of the first data file; the later segments are named
+	// after it, see segmentName
+	fileName string
+	// readers has a read handle for each of the data files, by their file ID. It is
+	// changed under both mu and filesMu, so that the reads which do not hold mu can
+	// look it up under filesMu.
+	readers map[uint32]*os.File
+	// mmaps has the mappings of the sealed data files with Options.MmapReads, see
+	// mapFile. It is guarded by filesMu, which the reads hold while copying out.
+	mmaps map[uint32][]byte
+	// formats has the Format of each of the data files, and fileFlags the flags of
+	// their file header; both are guarded like readers
+	formats   map[uint32]Format
+	fileFlags map[uint32]uint16
+	// dicts has the compression dictionaries of the data files which have one, see
+	// Options.CompressionDictionary, and is guarded like readers
+	dicts map[uint32][]byte
+	// vlogs are the read handles of the value log files, see Options.ValueLogThreshold,
+	// and are guarded like readers. vlogWriter appends to the one with vlogID, which
+	// ends at vlogOffset, and vlogDirty is whether it was written to since the last
+	// sync; they are guarded by mu, like writeFileHandle.
+	vlogs      map[uint32]*os.File
+	vlogWriter *os.File
+	vlogID     uint32
+	vlogOffset int64
+	vlogDirty  bool
+	// keys are the encryption keys, see Options.EncryptionKeys, and rotatedKey is the
+	// one RotateEncryptionKey rotated to, until a Compact encrypts everything with it;
+	// it is guarded by mu
+	keys       atomic.Pointer[keyRing]
+	rotatedKey uint32
+	// wbuf has the records at the end of the active file which are yet to be flushed
+	// to it, with Options.WriteBufferSize. It is guarded by mu.
+	wbuf []byte
+	// pending has the keyDir updates of the records which are written but cannot be
+	// read yet, in the order they were written, and pendingKeys has their keys; see
+	// deferRecord. They are guarded by mu.
+	pending     []pendingRecord
+	pendingKeys map[string]bool
+	filesMu     sync.RWMutex
+	// activeID is the file ID of the active data file, the one being appended to
+	activeID        uint32
 	writeFileHandle *os.File
 	currentOffset   uint32
+	// direct appends to the active file with Options.DirectIO, nil otherwise
+	direct *directFile
+	// sweeperStop and sweeperDone control the background expiry sweeper, if running
+	sweeperStop chan struct{}
+	sweeperDone chan struct{}
+	// dirty is set when there are writes which are not synced to the disk yet
+	dirty bool
+	// grouping is set while the writer runs a group of writes, whose syncs are put
+	// off until the end of the group, see runGroup
+	grouping bool
+	// failed is the error which put the store in the failed state, see Failed. It is
+	// set by the writer, and read by Failed from any goroutine, so it is atomic.
+	failed atomic.Pointer[error]
+	// flusherStop and flusherDone control the background flusher, if running
+	flusherStop chan struct{}
+	flusherDone chan struct{}
+	// compactorStop and compactorDone control the background compaction, if running,
+	// and compactorForce makes it run outside of its window
+	compactorStop  chan struct{}
+	compactorDone  chan struct{}
+	compactorForce chan struct{}
+	// checkpointerStop and checkpointerDone control the background checkpointer of
+	// Options.CheckpointInterval, if running
+	checkpointerStop chan struct{}
+	checkpointerDone chan struct{}
+	// refresherStop and refresherDone control the background refresher of
+	// Options.RefreshInterval, if running, and refreshing is set while Refresh scans
+	// the data files, see catchUp
+	refresherStop chan struct{}
+	refresherDone chan struct{}
+	refreshing    bool
+	// writes feeds the writer goroutine, which is stopped by writerStop and closes
+	// writerDone when it exits, see exec. They are nil for a read-only store.
+	writes     chan *writeRequest
+	writerStop chan struct{}
+	writerDone chan struct{}
+	// compactMu lets only one compaction run at a time; it is taken before mu
+	compactMu sync.Mutex
+	// compactionLimiter throttles the IO of the compaction
+	compactionLimiter *rateLimiter
+	// logMu guards logWrites, which is closed by the next write to the log, see
+	// logWritten
+	logMu     sync.Mutex
+	logWrites chan struct{}
+	// closed is closed by Close, which stops the changefeeds of Changes
+	closed chan struct{}
+	// quarantine lists the corrupt records found so far, see Quarantine; it is
+	// guarded by quarantineMu rather than mu
+	quarantineMu sync.Mutex
+	quarantine   []QuarantineEntry
+}
+
+var (
+	// ErrNotInteger is returned by Increment when the value is not a decimal integer
+	ErrNotInteger = errors.New("value is not an integer")
+	// ErrOverflow is returned by Increment when the result does not fit in an int64
+	ErrOverflow = errors.New("increment would overflow")
+	// ErrInvalidRange is returned by GetRange for a negative offset or length
+	ErrInvalidRange = errors.New("invalid range")
+	// ErrStoreFailed is returned by the writes of a store in the failed state, see
+	// Failed
+	ErrStoreFailed = errors.New("store has failed, reopen it to recover")
+	// ErrInconsistentOffset is returned when the end of the data file is not where the
+	// store expects it to be, e.g. because something else appended to the file. The
+	// store refuses to write then, since keyDir would point to the wrong records.
+	ErrInconsistentOffset = errors.New("write offset does not match the end of the data file")
+)
+
+// timeNow is the clock used for the record timestamps and the expiry checks. It is
+// a variable so that the tests can travel in time.
+var timeNow = time.Now
+
+func unixNow() uint32 {
+	return uint32(timeNow().Unix())
 }
 
 func isFileExists(fileName string) bool {
@@ -64,100 +226,1358 @@ func isFileExists(fileName string) bool {
 	return false
 }
 
-func getKeyDir(fileName string) (map[string]KeyEntry, error) {
-	var f *os.File
+// loadKeyDir scans the data file from the given offset, the start of the file unless
+// a checkpoint covers the records before it, and applies its records to keyDir.
+//
+// If the process died in the middle of a write, the file ends with a partial record.
+// Such a record was never acknowledged, so it is discarded: the file is truncated
+// back to the end of the last whole record, so that the new records are appended
+// right after it. Only the bytes after a whole record, which are fewer than the
+// sizes in their header claim, are taken for a partial record; the other bytes at
+// the end of the file are handled as a corrupt record. The records which fail their checksum are handled as per
+// Options.CorruptionMode. A read-only store leaves the file as is, and reads on from
+// the end of the last whole record when it is refreshed, see Refresh. It returns the
+// offset where the next record is to be written.
+//
+// The records are handed to apply, in the order of the file. The data files must be
+// applied in the order of their file IDs, so that the later records win; see
+// loadFiles for loading several of them at once.
+func (d *DiskStore) loadKeyDir(fileID uint32, from int64, apply applyFunc) (int64, error) {
+	fileName := segmentName(d.fileName, fileID)
+	end, fileSize, err := d.scanKeyDir(fileID, from, apply)
+	if err != nil {
+		return 0, err
+	}
+	if end == fileSize {
+		return end, nil
+	}
+	if d.opts.ReadOnly {
+		return end, nil
+	}
+	if err := os.Truncate(fileName, end); err != nil {
+		return 0, fmt.Errorf("failed to truncate the data file: %w", err)
+	}
+	return end, nil
+}
+
+// scanKeyDir reads the records of the file one by one, starting at the offset from,
+// and hands them to apply.
+// It returns the offset the file should be truncated to, i.e. the end of the last
+// whole record (or the start of the corruption, with TruncateAtCorruption), along
+// with the size of the file.
+func (d *DiskStore) scanKeyDir(fileID uint32, from int64, apply applyFunc) (int64, int64, error) {
+	fileName := segmentName(d.fileName, fileID)
+	f, err := os.Open(fileName)
+	if err != nil {
+		return 0, 0, err
+	}
 	defer f.Close()
-	keyDir := make(map[string]KeyEntry)
-	var err error
-	if isFileExists(fileName) {
-		f, err = os.Open(fileName)
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+	fileSize := info.Size()
+	// the bytes up to offset are reported to Options.OpenProgress as the scan goes, and
+	// the rest of the file once it is over, whatever the scan made of them
+	reported := from
+	progress := func(to int64) {
+		d.progress.advance(to - reported)
+		reported = to
+	}
+	defer func() { progress(fileSize) }()
+	format := d.formats[fileID]
+	if from < format.dataOffset() {
+		from = format.dataOffset()
+	}
+	if _, err := f.Seek(from, io.SeekStart); err != nil {
+		return 0, 0, err
+	}
+	r := bufio.NewReader(f)
+	now := unixNow()
+	offset := from
+	// the records are read into the same buffer, grown as needed, since only their
+	// keys are kept, as copies
+	var recordBuffer []byte
+	padded := false
+	for fileSize-offset >= int64(format.minHeaderSize()) {
+		// the size of the header is only known once it is decoded, so the largest one
+		// there can be is peeked at, or what is left of the file
+		header, err := r.Peek(maxHeaderSize)
+		if err != nil && err != io.EOF {
+			return 0, 0, err
+		}
+		if isZero(header[:format.minHeaderSize()]) {
+			// the zeros up to the end of the file are the padding of the direct IO
+			// writes, not a record
+			if padded, err = isZeroTail(f, offset, fileSize); err != nil {
+				return 0, 0, err
+			}
+			if padded {
+				break
+			}
+		}
+		h, err := format.decodeHeader(header)
+		totalSize := h.recordSize()
+		var record []byte
+		var corrupt error
+		if err != nil || offset+totalSize > fileSize {
+			if offset == 0 && format == FormatV1 {
+				if err := checkLegacyLayout(f, fileSize); err != nil {
+					return 0, 0, err
+				}
+			}
+			// the sizes claim more bytes than the file has left. Either the write got
+			// cut off here, or the header is corrupt, in which case there are whole
+			// records after it.
+			next, err := nextValidRecord(f, format, offset+1, fileSize)
+			if err != nil {
+				return 0, 0, err
+			}
+			if next == fileSize {
+				break
+			}
+			corrupt = ErrChecksumMismatch
+		} else {
+			if int64(cap(recordBuffer)) < totalSize {
+				recordBuffer = make([]byte, totalSize)
+			}
+			record = recordBuffer[:totalSize]
+			if _, err := io.ReadFull(r, record); err != nil {
+				return 0, 0, err
+			}
+			corrupt = verifyChecksum(record)
+			if corrupt != nil && offset == 0 && format == FormatV1 {
+				if err := checkLegacyLayout(f, fileSize); err != nil {
+					return 0, 0, err
+				}
+			}
+		}
+		if corrupt != nil {
+			switch d.opts.CorruptionMode {
+			case TruncateAtCorruption:
+				d.opts.Logger.Printf("caskdb: discarding %d bytes from the corrupt record at offset %d of %s", fileSize-offset, offset, fileName)
+				d.quarantineRecord(fileID, offset, fileSize-offset, "", corrupt, !d.opts.ReadOnly)
+				return offset, fileSize, nil
+			case SkipCorruptRecords:
+				next, err := nextValidRecord(f, format, offset+1, fileSize)
+				if err != nil {
+					return 0, 0, err
+				}
+				d.opts.Logger.Printf("caskdb: skipping %d corrupt bytes at offset %d of %s", next-offset, offset, fileName)
+				d.quarantineRecord(fileID, offset, next-offset, "", corrupt, false)
+				if _, err := f.Seek(next, io.SeekStart); err != nil {
+					return 0, 0, err
+				}
+				r.Reset(f)
+				offset = next
+				progress(offset)
+				continue
+			default:
+				return 0, 0, fmt.Errorf("record at offset %d: %w", offset, corrupt)
+			}
+		}
+		key := string(record[h.length : h.length+int(h.keySize)])
+		keyEntry := NewKeyEntry(h.timestamp, uint32(offset), uint32(totalSize))
+		keyEntry.FileID = fileID
+		keyEntry.Expiry = h.expiry
+		switch {
+		case isTombstone(h.valueSize) || keyEntry.isExpired(now):
+			apply(key, keyEntry, scanRemove)
+		case isMergeOperand(h.valueSize):
+			apply(key, keyEntry, scanOperand)
+		default:
+			apply(key, keyEntry, scanPut)
+		}
+		offset += totalSize
+		progress(offset)
+	}
+	if offset == 0 && offset < fileSize && format == FormatV1 {
+		// a file too short for a single record of FormatV1
+		if err := checkLegacyLayout(f, fileSize); err != nil {
+			return 0, 0, err
+		}
+	}
+	if offset < fileSize && !padded && !d.refreshing {
+		// the bytes are taken for a cut off write only if they follow a whole record,
+		// and are fewer than the record claims to have; anything else may be a file
+		// this version cannot read, and is not thrown away on a guess
+		partial, err := isPartialRecord(f, format, offset, fileSize)
 		if err != nil {
+			return 0, 0, err
+		}
+		partial = partial && offset > format.dataOffset()
+		switch {
+		case partial || d.opts.ReadOnly:
+			d.opts.Logger.Printf("caskdb: discarding a partial record of %d bytes at offset %d of %s", fileSize-offset, offset, fileName)
+			d.quarantineRecord(fileID, offset, fileSize-offset, "", ErrPartialRecord, !d.opts.ReadOnly)
+		case d.opts.CorruptionMode == FailOnCorruption:
+			return 0, 0, fmt.Errorf("record at offset %d: %w", offset, ErrCorruptRecord)
+		default:
+			d.opts.Logger.Printf("caskdb: discarding %d bytes from the corrupt record at offset %d of %s", fileSize-offset, offset, fileName)
+			d.quarantineRecord(fileID, offset, fileSize-offset, "", ErrCorruptRecord, true)
+		}
+	}
+	return offset, fileSize, nil
+}
+
+// isPartialRecord reports whether the bytes of the data file from offset to its end
+// can be a record whose write got cut off: the sizes in its header must claim more
+// bytes than there are, unless there are too few of them for the header itself.
+func isPartialRecord(f *os.File, format Format, offset int64, fileSize int64) (bool, error) {
+	header := make([]byte, maxHeaderSize)
+	if fileSize-offset < int64(len(header)) {
+		header = header[:fileSize-offset]
+	}
+	if _, err := f.ReadAt(header, offset); err != nil {
+		return false, err
+	}
+	h, err := format.decodeHeader(header)
+	if err != nil {
+		return len(header) < maxHeaderSize, nil
+	}
+	return offset+h.recordSize() > fileSize, nil
+}
+
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// isZeroTail reports whether the file has only zeros from offset to its end.
+func isZeroTail(f *os.File, offset int64, fileSize int64) (bool, error) {
+	buf := make([]byte, 64<<10)
+	for offset < fileSize {
+		n := int64(len(buf))
+		if fileSize-offset < n {
+			n = fileSize - offset
+		}
+		if _, err := f.ReadAt(buf[:n], offset); err != nil {
+			return false, err
+		}
+		if !isZero(buf[:n]) {
+			return false, nil
+		}
+		offset += n
+	}
+	return true, nil
+}
+
+// nextValidRecord looks for the first offset at or after from where a record passing
+// its checksum starts. Once a header is corrupt, the sizes in it cannot be trusted to
+// find the next record, so every offset is tried. It returns the file size if there
+// is no such record.
+func nextValidRecord(f *os.File, format Format, from int64, fileSize int64) (int64, error) {
+	headerBuffer := make([]byte, maxHeaderSize)
+	for offset := from; fileSize-offset >= int64(format.minHeaderSize()); offset++ {
+		header := headerBuffer
+		if fileSize-offset < int64(len(header)) {
+			header = header[:fileSize-offset]
+		}
+		if _, err := f.ReadAt(header, offset); err != nil {
+			return 0, err
+		}
+		h, err := format.decodeHeader(header)
+		totalSize := h.recordSize()
+		if err != nil || offset+totalSize > fileSize {
+			continue
+		}
+		record := make([]byte, totalSize)
+		if _, err := f.ReadAt(record, offset); err != nil {
+			return 0, err
+		}
+		if verifyChecksum(record) == nil {
+			return offset, nil
+		}
+	}
+	return fileSize, nil
+}
+
+// putKeyEntry points the key to its new record, replacing whatever it had before.
+// The caller must hold mu, as for all the changes to keyDir.
+func (d *DiskStore) putKeyEntry(key string, keyEntry KeyEntry) {
+	if _, ok := d.keyDir.get(key); !ok && d.sorted != nil {
+		d.sorted.insert(key)
+	}
+	d.untrackKey(key)
+	s := d.keyDir.shard(key)
+	s.mu.Lock()
+	s.own(d.keyDir.newIndex)
+	s.entries.Put(key, keyEntry)
+	delete(s.merges, key)
+	d.cache.remove(key)
+	s.mu.Unlock()
+	d.trackEntry(keyEntry)
+}
+
+// removeKeyEntry drops the key from keyDir.
+func (d *DiskStore) removeKeyEntry(key string) {
+	if _, ok := d.keyDir.get(key); ok && d.sorted != nil {
+		d.sorted.remove(key)
+	}
+	d.untrackKey(key)
+	s := d.keyDir.shard(key)
+	s.mu.Lock()
+	s.own(d.keyDir.newIndex)
+	s.entries.Delete(key)
+	delete(s.merges, key)
+	d.cache.remove(key)
+	s.mu.Unlock()
+}
+
+// trackEntry counts the record of the keyEntry as live in its data file. The bytes of
+// a file which are not live are garbage: the stale values and the tombstones. The
+// expired keys are still counted as live until they are removed, e.g. by SweepExpired.
+func (d *DiskStore) trackEntry(keyEntry KeyEntry) {
+	d.live[keyEntry.FileID] += int64(keyEntry.Size)
+}
+
+// untrackKey stops counting the records of the key as live, before they are replaced
+// or removed.
+func (d *DiskStore) untrackKey(key string) {
+	if m, ok := d.keyDir.merge(key); ok {
+		if m.hasBase {
+			d.live[m.base.FileID] -= int64(m.base.Size)
+		}
+		for _, operandEntry := range m.operands {
+			d.live[operandEntry.FileID] -= int64(operandEntry.Size)
+		}
+	} else if keyEntry, ok := d.keyDir.get(key); ok {
+		d.live[keyEntry.FileID] -= int64(keyEntry.Size)
+	}
+}
+
+// createFile creates an empty data file, and syncs its directory, so that the file
+// does not vanish after a crash.
+func createFile(fileName string, mode os.FileMode) error {
+	f, err := os.OpenFile(fileName, os.O_CREATE|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(fileName)); err != nil {
+		return fmt.Errorf("failed to sync the directory: %w", err)
+	}
+	return nil
+}
+
+// NewDiskStore opens the store at fileName with the default options, creating the
+// file if it does not exist.
+func NewDiskStore(fileName string) (*DiskStore, error) {
+	return NewDiskStoreWithOptions(fileName, Options{})
+}
+
+// NewDiskStoreWithOptions opens the store at fileName configured by opts.
+//
+// Unless it is read-only, the store holds an exclusive advisory lock on the file
+// until Close, so that two processes cannot append to the same file and interleave
+// their records. Opening a file which is locked by another store fails with
+// ErrDatabaseLocked. The read-only stores do not take the lock.
+func NewDiskStoreWithOptions(fileName string, opts Options) (*DiskStore, error) {
+	opts = opts.withDefaults()
+	if opts.Format != FormatV1 && opts.Format != FormatV2 {
+		return nil, fmt.Errorf("%w: %v", ErrUnknownFormat, opts.Format)
+	}
+	if err := checkCompression(opts); err != nil {
+		return nil, err
+	}
+	keys, err := checkEncryption(opts)
+	if err != nil {
+		return nil, err
+	}
+	if !opts.ReadOnly && !isFileExists(fileName) {
+		if err := createFile(fileName, opts.FileMode); err != nil {
 			return nil, err
 		}
-	} else {
-		f, err = os.Create(fileName)
+	}
+	store := &DiskStore{
+		opts:      opts,
+		live:      make(map[uint32]int64),
+		fileName:  fileName,
+		readers:   make(map[uint32]*os.File),
+		mmaps:     make(map[uint32][]byte),
+		formats:   make(map[uint32]Format),
+		fileFlags: make(map[uint32]uint16),
+		dicts:     make(map[uint32][]byte),
+		vlogs:     make(map[uint32]*os.File),
+		closed:    make(chan struct{}),
+
+		compactionLimiter: newRateLimiter(opts.CompactionRateLimit),
+	}
+	store.keys.Store(keys)
+	store.indexFiles.fail = store.fail
+	store.keyDir = newShardedKeyDir(store.newIndex)
+	if err := store.open(); err != nil {
+		store.closeFiles()
+		return nil, err
+	}
+	if opts.SortedIndex {
+		store.sorted = newSortedIndex(store.keyDir)
+	}
+	store.cache = newValueCache(opts.CacheSize)
+	if !opts.ReadOnly {
+		store.startWriter()
+	}
+	if interval := opts.SyncPolicy.interval(); interval > 0 && !opts.ReadOnly {
+		store.startFlusher(interval)
+	}
+	if opts.CheckpointInterval > 0 && !opts.ReadOnly {
+		store.startCheckpointer(opts.CheckpointInterval)
+	}
+	if opts.RefreshInterval > 0 && opts.ReadOnly {
+		store.startRefresher(opts.RefreshInterval)
+	}
+	return store, nil
+}
+
+// open opens all the data files, loads keyDir from them and makes the last one the
+// active file. The files opened so far are left for the caller to close on error.
+func (d *DiskStore) open() error {
+	f, err := os.Open(d.fileName)
+	if err != nil {
+		return err
+	}
+	d.readers[0] = f
+	if !d.opts.ReadOnly {
+		// the lock has to be taken before the scan, which may truncate the files. The
+		// first data file carries the lock of the whole store.
+		if err := lockFile(f); err != nil {
+			return err
+		}
+	}
+	if d.indexFiles.root != "" {
+		if err := d.indexFiles.open(d.fileName, d.opts.ReadOnly); err != nil {
+			return fmt.Errorf("disk index: %w", err)
+		}
+	}
+	fileIDs, err := listSegments(d.fileName)
+	if err != nil {
+		return err
+	}
+	if err := d.openValueLogs(); err != nil {
+		return err
+	}
+	checkpointed := d.loadCheckpoint(fileIDs)
+	for _, fileID := range fileIDs {
+		if fileID != 0 {
+			f, err := os.Open(segmentName(d.fileName, fileID))
+			if err != nil {
+				return err
+			}
+			d.readers[fileID] = f
+		}
+		format, flags, err := readFileHeader(d.readers[fileID])
 		if err != nil {
-			return nil, err
+			return fmt.Errorf("data file %d: %w", fileID, err)
+		}
+		d.formats[fileID], d.fileFlags[fileID] = format, flags
+		if flags&fileDictionary == 0 {
+			continue
+		}
+		if err := d.loadDictionary(fileID); err != nil {
+			return fmt.Errorf("data file %d: %w", fileID, err)
 		}
 	}
-	offset := 0
-	for {
-		headerBuffer := make([]byte, headerSize)
-		n, err := f.Read(headerBuffer)
-		if err == io.EOF || n == 0 {
-			break
+	ends, err := d.loadFiles(fileIDs, checkpointed)
+	if err != nil {
+		return err
+	}
+	if err := d.Failed(); err != nil {
+		// keyDir could not be loaded into the disk index
+		return err
+	}
+	d.activeID = fileIDs[len(fileIDs)-1]
+	d.currentOffset = uint32(ends[len(ends)-1])
+	for _, fileID := range fileIDs {
+		if fileID != d.activeID {
+			d.mapFile(fileID)
 		}
+	}
+	if d.opts.ReadOnly {
+		return nil
+	}
+	d.writeFileHandle, err = d.openWriter(segmentName(d.fileName, d.activeID))
+	if err != nil {
+		return err
+	}
+	if _, err := d.writeOffset(); err != nil {
+		return err
+	}
+	d.openDirect()
+	d.preallocate()
+	return d.adoptFormat()
+}
+
+// Get returns the value of the key. It returns ErrKeyNotFound if the key does not
+// exist, and any error hit while reading the record back from the disk. A short
+// read is reported as io.ErrUnexpectedEOF.
+func (d *DiskStore) Get(key string) (string, error) {
+	s := d.keyDir.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keyEntry, ok := d.lookup(key)
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	if _, ok := d.keyDir.merge(key); ok {
+		value, err := d.get(key)
+		return string(value), err
+	}
+	// the value is copied into the string, so the record can be read into a pooled
+	// buffer, unlike with GetBytes
+	if value, ok := d.cache.peek(key, keyEntry); ok {
+		return value, nil
+	}
+	buf := getBuffer(int(keyEntry.Size))
+	defer putBuffer(buf)
+	value, err := d.readValueInto(key, keyEntry, (*buf)[:keyEntry.Size])
+	if err != nil {
+		return "", err
+	}
+	d.cache.add(key, keyEntry, value)
+	return string(value), nil
+}
+
+// GetBytes is the same as Get, but returns the value as bytes. The returned slice is
+// owned by the caller.
+func (d *DiskStore) GetBytes(key string) ([]byte, error) {
+	s := d.keyDir.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return d.get(key)
+}
+
+// lookup returns the keyDir entry of the key, hiding the keys which have expired.
+func (d *DiskStore) lookup(key string) (KeyEntry, bool) {
+	keyEntry, ok := d.keyDir.get(key)
+	if !ok || keyEntry.isExpired(unixNow()) {
+		return KeyEntry{}, false
+	}
+	return keyEntry, true
+}
+
+func (d *DiskStore) get(key string) ([]byte, error) {
+	keyEntry, ok := d.lookup(key)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	if m, ok := d.keyDir.merge(key); ok {
+		return d.getMerged(key, m)
+	}
+	if value, ok := d.cache.get(key, keyEntry); ok {
+		return value, nil
+	}
+	value, err := d.readValue(key, keyEntry)
+	if err == nil {
+		d.cache.add(key, keyEntry, value)
+	}
+	return value, err
+}
+
+// readValue reads the record of the key pointed by keyEntry, verifies it and returns
+// its value. A corrupt record is added to the quarantine report.
+func (d *DiskStore) readValue(key string, keyEntry KeyEntry) ([]byte, error) {
+	return d.readValueInto(key, keyEntry, make([]byte, keyEntry.Size))
+}
+
+// readValueInto is the same as readValue, but reads the record into kvBuffer, which
+// must be keyEntry.Size bytes long. The value is a slice of it, unless it was
+// compressed.
+func (d *DiskStore) readValueInto(key string, keyEntry KeyEntry, kvBuffer []byte) ([]byte, error) {
+	if err := d.readAt(keyEntry.FileID, kvBuffer, int64(keyEntry.Offset)); err != nil {
+		return nil, err
+	}
+	format := d.fileFormat(keyEntry.FileID)
+	if err := format.verifyRecord(kvBuffer); err != nil {
+		d.quarantineRecord(keyEntry.FileID, int64(keyEntry.Offset), int64(keyEntry.Size), key, err, false)
+		return nil, err
+	}
+	value, err := d.recordValue(keyEntry.FileID, format, kvBuffer)
+	if errors.Is(err, ErrUnknownEncryptionKey) {
+		// the record is fine, the key is missing from the options
+		return nil, err
+	}
+	if err != nil {
+		d.quarantineRecord(keyEntry.FileID, int64(keyEntry.Offset), int64(keyEntry.Size), key, err, false)
+		return nil, err
+	}
+	return value, nil
+}
+
+// Meta is the metadata of a key's record, as kept in keyDir, along with the Metadata
+// stored with its value.
+type Meta struct {
+	Metadata
+	// Timestamp is when the record was written, with a granularity of one second
+	Timestamp time.Time
+	// Expiry is when the key expires; the zero time if it never expires
+	Expiry time.Time
+	// Size is the size of the whole record on the disk, header included
+	Size int
+	// FileID is the file ID of the data file the record is in, see MaxSegmentSize
+	FileID uint32
+	// Offset is the byte offset of the record in its data file
+	Offset int64
+}
+
+func newMeta(keyEntry KeyEntry) Meta {
+	meta := Meta{
+		Timestamp: time.Unix(int64(keyEntry.Timestamp), 0),
+		Size:      int(keyEntry.Size),
+		FileID:    keyEntry.FileID,
+		Offset:    int64(keyEntry.Offset),
+	}
+	if keyEntry.Expiry != 0 {
+		meta.Expiry = time.Unix(int64(keyEntry.Expiry), 0)
+	}
+	return meta
+}
+
+// GetWithMeta is the same as Get, but also returns the metadata of the key's record,
+// which is useful for auditing and for deciding how fresh a value is, and the
+// Metadata stored with the value by SetWithMeta, if any.
+func (d *DiskStore) GetWithMeta(key string) (string, Meta, error) {
+	s := d.keyDir.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	value, err := d.get(key)
+	if err != nil {
+		return "", Meta{}, err
+	}
+	keyEntry, _ := d.keyDir.get(key)
+	meta := newMeta(keyEntry)
+	if valueEntry, ok := d.valueEntry(key); ok {
+		encoded, err := d.readMetadata(valueEntry)
 		if err != nil {
-			return nil, err
+			return "", Meta{}, err
+		}
+		if meta.Metadata, err = decodeMetadata(encoded); err != nil {
+			return "", Meta{}, err
 		}
+	}
+	return string(value), meta, nil
+}
 
-		timestamp, keySize, valueSize := decodeHeader(headerBuffer)
-		kvBuffer := make([]byte, keySize+valueSize)
-		n, err = f.Read(kvBuffer)
+// SizeOf returns the size of the key's value in bytes. It is answered without
+// reading the value, so the callers can budget before fetching a huge value: from
+// keyDir alone for FormatV1, and with a read of the record header for FormatV2. The
+// only exceptions are the keys with pending merge operands, whose value has to be
+// computed first, and the encrypted values, which have to be decrypted.
+func (d *DiskStore) SizeOf(key string) (int, error) {
+	s := d.keyDir.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keyEntry, ok := d.lookup(key)
+	if !ok {
+		return 0, ErrKeyNotFound
+	}
+	if _, ok := d.keyDir.merge(key); ok {
+		value, err := d.get(key)
+		return len(value), err
+	}
+	_, size, _, err := d.valueLayout(key, keyEntry)
+	if err == nil && size < 0 {
+		value, err := d.get(key)
+		return len(value), err
+	}
+	return size, err
+}
+
+// GetRange returns length bytes of the value of the key, starting at offset. Instead
+// of reading the whole record, it reads just the requested range of the value from
+// the disk. The range is clipped to the end of the value, so an offset past the end
+// returns no bytes. Since the rest of the record is not read, its checksum cannot be
+// verified either. A value which is compressed, or in the value log, is read whole.
+func (d *DiskStore) GetRange(key string, offset int, length int) ([]byte, error) {
+	if offset < 0 || length < 0 {
+		return nil, ErrInvalidRange
+	}
+	s := d.keyDir.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keyEntry, ok := d.lookup(key)
+	if !ok {
+		return nil, ErrKeyNotFound
+	}
+	if _, ok := d.keyDir.merge(key); ok {
+		value, err := d.get(key)
 		if err != nil {
 			return nil, err
 		}
-		if n == 0 {
-			return nil, errors.New("EOF reading key")
+		return clipRange(value, offset, length), nil
+	}
+	valueOffset, valueSize, direct, err := d.valueLayout(key, keyEntry)
+	if err != nil {
+		return nil, err
+	}
+	if !direct {
+		value, err := d.get(key)
+		if err != nil {
+			return nil, err
 		}
-		data := append(headerBuffer, kvBuffer...)
-		_, key, _ := decodeKV(data)
-		totalSize := headerSize + keySize + valueSize
-		keyDir[key] = NewKeyEntry(timestamp, uint32(offset), totalSize)
-		offset += int(totalSize)
+		return clipRange(value, offset, length), nil
+	}
+	if offset >= valueSize {
+		return []byte{}, nil
+	}
+	if offset+length > valueSize {
+		length = valueSize - offset
+	}
+	buf := make([]byte, length)
+	if err := d.readAt(keyEntry.FileID, buf, valueOffset+int64(offset)); err != nil {
+		return nil, err
 	}
-	return keyDir, err
+	return buf, nil
 }
 
-func NewDiskStore(fileName string) (*DiskStore, error) {
-	var err error
-	var writeFileHandle *os.File
-	var readFileHandle *os.File
-	keyDir, err := getKeyDir(fileName)
+func clipRange(value []byte, offset int, length int) []byte {
+	if offset >= len(value) {
+		return []byte{}
+	}
+	if offset+length > len(value) {
+		length = len(value) - offset
+	}
+	return value[offset : offset+length]
+}
+
+// multiGetMaxGap is the largest gap (in bytes) between two records which GetMulti
+// still reads in one go. Reading a few stale bytes is cheaper than another seek.
+const multiGetMaxGap = 4096
+
+// GetMulti returns the values of all the given keys which exist in the store; the
+// missing keys are simply absent from the result. Instead of doing a random seek
+// per key, the records are sorted by their offset in the file and records which
+// sit next to each other (or close enough, see multiGetMaxGap) are fetched with a
+// single read.
+func (d *DiskStore) GetMulti(keys []string) (map[string]string, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	result := make(map[string]string, len(keys))
+	entries := make([]KeyEntry, 0, len(keys))
+	for _, key := range keys {
+		keyEntry, ok := d.lookup(key)
+		if _, seen := result[key]; !ok || seen {
+			continue
+		}
+		if m, ok := d.keyDir.merge(key); ok {
+			value, err := d.getMerged(key, m)
+			if err != nil {
+				return nil, err
+			}
+			result[key] = string(value)
+			continue
+		}
+		result[key] = ""
+		entries = append(entries, keyEntry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].before(entries[j])
+	})
+
+	for start := 0; start < len(entries); {
+		// find the run of records which can be fetched together
+		end := start + 1
+		fileID := entries[start].FileID
+		runEnd := entries[start].Offset + entries[start].Size
+		for end < len(entries) && entries[end].FileID == fileID && entries[end].Offset <= runEnd+multiGetMaxGap {
+			runEnd = entries[end].Offset + entries[end].Size
+			end++
+		}
+		runStart := entries[start].Offset
+		buf := make([]byte, runEnd-runStart)
+		if err := d.readAt(fileID, buf, int64(runStart)); err != nil {
+			return nil, err
+		}
+		format := d.fileFormat(fileID)
+		for _, keyEntry := range entries[start:end] {
+			pos := keyEntry.Offset - runStart
+			record := buf[pos : pos+keyEntry.Size]
+			if err := format.verifyRecord(record); err != nil {
+				d.quarantineRecord(keyEntry.FileID, int64(keyEntry.Offset), int64(keyEntry.Size), "", err, false)
+				return nil, err
+			}
+			_, key, _ := format.decodeKVBytes(record)
+			value, err := d.recordValue(fileID, format, record)
+			if err != nil {
+				d.quarantineRecord(keyEntry.FileID, int64(keyEntry.Offset), int64(keyEntry.Size), key, err, false)
+				return nil, err
+			}
+			result[key] = string(value)
+		}
+		start = end
+	}
+	return result, nil
+}
+
+// readAt fills buf with the bytes of the data file starting at offset. A short read
+// is reported as io.ErrUnexpectedEOF. It uses pread, which does not move the position
+// of the shared file handle, so any number of readers can read at the same time.
+func (d *DiskStore) readAt(fileID uint32, buf []byte, offset int64) error {
+	d.filesMu.RLock()
+	if data, ok := d.mmaps[fileID]; ok {
+		defer d.filesMu.RUnlock()
+		if offset+int64(len(buf)) > int64(len(data)) {
+			return io.ErrUnexpectedEOF
+		}
+		copy(buf, data[offset:])
+		return nil
+	}
+	f, ok := d.readers[fileID]
+	d.filesMu.RUnlock()
+	if !ok {
+		return fmt.Errorf("data file %d is not open", fileID)
+	}
+	n, err := f.ReadAt(buf, offset)
+	if n == len(buf) {
+		return nil
+	}
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Has reports whether the key exists in the store. It consults only the in-memory
+// keyDir and never touches the data file, so it is much cheaper than Get.
+func (d *DiskStore) Has(key string) bool {
+	s := d.keyDir.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := d.lookup(key)
+	return ok
+}
+
+// Keys returns all the live keys in the store, in no particular order. Binary keys
+// are returned as is; use []byte(key) to get the original bytes back.
+func (d *DiskStore) Keys() []string {
+	return d.KeysWithPrefix("")
+}
+
+// KeysWithPrefix returns all the live keys which start with the given prefix, in no
+// particular order. Like Has, it is answered from keyDir alone.
+func (d *DiskStore) KeysWithPrefix(prefix string) []string {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	now := unixNow()
+	var keys []string
+	d.keyDir.forEachPrefix(prefix, func(key string, keyEntry KeyEntry) {
+		if !keyEntry.isExpired(now) {
+			keys = append(keys, key)
+		}
+	})
+	return keys
+}
+
+// SetBinary stores a key value pair where both the key and the value are arbitrary
+// bytes, like hashes or serialised composite keys.
+func (d *DiskStore) SetBinary(key []byte, value []byte) error {
+	return d.SetBytes(string(key), value)
+}
+
+// GetBinary returns the value of a binary key set by SetBinary.
+func (d *DiskStore) GetBinary(key []byte) ([]byte, error) {
+	return d.GetBytes(string(key))
+}
+
+// HasBinary reports whether the binary key exists in the store.
+func (d *DiskStore) HasBinary(key []byte) bool {
+	return d.Has(string(key))
+}
+
+// DeleteBinary removes the binary key from the store.
+func (d *DiskStore) DeleteBinary(key []byte) error {
+	return d.Delete(string(key))
+}
+
+// Len returns the number of live keys in the store. The keys which have expired but
+// are not yet purged from keyDir are counted too.
+func (d *DiskStore) Len() int {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.keyDir.len()
+}
+
+// DiskSize returns the current size of all the data files and the value log in bytes,
+// including the stale records and tombstones which are yet to be reclaimed. It returns -1 if the
+// size cannot be determined.
+func (d *DiskStore) DiskSize() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var size int64
+	d.filesMu.RLock()
+	defer d.filesMu.RUnlock()
+	for _, files := range []map[uint32]*os.File{d.readers, d.vlogs} {
+		for _, f := range files {
+			info, err := f.Stat()
+			if err != nil {
+				return -1
+			}
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// Set stores the key value pair on the disk. The keyDir is updated only after the
+// record is written, and flushed with Options.WriteBufferSize, so a Set whose write
+// fails never makes the key visible. With SyncAlways, Set returns once the record is
+// synced as well, along with the other writes of its group, see runGroup, and the
+// value becomes visible to the reads only then; if the sync fails, which fails the
+// Set and puts the store in the failed state, see Failed, it never does. A value
+// larger than about 1GB is turned down with ErrValueTooLarge, see maxValueSize.
+func (d *DiskStore) Set(key string, value string) error {
+	return d.execKeys(nil, func() error {
+		return d.set(key, value, 0)
+	})
+}
+
+func (d *DiskStore) set(key string, value string, expiry uint32) error {
+	if err := checkValueSize(len(value)); err != nil {
+		return err
+	}
+	timestamp := unixNow()
+	buf := getBuffer(maxHeaderSize + len(key) + len(value))
+	defer putBuffer(buf)
+	if d.separating(len(value)) {
+		encoded, err := d.appendEntry(*buf, timestamp, expiry, key, []byte(value), nil)
+		if err != nil {
+			return err
+		}
+		*buf = encoded
+	} else {
+		*buf = d.appendKV(*buf, timestamp, expiry, key, value)
+	}
+	return d.writeKV(key, timestamp, expiry, *buf)
+}
+
+// SetBytes is the same as Set, but takes the value as bytes.
+func (d *DiskStore) SetBytes(key string, value []byte) error {
+	if err := checkValueSize(len(value)); err != nil {
+		return err
+	}
+	return d.execKeys(nil, func() error {
+		timestamp := unixNow()
+		buf := getBuffer(maxHeaderSize + len(key) + len(value))
+		defer putBuffer(buf)
+		encoded, err := d.appendEntry(*buf, timestamp, 0, key, value, nil)
+		if err != nil {
+			return err
+		}
+		*buf = encoded
+		return d.writeKV(key, timestamp, 0, *buf)
+	})
+}
+
+// writeKV appends an encoded record of the key to the file and points keyDir to it.
+// The record is not referenced once it returns, so it may come from getBuffer.
+func (d *DiskStore) writeKV(key string, timestamp uint32, expiry uint32, encodedKV []byte) error {
+	fileID, offset, err := d.write(encodedKV)
 	if err != nil {
-		return nil, err
+		return err
 	}
+	keyEntry := NewKeyEntry(timestamp, offset, uint32(len(encodedKV)))
+	keyEntry.FileID = fileID
+	keyEntry.Expiry = expiry
+	d.deferRecord(key, keyEntry, scanPut)
+	return nil
+}
 
-	writeFileHandle, err = os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+// CompareAndSwap sets the key to new only if its current value is old, and reports
+// whether the value was swapped. It returns false if the key does not exist. The
+// comparison and the write happen on the writer goroutine, so no other write can
+// sneak in between them.
+func (d *DiskStore) CompareAndSwap(key string, old string, new string) (bool, error) {
+	swapped := false
+	err := d.execKeys([]string{key}, func() error {
+		current, err := d.get(key)
+		if errors.Is(err, ErrKeyNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if string(current) != old {
+			return nil
+		}
+		keyEntry, _ := d.keyDir.get(key)
+		if err := d.set(key, new, keyEntry.Expiry); err != nil {
+			return err
+		}
+		swapped = true
+		return nil
+	})
+	return swapped, err
+}
+
+// SetIfAbsent sets the key only if it does not exist yet, and reports whether the
+// value was written. Like CompareAndSwap, the check and the write are atomic, which
+// makes it a building block for locks and leases.
+func (d *DiskStore) SetIfAbsent(key string, value string) (bool, error) {
+	return d.setIfAbsent(key, value, 0)
+}
+
+func (d *DiskStore) setIfAbsent(key string, value string, expiry uint32) (bool, error) {
+	written := false
+	err := d.execKeys([]string{key}, func() error {
+		if _, ok := d.lookup(key); ok {
+			return nil
+		}
+		if err := d.set(key, value, expiry); err != nil {
+			return err
+		}
+		written = true
+		return nil
+	})
+	return written, err
+}
+
+// GetOrSet returns the value of the key if it exists. Otherwise, it calls compute,
+// stores the value it returns and returns that. An error from compute is returned
+// as is and nothing is stored. The whole operation runs on the writer goroutine, so
+// compute is called at most once per missing key. compute must not call back into
+// the store, not even to read: the writer holds the store lock meanwhile, which the
+// reads of many keys, like Keys or Iterator, wait for.
+func (d *DiskStore) GetOrSet(key string, compute func() (string, error)) (string, error) {
+	var result string
+	err := d.execKeys([]string{key}, func() error {
+		value, err := d.get(key)
+		if err == nil {
+			result = string(value)
+			return nil
+		}
+		if !errors.Is(err, ErrKeyNotFound) {
+			return err
+		}
+		computed, err := compute()
+		if err != nil {
+			return err
+		}
+		if err := d.set(key, computed, 0); err != nil {
+			return err
+		}
+		result = computed
+		return nil
+	})
 	if err != nil {
-		return nil, err
+		return "", err
+	}
+	return result, nil
+}
+
+// Increment adds delta to the integer stored at the key and returns the new value.
+// The value is stored as a decimal string, so it can be read back with Get as
+// well. A missing key is treated as 0. It returns ErrNotInteger if the current value
+// is not an integer and ErrOverflow if the result does not fit in an int64.
+func (d *DiskStore) Increment(key string, delta int64) (int64, error) {
+	var result int64
+	err := d.Update(key, func(old string, exists bool) (string, error) {
+		var current int64
+		if exists {
+			var err error
+			current, err = strconv.ParseInt(old, 10, 64)
+			if err != nil {
+				return "", ErrNotInteger
+			}
+		}
+		result = current + delta
+		if (delta > 0 && result < current) || (delta < 0 && result > current) {
+			return "", ErrOverflow
+		}
+		return strconv.FormatInt(result, 10), nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+// Append appends the suffix to the value of the key, creating the key if it does not
+// exist. It is a read-modify-write like Update and the whole new value is written
+// out as a fresh record.
+func (d *DiskStore) Append(key string, suffix string) error {
+	return d.Update(key, func(old string, exists bool) (string, error) {
+		return old + suffix, nil
+	})
+}
+
+// Update performs a read-modify-write of the key on the writer goroutine. fn is
+// called with the current value and whether the key exists, and the value it returns
+// is stored. If fn returns an error, nothing is written and the error is returned
+// as is. The expiry of the key, if any, is kept. Since fn runs on the writer, which
+// holds the store lock, fn must not call back into the store, as GetOrSet says.
+func (d *DiskStore) Update(key string, fn func(old string, exists bool) (string, error)) error {
+	return d.execKeys([]string{key}, func() error {
+		return d.update(key, fn)
+	})
+}
+
+func (d *DiskStore) update(key string, fn func(old string, exists bool) (string, error)) error {
+	value, err := d.get(key)
+	if err != nil && !errors.Is(err, ErrKeyNotFound) {
+		return err
 	}
-	readFileHandle, err = os.Open(fileName)
+	newValue, err := fn(string(value), err == nil)
+	if err != nil {
+		return err
+	}
+	keyEntry, _ := d.lookup(key)
+	return d.set(key, newValue, keyEntry.Expiry)
+}
 
-	return &DiskStore{
-		keyDir:          keyDir,
-		writeFileHandle: writeFileHandle,
-		readFileHandle:  readFileHandle,
-		currentOffset:   0,
-	}, err
+// Delete removes the key from the store. Since the file is append only, the
+// record is not removed from the disk; instead we append a tombstone record and
+// drop the key from keyDir. Deleting a key which does not exist is a no-op.
+func (d *DiskStore) Delete(key string) error {
+	return d.execKeys([]string{key}, func() error {
+		return d.delete(key)
+	})
 }
 
-func (d *DiskStore) Get(key string) string {
-	var value string
-	if keyEntry, ok := d.keyDir[key]; ok {
-		d.readFileHandle.Seek(int64(keyEntry.Offset), 0)
-		kvBuffer := make([]byte, keyEntry.Size)
-		d.readFileHandle.Read(kvBuffer)
-		_, _, value = decodeKV(kvBuffer)
+func (d *DiskStore) delete(key string) error {
+	if _, ok := d.lookup(key); !ok {
+		return nil
+	}
+	timestamp := unixNow()
+	encoded := d.opts.Format.appendTombstone(nil, timestamp, key)
+	if _, _, err := d.write(encoded); err != nil {
+		return err
 	}
+	d.deferRecord(key, KeyEntry{}, scanRemove)
+	return nil
+}
 
-	return value
+// DeletePrefix deletes all the live keys which start with the prefix, and returns
+// the number of keys deleted. All the tombstones are written with a single write
+// and fsync, which is much faster than calling Delete in a loop.
+func (d *DiskStore) DeletePrefix(prefix string) (int, error) {
+	deleted := 0
+	err := d.exec(func() error {
+		now := unixNow()
+		var keys []string
+		d.keyDir.forEachPrefix(prefix, func(key string, keyEntry KeyEntry) {
+			if !keyEntry.isExpired(now) {
+				keys = append(keys, key)
+			}
+		})
+		if len(keys) == 0 {
+			return nil
+		}
+		if err := d.writeTombstones(keys); err != nil {
+			return err
+		}
+		deleted = len(keys)
+		return nil
+	})
+	return deleted, err
+}
+
+// DeleteMulti deletes all the given keys, writing their tombstones with a single
+// write and fsync. The keys which do not exist are skipped. keyDir is updated only
+// after the write succeeds, so either all of the keys are gone or none.
+func (d *DiskStore) DeleteMulti(keys []string) error {
+	return d.exec(func() error {
+		live := make([]string, 0, len(keys))
+		seen := make(map[string]bool, len(keys))
+		for _, key := range keys {
+			if _, ok := d.lookup(key); ok && !seen[key] {
+				seen[key] = true
+				live = append(live, key)
+			}
+		}
+		if len(live) == 0 {
+			return nil
+		}
+		return d.writeTombstones(live)
+	})
+}
+
+// writeTombstones appends tombstones for all the keys with a single write and fsync,
+// and drops the keys from keyDir once they are on the disk.
+func (d *DiskStore) writeTombstones(keys []string) error {
+	timestamp := unixNow()
+	var buf []byte
+	for _, key := range keys {
+		buf = d.opts.Format.appendTombstone(buf, timestamp, key)
+	}
+	if _, _, err := d.write(buf); err != nil {
+		return err
+	}
+	for _, key := range keys {
+		d.deferRecord(key, KeyEntry{}, scanRemove)
+	}
+	return nil
 }
 
-func (d *DiskStore) Set(key string, value string) {
-	timestamp := uint32(time.Now().Unix())
-	totalSize, encodedKV := encodeKV(timestamp, key, value)
-	d.keyDir[key] = NewKeyEntry(timestamp, d.currentOffset, uint32(totalSize))
-	d.writeFileHandle.Write(encodedKV)
-	d.currentOffset += uint32(totalSize)
-	err := d.writeFileHandle.Sync()
+// write appends the data to the end of the active file and syncs it to the disk, and
+// returns the file ID and the offset it was written at. If the data does not fit in
+// the active file, as per Options.MaxSegmentSize, a new one is started first. The
+// currentOffset is advanced by whatever got written, even on a partial write, so
+// that it keeps pointing at the end of the file, or at the end of the write buffer
+// with Options.WriteBufferSize, see bufferWrite.
+func (d *DiskStore) write(data []byte) (uint32, uint32, error) {
+	if d.opts.ReadOnly {
+		return 0, 0, ErrReadOnly
+	}
+	if err := d.Failed(); err != nil {
+		return 0, 0, err
+	}
+	if d.opts.MaxSegmentSize > 0 && int64(d.currentOffset) > d.opts.Format.dataOffset() && int64(d.currentOffset)+int64(len(data)) > d.opts.MaxSegmentSize {
+		if err := d.rotate(); err != nil {
+			return 0, 0, err
+		}
+	}
+	offset := d.currentOffset
+	if d.opts.WriteBufferSize > 0 {
+		if err := d.bufferWrite(data); err != nil {
+			return 0, 0, err
+		}
+	} else {
+		end, err := d.writeOffset()
+		if err != nil {
+			return 0, 0, err
+		}
+		if d.opts.MaxFileSize > 0 && end+int64(len(data)) > d.opts.MaxFileSize {
+			return 0, 0, ErrFileTooLarge
+		}
+		n, err := d.appendFile(data)
+		d.currentOffset += uint32(n)
+		if err != nil {
+			return 0, 0, d.fail(err)
+		}
+	}
+	d.notifyLog()
+	if d.opts.SyncPolicy != SyncAlways || d.grouping {
+		d.dirty = true
+		return d.activeID, offset, nil
+	}
+	if err := d.syncFile(); err != nil {
+		return 0, 0, d.fail(fmt.Errorf("failed to sync to disk: %w", err))
+	}
+	return d.activeID, offset, nil
+}
+
+// Failed returns an error wrapping ErrStoreFailed if the store is in the failed
+// state, nil otherwise. A store fails when a write or a sync to the file fails, or
+// an IO error is hit on the files of NewDiskIndex. The file might end with a partial
+// record then, and after a failed fsync, the kernel may have dropped the unsynced
+// writes already, so nothing written afterwards could be trusted. Instead of taking
+// the process down, all the writes are rejected from then on, while the reads keep
+// working. Reopening the store recovers from it; the partial record, if any, is
+// discarded by the startup scan.
+func (d *DiskStore) Failed() error {
+	failed := d.failed.Load()
+	if failed == nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %v", ErrStoreFailed, *failed)
+}
+
+// fail puts the store in the failed state because of err, and returns err.
+func (d *DiskStore) fail(err error) error {
+	d.failed.CompareAndSwap(nil, &err)
+	return err
+}
+
+// writeOffset returns the offset the next write to the file goes to, after checking
+// that it is the end of the data file, as it must be: the records are only ever
+// appended. Otherwise keyDir would end up pointing to the wrong records, so it returns
+// ErrInconsistentOffset instead. The records still in the write buffer are not in the
+// file yet. The file may go on past the records with Options.DirectIO, which pads it
+// to the next block, and with Options.Preallocate.
+func (d *DiskStore) writeOffset() (int64, error) {
+	end, err := d.writeFileHandle.Seek(0, io.SeekEnd)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to sync to disk %s", err.Error()))
+		return 0, err
 	}
+	expected := int64(d.currentOffset) - int64(len(d.wbuf))
+	switch {
+	case end == expected:
+	case d.direct != nil && end == alignUp(expected):
+	case d.preallocating() && end > expected:
+	default:
+		return 0, fmt.Errorf("%w: expected the end at %d, found at %d", ErrInconsistentOffset, expected, end)
+	}
+	return expected, nil
 }
 
-func (d *DiskStore) Close() bool {
-	d.readFileHandle.Close()
-	d.writeFileHandle.Close()
-	return true
+// Close closes the file handles. With SyncInterval, the writes made since the last
+// sync are synced first. If the store is in the failed state, e.g. because the
+// background flusher hit an error, that is reported here. It returns the first error
+// encountered, if any.
+func (d *DiskStore) Close() error {
+	select {
+	case <-d.closed:
+	default:
+		close(d.closed)
+	}
+	d.StopExpirySweeper()
+	d.StopBackgroundCompaction()
+	d.stopRefresher()
+	// wait for a Compact which is still running
+	d.compactMu.Lock()
+	defer d.compactMu.Unlock()
+	d.stopWriter()
+	d.stopFlusher()
+	if d.stopCheckpointer() {
+		// a checkpoint taken on the way out makes the next open instant
+		d.Checkpoint()
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.failed.Load() == nil {
+		d.flushBuffer()
+	}
+	if d.opts.SyncPolicy.interval() > 0 {
+		d.flush()
+	}
+	serr := d.Failed()
+	// the iterators left open cannot read anything from here on anyway
+	rerr := d.removeRetired()
+	cerr := d.closeFiles()
+	if serr != nil {
+		return serr
+	}
+	if rerr != nil {
+		return rerr
+	}
+	return cerr
+}
+
+// closeFiles closes all the file handles, and returns the first error encountered.
+func (d *DiskStore) closeFiles() error {
+	err := d.trimActive()
+	if d.writeFileHandle != nil {
+		if cerr := d.writeFileHandle.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if d.vlogWriter != nil {
+		if cerr := d.vlogWriter.Close(); err == nil {
+			err = cerr
+		}
+	}
+	d.filesMu.Lock()
+	defer d.filesMu.Unlock()
+	for fileID, f := range d.readers {
+		if cerr := d.unmapFile(fileID); err == nil {
+			err = cerr
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	for _, f := range d.vlogs {
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if cerr := d.indexFiles.close(); err == nil {
+		err = cerr
+	}
+	return err
 }
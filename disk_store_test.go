@@ -1,8 +1,21 @@
 package caskdb
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestDiskStore_Get(t *testing.T) {
@@ -12,8 +25,8 @@ func TestDiskStore_Get(t *testing.T) {
 	}
 	defer os.Remove("test.db")
 	store.Set("name", "jojo")
-	if val := store.Get("name"); val != "jojo" {
-		t.Errorf("Get() = %v, want %v", val, "jojo")
+	if val, err := store.Get("name"); err != nil || val != "jojo" {
+		t.Errorf("Get() = %v, %v, want %v", val, err, "jojo")
 	}
 }
 
@@ -23,8 +36,20 @@ func TestDiskStore_GetInvalid(t *testing.T) {
 		t.Fatalf("failed to create disk store: %v", err)
 	}
 	defer os.Remove("test.db")
-	if val := store.Get("some key"); val != "" {
-		t.Errorf("Get() = %v, want %v", val, "")
+	if val, err := store.Get("some key"); !errors.Is(err, ErrKeyNotFound) || val != "" {
+		t.Errorf("Get() = %v, %v, want '', %v", val, err, ErrKeyNotFound)
+	}
+}
+
+func TestDiskStore_GetEmptyValue(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("name", "")
+	if val, err := store.Get("name"); err != nil || val != "" {
+		t.Errorf("Get() = %v, %v, want '', nil", val, err)
 	}
 }
 
@@ -46,8 +71,8 @@ func TestDiskStore_SetWithPersistence(t *testing.T) {
 	}
 	for key, val := range tests {
 		store.Set(key, val)
-		if store.Get(key) != val {
-			t.Errorf("Get() = %v, want %v", store.Get(key), val)
+		if got, err := store.Get(key); err != nil || got != val {
+			t.Errorf("Get() = %v, %v, want %v", got, err, val)
 		}
 	}
 	store.Close()
@@ -56,8 +81,8 @@ func TestDiskStore_SetWithPersistence(t *testing.T) {
 		t.Fatalf("failed to create disk store: %v", err)
 	}
 	for key, val := range tests {
-		if store.Get(key) != val {
-			t.Errorf("Get() = %v, want %v", store.Get(key), val)
+		if got, err := store.Get(key); err != nil || got != val {
+			t.Errorf("Get() = %v, %v, want %v", got, err, val)
 		}
 	}
 	store.Close()
@@ -93,12 +118,963 @@ func TestDiskStore_Delete(t *testing.T) {
 		t.Fatalf("failed to create disk store: %v", err)
 	}
 	for key := range tests {
-		if store.Get(key) != "" {
-			t.Errorf("Get() = %v, want '' (empty)", store.Get(key))
+		if got, err := store.Get(key); err != nil || got != "" {
+			t.Errorf("Get() = %v, %v, want '' (empty)", got, err)
+		}
+	}
+	if got, err := store.Get("end"); err != nil || got != "yes" {
+		t.Errorf("Get() = %v, %v, want %v", got, err, "yes")
+	}
+	store.Close()
+}
+
+func TestDiskStore_DeleteWithPersistence(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.Set("hamlet", "shakespeare")
+	store.Set("othello", "shakespeare")
+	if err := store.Delete("hamlet"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if err := store.Delete("some rando key"); err != nil {
+		t.Fatalf("Delete() of missing key error = %v", err)
+	}
+	if _, err := store.Get("hamlet"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if _, err := store.Get("hamlet"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if got, err := store.Get("othello"); err != nil || got != "shakespeare" {
+		t.Errorf("Get() = %v, %v, want %v", got, err, "shakespeare")
+	}
+	store.Close()
+}
+
+func TestDiskStore_SetAfterClose(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := store.Set("name", "jojo"); err == nil {
+		t.Errorf("Set() on closed store error = nil, want error")
+	}
+	if _, err := store.Get("name"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if err := store.Close(); err == nil {
+		t.Errorf("Close() on closed store error = nil, want error")
+	}
+}
+
+func TestDiskStore_Has(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("name", "")
+	if !store.Has("name") {
+		t.Errorf("Has() = false, want true")
+	}
+	if store.Has("some key") {
+		t.Errorf("Has() = true, want false")
+	}
+	store.Delete("name")
+	if store.Has("name") {
+		t.Errorf("Has() after Delete() = true, want false")
+	}
+	store.Close()
+}
+
+func TestDiskStore_Keys(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("book:hamlet", "shakespeare")
+	store.Set("book:dune", "frank herbert")
+	store.Set("author:tolstoy", "russia")
+	store.Set("book:othello", "shakespeare")
+	store.Delete("book:othello")
+
+	keys := store.Keys()
+	sort.Strings(keys)
+	if want := []string{"author:tolstoy", "book:dune", "book:hamlet"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("Keys() = %v, want %v", keys, want)
+	}
+	keys = store.KeysWithPrefix("book:")
+	sort.Strings(keys)
+	if want := []string{"book:dune", "book:hamlet"}; !reflect.DeepEqual(keys, want) {
+		t.Errorf("KeysWithPrefix() = %v, want %v", keys, want)
+	}
+	if keys := store.KeysWithPrefix("movie:"); len(keys) != 0 {
+		t.Errorf("KeysWithPrefix() = %v, want []", keys)
+	}
+	store.Close()
+}
+
+func TestDiskStore_LenAndDiskSize(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	if store.Len() != 0 || store.DiskSize() != 0 {
+		t.Errorf("Len(), DiskSize() = %v, %v, want 0, 0", store.Len(), store.DiskSize())
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Set("hamlet", "shakespeare")
+	store.Delete("dune")
+	wantSize := int64(3*headerSize + 2*len("hamlet") + 2*len("shakespeare") +
+		len("dune") + len("frank herbert") + headerSize + len("dune"))
+	if store.Len() != 1 {
+		t.Errorf("Len() = %v, want 1", store.Len())
+	}
+	if store.DiskSize() != wantSize {
+		t.Errorf("DiskSize() = %v, want %v", store.DiskSize(), wantSize)
+	}
+	store.Close()
+}
+
+func TestDiskStore_SetBytes(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	blob := []byte{0x00, 0x01, 0xff, 0xfe, 0x00}
+	if err := store.SetBytes("blob", blob); err != nil {
+		t.Fatalf("SetBytes() error = %v", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if got, err := store.GetBytes("blob"); err != nil || !bytes.Equal(got, blob) {
+		t.Errorf("GetBytes() = %v, %v, want %v", got, err, blob)
+	}
+	if got, err := store.Get("blob"); err != nil || got != string(blob) {
+		t.Errorf("Get() = %v, %v, want %v", got, err, string(blob))
+	}
+	if _, err := store.GetBytes("some key"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetBytes() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	store.Close()
+}
+
+func TestDiskStore_SetBytesTooLarge(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	// a value of 1GB would take mergeFlag in value_size and be read back as an operand
+	if err := store.SetBytes("blob", make([]byte, 1<<30)); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("SetBytes() error = %v, want %v", err, ErrValueTooLarge)
+	}
+	if store.Has("blob") {
+		t.Errorf("Has() = true after a failed SetBytes()")
+	}
+}
+
+func TestDiskStore_BinaryKeys(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	keys := [][]byte{
+		{0xff, 0xfe, 0xfd},
+		{0x00},
+		{0x00, 0x00},
+		{0xc3, 0x28},
+	}
+	for i, key := range keys {
+		if err := store.SetBinary(key, []byte{byte(i)}); err != nil {
+			t.Fatalf("SetBinary() error = %v", err)
+		}
+	}
+	if err := store.DeleteBinary(keys[3]); err != nil {
+		t.Fatalf("DeleteBinary() error = %v", err)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	for i, key := range keys[:3] {
+		if got, err := store.GetBinary(key); err != nil || !bytes.Equal(got, []byte{byte(i)}) {
+			t.Errorf("GetBinary(%v) = %v, %v, want %v", key, got, err, []byte{byte(i)})
+		}
+	}
+	if store.HasBinary(keys[3]) {
+		t.Errorf("HasBinary(%v) = true, want false", keys[3])
+	}
+	if store.Len() != 3 {
+		t.Errorf("Len() = %v, want 3", store.Len())
+	}
+	store.Close()
+}
+
+func TestDiskStore_GetMulti(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	tests := map[string]string{
+		"crime and punishment": "dostoevsky",
+		"anna karenina":        "tolstoy",
+		"war and peace":        "tolstoy",
+		"hamlet":               "shakespeare",
+		"othello":              "shakespeare",
+		"brave new world":      "huxley",
+		"dune":                 "frank herbert",
+	}
+	for key, val := range tests {
+		store.Set(key, val)
+	}
+	// a large value in the middle forces the reads to be split into multiple runs
+	store.Set("big", strings.Repeat("x", 2*multiGetMaxGap))
+	store.Set("the idiot", "dostoevsky")
+	store.Set("hamlet", "shakespeare!")
+	tests["the idiot"] = "dostoevsky"
+	tests["hamlet"] = "shakespeare!"
+
+	keys := []string{"some key", "hamlet"}
+	for key := range tests {
+		keys = append(keys, key)
+	}
+	got, err := store.GetMulti(keys)
+	if err != nil {
+		t.Fatalf("GetMulti() error = %v", err)
+	}
+	if !reflect.DeepEqual(got, tests) {
+		t.Errorf("GetMulti() = %v, want %v", got, tests)
+	}
+	store.Close()
+}
+
+func TestDiskStore_CompareAndSwap(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("counter", "1")
+
+	if ok, err := store.CompareAndSwap("counter", "0", "2"); err != nil || ok {
+		t.Errorf("CompareAndSwap() = %v, %v, want false, nil", ok, err)
+	}
+	if ok, err := store.CompareAndSwap("counter", "1", "2"); err != nil || !ok {
+		t.Errorf("CompareAndSwap() = %v, %v, want true, nil", ok, err)
+	}
+	if ok, err := store.CompareAndSwap("some key", "", "1"); err != nil || ok {
+		t.Errorf("CompareAndSwap() on missing key = %v, %v, want false, nil", ok, err)
+	}
+	if got, err := store.Get("counter"); err != nil || got != "2" {
+		t.Errorf("Get() = %v, %v, want %v", got, err, "2")
+	}
+	if store.Has("some key") {
+		t.Errorf("Has() = true, want false")
+	}
+	store.Close()
+}
+
+func TestDiskStore_CompareAndSwapConcurrent(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("counter", "0")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; {
+				old, _ := store.Get("counter")
+				n, _ := strconv.Atoi(old)
+				if ok, _ := store.CompareAndSwap("counter", old, strconv.Itoa(n+1)); ok {
+					j++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if got, err := store.Get("counter"); err != nil || got != "40" {
+		t.Errorf("Get() = %v, %v, want %v", got, err, "40")
+	}
+	store.Close()
+}
+
+// TestDiskStore_Concurrent mixes the reads and writes of many goroutines; run it
+// with the race detector, go test -race, to catch any unsynchronised access.
+func TestDiskStore_Concurrent(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{SyncPolicy: SyncNever, MaxSegmentSize: 4096})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+
+	const writers, readers, n = 4, 4, 200
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				key := fmt.Sprintf("w%v-%v", i, j%10)
+				if err := store.Set(key, strconv.Itoa(j)); err != nil {
+					t.Errorf("Set() error = %v", err)
+					return
+				}
+				if j%7 == 0 {
+					store.Delete(key)
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < n; j++ {
+				key := fmt.Sprintf("w%v-%v", i%writers, j%10)
+				if _, err := store.Get(key); err != nil && err != ErrKeyNotFound {
+					t.Errorf("Get() error = %v", err)
+					return
+				}
+				store.Has(key)
+				store.Len()
+				if _, err := store.GetMulti([]string{key, "w0-0", "w1-1"}); err != nil {
+					t.Errorf("GetMulti() error = %v", err)
+					return
+				}
+				if j%50 == 0 {
+					it := store.Iterator()
+					for it.Next() {
+					}
+					if err := it.Err(); err != nil {
+						t.Errorf("Iterator() error = %v", err)
+						return
+					}
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// every writer leaves the last value of each of its keys, unless it deleted it
+	for i := 0; i < writers; i++ {
+		for k := 0; k < 10; k++ {
+			last := n - 10 + k
+			got, err := store.Get(fmt.Sprintf("w%v-%v", i, k))
+			if last%7 == 0 {
+				if err != ErrKeyNotFound {
+					t.Errorf("Get(w%v-%v) error = %v, want %v", i, k, err, ErrKeyNotFound)
+				}
+			} else if err != nil || got != strconv.Itoa(last) {
+				t.Errorf("Get(w%v-%v) = %v, %v, want %v", i, k, got, err, last)
+			}
+		}
+	}
+}
+
+func TestDiskStore_readAt(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("othello", "shakespeare")
+	size := headerSize + len("othello") + len("shakespeare")
+
+	buf := make([]byte, len("shakespeare"))
+	if err := store.readAt(0, buf, int64(size-len(buf))); err != nil || string(buf) != "shakespeare" {
+		t.Errorf("readAt() = %q, %v, want shakespeare", buf, err)
+	}
+	if err := store.readAt(0, buf, int64(size-1)); err != io.ErrUnexpectedEOF {
+		t.Errorf("readAt() past the end error = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	if err := store.readAt(1, buf, 0); err == nil {
+		t.Errorf("readAt() of a missing data file error = nil, want an error")
+	}
+}
+
+func TestDiskStore_SetIfAbsent(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	if ok, err := store.SetIfAbsent("lock", "owner-1"); err != nil || !ok {
+		t.Errorf("SetIfAbsent() = %v, %v, want true, nil", ok, err)
+	}
+	if ok, err := store.SetIfAbsent("lock", "owner-2"); err != nil || ok {
+		t.Errorf("SetIfAbsent() = %v, %v, want false, nil", ok, err)
+	}
+	if got, err := store.Get("lock"); err != nil || got != "owner-1" {
+		t.Errorf("Get() = %v, %v, want %v", got, err, "owner-1")
+	}
+	store.Delete("lock")
+	if ok, err := store.SetIfAbsent("lock", "owner-2"); err != nil || !ok {
+		t.Errorf("SetIfAbsent() after Delete() = %v, %v, want true, nil", ok, err)
+	}
+	store.Close()
+}
+
+func TestDiskStore_GetOrSet(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	calls := 0
+	compute := func() (string, error) {
+		calls++
+		return "shakespeare", nil
+	}
+	for i := 0; i < 2; i++ {
+		if got, err := store.GetOrSet("hamlet", compute); err != nil || got != "shakespeare" {
+			t.Errorf("GetOrSet() = %v, %v, want %v", got, err, "shakespeare")
+		}
+	}
+	if calls != 1 {
+		t.Errorf("compute called %v times, want 1", calls)
+	}
+
+	errCompute := errors.New("compute failed")
+	_, err = store.GetOrSet("othello", func() (string, error) {
+		return "", errCompute
+	})
+	if !errors.Is(err, errCompute) {
+		t.Errorf("GetOrSet() error = %v, want %v", err, errCompute)
+	}
+	if store.Has("othello") {
+		t.Errorf("Has() after failed compute = true, want false")
+	}
+	store.Close()
+}
+
+func TestDiskStore_Increment(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	tests := []struct {
+		delta int64
+		want  int64
+	}{
+		{1, 1},
+		{10, 11},
+		{-20, -9},
+		{0, -9},
+	}
+	for _, tt := range tests {
+		if got, err := store.Increment("counter", tt.delta); err != nil || got != tt.want {
+			t.Errorf("Increment(%v) = %v, %v, want %v", tt.delta, got, err, tt.want)
+		}
+	}
+	if got, err := store.Get("counter"); err != nil || got != "-9" {
+		t.Errorf("Get() = %v, %v, want %v", got, err, "-9")
+	}
+
+	store.Set("name", "jojo")
+	if _, err := store.Increment("name", 1); !errors.Is(err, ErrNotInteger) {
+		t.Errorf("Increment() error = %v, want %v", err, ErrNotInteger)
+	}
+	store.Set("big", strconv.FormatInt(math.MaxInt64, 10))
+	if _, err := store.Increment("big", 1); !errors.Is(err, ErrOverflow) {
+		t.Errorf("Increment() error = %v, want %v", err, ErrOverflow)
+	}
+	store.Close()
+}
+
+func TestDiskStore_Append(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	for _, suffix := range []string{"a", "b", "c"} {
+		if err := store.Append("log", suffix); err != nil {
+			t.Fatalf("Append() error = %v", err)
 		}
 	}
-	if store.Get("end") != "yes" {
-		t.Errorf("Get() = %v, want %v", store.Get("end"), "yes")
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if got, err := store.Get("log"); err != nil || got != "abc" {
+		t.Errorf("Get() = %v, %v, want %v", got, err, "abc")
+	}
+	store.Close()
+}
+
+func TestDiskStore_Update(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	appendX := func(old string, exists bool) (string, error) {
+		if !exists {
+			return "new", nil
+		}
+		return old + "x", nil
+	}
+	for i := 0; i < 3; i++ {
+		if err := store.Update("name", appendX); err != nil {
+			t.Fatalf("Update() error = %v", err)
+		}
+	}
+	if got, err := store.Get("name"); err != nil || got != "newxx" {
+		t.Errorf("Get() = %v, %v, want %v", got, err, "newxx")
+	}
+
+	errUpdate := errors.New("update failed")
+	err = store.Update("name", func(old string, exists bool) (string, error) {
+		return "dio", errUpdate
+	})
+	if !errors.Is(err, errUpdate) {
+		t.Errorf("Update() error = %v, want %v", err, errUpdate)
+	}
+	if got, err := store.Get("name"); err != nil || got != "newxx" {
+		t.Errorf("Get() after failed Update() = %v, %v, want %v", got, err, "newxx")
+	}
+	store.Close()
+}
+
+func TestDiskStore_GetRange(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("alphabet", "abcdefghijklmnopqrstuvwxyz")
+
+	tests := []struct {
+		offset int
+		length int
+		want   string
+	}{
+		{0, 3, "abc"},
+		{23, 3, "xyz"},
+		{23, 10, "xyz"},
+		{10, 0, ""},
+		{26, 1, ""},
+		{100, 1, ""},
+	}
+	for _, tt := range tests {
+		if got, err := store.GetRange("alphabet", tt.offset, tt.length); err != nil || string(got) != tt.want {
+			t.Errorf("GetRange(%v, %v) = %v, %v, want %v", tt.offset, tt.length, string(got), err, tt.want)
+		}
+	}
+	if _, err := store.GetRange("alphabet", -1, 1); !errors.Is(err, ErrInvalidRange) {
+		t.Errorf("GetRange() error = %v, want %v", err, ErrInvalidRange)
+	}
+	if _, err := store.GetRange("some key", 0, 1); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetRange() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	store.Close()
+}
+
+func TestDiskStore_DeletePrefix(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("book:hamlet", "shakespeare")
+	store.Set("book:dune", "frank herbert")
+	store.Set("author:tolstoy", "russia")
+
+	if n, err := store.DeletePrefix("book:"); err != nil || n != 2 {
+		t.Errorf("DeletePrefix() = %v, %v, want 2, nil", n, err)
+	}
+	if n, err := store.DeletePrefix("movie:"); err != nil || n != 0 {
+		t.Errorf("DeletePrefix() = %v, %v, want 0, nil", n, err)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if keys := store.Keys(); len(keys) != 1 || keys[0] != "author:tolstoy" {
+		t.Errorf("Keys() = %v, want [author:tolstoy]", keys)
+	}
+	store.Close()
+}
+
+func TestDiskStore_DeleteMulti(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("hamlet", "shakespeare")
+	store.Set("othello", "shakespeare")
+	store.Set("dune", "frank herbert")
+
+	sizeBefore := store.DiskSize()
+	if err := store.DeleteMulti([]string{"hamlet", "othello", "hamlet", "some key"}); err != nil {
+		t.Fatalf("DeleteMulti() error = %v", err)
+	}
+	wantSize := sizeBefore + int64(2*headerSize+len("hamlet")+len("othello"))
+	if store.DiskSize() != wantSize {
+		t.Errorf("DiskSize() = %v, want %v", store.DiskSize(), wantSize)
+	}
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if keys := store.Keys(); len(keys) != 1 || keys[0] != "dune" {
+		t.Errorf("Keys() = %v, want [dune]", keys)
+	}
+	store.Close()
+}
+
+func TestDiskStore_GetWithMeta(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	before := time.Now().Truncate(time.Second)
+	store.Set("name", "jojo")
+	store.SetWithTTL("hamlet", "shakespeare", time.Hour)
+
+	value, meta, err := store.GetWithMeta("hamlet")
+	if err != nil || value != "shakespeare" {
+		t.Fatalf("GetWithMeta() = %v, %v, want %v", value, err, "shakespeare")
+	}
+	wantOffset := int64(headerSize + len("name") + len("jojo"))
+	if meta.Offset != wantOffset {
+		t.Errorf("GetWithMeta() offset = %v, want %v", meta.Offset, wantOffset)
+	}
+	if meta.Size != headerSize+len("hamlet")+len("shakespeare") {
+		t.Errorf("GetWithMeta() size = %v, want %v", meta.Size, headerSize+len("hamlet")+len("shakespeare"))
+	}
+	if meta.Timestamp.Before(before) || meta.Timestamp.After(time.Now()) {
+		t.Errorf("GetWithMeta() timestamp = %v, want around %v", meta.Timestamp, before)
+	}
+	if meta.Expiry.Before(before.Add(time.Hour)) {
+		t.Errorf("GetWithMeta() expiry = %v, want after %v", meta.Expiry, before.Add(time.Hour))
+	}
+	if _, meta, _ := store.GetWithMeta("name"); !meta.Expiry.IsZero() {
+		t.Errorf("GetWithMeta() expiry = %v, want zero", meta.Expiry)
+	}
+	if _, _, err := store.GetWithMeta("some key"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("GetWithMeta() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	store.Close()
+}
+
+func TestDiskStore_SizeOf(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("hamlet", "shakespeare")
+	store.Set("empty", "")
+
+	if n, err := store.SizeOf("hamlet"); err != nil || n != len("shakespeare") {
+		t.Errorf("SizeOf() = %v, %v, want %v", n, err, len("shakespeare"))
+	}
+	if n, err := store.SizeOf("empty"); err != nil || n != 0 {
+		t.Errorf("SizeOf() = %v, %v, want 0", n, err)
+	}
+	if _, err := store.SizeOf("some key"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("SizeOf() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	store.Close()
+}
+
+func TestDiskStore_ChecksumMismatch(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("name", "jojo")
+	store.Set("hamlet", "shakespeare")
+	store.Close()
+
+	// flip a bit in the value of the second record, as bit rot would
+	data, err := os.ReadFile("test.db")
+	if err != nil {
+		t.Fatalf("failed to read the file: %v", err)
+	}
+	data[len(data)-1] ^= 0x01
+	if err := os.WriteFile("test.db", data, 0644); err != nil {
+		t.Fatalf("failed to write the file: %v", err)
+	}
+	if _, err := NewDiskStore("test.db"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("NewDiskStore() error = %v, want %v", err, ErrChecksumMismatch)
+	}
+}
+
+func TestDiskStore_GetChecksumMismatch(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("name", "jojo")
+	store.Set("hamlet", "shakespeare")
+
+	f, err := os.OpenFile("test.db", os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("failed to open the file: %v", err)
+	}
+	f.WriteAt([]byte("J"), int64(headerSize+len("name")))
+	f.Close()
+
+	if _, err := store.Get("name"); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("Get() error = %v, want %v", err, ErrChecksumMismatch)
+	}
+	if _, err := store.GetMulti([]string{"name"}); !errors.Is(err, ErrChecksumMismatch) {
+		t.Errorf("GetMulti() error = %v, want %v", err, ErrChecksumMismatch)
+	}
+	if got, err := store.Get("hamlet"); err != nil || got != "shakespeare" {
+		t.Errorf("Get() = %v, %v, want shakespeare, nil", got, err)
+	}
+	store.Close()
+}
+
+func TestDiskStore_TruncatedTail(t *testing.T) {
+	recordSize := int64(headerSize + len("name") + len("jojo"))
+	tests := []struct {
+		name string
+		tail []byte
+	}{
+		{"partial header", []byte{0x00, 0x01, 0x02}},
+		{"partial record", encodeHeader(10, 0, 4, 100)},
+	}
+	for _, tt := range tests {
+		store, err := NewDiskStore("test.db")
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		store.Set("name", "jojo")
+		store.Close()
+		f, err := os.OpenFile("test.db", os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("failed to open the file: %v", err)
+		}
+		f.Write(tt.tail)
+		f.Close()
+
+		var logs bytes.Buffer
+		store, err = NewDiskStoreWithOptions("test.db", Options{Logger: log.New(&logs, "", 0)})
+		if err != nil {
+			t.Fatalf("NewDiskStore() with %v error = %v", tt.name, err)
+		}
+		if got, err := store.Get("name"); err != nil || got != "jojo" {
+			t.Errorf("Get() with %v = %v, %v, want jojo", tt.name, got, err)
+		}
+		if store.DiskSize() != recordSize {
+			t.Errorf("DiskSize() with %v = %v, want %v", tt.name, store.DiskSize(), recordSize)
+		}
+		if !strings.Contains(logs.String(), "discarding a partial record") {
+			t.Errorf("log with %v = %q, want the discarded record reported", tt.name, logs.String())
+		}
+		store.Close()
+		os.Remove("test.db")
+	}
+}
+
+func TestDiskStore_BadTailNotTruncated(t *testing.T) {
+	tests := []struct {
+		name   string
+		format Format
+		record bool
+		tail   []byte
+	}{
+		// without a whole record before them, the bytes may be a file of another
+		// version, rather than a write which got cut off
+		{"no whole record", FormatV1, false, append(encodeHeader(10, 0, 4, 100), "jojo"...)},
+		// a header which does not decode cannot tell how long its record is, so the
+		// bytes can be a partial record only if they are fewer than any header
+		{"bytes past a header", FormatV2, true, bytes.Repeat([]byte{0xff}, 2*maxHeaderSize)},
+	}
+	for _, tt := range tests {
+		fileName := filepath.Join(t.TempDir(), "test.db")
+		store, err := NewDiskStoreWithOptions(fileName, Options{Format: tt.format})
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		if tt.record {
+			store.Set("name", "jojo")
+		}
+		store.Close()
+		f, err := os.OpenFile(fileName, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatalf("failed to open the file: %v", err)
+		}
+		f.Write(tt.tail)
+		f.Close()
+		data, _ := os.ReadFile(fileName)
+
+		if _, err := NewDiskStoreWithOptions(fileName, Options{Format: tt.format}); !errors.Is(err, ErrCorruptRecord) {
+			t.Errorf("NewDiskStore() with %v error = %v, want %v", tt.name, err, ErrCorruptRecord)
+		}
+		if got, _ := os.ReadFile(fileName); !bytes.Equal(got, data) {
+			t.Errorf("NewDiskStore() with %v changed the data file to %v bytes, want %v", tt.name, len(got), len(data))
+		}
+	}
+}
+
+func TestDiskStore_SetAfterReopen(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("name", "jojo")
+	store.Close()
+
+	for i, value := range []string{"dio", "jotaro"} {
+		store, err = NewDiskStore("test.db")
+		if err != nil {
+			t.Fatalf("failed to reopen disk store: %v", err)
+		}
+		store.Set("key"+strconv.Itoa(i), value)
+		store.Set("name", value)
+		if got, err := store.Get("name"); err != nil || got != value {
+			t.Errorf("Get() = %v, %v, want %v", got, err, value)
+		}
+		store.Close()
+	}
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	want := map[string]string{"name": "jotaro", "key0": "dio", "key1": "jotaro"}
+	for key, value := range want {
+		if got, err := store.Get(key); err != nil || got != value {
+			t.Errorf("Get(%v) = %v, %v, want %v", key, got, err, value)
+		}
+	}
+	store.Close()
+}
+
+func TestDiskStore_InconsistentOffset(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("name", "jojo")
+
+	// another writer sneaking in behind the back of the store
+	f, err := os.OpenFile("test.db", os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("failed to open the file: %v", err)
+	}
+	f.Write([]byte("garbage"))
+	f.Close()
+
+	if err := store.Set("name", "dio"); !errors.Is(err, ErrInconsistentOffset) {
+		t.Errorf("Set() error = %v, want %v", err, ErrInconsistentOffset)
+	}
+	if got, err := store.Get("name"); err != nil || got != "jojo" {
+		t.Errorf("Get() = %v, %v, want jojo", got, err)
+	}
+	store.Close()
+}
+
+func TestDiskStore_Failed(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("name", "jojo")
+
+	// swap in a handle which cannot be written to, to fail the next write
+	writeFileHandle := store.writeFileHandle
+	store.writeFileHandle, err = os.Open("test.db")
+	if err != nil {
+		t.Fatalf("failed to open the file: %v", err)
+	}
+	// Failed may be called from any goroutine, while the writer fails the store
+	failed := make(chan struct{})
+	go func() {
+		for store.Failed() == nil {
+			time.Sleep(time.Millisecond)
+		}
+		close(failed)
+	}()
+	if err := store.Set("name", "dio"); err == nil || errors.Is(err, ErrStoreFailed) {
+		t.Errorf("Set() error = %v, want the write error", err)
+	}
+	select {
+	case <-failed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Failed() = nil after the failed write")
+	}
+	if err := store.Failed(); !errors.Is(err, ErrStoreFailed) {
+		t.Errorf("Failed() = %v, want %v", err, ErrStoreFailed)
+	}
+	store.writeFileHandle.Close()
+	store.writeFileHandle = writeFileHandle
+	if err := store.Set("name", "dio"); !errors.Is(err, ErrStoreFailed) {
+		t.Errorf("Set() on a failed store error = %v, want %v", err, ErrStoreFailed)
+	}
+	if got, err := store.Get("name"); err != nil || got != "jojo" {
+		t.Errorf("Get() on a failed store = %v, %v, want jojo", got, err)
+	}
+	if err := store.Close(); !errors.Is(err, ErrStoreFailed) {
+		t.Errorf("Close() of a failed store = %v, want %v", err, ErrStoreFailed)
+	}
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	if err := store.Set("name", "dio"); err != nil {
+		t.Errorf("Set() after reopen error = %v", err)
 	}
 	store.Close()
 }
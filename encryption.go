@@ -0,0 +1,192 @@
+package caskdb
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+)
+
+var (
+	// ErrInvalidEncryptionKey is returned for an EncryptionKey which is not a valid AES
+	// key, or whose ID is 0 or taken, and for the encryption keys given with a
+	// Options.Format other than FormatV2.
+	ErrInvalidEncryptionKey = errors.New("invalid encryption key")
+	// ErrUnknownEncryptionKey is returned when reading a value encrypted with a key
+	// which is not in Options.EncryptionKeys.
+	ErrUnknownEncryptionKey = errors.New("unknown encryption key")
+)
+
+// EncryptionKey is a key the values are encrypted with, see Options.EncryptionKeys.
+// The ID of the key is kept in every record encrypted with it, so that the record
+// can be decrypted with the right key whatever keys came after it; it must not be 0.
+type EncryptionKey struct {
+	ID uint32
+	// Key is an AES-128, AES-192 or AES-256 key, of 16, 24 or 32 bytes
+	Key []byte
+}
+
+// The encrypted values are sealed with AES-GCM, and stored as the random nonce
+// followed by the ciphertext and its tag. The key of the record is authenticated
+// along with the value, so that the value of one key cannot be passed off as
+// another's. The compressed values are compressed first, since the ciphertext does
+// not compress.
+
+// keyRing has the ciphers of all the encryption keys by ID, and the ID of the one the
+// new values are encrypted with; 0 if there is none. It is never modified, but
+// replaced as a whole by RotateEncryptionKey.
+type keyRing struct {
+	active uint32
+	aeads  map[uint32]cipher.AEAD
+}
+
+// newKeyRing returns the keyRing of the keys, the last of which is the active one.
+func newKeyRing(keys []EncryptionKey) (*keyRing, error) {
+	r := &keyRing{aeads: make(map[uint32]cipher.AEAD, len(keys))}
+	for _, key := range keys {
+		if err := r.add(key); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// with returns a copy of the keyRing with the key added, as the active one.
+func (r *keyRing) with(key EncryptionKey) (*keyRing, error) {
+	next := &keyRing{aeads: make(map[uint32]cipher.AEAD, len(r.aeads)+1)}
+	for id, aead := range r.aeads {
+		next.aeads[id] = aead
+	}
+	if err := next.add(key); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+func (r *keyRing) add(key EncryptionKey) error {
+	if key.ID == 0 {
+		return fmt.Errorf("%w: the ID must not be 0", ErrInvalidEncryptionKey)
+	}
+	if _, ok := r.aeads[key.ID]; ok {
+		return fmt.Errorf("%w: duplicate ID %d", ErrInvalidEncryptionKey, key.ID)
+	}
+	block, err := aes.NewCipher(key.Key)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidEncryptionKey, err)
+	}
+	// the standard nonce and tag sizes do not fail with an AES block
+	aead, _ := cipher.NewGCM(block)
+	r.aeads[key.ID] = aead
+	r.active = key.ID
+	return nil
+}
+
+// seal appends the value of the key, encrypted with the active key, to dst.
+func (r *keyRing) seal(dst []byte, key string, value []byte) []byte {
+	aead := r.aeads[r.active]
+	start := len(dst)
+	dst = append(dst, make([]byte, aead.NonceSize())...)
+	if _, err := io.ReadFull(rand.Reader, dst[start:]); err != nil {
+		panic("caskdb: failed to read a random nonce: " + err.Error())
+	}
+	return aead.Seal(dst, dst[start:], value, []byte(key))
+}
+
+// open decrypts the value of the key, which was encrypted with the key of keyID.
+func (r *keyRing) open(keyID uint32, key string, sealed []byte) ([]byte, error) {
+	var aead cipher.AEAD
+	if r != nil {
+		aead = r.aeads[keyID]
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("%w: %d", ErrUnknownEncryptionKey, keyID)
+	}
+	n := aead.NonceSize()
+	if len(sealed) < n+aead.Overhead() {
+		return nil, ErrCorruptRecord
+	}
+	value, err := aead.Open(nil, sealed[:n], sealed[n:], []byte(key))
+	if err != nil {
+		return nil, ErrCorruptRecord
+	}
+	return value, nil
+}
+
+// checkEncryption validates Options.EncryptionKeys and returns their keyRing.
+func checkEncryption(opts Options) (*keyRing, error) {
+	if len(opts.EncryptionKeys) > 0 && opts.Format != FormatV2 {
+		return nil, fmt.Errorf("%w: the encryption needs FormatV2", ErrInvalidEncryptionKey)
+	}
+	return newKeyRing(opts.EncryptionKeys)
+}
+
+// encrypting reports whether the values are encrypted as they are written.
+func (d *DiskStore) encrypting() bool {
+	return d.keys.Load().active != 0
+}
+
+// appendSealed appends the record of a value which is already compressed with the
+// Compression, encrypting it first if the values are encrypted at all.
+func (d *DiskStore) appendSealed(dst []byte, timestamp uint32, expiry uint32, key string, value []byte, compression Compression, meta []byte) []byte {
+	keys := d.keys.Load()
+	if keys.active == 0 {
+		return d.opts.Format.appendValue(dst, timestamp, expiry, key, value, compression, 0, meta)
+	}
+	buf := getBuffer(len(value) + 64)
+	defer putBuffer(buf)
+	*buf = keys.seal(*buf, key, value)
+	return d.opts.Format.appendValue(dst, timestamp, expiry, key, *buf, compression, keys.active, meta)
+}
+
+// appendMergeOperand encodes a merge operand of the key in Options.Format at the end
+// of dst, encrypted like the values are.
+func (d *DiskStore) appendMergeOperand(dst []byte, timestamp uint32, expiry uint32, key string, operand string) []byte {
+	keys := d.keys.Load()
+	if keys.active == 0 {
+		return d.opts.Format.appendMergeOperand(dst, timestamp, expiry, key, operand)
+	}
+	sealed := keys.seal(nil, key, []byte(operand))
+	start := len(dst)
+	dst = d.opts.Format.appendHeader(dst, timestamp, expiry, uint32(len(key)), uint32(len(sealed))|mergeFlag, 0, keys.active, nil)
+	dst = append(dst, key...)
+	dst = append(dst, sealed...)
+	setChecksum(dst[start:])
+	return dst
+}
+
+// RotateEncryptionKey adds the key to the encryption keys, and encrypts the values
+// written from then on with it, without closing the store. The values written
+// before are still decrypted with their own keys, until the next Compact, which
+// encrypts them all anew with the key, in the data files and in the value log alike;
+// once it returns, the older keys are no longer needed. The key has to be added to
+// the end of Options.EncryptionKeys for the store to be opened again, and the older
+// ones kept until then. It needs FormatV2, and the encryption can be turned on this
+// way as well.
+func (d *DiskStore) RotateEncryptionKey(key EncryptionKey) error {
+	if d.opts.Format != FormatV2 {
+		return fmt.Errorf("%w: the encryption needs FormatV2", ErrInvalidEncryptionKey)
+	}
+	return d.exec(func() error {
+		keys, err := d.keys.Load().with(key)
+		if err != nil {
+			return err
+		}
+		d.keys.Store(keys)
+		d.rotatedKey = key.ID
+		// the value log file being appended to is sealed, so that the next Compact
+		// can collect it
+		if d.vlogWriter != nil {
+			if err := d.syncValueLog(); err != nil {
+				return d.fail(fmt.Errorf("failed to sync to disk: %w", err))
+			}
+			if err := d.vlogWriter.Close(); err != nil {
+				return d.fail(err)
+			}
+			d.vlogWriter = nil
+		}
+		// the active file may need fileEncrypted, if there were no keys before
+		return d.adoptFormat()
+	})
+}
@@ -0,0 +1,161 @@
+package caskdb
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func testKey(id uint32) EncryptionKey {
+	return EncryptionKey{ID: id, Key: bytes.Repeat([]byte{byte(id)}, 32)}
+}
+
+func TestKeyRing(t *testing.T) {
+	keys, err := newKeyRing([]EncryptionKey{testKey(1), testKey(2)})
+	if err != nil {
+		t.Fatalf("newKeyRing() error = %v", err)
+	}
+	if keys.active != 2 {
+		t.Errorf("active = %v, want 2", keys.active)
+	}
+	sealed := keys.seal(nil, "book", []byte("dune"))
+	if bytes.Contains(sealed, []byte("dune")) {
+		t.Errorf("seal() = %q, want the value encrypted", sealed)
+	}
+	if got, err := keys.open(2, "book", sealed); err != nil || string(got) != "dune" {
+		t.Errorf("open() = %q, %v, want dune", got, err)
+	}
+	if _, err := keys.open(2, "other", sealed); err != ErrCorruptRecord {
+		t.Errorf("open() with another key error = %v, want %v", err, ErrCorruptRecord)
+	}
+	if _, err := keys.open(1, "book", sealed); err != ErrCorruptRecord {
+		t.Errorf("open() with another encryption key error = %v, want %v", err, ErrCorruptRecord)
+	}
+	if _, err := keys.open(3, "book", sealed); !errors.Is(err, ErrUnknownEncryptionKey) {
+		t.Errorf("open() with an unknown key error = %v, want %v", err, ErrUnknownEncryptionKey)
+	}
+
+	for _, keys := range [][]EncryptionKey{
+		{{ID: 0, Key: testKey(1).Key}},
+		{testKey(1), testKey(1)},
+		{{ID: 1, Key: []byte("short")}},
+	} {
+		if _, err := newKeyRing(keys); !errors.Is(err, ErrInvalidEncryptionKey) {
+			t.Errorf("newKeyRing(%v) error = %v, want %v", keys, err, ErrInvalidEncryptionKey)
+		}
+	}
+}
+
+func TestDiskStore_Encryption(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{
+		Format:            FormatV2,
+		Compression:       Snappy,
+		ValueLogThreshold: 1024,
+		MergeOperator:     joinOperator,
+		EncryptionKeys:    []EncryptionKey{testKey(1)},
+	}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	long := strings.Repeat("secret ", 100)
+	store.Set("small", "secret")
+	store.Set("long", long)
+	store.Set("big", bigValue(1))
+	store.Merge("small", "operand")
+	if size, err := store.SizeOf("long"); err != nil || size != len(long) {
+		t.Errorf("SizeOf(long) = %v, %v, want %v", size, err, len(long))
+	}
+	if got, err := store.GetRange("long", 7, 6); err != nil || string(got) != "secret" {
+		t.Errorf("GetRange(long) = %q, %v, want secret", got, err)
+	}
+	store.Close()
+
+	for _, name := range []string{fileName, valueLogName(fileName, 1)} {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatalf("failed to read %v: %v", name, err)
+		}
+		for _, plain := range []string{"secret", "operand", "value 1;"} {
+			if bytes.Contains(data, []byte(plain)) {
+				t.Errorf("%v has %q in plain text", name, plain)
+			}
+		}
+	}
+
+	check := func(store *DiskStore) {
+		t.Helper()
+		for key, want := range map[string]string{"small": "secret+operand", "long": long, "big": bigValue(1)} {
+			if got, err := store.Get(key); err != nil || got != want {
+				t.Errorf("Get(%v) = %v, %v, want %v", key, got, err, want)
+			}
+		}
+	}
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	check(store)
+	store.Close()
+
+	noKeys := opts
+	noKeys.EncryptionKeys = nil
+	store, err = NewDiskStoreWithOptions(fileName, noKeys)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	if _, err := store.Get("long"); !errors.Is(err, ErrUnknownEncryptionKey) {
+		t.Errorf("Get() without the key error = %v, want %v", err, ErrUnknownEncryptionKey)
+	}
+	if report := store.Quarantine(); len(report) != 0 {
+		t.Errorf("Quarantine() = %v, want the records left alone", report)
+	}
+	store.Close()
+}
+
+func TestDiskStore_RotateEncryptionKey(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{Format: FormatV2, ValueLogThreshold: 1024, EncryptionKeys: []EncryptionKey{testKey(1)}}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("old", "value")
+	store.Set("old big", bigValue(1))
+	if err := store.RotateEncryptionKey(testKey(1)); !errors.Is(err, ErrInvalidEncryptionKey) {
+		t.Errorf("RotateEncryptionKey() with a taken ID error = %v, want %v", err, ErrInvalidEncryptionKey)
+	}
+	if err := store.RotateEncryptionKey(testKey(2)); err != nil {
+		t.Fatalf("RotateEncryptionKey() error = %v", err)
+	}
+	store.Set("new", "value")
+	store.Set("new big", bigValue(2))
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	store.Close()
+
+	// the old key is no longer needed
+	opts.EncryptionKeys = []EncryptionKey{testKey(2)}
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	for key, want := range map[string]string{"old": "value", "old big": bigValue(1), "new": "value", "new big": bigValue(2)} {
+		if got, err := store.Get(key); err != nil || got != want {
+			t.Errorf("Get(%v) = %v, %v, want %v", key, got, err, want)
+		}
+	}
+}
+
+func TestDiskStore_EncryptionFormatV1(t *testing.T) {
+	opts := Options{EncryptionKeys: []EncryptionKey{testKey(1)}}
+	if _, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), opts); !errors.Is(err, ErrInvalidEncryptionKey) {
+		t.Errorf("NewDiskStoreWithOptions() error = %v, want %v", err, ErrInvalidEncryptionKey)
+	}
+}
@@ -0,0 +1,32 @@
+package caskdb
+
+// Fold calls fn for every live key value pair of the store, passing the value
+// returned by the previous call as acc, and returns the result of the last call,
+// just like the fold function of the bitcask paper. acc0 is passed to the first
+// call, and is returned as is when the store is empty.
+//
+// The pairs are visited in the order of their records in the file, with the same
+// semantics for the concurrent writes as Iterator. Fold stops at the first read
+// error and returns the result accumulated so far, which cannot be told apart from
+// a complete one; use FoldWithError to get the error.
+//
+// Typical usage example:
+//
+//	total := store.Fold(func(key, value string, acc any) any {
+//		return acc.(int) + len(value)
+//	}, 0).(int)
+func (d *DiskStore) Fold(fn func(key, value string, acc any) any, acc0 any) any {
+	acc, _ := d.FoldWithError(fn, acc0)
+	return acc
+}
+
+// FoldWithError is the same as Fold, but also returns the read error which stopped
+// the fold, if any, along with the result accumulated up to it.
+func (d *DiskStore) FoldWithError(fn func(key, value string, acc any) any, acc0 any) (any, error) {
+	acc := acc0
+	it := d.Iterator()
+	for it.Next() {
+		acc = fn(it.Key(), it.Value(), acc)
+	}
+	return acc, it.Err()
+}
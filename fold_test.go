@@ -0,0 +1,66 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestDiskStore_Fold(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	if got := store.Fold(func(key, value string, acc any) any {
+		return acc.(int) + 1
+	}, 0); got != 0 {
+		t.Errorf("Fold() on empty store = %v, want 0", got)
+	}
+
+	store.Set("b", "2")
+	store.Set("a", "1")
+	store.Set("c", "3")
+	store.Set("b", "22")
+	store.Delete("c")
+
+	got := store.Fold(func(key, value string, acc any) any {
+		return append(acc.([]string), key+"="+value)
+	}, []string(nil))
+	// a was written before the last write of b, so it comes first in the file
+	if want := []string{"a=1", "b=22"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Fold() = %v, want %v", got, want)
+	}
+	store.Close()
+}
+
+func TestDiskStore_FoldWithError(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("hamlet", "shakespeare")
+	store.Set("name", "jojo")
+
+	count := func(key, value string, acc any) any {
+		return acc.(int) + 1
+	}
+	if got, err := store.FoldWithError(count, 0); err != nil || got != 2 {
+		t.Errorf("FoldWithError() = %v, %v, want 2, nil", got, err)
+	}
+
+	// the value of name is corrupted, so the fold stops after hamlet
+	f, err := os.OpenFile("test.db", os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("failed to open the file: %v", err)
+	}
+	f.WriteAt([]byte("J"), int64(2*headerSize+len("hamlet")+len("shakespeare")+len("name")))
+	f.Close()
+	if got, err := store.FoldWithError(count, 0); !errors.Is(err, ErrChecksumMismatch) || got != 1 {
+		t.Errorf("FoldWithError() = %v, %v, want 1, %v", got, err, ErrChecksumMismatch)
+	}
+}
@@ -2,6 +2,24 @@ package caskdb
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+var (
+	// ErrChecksumMismatch is returned when a record read from the disk does not match
+	// its checksum, i.e. it has been corrupted
+	ErrChecksumMismatch = errors.New("checksum mismatch")
+	// ErrCorruptRecord is returned when the sizes in the header of a record read from
+	// the disk do not add up to the length of the record
+	ErrCorruptRecord = errors.New("corrupt record")
+	// ErrPartialRecord reports a record cut off by the end of the file, i.e. a write
+	// which did not complete
+	ErrPartialRecord = errors.New("partial record")
+	// ErrValueTooLarge is returned by the writes of a value larger than a record can
+	// hold, about 1GB, see maxValueSize
+	ErrValueTooLarge = errors.New("value is too large")
 )
 
 // format file provides encode/decode functions for serialisation and deserialisation
@@ -43,35 +61,99 @@ import (
 // headerSize specifies the total header size. Our key value pair, when stored on disk
 // looks like this:
 //
-//	┌───────────┬──────────┬────────────┬─────┬───────┐
-//	│ timestamp │ key_size │ value_size │ key │ value │
-//	└───────────┴──────────┴────────────┴─────┴───────┘
+//	┌─────┬───────────┬────────┬──────────┬────────────┬─────┬───────┐
+//	│ crc │ timestamp │ expiry │ key_size │ value_size │ key │ value │
+//	└─────┴───────────┴────────┴──────────┴────────────┴─────┴───────┘
 //
 // This is analogous to a typical database's row (or a record). The total length of
 // the row is variable, depending on the contents of the key and value.
 //
-// The first three fields form the header:
+// The first five fields form the header:
+//
+//	┌─────────┬───────────────┬────────────┬──────────────┬────────────────┐
+//	│ crc(4B) │ timestamp(4B) │ expiry(4B) │ key_size(4B) │ value_size(4B) │
+//	└─────────┴───────────────┴────────────┴──────────────┴────────────────┘
+//
+// These five fields store unsigned integers of size 4 bytes, giving our header a
+// fixed length of 20 bytes. CRC field stores the CRC32 (IEEE) checksum of the rest
+// of the record, everything after the crc field itself, just like the bitcask paper
+// does. It lets us detect the records damaged by bit rot or a partial write, instead
+// of returning garbage. Timestamp field stores the time the record we
+// inserted in unix epoch seconds. Expiry field stores the time, again in unix epoch
+// seconds, after which the key is considered deleted; 0 means the key never
+// expires. Key size and value size fields store the length of
+// bytes occupied by the key and value. The maximum integer stored by 4 bytes is
+// 4,294,967,295 (2 ** 32 - 1), roughly ~4.2GB. So, the size of each key or value
+// cannot exceed this. Theoretically, a single row can be as large as ~8.4GB.
 //
-//	┌───────────────┬──────────────┬────────────────┐
-//	│ timestamp(4B) │ key_size(4B) │ value_size(4B) │
-//	└───────────────┴──────────────┴────────────────┘
+// The key and value are stored as raw bytes, exactly as given, so they can hold
+// anything, including invalid UTF-8 and zero bytes.
 //
-// These three fields store unsigned integers of size 4 bytes, giving our header a
-// fixed length of 12 bytes. Timestamp field stores the time the record we
-// inserted in unix epoch seconds. Key size and value size fields store the length of
-// bytes occupied by the key and value. The maximum integer
-// stored by 4 bytes is 4,294,967,295 (2 ** 32 - 1), roughly ~4.2GB. So, the size of
-// each key or value cannot exceed this. Theoretically, a single row can be as large
-// as ~8.4GB.
-const headerSize = 12
+// The two most significant bits of value_size are reserved for the record flags (see
+// tombstoneFlag and mergeFlag), which brings the maximum value size down to ~1GB.
+//
+// This is the layout of FormatV1, and of the functions in this file; see Format for
+// the later ones, and legacyLayout for the earlier ones, without the crc.
+const headerSize = 20
+
+// tombstoneFlag is set in the value_size field of a record to mark the key as
+// deleted. We never modify the existing records in the file, so a delete is just
+// another record appended to the log: a tombstone. It carries the key but no value:
+//
+//	┌─────┬───────────┬────────┬──────────┬────────────┬─────┐
+//	│ crc │ timestamp │ expiry │ key_size │ 0x80000000 │ key │
+//	└─────┴───────────┴────────┴──────────┴────────────┴─────┘
+//
+// When we load the file at the startup, a tombstone removes the key from keyDir, so
+// the deleted keys do not come back to life after a restart.
+const tombstoneFlag uint32 = 1 << 31
+
+// mergeFlag is set in the value_size field of a merge operand record. Such a record
+// does not hold the value of the key, but an operand which is folded into the value
+// by the user's MergeOperator when the key is read.
+const mergeFlag uint32 = 1 << 30
+
+// recordFlags masks all the flag bits of the value_size field.
+const recordFlags = tombstoneFlag | mergeFlag
+
+// maxValueSize is the size of the largest value a record can have, with value_size
+// keeping the record flags in its top bits.
+const maxValueSize = uint64(^recordFlags)
+
+// checkValueSize returns ErrValueTooLarge if a value of the given size does not fit
+// in value_size, where its top bits would be taken for the record flags.
+func checkValueSize(size int) error {
+	if uint64(size) > maxValueSize {
+		return fmt.Errorf("%w: %d bytes", ErrValueTooLarge, size)
+	}
+	return nil
+}
 
 // KeyEntry keeps the metadata about the KV, specially the position of
 // the byte offset in the file. Whenever we insert/update a key, we create a new
 // KeyEntry object and insert that into keyDir.
 type KeyEntry struct {
+	// FileID is the data file the record is in, see MaxSegmentSize
+	FileID    uint32
 	Offset    uint32
 	Size      uint32
 	Timestamp uint32
+	// Expiry is the unix timestamp after which the key is gone, 0 if it never expires
+	Expiry uint32
+}
+
+// before reports whether the record of k comes before the one of o in the log, i.e.
+// in an older data file, or earlier in the same one.
+func (k KeyEntry) before(o KeyEntry) bool {
+	if k.FileID != o.FileID {
+		return k.FileID < o.FileID
+	}
+	return k.Offset < o.Offset
+}
+
+// isExpired reports whether the key has expired at the given unix timestamp.
+func (k KeyEntry) isExpired(now uint32) bool {
+	return k.Expiry != 0 && k.Expiry <= now
 }
 
 func NewKeyEntry(timestamp uint32, position uint32, totalSize uint32) KeyEntry {
@@ -82,41 +164,132 @@ func NewKeyEntry(timestamp uint32, position uint32, totalSize uint32) KeyEntry {
 	}
 }
 
-func encodeHeader(timestamp uint32, keySize uint32, valueSize uint32) []byte {
-	header := make([]byte, 0, headerSize)
-	header = binary.BigEndian.AppendUint32(header, timestamp)
-	header = binary.BigEndian.AppendUint32(header, keySize)
-	header = binary.BigEndian.AppendUint32(header, valueSize)
-	return header
+func encodeHeader(timestamp uint32, expiry uint32, keySize uint32, valueSize uint32) []byte {
+	return appendHeader(make([]byte, 0, headerSize), timestamp, expiry, keySize, valueSize)
+}
+
+// appendHeader encodes the header at the end of dst, so that the callers can build
+// the whole record in a single buffer without copying the header around. The crc
+// field is left zero; once the rest of the record is in place, setChecksum fills it.
+func appendHeader(dst []byte, timestamp uint32, expiry uint32, keySize uint32, valueSize uint32) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	dst = binary.BigEndian.AppendUint32(dst, timestamp)
+	dst = binary.BigEndian.AppendUint32(dst, expiry)
+	dst = binary.BigEndian.AppendUint32(dst, keySize)
+	dst = binary.BigEndian.AppendUint32(dst, valueSize)
+	return dst
+}
+
+// decodeHeader decodes the timestamp, expiry, key_size and value_size fields of the
+// header. It returns ErrCorruptRecord if the header is not exactly headerSize bytes.
+func decodeHeader(header []byte) (uint32, uint32, uint32, uint32, error) {
+	if len(header) != headerSize {
+		return 0, 0, 0, 0, ErrCorruptRecord
+	}
+	timestamp := binary.BigEndian.Uint32(header[4:8])
+	expiry := binary.BigEndian.Uint32(header[8:12])
+	keySize := binary.BigEndian.Uint32(header[12:16])
+	valueSize := binary.BigEndian.Uint32(header[16:])
+	return timestamp, expiry, keySize, valueSize, nil
+}
+
+// setChecksum computes the checksum of the whole record and stores it in its crc
+// field.
+func setChecksum(record []byte) []byte {
+	binary.BigEndian.PutUint32(record[0:4], crc32.ChecksumIEEE(record[4:]))
+	return record
 }
 
-func decodeHeader(header []byte) (uint32, uint32, uint32) {
-	if len(header) != 12 {
-		panic("Invalid header")
+// verifyChecksum returns ErrChecksumMismatch if the record does not match the
+// checksum stored in its crc field.
+func verifyChecksum(record []byte) error {
+	if binary.BigEndian.Uint32(record[0:4]) != crc32.ChecksumIEEE(record[4:]) {
+		return ErrChecksumMismatch
 	}
-	timestamp := binary.BigEndian.Uint32(header[0:4])
-	keySize := binary.BigEndian.Uint32(header[4:8])
-	valueSize := binary.BigEndian.Uint32(header[8:])
-	return timestamp, keySize, valueSize
+	return nil
+}
+
+// verifyRecord checks that the record is sane before it is decoded: the sizes in the
+// header must add up to the length of the record, and its checksum must match.
+func verifyRecord(record []byte) error {
+	return FormatV1.verifyRecord(record)
 }
 
 func encodeKV(timestamp uint32, key string, value string) (int, []byte) {
-	keySize := len(key)
-	valueSize := len(value)
-	header := encodeHeader(timestamp, uint32(keySize), uint32(valueSize))
-	kv := make([]byte, 0, headerSize+keySize+valueSize)
-	kv = append(kv, header...)
-	kv = append(kv, []byte(key)...)
-	kv = append(kv, []byte(value)...)
-	return headerSize + keySize + valueSize, kv
+	return encodeKVWithExpiry(timestamp, 0, key, value)
+}
 
+// encodeKVWithExpiry is the same as encodeKV, but also stores the expiry of the key
+// in the header.
+func encodeKVWithExpiry(timestamp uint32, expiry uint32, key string, value string) (int, []byte) {
+	size := headerSize + len(key) + len(value)
+	return size, appendKV(make([]byte, 0, size), timestamp, expiry, key, value)
+}
+
+// appendKV encodes the record at the end of dst and returns the extended slice, the
+// record being its last bytes. With a dst of enough capacity, e.g. from getBuffer,
+// encoding does not allocate at all.
+func appendKV(dst []byte, timestamp uint32, expiry uint32, key string, value string) []byte {
+	return FormatV1.appendKV(dst, timestamp, expiry, key, value)
+}
+
+// encodeKVBytes is the same as encodeKVWithExpiry, but takes the value as bytes so
+// that binary payloads do not have to be converted to a string first.
+func encodeKVBytes(timestamp uint32, expiry uint32, key string, value []byte) (int, []byte) {
+	size := headerSize + len(key) + len(value)
+	return size, appendKVBytes(make([]byte, 0, size), timestamp, expiry, key, value)
+}
+
+// appendKVBytes is the same as appendKV, but takes the value as bytes.
+func appendKVBytes(dst []byte, timestamp uint32, expiry uint32, key string, value []byte) []byte {
+	return FormatV1.appendKVBytes(dst, timestamp, expiry, key, value)
+}
+
+func encodeTombstone(timestamp uint32, key string) (int, []byte) {
+	size := headerSize + len(key)
+	return size, appendTombstone(make([]byte, 0, size), timestamp, key)
+}
+
+// appendTombstone is the same as appendKV, but for a tombstone.
+func appendTombstone(dst []byte, timestamp uint32, key string) []byte {
+	return FormatV1.appendTombstone(dst, timestamp, key)
+}
+
+func encodeMergeOperand(timestamp uint32, expiry uint32, key string, operand string) (int, []byte) {
+	size := headerSize + len(key) + len(operand)
+	return size, FormatV1.appendMergeOperand(make([]byte, 0, size), timestamp, expiry, key, operand)
+}
+
+func isTombstone(valueSize uint32) bool {
+	return valueSize&tombstoneFlag != 0
+}
+
+func isMergeOperand(valueSize uint32) bool {
+	return valueSize&mergeFlag != 0
+}
+
+// valueLength returns the length of the value, stripping the flags off value_size.
+func valueLength(valueSize uint32) uint32 {
+	return valueSize &^ recordFlags
 }
 
 func decodeKV(data []byte) (uint32, string, string) {
-	timestamp, keySize, valueSize := decodeHeader(data[0:12])
-	key := data[12 : 12+keySize]
-	value := data[12+keySize : 12+keySize+valueSize]
+	timestamp, key, value := decodeKVBytes(data)
+	return timestamp, key, string(value)
+}
 
-	return timestamp, string(key), string(value)
+// decodeValue returns the value of the record as a slice of it, without decoding the
+// key, which saves copying it into a string on the reads which only need the value.
+// As with decodeKVBytes, the record must be verified first.
+func decodeValue(data []byte) []byte {
+	return FormatV1.decodeValue(data)
+}
 
+// decodeKVBytes is the same as decodeKV, but the value is returned as a slice of
+// data instead of a copy. The caller must not modify data while using the value.
+//
+// The sizes in the header are trusted, so the records read from the disk must pass
+// verifyRecord before they are decoded.
+func decodeKVBytes(data []byte) (uint32, string, []byte) {
+	return FormatV1.decodeKVBytes(data)
 }
@@ -1,25 +1,34 @@
 package caskdb
 
 import (
+	"bytes"
+	"errors"
 	"testing"
 )
 
 func Test_encodeHeader(t *testing.T) {
 	tests := []struct {
 		timestamp uint32
+		expiry    uint32
 		keySize   uint32
 		valueSize uint32
 	}{
-		{10, 10, 10},
-		{0, 0, 0},
-		{10000, 10000, 10000},
+		{10, 10, 10, 10},
+		{0, 0, 0, 0},
+		{10000, 20000, 10000, 10000},
 	}
 	for _, tt := range tests {
-		data := encodeHeader(tt.timestamp, tt.keySize, tt.valueSize)
-		timestamp, keySize, valueSize := decodeHeader(data)
+		data := encodeHeader(tt.timestamp, tt.expiry, tt.keySize, tt.valueSize)
+		timestamp, expiry, keySize, valueSize, err := decodeHeader(data)
+		if err != nil {
+			t.Fatalf("decodeHeader() error = %v", err)
+		}
 		if timestamp != tt.timestamp {
 			t.Errorf("encodeHeader() timestamp = %v, want %v", timestamp, tt.timestamp)
 		}
+		if expiry != tt.expiry {
+			t.Errorf("encodeHeader() expiry = %v, want %v", expiry, tt.expiry)
+		}
 		if keySize != tt.keySize {
 			t.Errorf("encodeHeader() keySize = %v, want %v", keySize, tt.keySize)
 		}
@@ -29,6 +38,14 @@ func Test_encodeHeader(t *testing.T) {
 	}
 }
 
+func Test_decodeHeaderInvalid(t *testing.T) {
+	for _, size := range []int{0, headerSize - 1, headerSize + 1} {
+		if _, _, _, _, err := decodeHeader(make([]byte, size)); err != ErrCorruptRecord {
+			t.Errorf("decodeHeader() of %v bytes error = %v, want %v", size, err, ErrCorruptRecord)
+		}
+	}
+}
+
 func Test_encodeKV(t *testing.T) {
 	tests := []struct {
 		timestamp uint32
@@ -57,3 +74,133 @@ func Test_encodeKV(t *testing.T) {
 		}
 	}
 }
+
+func Test_appendKV(t *testing.T) {
+	_, want := encodeKVWithExpiry(10, 20, "hello", "world")
+	// the record goes after whatever dst has already, and is the same as a fresh one
+	data := appendKV([]byte("prefix"), 10, 20, "hello", "world")
+	if string(data[:6]) != "prefix" || !bytes.Equal(data[6:], want) {
+		t.Errorf("appendKV() = %v, want prefix followed by %v", data, want)
+	}
+	data = appendKVBytes(nil, 10, 20, "hello", []byte("world"))
+	if !bytes.Equal(data, want) {
+		t.Errorf("appendKVBytes() = %v, want %v", data, want)
+	}
+	if value := decodeValue(want); string(value) != "world" {
+		t.Errorf("decodeValue() = %q, want world", value)
+	}
+	if _, tombstone := encodeTombstone(10, "hello"); decodeValue(tombstone) != nil {
+		t.Errorf("decodeValue() of a tombstone = %q, want nil", decodeValue(tombstone))
+	}
+}
+
+func Test_encodeTombstone(t *testing.T) {
+	size, data := encodeTombstone(10, "hello")
+	if size != headerSize+5 {
+		t.Errorf("encodeTombstone() size = %v, want %v", size, headerSize+5)
+	}
+	_, _, _, valueSize, _ := decodeHeader(data[:headerSize])
+	if !isTombstone(valueSize) {
+		t.Errorf("encodeTombstone() header is not marked as tombstone")
+	}
+	timestamp, key, value := decodeKV(data)
+	if timestamp != 10 || key != "hello" || value != "" {
+		t.Errorf("decodeKV() = %v, %v, %v, want 10, hello, ''", timestamp, key, value)
+	}
+}
+
+func Test_encodeKVBytes(t *testing.T) {
+	tests := []struct {
+		key   string
+		value []byte
+	}{
+		{"hello", []byte("world")},
+		{"blob", []byte{0x00, 0xff, 0xfe, 0x00}},
+		{"empty", []byte{}},
+	}
+	for _, tt := range tests {
+		size, data := encodeKVBytes(10, 0, tt.key, tt.value)
+		if size != headerSize+len(tt.key)+len(tt.value) {
+			t.Errorf("encodeKVBytes() size = %v, want %v", size, headerSize+len(tt.key)+len(tt.value))
+		}
+		_, key, value := decodeKVBytes(data)
+		if key != tt.key {
+			t.Errorf("decodeKVBytes() key = %v, want %v", key, tt.key)
+		}
+		if !bytes.Equal(value, tt.value) {
+			t.Errorf("decodeKVBytes() value = %v, want %v", value, tt.value)
+		}
+	}
+}
+
+func Test_encodeKVWithExpiry(t *testing.T) {
+	size, data := encodeKVWithExpiry(10, 20, "hello", "world")
+	if size != headerSize+10 {
+		t.Errorf("encodeKVWithExpiry() size = %v, want %v", size, headerSize+10)
+	}
+	timestamp, expiry, _, _, _ := decodeHeader(data[:headerSize])
+	if timestamp != 10 || expiry != 20 {
+		t.Errorf("decodeHeader() timestamp, expiry = %v, %v, want 10, 20", timestamp, expiry)
+	}
+	if _, key, value := decodeKV(data); key != "hello" || value != "world" {
+		t.Errorf("decodeKV() = %v, %v, want hello, world", key, value)
+	}
+}
+
+func Test_encodeMergeOperand(t *testing.T) {
+	size, data := encodeMergeOperand(10, 20, "tags", "go")
+	if size != headerSize+6 {
+		t.Errorf("encodeMergeOperand() size = %v, want %v", size, headerSize+6)
+	}
+	_, expiry, _, valueSize, _ := decodeHeader(data[:headerSize])
+	if !isMergeOperand(valueSize) || isTombstone(valueSize) || valueLength(valueSize) != 2 {
+		t.Errorf("encodeMergeOperand() value_size = %#x, want merge operand of length 2", valueSize)
+	}
+	if expiry != 20 {
+		t.Errorf("encodeMergeOperand() expiry = %v, want 20", expiry)
+	}
+	if _, key, value := decodeKV(data); key != "tags" || value != "go" {
+		t.Errorf("decodeKV() = %v, %v, want tags, go", key, value)
+	}
+}
+
+func Test_verifyChecksum(t *testing.T) {
+	_, data := encodeKV(10, "hello", "world")
+	if err := verifyChecksum(data); err != nil {
+		t.Errorf("verifyChecksum() = %v, want nil", err)
+	}
+	for i := range data {
+		corrupted := append([]byte(nil), data...)
+		corrupted[i] ^= 0x01
+		if err := verifyChecksum(corrupted); err != ErrChecksumMismatch {
+			t.Errorf("verifyChecksum() with byte %v flipped = %v, want %v", i, err, ErrChecksumMismatch)
+		}
+	}
+}
+
+func Test_verifyRecord(t *testing.T) {
+	_, data := encodeKV(10, "hello", "world")
+	if err := verifyRecord(data); err != nil {
+		t.Errorf("verifyRecord() = %v, want nil", err)
+	}
+	if err := verifyRecord(data[:headerSize-1]); err != ErrCorruptRecord {
+		t.Errorf("verifyRecord() of a short record = %v, want %v", err, ErrCorruptRecord)
+	}
+	// a record whose checksum matches, but with more bytes than its header says
+	extra := setChecksum(append(append([]byte(nil), data...), '!'))
+	if err := verifyRecord(extra); err != ErrCorruptRecord {
+		t.Errorf("verifyRecord() of a longer record = %v, want %v", err, ErrCorruptRecord)
+	}
+}
+
+func Test_checkValueSize(t *testing.T) {
+	for _, size := range []int{0, 1 << 20, int(maxValueSize)} {
+		if err := checkValueSize(size); err != nil {
+			t.Errorf("checkValueSize(%v) error = %v", size, err)
+		}
+	}
+	// the next size would set mergeFlag in value_size
+	if err := checkValueSize(int(maxValueSize) + 1); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("checkValueSize(%v) error = %v, want %v", maxValueSize+1, err, ErrValueTooLarge)
+	}
+}
@@ -0,0 +1,55 @@
+package caskdb
+
+// Index is the in-memory index of keyDir, which maps the keys to the entries of their
+// latest records. keyDir is split into shards, and each shard keeps its keys in an
+// Index of its own, made by Options.NewIndex. The default is a Go map; the other
+// implementations, like a radix tree or an index off the Go heap, can be plugged in
+// without touching the rest of the store.
+//
+// The store takes care of the locking: an Index is never changed concurrently with
+// any other call, but Get, Range and Len may be called concurrently with each other.
+type Index interface {
+	// Put points the key to the entry, replacing the one it had, if any
+	Put(key string, keyEntry KeyEntry)
+	// Get returns the entry of the key, and whether the key is in the index
+	Get(key string) (KeyEntry, bool)
+	// Delete drops the key from the index; it is a no-op for a missing key
+	Delete(key string)
+	// Range calls fn for every key in the index and its entry, in any order, until fn
+	// returns false. fn must not change the index.
+	Range(fn func(key string, keyEntry KeyEntry) bool)
+	// Len returns the number of keys in the index
+	Len() int
+}
+
+// mapIndex is the default Index, backed by a Go map.
+type mapIndex map[string]KeyEntry
+
+func newMapIndex() Index {
+	return make(mapIndex)
+}
+
+func (m mapIndex) Put(key string, keyEntry KeyEntry) {
+	m[key] = keyEntry
+}
+
+func (m mapIndex) Get(key string) (KeyEntry, bool) {
+	keyEntry, ok := m[key]
+	return keyEntry, ok
+}
+
+func (m mapIndex) Delete(key string) {
+	delete(m, key)
+}
+
+func (m mapIndex) Range(fn func(key string, keyEntry KeyEntry) bool) {
+	for key, keyEntry := range m {
+		if !fn(key, keyEntry) {
+			return
+		}
+	}
+}
+
+func (m mapIndex) Len() int {
+	return len(m)
+}
@@ -0,0 +1,77 @@
+package caskdb
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMapIndex(t *testing.T) {
+	idx := newMapIndex()
+	idx.Put("name", KeyEntry{Offset: 1})
+	idx.Put("stand", KeyEntry{Offset: 2})
+	idx.Put("name", KeyEntry{Offset: 3})
+	if keyEntry, ok := idx.Get("name"); !ok || keyEntry.Offset != 3 {
+		t.Errorf("Get(name) = %v, %v, want offset 3", keyEntry, ok)
+	}
+	if got := idx.Len(); got != 2 {
+		t.Errorf("Len() = %v, want 2", got)
+	}
+	idx.Delete("stand")
+	idx.Delete("missing")
+	if _, ok := idx.Get("stand"); ok {
+		t.Errorf("Get(stand) = _, true after Delete")
+	}
+	idx.Put("other", KeyEntry{})
+	visited := 0
+	idx.Range(func(key string, keyEntry KeyEntry) bool {
+		visited++
+		return false
+	})
+	if visited != 1 {
+		t.Errorf("Range() visited %v keys after returning false, want 1", visited)
+	}
+}
+
+// countingIndex is a mapIndex which counts the keys put into it.
+type countingIndex struct {
+	mapIndex
+	puts *int
+}
+
+func (c countingIndex) Put(key string, keyEntry KeyEntry) {
+	*c.puts++
+	c.mapIndex.Put(key, keyEntry)
+}
+
+func TestDiskStore_NewIndex(t *testing.T) {
+	puts := 0
+	opts := Options{NewIndex: func() Index {
+		return countingIndex{make(mapIndex), &puts}
+	}}
+	store, err := NewDiskStoreWithOptions("test.db", opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("name", "jojo")
+	store.Set("stand", "star platinum")
+	store.Delete("stand")
+	if puts != 2 {
+		t.Errorf("the index got %v puts, want 2", puts)
+	}
+	if got, err := store.Get("name"); err != nil || got != "jojo" {
+		t.Errorf("Get(name) = %v, %v, want jojo", got, err)
+	}
+	store.Close()
+
+	// the keys are loaded into the index on the startup as well
+	puts = 0
+	store, err = NewDiskStoreWithOptions("test.db", opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if puts == 0 || store.Len() != 1 || !store.Has("name") {
+		t.Errorf("reopened store has %v keys after %v puts, want name only", store.Len(), puts)
+	}
+}
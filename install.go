@@ -0,0 +1,51 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// installFile atomically replaces (or creates) the file at path with the contents
+// written by fn, so that a crash at any point leaves either the old file or the
+// whole new one, never a mix of the two. The contents are written to a temporary
+// file next to path, synced, and then renamed over path; finally the directory is
+// synced to make the rename itself durable. On any error the temporary file is
+// removed and path is left untouched.
+//
+// This is how a compaction installs its output: the callers must swap keyDir to the
+// new file only after installFile returns nil. On windows, the file cannot be renamed
+// over as long as it is open, so the callers have to close their handles of path
+// first.
+func installFile(path string, mode os.FileMode, fn func(f *os.File) error) (err error) {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmpName := f.Name()
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(tmpName)
+		}
+	}()
+	if err := f.Chmod(mode); err != nil {
+		return err
+	}
+	if err := fn(f); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return fmt.Errorf("failed to sync to disk: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpName, path); err != nil {
+		return err
+	}
+	if err := syncDir(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("failed to sync the directory: %w", err)
+	}
+	return nil
+}
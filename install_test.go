@@ -0,0 +1,48 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_installFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "test.db")
+	if err := os.WriteFile(path, []byte("old"), 0644); err != nil {
+		t.Fatalf("failed to write the file: %v", err)
+	}
+
+	failure := errors.New("failure")
+	err := installFile(path, 0644, func(f *os.File) error {
+		f.Write([]byte("half"))
+		return failure
+	})
+	if !errors.Is(err, failure) {
+		t.Errorf("installFile() error = %v, want %v", err, failure)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "old" {
+		t.Errorf("file after a failed installFile() = %q, want %q", data, "old")
+	}
+
+	err = installFile(path, 0644, func(f *os.File) error {
+		_, err := f.Write([]byte("new"))
+		return err
+	})
+	if err != nil {
+		t.Errorf("installFile() error = %v, want nil", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "new" {
+		t.Errorf("file after installFile() = %q, want %q", data, "new")
+	}
+
+	// neither of the calls should leave a temporary file behind
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read the directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory has %v files, want only test.db", len(entries))
+	}
+}
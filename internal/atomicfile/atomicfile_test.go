@@ -0,0 +1,27 @@
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "position")
+	for _, want := range []string{"0:16\n", "1:32\n"} {
+		if err := WriteFile(path, []byte(want), 0644); err != nil {
+			t.Fatalf("WriteFile() error = %v", err)
+		}
+		if data, _ := os.ReadFile(path); string(data) != want {
+			t.Errorf("file after WriteFile() = %q, want %q", data, want)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("failed to read the directory: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("directory has %v files, want only position", len(entries))
+	}
+}
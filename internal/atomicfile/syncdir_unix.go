@@ -0,0 +1,20 @@
+//go:build !windows
+
+package atomicfile
+
+import "os"
+
+// syncDir fsyncs the directory, which makes the creation, renaming or removal of the
+// files in it durable. Syncing the file itself does not cover its directory entry, so
+// without this, a newly created file can vanish after a crash.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
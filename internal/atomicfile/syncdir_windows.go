@@ -0,0 +1,9 @@
+//go:build windows
+
+package atomicfile
+
+// syncDir is a no-op on windows, where the directories cannot be opened for fsync;
+// NTFS journals the changes of the directory entries by itself.
+func syncDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,212 @@
+package caskdb
+
+import (
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Iterator streams over the key value pairs of a DiskStore, reading one value at a
+// time from the disk, so that the whole store never has to fit in the memory.
+//
+// An iterator sees the store as it was when the iterator was created: the writes made
+// later, including the deletes, are not visible to it, so it never visits a key twice
+// or skips one. This is cheap, since the records in the file are never modified; the
+// iterator only keeps a frozen view of keyDir, and reads the old records it points
+// to. Taking the view keeps out the writes only for a moment, whatever the number of
+// keys, see shardedKeyDir.view. The keys are visited in the order of their records in
+// the file, which keeps the reads mostly sequential.
+//
+// The data files the view points to are kept until the iterator is done, even if
+// they are compacted meanwhile, see retireSources. It is done once Next returns
+// false; call Close to be done with it sooner.
+//
+// Typical usage example:
+//
+//	it := store.Iterator()
+//	defer it.Close()
+//	for it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+//	if err := it.Err(); err != nil {
+//		...
+//	}
+type Iterator struct {
+	store   *DiskStore
+	entries []snapshotEntry
+	pos     int
+	key     string
+	value   string
+	err     error
+	// pinned is set until the iterator lets go of the data files, see pinView
+	pinned bool
+}
+
+// snapshotEntry is the state of a key at the time an iterator was created.
+type snapshotEntry struct {
+	key      string
+	keyEntry KeyEntry
+	// merge is the pending merge of the key as it was then, nil if it has none; it
+	// must not be changed
+	merge *pendingMerge
+}
+
+// snapshot captures the current state of the given keys, skipping the ones which are
+// not live.
+func (d *DiskStore) snapshot(keys []string) []snapshotEntry {
+	entries := make([]snapshotEntry, 0, len(keys))
+	for _, key := range keys {
+		keyEntry, ok := d.lookup(key)
+		if !ok {
+			continue
+		}
+		e := snapshotEntry{key: key, keyEntry: keyEntry}
+		if m, ok := d.keyDir.merge(key); ok {
+			// the operands appended later go past the length of the copy
+			merge := *m
+			merge.operands = m.operands[:len(m.operands):len(m.operands)]
+			e.merge = &merge
+		}
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// Iterator returns an iterator over all the live keys of the store.
+func (d *DiskStore) Iterator() *Iterator {
+	d.mu.RLock()
+	view := d.keyDir.view()
+	it := d.newIterator(nil)
+	d.mu.RUnlock()
+	now := unixNow()
+	var entries []snapshotEntry
+	view.forEach(func(key string, keyEntry KeyEntry, m *pendingMerge) {
+		if !keyEntry.isExpired(now) {
+			entries = append(entries, snapshotEntry{key: key, keyEntry: keyEntry, merge: m})
+		}
+	})
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].keyEntry.before(entries[j].keyEntry)
+	})
+	it.entries = entries
+	return it
+}
+
+// newIterator returns an iterator over the entries, which pins the data files they
+// point to, see pinView. The caller must hold mu, for reading at least.
+func (d *DiskStore) newIterator(entries []snapshotEntry) *Iterator {
+	d.pinView()
+	it := &Iterator{store: d, entries: entries, pinned: true}
+	// an iterator which is dropped half way must not keep the files forever
+	runtime.SetFinalizer(it, (*Iterator).Close)
+	return it
+}
+
+// pinView keeps the data files the current keyDir points to until unpinView is
+// called: the compactions retire them rather than removing them meanwhile. The caller
+// must hold mu, for reading at least, so that no compaction is removing them.
+func (d *DiskStore) pinView() {
+	d.views.Add(1)
+}
+
+// unpinView lets go of the data files kept by pinView, and removes the ones which
+// were retired meanwhile once nothing else keeps them. The caller must not hold mu.
+func (d *DiskStore) unpinView() {
+	if d.views.Add(-1) > 0 {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.views.Load() == 0 {
+		// on an error, they are retried by the next compaction, or Close
+		d.removeRetired()
+	}
+}
+
+// IteratorWrittenBetween is the same as Iterator, but visits only the keys whose last
+// write happened in [from, to), going by the timestamps kept in keyDir, so it does not
+// read the other records at all. A zero to means there is no upper bound, so that
+// IteratorWrittenBetween(yesterday, time.Time{}) visits everything written since
+// yesterday. The timestamps have a granularity of one second.
+func (d *DiskStore) IteratorWrittenBetween(from time.Time, to time.Time) *Iterator {
+	it := d.Iterator()
+	entries := it.entries[:0]
+	for _, e := range it.entries {
+		written := time.Unix(int64(e.keyEntry.Timestamp), 0)
+		if !written.Before(from) && (to.IsZero() || written.Before(to)) {
+			entries = append(entries, e)
+		}
+	}
+	it.entries = entries
+	return it
+}
+
+// IteratorWithPrefix is the same as Iterator, but visits only the keys which start
+// with the prefix.
+func (d *DiskStore) IteratorWithPrefix(prefix string) *Iterator {
+	it := d.Iterator()
+	entries := it.entries[:0]
+	for _, e := range it.entries {
+		if strings.HasPrefix(e.key, prefix) {
+			entries = append(entries, e)
+		}
+	}
+	it.entries = entries
+	return it
+}
+
+// Next advances the iterator to the next key value pair, and reports whether there
+// is one. It returns false at the end of the iteration or on an error; check Err
+// to tell them apart.
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.pos >= len(it.entries) {
+		it.Close()
+		return false
+	}
+	e := it.entries[it.pos]
+	it.pos++
+	it.store.mu.RLock()
+	var value []byte
+	var err error
+	if e.merge != nil {
+		value, err = it.store.getMerged(e.key, e.merge)
+	} else {
+		value, err = it.store.readValue(e.key, e.keyEntry)
+	}
+	it.store.mu.RUnlock()
+	if err != nil {
+		it.err = err
+		it.Close()
+		return false
+	}
+	it.key, it.value = e.key, string(value)
+	return true
+}
+
+// Key returns the key of the current pair.
+func (it *Iterator) Key() string {
+	return it.key
+}
+
+// Value returns the value of the current pair.
+func (it *Iterator) Value() string {
+	return it.value
+}
+
+// Close lets go of the data files kept for the iterator, see Iterator; Next returns
+// false from then on. It may be called more than once.
+func (it *Iterator) Close() {
+	it.pos = len(it.entries)
+	if !it.pinned {
+		return
+	}
+	it.pinned = false
+	runtime.SetFinalizer(it, nil)
+	it.store.unpinView()
+}
+
+// Err returns the error which stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
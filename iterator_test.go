@@ -0,0 +1,202 @@
+package caskdb
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_Iterator(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	tests := map[string]string{
+		"crime and punishment": "dostoevsky",
+		"anna karenina":        "tolstoy",
+		"war and peace":        "tolstoy",
+		"hamlet":               "shakespeare",
+	}
+	for key, val := range tests {
+		store.Set(key, val)
+	}
+	store.Delete("hamlet")
+	delete(tests, "hamlet")
+
+	got := make(map[string]string)
+	it := store.Iterator()
+	for it.Next() {
+		got[it.Key()] = it.Value()
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Err() = %v", err)
+	}
+	if !reflect.DeepEqual(got, tests) {
+		t.Errorf("Iterator() = %v, want %v", got, tests)
+	}
+	store.Close()
+}
+
+func TestDiskStore_IteratorWithWrites(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("a", "1")
+	store.Set("b", "2")
+	store.Set("c", "3")
+
+	it := store.Iterator()
+	if !it.Next() || it.Key() != "a" || it.Value() != "1" {
+		t.Fatalf("Next() = %v, %v, want a, 1", it.Key(), it.Value())
+	}
+	store.Delete("b")
+	store.Set("c", "33")
+	store.Set("d", "4")
+
+	var keys, values []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+		values = append(values, it.Value())
+	}
+	// the iterator should not see any of the writes made after it was created
+	if !reflect.DeepEqual(keys, []string{"b", "c"}) || !reflect.DeepEqual(values, []string{"2", "3"}) {
+		t.Errorf("Iterator() = %v, %v, want [b c], [2 3]", keys, values)
+	}
+	if got, _ := store.Get("c"); got != "33" {
+		t.Errorf("Get() = %v, want 33", got)
+	}
+	store.Close()
+}
+
+func TestDiskStore_IteratorWithCompaction(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("a", "1")
+	store.Set("b", "2")
+	store.Set("b", "22")
+	store.Set("c", "3")
+
+	it := store.Iterator()
+	if !it.Next() || it.Key() != "a" || it.Value() != "1" {
+		t.Fatalf("Next() = %v, %v, want a, 1", it.Key(), it.Value())
+	}
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact() = %v", err)
+	}
+	// the compacted file is kept for the iterator
+	if info, err := os.Stat(fileName); err != nil || info.Size() == 0 {
+		t.Fatalf("the compacted file is gone while an iterator reads from it")
+	}
+	var keys, values []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+		values = append(values, it.Value())
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("Err() = %v", err)
+	}
+	if !reflect.DeepEqual(keys, []string{"b", "c"}) || !reflect.DeepEqual(values, []string{"22", "3"}) {
+		t.Errorf("Iterator() = %v, %v, want [b c], [22 3]", keys, values)
+	}
+	// and is truncated once the iterator is done
+	if info, err := os.Stat(fileName); err != nil || info.Size() != 0 {
+		t.Errorf("the compacted file is kept after the iterator is done")
+	}
+
+	it = store.Iterator()
+	store.Set("a", "11")
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact() = %v", err)
+	}
+	it.Close()
+	if it.Next() {
+		t.Errorf("Next() = true after Close, want false")
+	}
+	if got, _ := store.Get("a"); got != "11" {
+		t.Errorf("Get() = %v, want 11", got)
+	}
+}
+
+func TestDiskStore_IteratorSnapshotMerge(t *testing.T) {
+	store, err := NewDiskStoreWithOptions("test.db", Options{MergeOperator: joinOperator})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("tags", "a")
+	store.Merge("tags", "b")
+
+	it := store.Iterator()
+	store.Merge("tags", "c")
+	if !it.Next() || it.Key() != "tags" || it.Value() != "a+b" {
+		t.Errorf("Next() = %v, %v, want tags, a+b", it.Key(), it.Value())
+	}
+	if it.Next() {
+		t.Errorf("Next() = true, want false")
+	}
+	store.Close()
+}
+
+func TestDiskStore_IteratorWrittenBetween(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	start := time.Now()
+	back := travel(-48 * time.Hour)
+	store.Set("old", "1")
+	store.Set("updated", "1")
+	back()
+	store.Set("new", "2")
+	store.Set("updated", "2")
+
+	collect := func(it *Iterator) []string {
+		var keys []string
+		for it.Next() {
+			keys = append(keys, it.Key()+"="+it.Value())
+		}
+		return keys
+	}
+	yesterday := start.Add(-24 * time.Hour)
+	if got, want := collect(store.IteratorWrittenBetween(yesterday, time.Time{})), []string{"new=2", "updated=2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("IteratorWrittenBetween(yesterday, zero) = %v, want %v", got, want)
+	}
+	if got, want := collect(store.IteratorWrittenBetween(time.Time{}, yesterday)), []string{"old=1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("IteratorWrittenBetween(zero, yesterday) = %v, want %v", got, want)
+	}
+	store.Close()
+}
+
+func TestDiskStore_IteratorWithPrefix(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for _, key := range []string{"book:1", "author:1", "book:2", "books"} {
+		store.Set(key, key)
+	}
+	got := map[string]string{}
+	it := store.IteratorWithPrefix("book:")
+	for it.Next() {
+		got[it.Key()] = it.Value()
+	}
+	if err := it.Err(); err != nil {
+		t.Fatalf("iterator error = %v", err)
+	}
+	want := map[string]string{"book:1": "book:1", "book:2": "book:2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("IteratorWithPrefix(book:) = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,215 @@
+package caskdb
+
+import (
+	"strings"
+	"sync"
+)
+
+// keyDirShards is the number of shards keyDir is split into.
+const keyDirShards = 64
+
+// shardedKeyDir is keyDir, the in-memory index of all the keys, split into shards by
+// the hash of the key, each with its own lock and its own Index. The merge operands of
+// the keys live in the same shard as their keys.
+//
+// The writes already take DiskStore.mu exclusively, since they append to the same
+// file; on top of that, they take the lock of the key's shard to update it. A read of
+// a single key, like Get, does not take DiskStore.mu at all, only the read lock of the
+// key's shard, so it never waits for the writes of the other keys. The operations
+// over many keys, like Iterator, take the read lock of DiskStore.mu instead, which
+// keeps out all the writes while they look at the whole of keyDir, or take a view of
+// it, see view, and look at that without holding any lock.
+type shardedKeyDir struct {
+	shards   [keyDirShards]keyDirShard
+	newIndex func() Index
+}
+
+type keyDirShard struct {
+	mu      sync.RWMutex
+	entries Index
+	// merges keeps the merge operands of the keys which are yet to be folded
+	merges map[string]*pendingMerge
+	// shared is set while a view refers to the index and the merges of the shard,
+	// which must not be changed then, see own
+	shared bool
+}
+
+// replace replaces the keys of keyDir with the ones of other, which must not be
+// changed from then on, shard by shard.
+func (k *shardedKeyDir) replace(other *shardedKeyDir) {
+	for i := range k.shards {
+		s, from := &k.shards[i], &other.shards[i]
+		s.mu.Lock()
+		s.entries, s.merges, s.shared = from.entries, from.merges, false
+		s.mu.Unlock()
+	}
+}
+
+// newShardedKeyDir returns an empty keyDir, whose shards keep their keys in the
+// indexes made by newIndex.
+func newShardedKeyDir(newIndex func() Index) *shardedKeyDir {
+	k := &shardedKeyDir{newIndex: newIndex}
+	for i := range k.shards {
+		k.shards[i].entries = newIndex()
+		k.shards[i].merges = make(map[string]*pendingMerge)
+	}
+	return k
+}
+
+// shardIndex returns the index of the key's shard, using the FNV-1a hash of the key.
+func shardIndex(key string) int {
+	hash := uint32(2166136261)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint32(key[i])
+		hash *= 16777619
+	}
+	return int(hash % keyDirShards)
+}
+
+// shard returns the shard of the key.
+func (k *shardedKeyDir) shard(key string) *keyDirShard {
+	return &k.shards[shardIndex(key)]
+}
+
+// own makes the index and the merges of the shard safe to change: if a view shares
+// them, the shard switches to its own copies first. The pending merges are copied as
+// well, since they are changed in place. The caller must hold the write lock of the
+// shard, and must call own before every change to them. An index which implements
+// Cloner copies itself; the others are copied key by key.
+func (s *keyDirShard) own(newIndex func() Index) {
+	if !s.shared {
+		return
+	}
+	var entries Index
+	if cloner, ok := s.entries.(Cloner); ok {
+		entries = cloner.Clone()
+	} else {
+		entries = newIndex()
+		s.entries.Range(func(key string, keyEntry KeyEntry) bool {
+			entries.Put(key, keyEntry)
+			return true
+		})
+	}
+	merges := make(map[string]*pendingMerge, len(s.merges))
+	for key, m := range s.merges {
+		// the operands appended later go past the length of the view's copy
+		merge := *m
+		merge.operands = m.operands[:len(m.operands):len(m.operands)]
+		merges[key] = &merge
+	}
+	s.entries, s.merges, s.shared = entries, merges, false
+}
+
+// get returns the keyDir entry of the key. The caller must hold either DiskStore.mu
+// or the lock of the key's shard, and so for the rest of the methods.
+func (k *shardedKeyDir) get(key string) (KeyEntry, bool) {
+	return k.shard(key).entries.Get(key)
+}
+
+// merge returns the pending merge of the key, if it has one.
+func (k *shardedKeyDir) merge(key string) (*pendingMerge, bool) {
+	m, ok := k.shard(key).merges[key]
+	return m, ok
+}
+
+// len returns the number of keys, including the expired ones.
+func (k *shardedKeyDir) len() int {
+	n := 0
+	for i := range k.shards {
+		n += k.shards[i].entries.Len()
+	}
+	return n
+}
+
+// forEach calls fn with every key and its entry, in no particular order.
+func (k *shardedKeyDir) forEach(fn func(key string, keyEntry KeyEntry)) {
+	for i := range k.shards {
+		k.shards[i].entries.Range(func(key string, keyEntry KeyEntry) bool {
+			fn(key, keyEntry)
+			return true
+		})
+	}
+}
+
+// forEachPrefix calls fn with every key which starts with the prefix and its entry, in
+// no particular order. The shards with an OrderedIndex only visit the matching keys.
+func (k *shardedKeyDir) forEachPrefix(prefix string, fn func(key string, keyEntry KeyEntry)) {
+	for i := range k.shards {
+		visit := func(key string, keyEntry KeyEntry) bool {
+			if strings.HasPrefix(key, prefix) {
+				fn(key, keyEntry)
+			}
+			return true
+		}
+		if ordered, ok := k.shards[i].entries.(OrderedIndex); ok {
+			ordered.RangePrefix(prefix, visit)
+		} else {
+			k.shards[i].entries.Range(visit)
+		}
+	}
+}
+
+// forEachBetween calls fn with every key in [start, end) and its entry, in no
+// particular order; an empty end means there is no upper bound. The shards with an
+// OrderedIndex only visit the matching keys.
+func (k *shardedKeyDir) forEachBetween(start string, end string, fn func(key string, keyEntry KeyEntry)) {
+	for i := range k.shards {
+		if ordered, ok := k.shards[i].entries.(OrderedIndex); ok {
+			ordered.RangeFrom(start, func(key string, keyEntry KeyEntry) bool {
+				if end != "" && key >= end {
+					return false
+				}
+				fn(key, keyEntry)
+				return true
+			})
+			continue
+		}
+		k.shards[i].entries.Range(func(key string, keyEntry KeyEntry) bool {
+			if key >= start && (end == "" || key < end) {
+				fn(key, keyEntry)
+			}
+			return true
+		})
+	}
+}
+
+// keyDirView is a frozen copy of keyDir, taken by view. It is never changed, so it
+// can be read without any lock, while keyDir itself keeps changing.
+type keyDirView struct {
+	entries [keyDirShards]Index
+	merges  [keyDirShards]map[string]*pendingMerge
+}
+
+// view returns a view of keyDir as it is now. Nothing is copied up front: the shards
+// are only marked as shared, and the next change to each of them copies it, see
+// own. So taking a view is cheap, and the cost of the copy is spread over the writes
+// which come later. The caller must hold DiskStore.mu, in either mode, so that the
+// view is consistent across the shards.
+func (k *shardedKeyDir) view() *keyDirView {
+	v := &keyDirView{}
+	for i := range k.shards {
+		s := &k.shards[i]
+		s.mu.Lock()
+		s.shared = true
+		v.entries[i], v.merges[i] = s.entries, s.merges
+		s.mu.Unlock()
+	}
+	return v
+}
+
+// get returns the keyDir entry of the key, as it was when the view was taken.
+func (v *keyDirView) get(key string) (KeyEntry, bool) {
+	return v.entries[shardIndex(key)].Get(key)
+}
+
+// forEach calls fn with every key of the view, its entry and its pending merge, nil
+// if it has none, in no particular order. The pending merges must not be changed.
+func (v *keyDirView) forEach(fn func(key string, keyEntry KeyEntry, m *pendingMerge)) {
+	for i := range v.entries {
+		merges := v.merges[i]
+		v.entries[i].Range(func(key string, keyEntry KeyEntry) bool {
+			fn(key, keyEntry, merges[key])
+			return true
+		})
+	}
+}
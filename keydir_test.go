@@ -0,0 +1,83 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+)
+
+func Test_shardedKeyDir(t *testing.T) {
+	k := newShardedKeyDir(newMapIndex)
+	var want []string
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%v", i)
+		k.shard(key).entries.Put(key, KeyEntry{Offset: uint32(i)})
+		want = append(want, key)
+	}
+	if got := k.len(); got != len(want) {
+		t.Errorf("len() = %v, want %v", got, len(want))
+	}
+	if keyEntry, ok := k.get("key-42"); !ok || keyEntry.Offset != 42 {
+		t.Errorf("get(key-42) = %v, %v, want offset 42", keyEntry, ok)
+	}
+	if _, ok := k.get("missing"); ok {
+		t.Errorf("get(missing) = _, true, want false")
+	}
+	var got []string
+	k.forEach(func(key string, _ KeyEntry) {
+		got = append(got, key)
+	})
+	sort.Strings(got)
+	sort.Strings(want)
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("forEach() visited %v keys, want %v", len(got), len(want))
+	}
+	// the keys are spread over all the shards
+	for i := range k.shards {
+		if k.shards[i].entries.Len() == 0 {
+			t.Errorf("shard %v is empty", i)
+		}
+	}
+}
+
+func TestDiskStore_keyDirView(t *testing.T) {
+	store, err := NewDiskStoreWithOptions("test.db", Options{MergeOperator: joinOperator})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	store.Set("name", "jojo")
+	store.Set("stand", "star platinum")
+	store.Merge("log", "a")
+
+	store.mu.RLock()
+	view := store.keyDir.view()
+	store.mu.RUnlock()
+	store.Set("name", "dio")
+	store.Delete("stand")
+	store.Set("new", "key")
+	store.Merge("log", "b")
+
+	seen := make(map[string]bool)
+	view.forEach(func(key string, keyEntry KeyEntry, m *pendingMerge) {
+		seen[key] = true
+		if key == "log" && (m == nil || len(m.operands) != 1) {
+			t.Errorf("view has the merge %v of log, want one operand", m)
+		}
+	})
+	if len(seen) != 3 || !seen["name"] || !seen["stand"] || !seen["log"] {
+		t.Errorf("view has the keys %v, want name, stand and log", seen)
+	}
+	if _, ok := view.get("new"); ok {
+		t.Errorf("view.get(new) = _, true, want the key written after the view to be missing")
+	}
+	// the store itself moved on
+	if got, err := store.Get("log"); err != nil || got != "<nil>+a+b" {
+		t.Errorf("Get(log) = %v, %v, want <nil>+a+b", got, err)
+	}
+	if store.Has("stand") {
+		t.Errorf("Has(stand) = true after Delete")
+	}
+}
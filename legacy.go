@@ -0,0 +1,265 @@
+package caskdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// ErrLegacyFormat is returned when opening a store whose data file is in one of the
+// record layouts from before the records had checksums, see legacyLayout. Such a
+// store is not opened, rather than misread; Migrate copies it into a new store.
+var ErrLegacyFormat = errors.New("data file is in a legacy record layout, upgrade it with Migrate")
+
+// legacyLayout is one of the record layouts the data files had before FormatV1 got
+// its crc field; its value is the size of the record header. The first stores had
+// the header of timestamp, key_size and value_size alone:
+//
+//	┌───────────────┬──────────────┬────────────────┐
+//	│ timestamp(4B) │ key_size(4B) │ value_size(4B) │
+//	└───────────────┴──────────────┴────────────────┘
+//
+// and then the expiry came in after the timestamp:
+//
+//	┌───────────────┬────────────┬──────────────┬────────────────┐
+//	│ timestamp(4B) │ expiry(4B) │ key_size(4B) │ value_size(4B) │
+//	└───────────────┴────────────┴──────────────┴────────────────┘
+//
+// value_size has the record flags in its top bits, as in FormatV1. There was no file
+// header, nor segments, so such a store is the single data file.
+type legacyLayout int
+
+const (
+	legacyNoExpiry legacyLayout = 12
+	legacyExpiry   legacyLayout = 16
+)
+
+// decodeHeader decodes the record header of the layout at the start of data, which
+// must have at least as many bytes as the header.
+func (l legacyLayout) decodeHeader(data []byte) recordHeader {
+	h := recordHeader{timestamp: binary.BigEndian.Uint32(data[0:4]), length: int(l)}
+	fields := data[4:l]
+	if l == legacyExpiry {
+		h.expiry = binary.BigEndian.Uint32(fields[0:4])
+		fields = fields[4:]
+	}
+	h.keySize = binary.BigEndian.Uint32(fields[0:4])
+	h.valueSize = binary.BigEndian.Uint32(fields[4:8])
+	return h
+}
+
+// validFlags reports whether value_size has the record flags the layout could have:
+// a tombstone has no value, and the merge operands came along with the expiry.
+func (l legacyLayout) validFlags(valueSize uint32) bool {
+	switch valueSize & recordFlags {
+	case 0:
+		return true
+	case tombstoneFlag:
+		return valueLength(valueSize) == 0
+	case mergeFlag:
+		return l == legacyExpiry
+	}
+	return false
+}
+
+// walk reads the headers of the records of the layout in the file, one after the
+// other, and hands them to fn along with their offsets. It reports whether the
+// records end exactly at the end of the file: with no checksums, that is the only
+// way to tell a file in the layout, since the sizes of any other file send the walk
+// past its end sooner or later.
+func (l legacyLayout) walk(f *os.File, fileSize int64, fn func(offset int64, h recordHeader)) (bool, error) {
+	r := bufio.NewReader(io.NewSectionReader(f, 0, fileSize))
+	header := make([]byte, l)
+	offset := int64(0)
+	for fileSize-offset >= int64(l) {
+		if _, err := io.ReadFull(r, header); err != nil {
+			return false, err
+		}
+		h := l.decodeHeader(header)
+		if !l.validFlags(h.valueSize) || offset+h.recordSize() > fileSize {
+			return false, nil
+		}
+		if fn != nil {
+			fn(offset, h)
+		}
+		if _, err := r.Discard(int(h.recordSize()) - int(l)); err != nil {
+			return false, err
+		}
+		offset += h.recordSize()
+	}
+	return offset == fileSize && offset > 0, nil
+}
+
+// detectLegacyLayout returns the legacy layout the data file is in, or 0 if it is in
+// neither of them.
+func detectLegacyLayout(f *os.File, fileSize int64) (legacyLayout, error) {
+	for _, l := range []legacyLayout{legacyExpiry, legacyNoExpiry} {
+		ok, err := l.walk(f, fileSize, nil)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return l, nil
+		}
+	}
+	return 0, nil
+}
+
+// checkLegacyLayout returns an error wrapping ErrLegacyFormat if the data file is in
+// a legacy layout. It is called once the first record of a FormatV1 file turns out
+// not to be a valid record, so that such a file is reported as what it is, instead
+// of as corrupt, and is never truncated.
+func checkLegacyLayout(f *os.File, fileSize int64) error {
+	l, err := detectLegacyLayout(f, fileSize)
+	if err != nil {
+		return err
+	}
+	if l != 0 {
+		return fmt.Errorf("%w: %d byte record headers", ErrLegacyFormat, int(l))
+	}
+	return nil
+}
+
+// legacyStore reads a store in a legacy layout, for Migrate. Its keyDir is built as
+// the one of a DiskStore, from the records in the order of the file; the values are
+// read from the file when they are asked for.
+type legacyStore struct {
+	f      *os.File
+	layout legacyLayout
+	// keyDir has the base value and the pending merge operands of each key
+	keyDir        map[string]*pendingMerge
+	mergeOperator MergeOperator
+}
+
+// openLegacyStore opens the store at fileName, which must be in a legacy layout.
+func openLegacyStore(fileName string, mergeOperator MergeOperator) (*legacyStore, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+	s := &legacyStore{f: f, keyDir: make(map[string]*pendingMerge), mergeOperator: mergeOperator}
+	if err := s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *legacyStore) load() error {
+	info, err := s.f.Stat()
+	if err != nil {
+		return err
+	}
+	if s.layout, err = detectLegacyLayout(s.f, info.Size()); err != nil {
+		return err
+	}
+	if s.layout == 0 {
+		return fmt.Errorf("%w: not in a legacy layout", ErrCorruptRecord)
+	}
+	var keyBuffer []byte
+	var loadErr error
+	_, err = s.layout.walk(s.f, info.Size(), func(offset int64, h recordHeader) {
+		if loadErr != nil {
+			return
+		}
+		if cap(keyBuffer) < int(h.keySize) {
+			keyBuffer = make([]byte, h.keySize)
+		}
+		key := keyBuffer[:h.keySize]
+		if _, err := s.f.ReadAt(key, offset+int64(h.length)); err != nil {
+			loadErr = err
+			return
+		}
+		keyEntry := NewKeyEntry(h.timestamp, uint32(offset), uint32(h.recordSize()))
+		keyEntry.Expiry = h.expiry
+		switch {
+		case isTombstone(h.valueSize):
+			delete(s.keyDir, string(key))
+		case isMergeOperand(h.valueSize):
+			m, ok := s.keyDir[string(key)]
+			if !ok {
+				m = &pendingMerge{}
+				s.keyDir[string(key)] = m
+			}
+			m.operands = append(m.operands, keyEntry)
+		default:
+			s.keyDir[string(key)] = &pendingMerge{base: keyEntry, hasBase: true}
+		}
+	})
+	if loadErr != nil {
+		return loadErr
+	}
+	return err
+}
+
+// lastEntry returns the keyDir entry of the last record of the key.
+func lastEntry(m *pendingMerge) KeyEntry {
+	if len(m.operands) > 0 {
+		return m.operands[len(m.operands)-1]
+	}
+	return m.base
+}
+
+// Keys returns the live keys of the store.
+func (s *legacyStore) Keys() []string {
+	now := unixNow()
+	keys := make([]string, 0, len(s.keyDir))
+	for key, m := range s.keyDir {
+		if !lastEntry(m).isExpired(now) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+// GetWithMeta returns the value of the key, with the pending merge operands folded
+// into it, and the timestamp and expiry of its last record. There is no Metadata in
+// the legacy layouts.
+func (s *legacyStore) GetWithMeta(key string) (string, Meta, error) {
+	m, ok := s.keyDir[key]
+	if !ok || lastEntry(m).isExpired(unixNow()) {
+		return "", Meta{}, ErrKeyNotFound
+	}
+	meta := newMeta(lastEntry(m))
+	if len(m.operands) == 0 {
+		value, err := s.readValue(m.base)
+		return string(value), meta, err
+	}
+	if s.mergeOperator == nil {
+		return "", Meta{}, ErrNoMergeOperator
+	}
+	var base []byte
+	if m.hasBase {
+		var err error
+		if base, err = s.readValue(m.base); err != nil {
+			return "", Meta{}, err
+		}
+	}
+	operands := make([]string, len(m.operands))
+	for i, operandEntry := range m.operands {
+		operand, err := s.readValue(operandEntry)
+		if err != nil {
+			return "", Meta{}, err
+		}
+		operands[i] = string(operand)
+	}
+	value, err := s.mergeOperator(key, string(base), m.hasBase, operands)
+	return value, meta, err
+}
+
+// readValue reads the value of the record of keyEntry.
+func (s *legacyStore) readValue(keyEntry KeyEntry) ([]byte, error) {
+	record := make([]byte, keyEntry.Size)
+	if _, err := s.f.ReadAt(record, int64(keyEntry.Offset)); err != nil {
+		return nil, err
+	}
+	h := s.layout.decodeHeader(record)
+	return record[h.length+int(h.keySize):], nil
+}
+
+func (s *legacyStore) Close() error {
+	return s.f.Close()
+}
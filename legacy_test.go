@@ -0,0 +1,105 @@
+package caskdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// appendLegacyRecord encodes a record of the legacy layout at the end of dst, as the
+// stores of its time wrote it.
+func appendLegacyRecord(dst []byte, l legacyLayout, timestamp uint32, expiry uint32, key string, valueSize uint32, value string) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, timestamp)
+	if l == legacyExpiry {
+		dst = binary.BigEndian.AppendUint32(dst, expiry)
+	}
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(key)))
+	dst = binary.BigEndian.AppendUint32(dst, valueSize)
+	dst = append(dst, key...)
+	return append(dst, value...)
+}
+
+func TestNewDiskStore_legacyLayout(t *testing.T) {
+	for _, l := range []legacyLayout{legacyNoExpiry, legacyExpiry} {
+		fileName := filepath.Join(t.TempDir(), "test.db")
+		var data []byte
+		data = appendLegacyRecord(data, l, 100, 0, "othello", 11, "shakespeare")
+		data = appendLegacyRecord(data, l, 101, 0, "hamlet", 11, "shakespeare")
+		data = appendLegacyRecord(data, l, 102, 0, "othello", tombstoneFlag, "")
+		if err := os.WriteFile(fileName, data, 0644); err != nil {
+			t.Fatalf("failed to write the data file: %v", err)
+		}
+		for _, mode := range []CorruptionMode{FailOnCorruption, TruncateAtCorruption, SkipCorruptRecords} {
+			if _, err := NewDiskStoreWithOptions(fileName, Options{CorruptionMode: mode}); !errors.Is(err, ErrLegacyFormat) {
+				t.Errorf("NewDiskStore() of %v byte headers with %v error = %v, want %v", int(l), mode, err, ErrLegacyFormat)
+			}
+		}
+		if got, _ := os.ReadFile(fileName); string(got) != string(data) {
+			t.Errorf("NewDiskStore() changed the legacy data file")
+		}
+	}
+
+	// a file shorter than a header of FormatV1
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	os.WriteFile(fileName, appendLegacyRecord(nil, legacyNoExpiry, 100, 0, "a", 1, "b"), 0644)
+	if _, err := NewDiskStore(fileName); !errors.Is(err, ErrLegacyFormat) {
+		t.Errorf("NewDiskStore() of a short legacy file error = %v, want %v", err, ErrLegacyFormat)
+	}
+}
+
+func TestMigrate_legacyLayout(t *testing.T) {
+	now := uint32(time.Now().Unix())
+	tests := []struct {
+		layout legacyLayout
+		data   []byte
+		want   map[string]string
+	}{
+		{
+			legacyNoExpiry,
+			appendLegacyRecord(appendLegacyRecord(appendLegacyRecord(nil,
+				legacyNoExpiry, 100, 0, "othello", 11, "shakespeare"),
+				legacyNoExpiry, 101, 0, "emma", 6, "austen"),
+				legacyNoExpiry, 102, 0, "othello", tombstoneFlag, ""),
+			map[string]string{"emma": "austen"},
+		},
+		{
+			legacyExpiry,
+			appendLegacyRecord(appendLegacyRecord(appendLegacyRecord(appendLegacyRecord(nil,
+				legacyExpiry, 100, 0, "emma", 6, "austen"),
+				legacyExpiry, 101, now-10, "session", 4, "jojo"),
+				legacyExpiry, 102, 0, "emma", 2|mergeFlag, "!!"),
+				legacyExpiry, 103, now+3600, "lease", 4, "held"),
+			map[string]string{"emma": "austen+!!", "lease": "held"},
+		},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		oldPath, newPath := filepath.Join(dir, "old.db"), filepath.Join(dir, "new.db")
+		if err := os.WriteFile(oldPath, tt.data, 0644); err != nil {
+			t.Fatalf("failed to write the data file: %v", err)
+		}
+		opts := MigrateOptions{Options: Options{MergeOperator: joinOperator}}
+		if err := Migrate(oldPath, newPath, opts); err != nil {
+			t.Fatalf("Migrate() of %v byte headers error = %v", int(tt.layout), err)
+		}
+		store, err := NewDiskStoreWithOptions(newPath, Options{Format: FormatV2, MergeOperator: joinOperator})
+		if err != nil {
+			t.Fatalf("failed to open the new store: %v", err)
+		}
+		if n := store.Len(); n != len(tt.want) {
+			t.Errorf("Len() = %v, want %v", n, len(tt.want))
+		}
+		for key, want := range tt.want {
+			if got, err := store.Get(key); err != nil || got != want {
+				t.Errorf("Get(%v) = %v, %v, want %v", key, got, err, want)
+			}
+		}
+		if _, meta, _ := store.GetWithMeta("lease"); tt.layout == legacyExpiry && !meta.Expiry.Equal(time.Unix(int64(now+3600), 0)) {
+			t.Errorf("GetWithMeta(lease) expiry = %v, want the legacy expiry", meta.Expiry)
+		}
+		store.Close()
+	}
+}
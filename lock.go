@@ -0,0 +1,7 @@
+package caskdb
+
+import "errors"
+
+// ErrDatabaseLocked is returned when opening a store whose file is locked by another
+// store, most likely in another process
+var ErrDatabaseLocked = errors.New("database is locked by another process")
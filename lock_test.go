@@ -0,0 +1,41 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestDiskStore_Lock(t *testing.T) {
+	switch runtime.GOOS {
+	case "darwin", "dragonfly", "freebsd", "linux", "netbsd", "openbsd", "windows":
+	default:
+		t.Skip("file locking is not supported on " + runtime.GOOS)
+	}
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("name", "jojo")
+
+	if _, err := NewDiskStore("test.db"); !errors.Is(err, ErrDatabaseLocked) {
+		t.Errorf("NewDiskStore() of a locked file error = %v, want %v", err, ErrDatabaseLocked)
+	}
+	reader, err := NewDiskStoreWithOptions("test.db", Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("NewDiskStoreWithOptions() read-only of a locked file error = %v", err)
+	}
+	if got, err := reader.Get("name"); err != nil || got != "jojo" {
+		t.Errorf("Get() = %v, %v, want jojo", got, err)
+	}
+	reader.Close()
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("NewDiskStore() after Close() error = %v", err)
+	}
+	store.Close()
+}
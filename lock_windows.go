@@ -0,0 +1,34 @@
+//go:build windows
+
+package caskdb
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var procLockFileEx = syscall.NewLazyDLL("kernel32.dll").NewProc("LockFileEx")
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+	errorLockViolation      = syscall.Errno(33)
+)
+
+// lockFile takes an exclusive lock on the file with LockFileEx, without waiting for
+// it. It returns ErrDatabaseLocked if the lock is held by someone else. The lock is
+// released when the file is closed.
+func lockFile(f *os.File) error {
+	// the locks on windows are mandatory, so a byte far beyond the end of the file
+	// is locked instead of the data, which would block the reads of the other handles
+	ol := syscall.Overlapped{Offset: 0xffffffff, OffsetHigh: 0x7fffffff}
+	r, _, err := procLockFileEx.Call(f.Fd(), lockfileExclusiveLock|lockfileFailImmediately, 0, 1, 0, uintptr(unsafe.Pointer(&ol)))
+	if r != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return ErrDatabaseLocked
+	}
+	return err
+}
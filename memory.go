@@ -0,0 +1,115 @@
+package caskdb
+
+// The approximate sizes, in bytes, the estimates of the memory use go by, on a 64 bit
+// platform. They include the bookkeeping of the Go runtime, e.g. the buckets of a map
+// are less than full on average, but not the rounding of the allocations.
+const (
+	// mapEntryOverhead is what a key takes in a map[string]KeyEntry on top of its
+	// bytes: the string header, the KeyEntry and the share of its bucket
+	mapEntryOverhead = 96
+	// artNodeSize is the size of an artNode, without its slices
+	artNodeSize = 112
+	// packedSlotSize is the size of a packedSlot
+	packedSlotSize = 40
+	// sortedKeyOverhead is what a key takes in the sorted index of
+	// Options.SortedIndex: the string header, the bytes are shared with keyDir
+	sortedKeyOverhead = 16
+	// pendingMergeOverhead is what a pending merge takes on top of its operands: the
+	// pointer in the map, the map entry and the struct
+	pendingMergeOverhead = 96
+	// sparseKeyOverhead is what a key of the sparse index of a diskRun takes on top of
+	// its bytes: the string header and the offset
+	sparseKeyOverhead = 24
+)
+
+// MemoryEstimator is implemented by the indexes which can tell how much memory they
+// take. The store falls back to the estimate of a Go map for the other ones.
+type MemoryEstimator interface {
+	// EstimateMemory returns the approximate number of bytes the index takes,
+	// including the keys
+	EstimateMemory() int64
+}
+
+// EstimateIndexMemory returns the approximate number of bytes keyDir takes in the
+// memory: the keys and their entries in the indexes, the pending merge operands and
+// the sorted index, if any. Since all the keys have to be in the memory, this is what
+// grows with the store, while the values stay on the disk. It goes over all of keyDir
+// with the default index, so it is meant for the monitoring, not for every request.
+//
+// See EstimateIndexMemoryFor to predict the memory a store needs before filling it.
+func (d *DiskStore) EstimateIndexMemory() int64 {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	var total int64
+	for i := range d.keyDir.shards {
+		s := &d.keyDir.shards[i]
+		if estimator, ok := s.entries.(MemoryEstimator); ok {
+			total += estimator.EstimateMemory()
+		} else {
+			s.entries.Range(func(key string, _ KeyEntry) bool {
+				total += int64(len(key)) + mapEntryOverhead
+				return true
+			})
+		}
+		for key, m := range s.merges {
+			total += int64(len(key)) + pendingMergeOverhead + int64(cap(m.operands))*keyEntrySize
+		}
+	}
+	if d.sorted != nil {
+		total += int64(cap(d.sorted.keys)) * sortedKeyOverhead
+	}
+	return total
+}
+
+// EstimateIndexMemoryFor returns the approximate number of bytes keyDir would take
+// with the given number of keys of the given average size, with the default index and
+// without the sorted index, so that the capacity planners can tell ahead whether the
+// keys fit in the RAM they have.
+func EstimateIndexMemoryFor(keys int64, avgKeySize int64) int64 {
+	return keys * (avgKeySize + mapEntryOverhead)
+}
+
+func (m mapIndex) EstimateMemory() int64 {
+	var total int64
+	for key := range m {
+		total += int64(len(key)) + mapEntryOverhead
+	}
+	return total
+}
+
+func (t *artIndex) EstimateMemory() int64 {
+	if t.root == nil {
+		return 0
+	}
+	return t.root.estimateMemory()
+}
+
+func (n *artNode) estimateMemory() int64 {
+	total := int64(artNodeSize + cap(n.prefix) + cap(n.keys) + cap(n.children)*8)
+	if n.index != nil {
+		total += int64(len(n.index))
+	}
+	n.eachChild(0, func(_ byte, child *artNode) bool {
+		total += child.estimateMemory()
+		return true
+	})
+	return total
+}
+
+func (p *packedIndex) EstimateMemory() int64 {
+	return int64(cap(p.slots))*packedSlotSize + int64(cap(p.arena))
+}
+
+func (x *diskIndex) EstimateMemory() int64 {
+	var total int64
+	for key := range x.delta {
+		total += int64(len(key)) + mapEntryOverhead
+	}
+	for _, run := range x.runs {
+		for _, key := range run.firstKeys {
+			total += int64(len(key)) + sparseKeyOverhead
+		}
+		total += int64(cap(run.filter.bits)) * 8
+	}
+	return total
+}
@@ -8,14 +8,24 @@ func NewMemoryStore() *MemoryStore {
 	return &MemoryStore{make(map[string]string)}
 }
 
-func (m *MemoryStore) Get(key string) string {
-	return m.data[key]
+func (m *MemoryStore) Get(key string) (string, error) {
+	value, ok := m.data[key]
+	if !ok {
+		return "", ErrKeyNotFound
+	}
+	return value, nil
 }
 
-func (m *MemoryStore) Set(key string, value string) {
+func (m *MemoryStore) Set(key string, value string) error {
 	m.data[key] = value
+	return nil
 }
 
-func (m *MemoryStore) Close() bool {
-	return true
+func (m *MemoryStore) Delete(key string) error {
+	delete(m.data, key)
+	return nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
 }
@@ -1,25 +1,39 @@
 package caskdb
 
-import "testing"
+import (
+	"errors"
+	"testing"
+)
 
 func TestMemoryStore_Get(t *testing.T) {
 	store := NewMemoryStore()
 	store.Set("name", "jojo")
-	if val := store.Get("name"); val != "jojo" {
-		t.Errorf("Get() = %v, want %v", val, "jojo")
+	if val, err := store.Get("name"); err != nil || val != "jojo" {
+		t.Errorf("Get() = %v, %v, want %v", val, err, "jojo")
 	}
 }
 
 func TestMemoryStore_InvalidGet(t *testing.T) {
 	store := NewMemoryStore()
-	if val := store.Get("some rando key"); val != "" {
-		t.Errorf("Get() = %v, want %v", val, "")
+	if val, err := store.Get("some rando key"); !errors.Is(err, ErrKeyNotFound) || val != "" {
+		t.Errorf("Get() = %v, %v, want '', %v", val, err, ErrKeyNotFound)
 	}
 }
 
 func TestMemoryStore_Close(t *testing.T) {
 	store := NewMemoryStore()
-	if !store.Close() {
-		t.Errorf("Close() failed")
+	if err := store.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
+
+func TestMemoryStore_Delete(t *testing.T) {
+	store := NewMemoryStore()
+	store.Set("name", "jojo")
+	if err := store.Delete("name"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	if _, err := store.Get("name"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() error = %v, want %v", err, ErrKeyNotFound)
 	}
 }
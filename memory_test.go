@@ -0,0 +1,47 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestDiskStore_EstimateIndexMemory(t *testing.T) {
+	for name, newIndex := range map[string]func() Index{"map": newMapIndex, "art": NewARTIndex, "packed": NewPackedIndex} {
+		t.Run(name, func(t *testing.T) {
+			store, err := NewDiskStoreWithOptions("test.db", Options{NewIndex: newIndex})
+			if err != nil {
+				t.Fatalf("failed to create disk store: %v", err)
+			}
+			defer os.Remove("test.db")
+			defer store.Close()
+
+			empty := store.EstimateIndexMemory()
+			const keys = 1000
+			for i := 0; i < keys; i++ {
+				store.Set(fmt.Sprintf("user:%06d", i), "value")
+			}
+			full := store.EstimateIndexMemory()
+			// the keys alone take 11 bytes each, and no index is that lean
+			if full-empty < keys*11 || full-empty > keys*1000 {
+				t.Errorf("EstimateIndexMemory() grew by %v bytes for %v keys", full-empty, keys)
+			}
+		})
+	}
+}
+
+func TestEstimateIndexMemoryFor(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+	for i := 0; i < 100; i++ {
+		store.Set(fmt.Sprintf("key-%05d", i), "value")
+	}
+	// the prediction matches what the store reports for the same keys
+	if got, want := EstimateIndexMemoryFor(100, 9), store.EstimateIndexMemory(); got != want {
+		t.Errorf("EstimateIndexMemoryFor(100, 9) = %v, want %v", got, want)
+	}
+}
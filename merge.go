@@ -0,0 +1,126 @@
+package caskdb
+
+import "errors"
+
+// ErrNoMergeOperator is returned when a key with merge operands is written or read
+// without Options.MergeOperator being set
+var ErrNoMergeOperator = errors.New("no merge operator")
+
+// MergeOperator folds the merge operands of a key into its value. It is called with
+// the key, its base value (exists is false if the key had no value before the
+// operands) and all the operands in the order they were merged. The returned value
+// becomes the value of the key.
+//
+// A counter for example, stores the deltas as operands and sums them up:
+//
+//	func(key, base string, exists bool, operands []string) (string, error) {
+//		total, _ := strconv.Atoi(base)
+//		for _, op := range operands {
+//			delta, _ := strconv.Atoi(op)
+//			total += delta
+//		}
+//		return strconv.Itoa(total), nil
+//	}
+type MergeOperator func(key string, base string, exists bool, operands []string) (string, error)
+
+// pendingMerge keeps track of the merge operands of a key which are yet to be folded
+// into its value. While a key has pending operands, its keyDir entry points to the
+// latest operand and the base value, if any, is kept here.
+type pendingMerge struct {
+	base     KeyEntry
+	hasBase  bool
+	operands []KeyEntry
+}
+
+// Merge appends a merge operand for the key, like RocksDB's merge. Instead of reading
+// the value, updating it and writing the whole of it back, only the small operand is
+// written. The operands are folded into the value by Options.MergeOperator whenever
+// the key is read. Any write which replaces the value, like Set or Delete, discards
+// the pending operands. The expiry of the key, if any, is kept.
+func (d *DiskStore) Merge(key string, operand string) error {
+	if d.opts.MergeOperator == nil {
+		return ErrNoMergeOperator
+	}
+	if err := checkValueSize(len(operand)); err != nil {
+		return err
+	}
+	return d.execKeys([]string{key}, func() error {
+		return d.merge(key, operand)
+	})
+}
+
+func (d *DiskStore) merge(key string, operand string) error {
+	keyEntry, ok := d.lookup(key)
+	if !ok {
+		// the key might still be around in keyDir, if it has expired
+		d.removeKeyEntry(key)
+	}
+	timestamp := unixNow()
+	encoded := d.appendMergeOperand(nil, timestamp, keyEntry.Expiry, key, operand)
+	fileID, offset, err := d.write(encoded)
+	if err != nil {
+		return err
+	}
+	operandEntry := NewKeyEntry(timestamp, offset, uint32(len(encoded)))
+	operandEntry.FileID = fileID
+	operandEntry.Expiry = keyEntry.Expiry
+	d.deferRecord(key, operandEntry, scanOperand)
+	return nil
+}
+
+// addMergeOperand records a merge operand of the key which has been written to the
+// file.
+func (d *DiskStore) addMergeOperand(key string, operandEntry KeyEntry) {
+	s := d.keyDir.shard(key)
+	s.mu.Lock()
+	s.own(d.keyDir.newIndex)
+	m, ok := s.merges[key]
+	if !ok {
+		m = &pendingMerge{}
+		m.base, m.hasBase = s.entries.Get(key)
+		s.merges[key] = m
+	}
+	m.operands = append(m.operands, operandEntry)
+	s.entries.Put(key, operandEntry)
+	d.cache.remove(key)
+	s.mu.Unlock()
+	if !ok && !m.hasBase && d.sorted != nil {
+		d.sorted.insert(key)
+	}
+	d.trackEntry(operandEntry)
+}
+
+// getMerged reads the base value and all the operands of the key, and folds them
+// into the current value.
+func (d *DiskStore) getMerged(key string, m *pendingMerge) ([]byte, error) {
+	return d.foldMerge(key, m, func(keyEntry KeyEntry) ([]byte, error) {
+		return d.readValue(key, keyEntry)
+	})
+}
+
+// foldMerge is getMerged with the values read by the given func.
+func (d *DiskStore) foldMerge(key string, m *pendingMerge, read func(KeyEntry) ([]byte, error)) ([]byte, error) {
+	if d.opts.MergeOperator == nil {
+		return nil, ErrNoMergeOperator
+	}
+	var base []byte
+	if m.hasBase {
+		var err error
+		if base, err = read(m.base); err != nil {
+			return nil, err
+		}
+	}
+	operands := make([]string, len(m.operands))
+	for i, operandEntry := range m.operands {
+		operand, err := read(operandEntry)
+		if err != nil {
+			return nil, err
+		}
+		operands[i] = string(operand)
+	}
+	value, err := d.opts.MergeOperator(key, string(base), m.hasBase, operands)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(value), nil
+}
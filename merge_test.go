@@ -0,0 +1,89 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func joinOperator(key string, base string, exists bool, operands []string) (string, error) {
+	if !exists {
+		base = "<nil>"
+	}
+	return base + "+" + strings.Join(operands, "+"), nil
+}
+
+func TestDiskStore_Merge(t *testing.T) {
+	opts := Options{MergeOperator: joinOperator}
+	store, err := NewDiskStoreWithOptions("test.db", opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.Set("tags", "a")
+	for _, operand := range []string{"b", "c"} {
+		if err := store.Merge("tags", operand); err != nil {
+			t.Fatalf("Merge() error = %v", err)
+		}
+	}
+	store.Merge("new", "x")
+	store.Merge("reset", "x")
+	store.Set("reset", "y")
+	store.Merge("deleted", "x")
+	store.Delete("deleted")
+
+	check := func() {
+		want := map[string]string{
+			"tags":  "a+b+c",
+			"new":   "<nil>+x",
+			"reset": "y",
+		}
+		for key, val := range want {
+			if got, err := store.Get(key); err != nil || got != val {
+				t.Errorf("Get(%v) = %v, %v, want %v", key, got, err, val)
+			}
+		}
+		if got, err := store.GetMulti([]string{"tags", "reset"}); err != nil || got["tags"] != "a+b+c" || got["reset"] != "y" {
+			t.Errorf("GetMulti() = %v, %v, want tags:a+b+c reset:y", got, err)
+		}
+		if store.Has("deleted") {
+			t.Errorf("Has() = true, want false")
+		}
+		if store.Len() != 3 {
+			t.Errorf("Len() = %v, want 3", store.Len())
+		}
+	}
+	check()
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions("test.db", opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	check()
+	store.Close()
+}
+
+func TestDiskStore_MergeWithoutOperator(t *testing.T) {
+	store, err := NewDiskStoreWithOptions("test.db", Options{MergeOperator: joinOperator})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Merge("tags", "a")
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if err := store.Merge("tags", "b"); !errors.Is(err, ErrNoMergeOperator) {
+		t.Errorf("Merge() error = %v, want %v", err, ErrNoMergeOperator)
+	}
+	if _, err := store.Get("tags"); !errors.Is(err, ErrNoMergeOperator) {
+		t.Errorf("Get() error = %v, want %v", err, ErrNoMergeOperator)
+	}
+	store.Close()
+}
@@ -0,0 +1,129 @@
+package caskdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrMetadataTooLarge is returned by SetWithMeta for a Metadata which takes more
+	// than 255 bytes once encoded.
+	ErrMetadataTooLarge = errors.New("metadata is too large")
+	// ErrMetadataUnsupported is returned by SetWithMeta when Options.Format is not
+	// FormatV2, the only format with the room for the metadata in its records.
+	ErrMetadataUnsupported = errors.New("metadata needs FormatV2")
+)
+
+// Metadata is what an application keeps about a value, in its record next to it
+// rather than encoded into the value itself, see SetWithMeta. All the fields are
+// optional.
+type Metadata struct {
+	// ContentType is the media type of the value, e.g. "application/json"
+	ContentType string
+	// Encoding is how the value is encoded on top of its content type, e.g. "gzip"
+	Encoding string
+	// Tag is for the application to use as it sees fit, e.g. for a version or an ETag
+	Tag string
+}
+
+// maxMetadataSize is the size of the largest encoded Metadata, whose size is kept in
+// a byte of the record header, see appendHeader.
+const maxMetadataSize = 255
+
+// encode returns the Metadata encoded as the record header keeps it: each field as
+// its length, as a uvarint, followed by its bytes, in order. The empty Metadata is
+// encoded as nothing, so that the records without metadata do not pay for it.
+func (m Metadata) encode() ([]byte, error) {
+	if m == (Metadata{}) {
+		return nil, nil
+	}
+	var meta []byte
+	for _, field := range [...]string{m.ContentType, m.Encoding, m.Tag} {
+		meta = binary.AppendUvarint(meta, uint64(len(field)))
+		meta = append(meta, field...)
+	}
+	if len(meta) > maxMetadataSize {
+		return nil, fmt.Errorf("%w: %d bytes, at most %d", ErrMetadataTooLarge, len(meta), maxMetadataSize)
+	}
+	return meta, nil
+}
+
+// decodeMetadata decodes the encoded Metadata of a record. The fields missing at the
+// end are empty, and the ones after Tag, which a later version may add, are ignored.
+func decodeMetadata(meta []byte) (Metadata, error) {
+	var fields [3]string
+	for i := 0; i < len(fields) && len(meta) > 0; i++ {
+		n, k := binary.Uvarint(meta)
+		if k <= 0 || n > uint64(len(meta)-k) {
+			return Metadata{}, ErrCorruptRecord
+		}
+		fields[i] = string(meta[k : k+int(n)])
+		meta = meta[k+int(n):]
+	}
+	return Metadata{ContentType: fields[0], Encoding: fields[1], Tag: fields[2]}, nil
+}
+
+// SetWithMeta is the same as Set, but stores the metadata along with the value,
+// which GetWithMeta returns. Any later write of the value, Set included, replaces the
+// metadata as well, while Touch, Persist and the compactions keep it. It returns
+// ErrMetadataUnsupported unless Options.Format is FormatV2.
+func (d *DiskStore) SetWithMeta(key string, value string, meta Metadata) error {
+	encoded, err := meta.encode()
+	if err != nil {
+		return err
+	}
+	if encoded != nil && d.opts.Format != FormatV2 {
+		return ErrMetadataUnsupported
+	}
+	if err := checkValueSize(len(value)); err != nil {
+		return err
+	}
+	return d.execKeys(nil, func() error {
+		timestamp := unixNow()
+		buf := getBuffer(maxHeaderSize + len(encoded) + len(key) + len(value))
+		defer putBuffer(buf)
+		record, err := d.appendEntry(*buf, timestamp, 0, key, []byte(value), encoded)
+		if err != nil {
+			return err
+		}
+		*buf = record
+		return d.writeKV(key, timestamp, 0, *buf)
+	})
+}
+
+// valueEntry returns the keyDir entry of the record with the key's value, whose
+// metadata is the key's: the base value of the pending merge operands, if there are
+// any.
+func (d *DiskStore) valueEntry(key string) (KeyEntry, bool) {
+	if m, ok := d.keyDir.merge(key); ok {
+		return m.base, m.hasBase
+	}
+	return d.keyDir.get(key)
+}
+
+// readMetadata returns the encoded Metadata of the record keyEntry points to, if it
+// has any. Only the record header is read, so the checksum is not verified, as with
+// GetRange.
+func (d *DiskStore) readMetadata(keyEntry KeyEntry) ([]byte, error) {
+	format := d.fileFormat(keyEntry.FileID)
+	if format != FormatV2 {
+		return nil, nil
+	}
+	n := maxHeaderSize + maxMetadataSize
+	if n > int(keyEntry.Size) {
+		n = int(keyEntry.Size)
+	}
+	buf := make([]byte, n)
+	if err := d.readAt(keyEntry.FileID, buf, int64(keyEntry.Offset)); err != nil {
+		return nil, err
+	}
+	h, err := format.decodeHeader(buf)
+	if err != nil || h.length > n || h.recordSize() != int64(keyEntry.Size) {
+		return nil, ErrCorruptRecord
+	}
+	if h.metaSize == 0 {
+		return nil, nil
+	}
+	return buf[h.length-h.metaSize : h.length], nil
+}
@@ -0,0 +1,102 @@
+package caskdb
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetadata_encode(t *testing.T) {
+	tests := []Metadata{
+		{},
+		{ContentType: "application/json"},
+		{ContentType: "text/plain", Encoding: "gzip", Tag: "v2"},
+		{Tag: strings.Repeat("t", 200)},
+	}
+	for _, meta := range tests {
+		encoded, err := meta.encode()
+		if err != nil {
+			t.Fatalf("encode(%+v) error = %v", meta, err)
+		}
+		if got, err := decodeMetadata(encoded); err != nil || got != meta {
+			t.Errorf("decodeMetadata(encode(%+v)) = %+v, %v", meta, got, err)
+		}
+	}
+	if _, err := (Metadata{Tag: strings.Repeat("t", 256)}).encode(); !errors.Is(err, ErrMetadataTooLarge) {
+		t.Errorf("encode() error = %v, want %v", err, ErrMetadataTooLarge)
+	}
+	if _, err := decodeMetadata([]byte{5, 'a'}); err != ErrCorruptRecord {
+		t.Errorf("decodeMetadata() error = %v, want %v", err, ErrCorruptRecord)
+	}
+}
+
+func TestDiskStore_SetWithMeta(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{Format: FormatV2, ValueLogThreshold: 1024}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	meta := Metadata{ContentType: "application/json", Encoding: "identity", Tag: "etag-1"}
+	if err := store.SetWithMeta("book", `{"title": "Dune"}`, meta); err != nil {
+		t.Fatalf("SetWithMeta() error = %v", err)
+	}
+	if err := store.SetWithMeta("big", bigValue(1), meta); err != nil {
+		t.Fatalf("SetWithMeta() error = %v", err)
+	}
+	store.Set("plain", "value")
+	if err := store.Touch("book", time.Hour); err != nil {
+		t.Fatalf("Touch() error = %v", err)
+	}
+
+	check := func() {
+		t.Helper()
+		for key, value := range map[string]string{"book": `{"title": "Dune"}`, "big": bigValue(1)} {
+			got, gotMeta, err := store.GetWithMeta(key)
+			if err != nil || got != value || gotMeta.Metadata != meta {
+				t.Errorf("GetWithMeta(%v) = %v, %+v, %v, want %v, %+v", key, got, gotMeta.Metadata, err, value, meta)
+			}
+		}
+		if _, gotMeta, err := store.GetWithMeta("plain"); err != nil || gotMeta.Metadata != (Metadata{}) {
+			t.Errorf("GetWithMeta(plain) = %+v, %v, want no metadata", gotMeta.Metadata, err)
+		}
+		if got, err := store.GetRange("book", 2, 5); err != nil || string(got) != "title" {
+			t.Errorf("GetRange(book) = %q, %v, want %q", got, err, "title")
+		}
+	}
+	check()
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	check()
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	check()
+
+	// a write of the value replaces the metadata
+	store.Set("book", "value")
+	if _, gotMeta, err := store.GetWithMeta("book"); err != nil || gotMeta.Metadata != (Metadata{}) {
+		t.Errorf("GetWithMeta(book) = %+v, %v, want no metadata", gotMeta.Metadata, err)
+	}
+}
+
+func TestDiskStore_SetWithMeta_formatV1(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	if err := store.SetWithMeta("book", "value", Metadata{Tag: "v1"}); err != ErrMetadataUnsupported {
+		t.Errorf("SetWithMeta() error = %v, want %v", err, ErrMetadataUnsupported)
+	}
+	if err := store.SetWithMeta("book", "value", Metadata{}); err != nil {
+		t.Errorf("SetWithMeta() with no metadata error = %v", err)
+	}
+}
@@ -0,0 +1,164 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+)
+
+// ErrMigrationMismatch is returned by Migrate when the new store, read back from the
+// disk, does not have the same keys, values and expiries as the old one.
+var ErrMigrationMismatch = errors.New("migrated store does not match the original")
+
+// MigrateOptions are the options of Migrate.
+type MigrateOptions struct {
+	// Options are the options of the new store. The old store is opened with them as
+	// well, read-only, so they must have the MergeOperator and the EncryptionKeys it
+	// needs. Format defaults to FormatV2 rather than FormatV1, which is the point of
+	// a migration.
+	Options Options
+}
+
+// Migrate copies the store at oldPath into a new store at newPath, with the records
+// in MigrateOptions.Options.Format, compressed and encrypted as its options say. Only
+// the live keys are copied, with their timestamps, expiries and metadata; the pending
+// merge operands are folded into the values. Once copied, the new store is opened
+// again and checked key by key against the old one, and ErrMigrationMismatch is
+// returned if they differ.
+//
+// A store written before the records had checksums, in one of the legacy layouts
+// which the stores refuse to open with ErrLegacyFormat, is migrated the same way;
+// it has no metadata.
+//
+// The old store is only read, so it can still be used if the migration fails; the
+// new one is then left as it is, and has to be removed before trying again, since
+// Migrate does not write over an existing store. Nothing must write to the old store
+// while it runs. The metadata is dropped when migrating to FormatV1.
+func Migrate(oldPath, newPath string, opts MigrateOptions) error {
+	if isFileExists(newPath) {
+		return fmt.Errorf("migrate to %s: %w", newPath, fs.ErrExist)
+	}
+	options := opts.Options
+	if options.Format == 0 {
+		options.Format = FormatV2
+	}
+	sourceOptions := options
+	sourceOptions.ReadOnly = true
+	source, err := openMigrationSource(oldPath, sourceOptions)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", oldPath, err)
+	}
+	defer source.Close()
+
+	// the new store is synced once, when it is all written
+	targetOptions := options
+	targetOptions.ReadOnly, targetOptions.SyncPolicy = false, SyncNever
+	target, err := NewDiskStoreWithOptions(newPath, targetOptions)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", newPath, err)
+	}
+	keys := source.Keys()
+	for _, key := range keys {
+		if err := target.migrateKey(source, key); err != nil {
+			target.Close()
+			return fmt.Errorf("failed to migrate %q: %w", key, err)
+		}
+	}
+	if err := target.Sync(); err != nil {
+		target.Close()
+		return err
+	}
+	if err := target.Close(); err != nil {
+		return err
+	}
+
+	target, err = NewDiskStoreWithOptions(newPath, sourceOptions)
+	if err != nil {
+		return fmt.Errorf("failed to reopen %s: %w", newPath, err)
+	}
+	defer target.Close()
+	return verifyMigration(source, target, keys, options.Format)
+}
+
+// migrationSource is the store Migrate copies from: a DiskStore, or a legacyStore for
+// a store in a legacy layout.
+type migrationSource interface {
+	Keys() []string
+	GetWithMeta(key string) (string, Meta, error)
+	Close() error
+}
+
+// openMigrationSource opens the store at path, read-only, with the given options,
+// or as a legacyStore if it is in a legacy layout.
+func openMigrationSource(path string, opts Options) (migrationSource, error) {
+	store, err := NewDiskStoreWithOptions(path, opts)
+	if errors.Is(err, ErrLegacyFormat) {
+		return openLegacyStore(path, opts.MergeOperator)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// migrateKey copies the key's value, and the rest of its record, from the source
+// store.
+func (d *DiskStore) migrateKey(source migrationSource, key string) error {
+	value, meta, err := source.GetWithMeta(key)
+	if errors.Is(err, ErrKeyNotFound) {
+		// it expired meanwhile
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	encodedMeta, err := meta.Metadata.encode()
+	if err != nil {
+		return err
+	}
+	if d.opts.Format != FormatV2 {
+		encodedMeta = nil
+	}
+	timestamp, expiry := uint32(meta.Timestamp.Unix()), uint32(0)
+	if !meta.Expiry.IsZero() {
+		expiry = uint32(meta.Expiry.Unix())
+	}
+	return d.execKeys(nil, func() error {
+		record, err := d.appendEntry(nil, timestamp, expiry, key, []byte(value), encodedMeta)
+		if err != nil {
+			return err
+		}
+		return d.writeKV(key, timestamp, expiry, record)
+	})
+}
+
+// verifyMigration checks that the target store has the same keys as the source, with
+// the same values, expiries and, unless the target is in FormatV1, metadata, leaving
+// out the keys which have expired since they were copied.
+func verifyMigration(source migrationSource, target *DiskStore, keys []string, format Format) error {
+	count := 0
+	for _, key := range keys {
+		value, meta, err := source.GetWithMeta(key)
+		if errors.Is(err, ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		count++
+		got, gotMeta, err := target.GetWithMeta(key)
+		if err != nil {
+			return fmt.Errorf("%w: %q: %v", ErrMigrationMismatch, key, err)
+		}
+		if format != FormatV2 {
+			meta.Metadata = Metadata{}
+		}
+		if got != value || !gotMeta.Expiry.Equal(meta.Expiry) || gotMeta.Metadata != meta.Metadata {
+			return fmt.Errorf("%w: %q", ErrMigrationMismatch, key)
+		}
+	}
+	if n := len(target.Keys()); n != count {
+		return fmt.Errorf("%w: %d keys, want %d", ErrMigrationMismatch, n, count)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	oldPath, newPath := filepath.Join(dir, "old.db"), filepath.Join(dir, "new.db")
+	store, err := NewDiskStoreWithOptions(oldPath, Options{MergeOperator: joinOperator, MaxSegmentSize: 4096})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		store.Set(fmt.Sprintf("book:%d", i), jsonValue(i))
+	}
+	store.Delete("book:7")
+	store.SetWithTTL("session", "jojo", time.Hour)
+	store.Merge("book:3", "operand")
+	_, sessionMeta, _ := store.GetWithMeta("session")
+	store.Close()
+
+	opts := MigrateOptions{Options: Options{MergeOperator: joinOperator, Compression: Snappy, CompressionMinSize: 32}}
+	if err := Migrate(oldPath, newPath, opts); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	f, err := os.Open(newPath)
+	if err != nil {
+		t.Fatalf("failed to open the new store: %v", err)
+	}
+	format, err := readFormat(f)
+	f.Close()
+	if err != nil || format != FormatV2 {
+		t.Errorf("format of the new store = %v, %v, want %v", format, err, FormatV2)
+	}
+
+	store, err = NewDiskStoreWithOptions(newPath, Options{Format: FormatV2})
+	if err != nil {
+		t.Fatalf("failed to open the new store: %v", err)
+	}
+	defer store.Close()
+	if n := store.Len(); n != 100 {
+		t.Errorf("Len() = %v, want 100", n)
+	}
+	if got, err := store.Get("book:3"); err != nil || got != jsonValue(3)+"+operand" {
+		t.Errorf("Get(book:3) = %v, %v, want the operand folded in", got, err)
+	}
+	if store.Has("book:7") {
+		t.Errorf("Has(book:7) = true, want the deleted key left out")
+	}
+	if _, meta, err := store.GetWithMeta("session"); err != nil || !meta.Expiry.Equal(sessionMeta.Expiry) || !meta.Timestamp.Equal(sessionMeta.Timestamp) {
+		t.Errorf("GetWithMeta(session) = %+v, %v, want %+v", meta, err, sessionMeta)
+	}
+	if got, err := store.Get("book:50"); err != nil || got != jsonValue(50) {
+		t.Errorf("Get(book:50) = %v, %v, want %v", got, err, jsonValue(50))
+	}
+
+	if err := Migrate(oldPath, newPath, opts); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("Migrate() over an existing store error = %v, want %v", err, fs.ErrExist)
+	}
+}
+
+func TestMigrate_metadata(t *testing.T) {
+	dir := t.TempDir()
+	oldPath, newPath := filepath.Join(dir, "old.db"), filepath.Join(dir, "new.db")
+	store, err := NewDiskStoreWithOptions(oldPath, Options{Format: FormatV2})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	meta := Metadata{ContentType: "application/json", Tag: "v1"}
+	store.SetWithMeta("book", jsonValue(1), meta)
+	store.Close()
+
+	keys := []EncryptionKey{testKey(1)}
+	if err := Migrate(oldPath, newPath, MigrateOptions{Options: Options{EncryptionKeys: keys}}); err != nil {
+		t.Fatalf("Migrate() error = %v", err)
+	}
+	store, err = NewDiskStoreWithOptions(newPath, Options{Format: FormatV2, EncryptionKeys: keys})
+	if err != nil {
+		t.Fatalf("failed to open the new store: %v", err)
+	}
+	defer store.Close()
+	if got, gotMeta, err := store.GetWithMeta("book"); err != nil || got != jsonValue(1) || gotMeta.Metadata != meta {
+		t.Errorf("GetWithMeta(book) = %v, %+v, %v, want %v, %+v", got, gotMeta.Metadata, err, jsonValue(1), meta)
+	}
+}
@@ -0,0 +1,42 @@
+package caskdb
+
+// mapFile maps the sealed data file for Options.MmapReads, so that readAt copies its
+// records out of the mapping instead of making a syscall for each. A file which
+// cannot be mapped, e.g. an empty one or on a platform without mmap, is left to be
+// read with pread. The caller must hold mu; the sealed files never change, so the
+// mapping stays valid until unmapFile.
+func (d *DiskStore) mapFile(fileID uint32) {
+	if !d.opts.MmapReads {
+		return
+	}
+	d.filesMu.RLock()
+	f, ok := d.readers[fileID]
+	_, mapped := d.mmaps[fileID]
+	d.filesMu.RUnlock()
+	if !ok || mapped {
+		return
+	}
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 || int64(int(info.Size())) != info.Size() {
+		return
+	}
+	data, err := mmapFile(f, info.Size())
+	if err != nil {
+		d.opts.Logger.Printf("caskdb: reading data file %d without mmap: %v", fileID, err)
+		return
+	}
+	d.filesMu.Lock()
+	d.mmaps[fileID] = data
+	d.filesMu.Unlock()
+}
+
+// unmapFile removes the mapping of the data file, if it has one. The caller must hold
+// filesMu for writing, so that no read is copying out of the mapping.
+func (d *DiskStore) unmapFile(fileID uint32) error {
+	data, ok := d.mmaps[fileID]
+	if !ok {
+		return nil
+	}
+	delete(d.mmaps, fileID)
+	return munmapFile(data)
+}
@@ -0,0 +1,18 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+
+package caskdb
+
+import (
+	"errors"
+	"os"
+)
+
+// mmapFile is not supported on the other platforms; the files are read with pread
+// there, even with Options.MmapReads.
+func mmapFile(f *os.File, size int64) ([]byte, error) {
+	return nil, errors.New("mmap is not supported on this platform")
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
@@ -0,0 +1,60 @@
+package caskdb
+
+import (
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestDiskStore_MmapReads(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	recordSize := int64(headerSize + len("k0") + len("v0"))
+	opts := Options{MaxSegmentSize: 2 * recordSize, MergeOperator: joinOperator, MmapReads: true}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	fillSegments(t, store)
+	want := map[string]string{"k0": "v3", "k2": "v5", "k3": "v4", "tags": "<nil>+a+b"}
+	check := func(stage string) {
+		t.Helper()
+		for key, value := range want {
+			if got, err := store.Get(key); err != nil || got != value {
+				t.Errorf("%v: Get(%v) = %v, %v, want %v", stage, key, got, err, value)
+			}
+		}
+		if runtime.GOOS != "linux" {
+			return
+		}
+		// every file but the active one is mapped
+		store.filesMu.RLock()
+		defer store.filesMu.RUnlock()
+		for fileID := range store.readers {
+			if _, ok := store.mmaps[fileID]; !ok && fileID != store.activeID && !store.isEmptyFile(fileID) {
+				t.Errorf("%v: data file %d is not mapped", stage, fileID)
+			}
+		}
+		if _, ok := store.mmaps[store.activeID]; ok {
+			t.Errorf("%v: the active file is mapped", stage)
+		}
+	}
+	check("after the writes")
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	check("after Compact")
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	check("after reopening")
+}
+
+// isEmptyFile reports whether the data file has no bytes, which leaves it unmapped.
+func (d *DiskStore) isEmptyFile(fileID uint32) bool {
+	info, err := d.readers[fileID].Stat()
+	return err == nil && info.Size() == 0
+}
@@ -0,0 +1,287 @@
+package caskdb
+
+import (
+	"compress/flate"
+	"errors"
+	"log"
+	"os"
+	"runtime"
+	"time"
+)
+
+var (
+	// ErrReadOnly is returned by the write operations of a store opened as read-only
+	ErrReadOnly = errors.New("store is read-only")
+	// ErrFileTooLarge is returned when a write would grow the data file beyond
+	// Options.MaxFileSize
+	ErrFileTooLarge = errors.New("data file would exceed the maximum size")
+)
+
+// SyncPolicy decides when the writes are flushed to the disk with fsync. It is one of
+// SyncAlways, SyncNever or a SyncInterval.
+type SyncPolicy int64
+
+const (
+	// SyncAlways syncs the file after every write. This is the default and is the
+	// safest: once a write returns, it survives a crash.
+	SyncAlways SyncPolicy = 0
+	// SyncNever never syncs the file, and leaves the flushing to the OS. It is the
+	// fastest, but the recent writes may get lost on a crash.
+	SyncNever SyncPolicy = -1
+)
+
+// SyncInterval returns a policy which syncs the file from a background goroutine
+// every d, if anything was written since the last sync. A crash loses at most the
+// writes of the last d, while the writes themselves do not wait for the disk. An
+// interval which is not positive gives SyncAlways.
+func SyncInterval(d time.Duration) SyncPolicy {
+	if d <= 0 {
+		return SyncAlways
+	}
+	return SyncPolicy(d)
+}
+
+// interval returns the interval of a SyncInterval policy, 0 for the others.
+func (p SyncPolicy) interval() time.Duration {
+	if p <= 0 {
+		return 0
+	}
+	return time.Duration(p)
+}
+
+// CorruptionMode decides how opening a store reacts to the records which fail their
+// checksum.
+type CorruptionMode int
+
+const (
+	// FailOnCorruption fails the open with ErrChecksumMismatch. This is the default
+	// and is the strictest: nothing is touched until an operator has a look.
+	FailOnCorruption CorruptionMode = iota
+	// TruncateAtCorruption discards the corrupt record and everything after it, by
+	// truncating the file, as if the file ended right before the corruption. The
+	// writes made after the corruption are lost, but the store is exactly as it was
+	// at some point in time.
+	TruncateAtCorruption
+	// SkipCorruptRecords skips over the corrupted bytes and keeps loading the records
+	// after them. It recovers as much as possible, but the keys whose latest record
+	// was lost come back with an older value, if they had one.
+	SkipCorruptRecords
+)
+
+// CompactionWindow restricts the background compaction to a time of day, e.g. from
+// 02:00 to 05:00, when the store is not busy. Start and End are the offsets from the
+// midnight in the local time; a window with End before Start spans the midnight. The
+// zero value, or any window with Start equal to End, allows the compaction at any
+// time.
+type CompactionWindow struct {
+	Start time.Duration
+	End   time.Duration
+}
+
+// contains reports whether t falls in the window.
+func (w CompactionWindow) contains(t time.Time) bool {
+	if w.Start == w.End {
+		return true
+	}
+	hour, min, sec := t.Clock()
+	offset := time.Duration(hour)*time.Hour + time.Duration(min)*time.Minute + time.Duration(sec)*time.Second
+	if w.Start < w.End {
+		return offset >= w.Start && offset < w.End
+	}
+	return offset >= w.Start || offset < w.End
+}
+
+// Options configure a DiskStore opened with NewDiskStoreWithOptions. The zero value
+// gives the same defaults as NewDiskStore.
+type Options struct {
+	// SyncPolicy decides when the writes are synced to the disk: SyncAlways,
+	// SyncNever or SyncInterval(d); defaults to SyncAlways
+	SyncPolicy SyncPolicy
+	// MaxFileSize is the maximum size of a data file in bytes. The writes which
+	// would grow the file beyond it fail with ErrFileTooLarge. Defaults to 0, which
+	// means no limit.
+	MaxFileSize int64
+	// MaxSegmentSize splits the data into multiple files, like the bitcask paper
+	// does: once the active data file would grow beyond MaxSegmentSize bytes, it is
+	// sealed, never to be written again, and a new active file is started. Defaults
+	// to 0, which keeps all the data in a single file. See segmentName for how the
+	// files are named.
+	MaxSegmentSize int64
+	// ReadOnly opens the store without write access. The data file must exist, and
+	// all the write operations fail with ErrReadOnly. The read-only stores take no
+	// lock, so one can be opened by another process while the store is written to.
+	ReadOnly bool
+	// RefreshInterval refreshes a ReadOnly store every interval, see
+	// DiskStore.Refresh, so that it keeps up with the writes of the process which has
+	// the store open for writing; defaults to 0, which never refreshes. The data files
+	// of such a store are read without MmapReads.
+	RefreshInterval time.Duration
+	// CacheSize keeps the most recently read values in the memory, up to about this
+	// many bytes, so that the reads of the hot keys do not go to the disk; defaults to
+	// 0, which caches nothing. A value is dropped from the cache as soon as its key
+	// is changed.
+	CacheSize int64
+	// WriteBufferSize buffers the writes in the memory, up to this many bytes, so that
+	// the small writes do not each become a write syscall; defaults to 0, which writes
+	// every record out right away. The buffer is flushed to the file when it is full,
+	// on every sync and at the end of a batch commit; with SyncNever or SyncInterval,
+	// a crash of the process, not only of the machine, loses what is in there. The
+	// buffered records are not visible to the reads until they are flushed, or with
+	// SyncAlways, until they are synced as well, which no write returns before; a
+	// write which reads a buffered key, like Update or Delete, flushes the buffer
+	// first. The buffered writes are not sent to the followers, see ReadLog, until
+	// they are flushed either.
+	WriteBufferSize int
+	// Preallocate extends every new active file to MaxSegmentSize upfront, with
+	// fallocate where available, so that the appends do not allocate the blocks one by
+	// one and the file is not fragmented. The store keeps track of where the records
+	// end, and the sealed files are trimmed to it. It needs MaxSegmentSize.
+	Preallocate bool
+	// DirectIO appends the records to the active file with direct IO (O_DIRECT),
+	// bypassing the page cache, which saves the memory it would take on a disk
+	// dedicated to the store. The reads still go through the page cache. It falls back
+	// to the normal writes, with a notice to the Logger, on the platforms and file
+	// systems which do not support it; only Linux does.
+	DirectIO bool
+	// MmapReads maps the sealed data files into the memory, and serves the reads of
+	// them by copying out of the mappings instead of making a syscall for each, which
+	// cuts the latency when the data is in the page cache. The active file is still
+	// read with pread. Best for the read heavy stores whose working set fits in the
+	// RAM; an IO error in a mapped file crashes the process instead of failing the
+	// read.
+	MmapReads bool
+	// Format is the record format of the data files the store creates: FormatV1 or
+	// FormatV2; defaults to FormatV1, which the older releases can read. The existing
+	// files keep their format, and are read in it, so a store can switch at any time:
+	// if the active file is in another format, it is sealed on open and the next one
+	// starts in the new format, and a compaction rewrites the files it takes on into
+	// it.
+	Format Format
+	// Compression compresses the values as they are written, with Snappy or Deflate,
+	// which saves the disk space and the IO for the values which compress well, at the
+	// cost of the CPU time to compress and decompress them. Only the values of at least
+	// CompressionMinSize bytes are compressed, and only those which get smaller; see
+	// CompressionStats for how well they do. It needs FormatV2; the existing records
+	// keep their compression, and a compaction compresses the values it copies.
+	Compression Compression
+	// CompressionMinSize is the size of the smallest value which is compressed, since
+	// the smaller ones seldom shrink by enough to pay for it; defaults to 256
+	CompressionMinSize int
+	// CompressionLevel is the level of Deflate, from 1 (the fastest) to 9 (the best
+	// ratio), as in compress/flate; defaults to 6. Snappy has no levels.
+	CompressionLevel int
+	// CompressionDictionary makes every compaction train a dictionary out of a sample
+	// of the values it copies, which is kept next to its output, and compress all the
+	// values of the output with Deflate and it. The many small values which share
+	// their structure, like the JSON objects of the same schema, compress poorly on
+	// their own, but well with a dictionary, and each is still read on its own. It
+	// needs Deflate, and uses level 7 at least; a lower CompressionMinSize lets it take
+	// on the smaller values.
+	CompressionDictionary bool
+	// ValueLogThreshold moves the values of at least this many bytes out of the data
+	// files, into a value log next to them, with only a pointer to the value left in
+	// the record, as WiscKey does. The compactions then copy the pointers rather than
+	// the values, which is much less IO for the big values; the value log is collected
+	// on its own by Compact, file by file, once enough of a file is dead, see
+	// CompactionDeadRatio. 0, the default, keeps all the values in the data files. It
+	// needs FormatV2. Unless SyncPolicy is SyncAlways, a crash may leave a pointer to a
+	// value which did not make it to the disk, which is reported as ErrCorruptRecord.
+	ValueLogThreshold int
+	// ValueLogFileSize is the size a file of the value log grows to before the next
+	// one is started; defaults to 256 MiB
+	ValueLogFileSize int64
+	// EncryptionKeys turns on the encryption of the values at rest, with AES-GCM: the
+	// values, and the merge operands, are encrypted with the last of the keys as they
+	// are written, and the others are kept to decrypt the ones written before, see
+	// RotateEncryptionKey. The keys of the values, their metadata and the rest of the
+	// record headers are not encrypted. It needs FormatV2.
+	EncryptionKeys []EncryptionKey
+	// FileMode is the permission bits of the data file, if it has to be created;
+	// defaults to 0644
+	FileMode os.FileMode
+	// MergeOperator folds the merge operands written by Merge into the values. It must
+	// be set to use Merge, and to read the keys having merge operands.
+	MergeOperator MergeOperator
+	// SortedIndex maintains a sorted view of the keys on every write, which makes the
+	// Range scans cheap at the cost of some memory and slower inserts of new keys
+	SortedIndex bool
+	// NewIndex makes the Index each shard of keyDir keeps its keys in; defaults to a
+	// Go map. See NewARTIndex, NewPackedIndex and NewDiskIndex for the
+	// alternatives.
+	NewIndex func() Index
+	// CorruptionMode decides what to do with the corrupt records found while opening
+	// the store; defaults to FailOnCorruption
+	CorruptionMode CorruptionMode
+	// CompactionDeadRatio is the share of garbage, from 0 to 1, a sealed data file
+	// must have for the background compaction to compact it, see
+	// StartBackgroundCompaction; defaults to 0.5
+	CompactionDeadRatio float64
+	// CompactionMaxBytes is the most bytes of sealed data files one run of the background
+	// compaction takes on, so that each run is short; defaults to 0, which means no
+	// limit. A file larger than the limit is still compacted, but on its own.
+	CompactionMaxBytes int64
+	// CompactionRateLimit is the number of bytes per second the compaction may read
+	// and write, so that it does not hog the disk; defaults to 0, which means no
+	// limit. It can be changed later with DiskStore.SetCompactionRateLimit.
+	CompactionRateLimit int64
+	// TombstoneRetention keeps the tombstones of the deleted keys around for at least
+	// this long, so that the replicas and the backups taken from the data files get
+	// to see the deletes; defaults to 0, which lets the compaction drop a tombstone as
+	// soon as there is no older record for it to hide. A tombstone which still hides
+	// an older record is never dropped.
+	TombstoneRetention time.Duration
+	// CompactionWindow is the time of day the background compaction may run in;
+	// defaults to any time. See DiskStore.ForceBackgroundCompaction to run outside of
+	// it.
+	CompactionWindow CompactionWindow
+	// CheckpointInterval takes a checkpoint of keyDir every interval, and on Close,
+	// so that opening the store only has to scan the records written since the last
+	// one; defaults to 0, which takes none. See DiskStore.Checkpoint.
+	CheckpointInterval time.Duration
+	// OpenWorkers is the number of data files scanned at the same time while opening
+	// the store, to load keyDir faster on the machines with many cores; defaults to
+	// GOMAXPROCS. It only matters with more than one data file, see MaxSegmentSize.
+	OpenWorkers int
+	// OpenProgress is called while the store is being opened with the number of bytes
+	// of the data files scanned so far, out of the total to scan, so that a service can
+	// tell how far along a long startup is. It is called at the start, about every
+	// MiB, and once all is scanned, never concurrently. See OpenAsync.
+	OpenProgress func(scanned int64, total int64)
+	// Logger receives the notices about the recoveries made while opening the store,
+	// like discarding a partial record; defaults to log.Default()
+	Logger *log.Logger
+}
+
+func (o Options) withDefaults() Options {
+	if o.Format == 0 {
+		o.Format = FormatV1
+	}
+	if o.CompressionMinSize == 0 {
+		o.CompressionMinSize = 256
+	}
+	if o.CompressionLevel == 0 {
+		o.CompressionLevel = flate.DefaultCompression
+	}
+	if o.ValueLogFileSize == 0 {
+		o.ValueLogFileSize = 256 << 20
+	}
+	if o.FileMode == 0 {
+		o.FileMode = 0644
+	}
+	if o.Logger == nil {
+		o.Logger = log.Default()
+	}
+	if o.NewIndex == nil {
+		o.NewIndex = newMapIndex
+	}
+	if o.CompactionDeadRatio == 0 {
+		o.CompactionDeadRatio = 0.5
+	}
+	if o.OpenWorkers <= 0 {
+		o.OpenWorkers = runtime.GOMAXPROCS(0)
+	}
+	if o.ReadOnly && o.RefreshInterval > 0 {
+		o.MmapReads = false
+	}
+	return o
+}
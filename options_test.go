@@ -0,0 +1,197 @@
+package caskdb
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"os"
+	"reflect"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_ReadOnly(t *testing.T) {
+	if _, err := NewDiskStoreWithOptions("test.db", Options{ReadOnly: true}); err == nil {
+		t.Fatalf("NewDiskStoreWithOptions() of missing file in read-only mode error = nil, want error")
+	}
+
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("name", "jojo")
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions("test.db", Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if got, err := store.Get("name"); err != nil || got != "jojo" {
+		t.Errorf("Get() = %v, %v, want %v", got, err, "jojo")
+	}
+	if err := store.Set("name", "dio"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Set() error = %v, want %v", err, ErrReadOnly)
+	}
+	if err := store.Delete("name"); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Delete() error = %v, want %v", err, ErrReadOnly)
+	}
+	if got, err := store.Get("name"); err != nil || got != "jojo" {
+		t.Errorf("Get() = %v, %v, want %v", got, err, "jojo")
+	}
+	if err := store.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
+
+func TestDiskStore_MaxFileSize(t *testing.T) {
+	maxSize := int64(2 * (headerSize + len("name") + len("jojo")))
+	store, err := NewDiskStoreWithOptions("test.db", Options{MaxFileSize: maxSize})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	for i := 0; i < 2; i++ {
+		if err := store.Set("name", "jojo"); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	if err := store.Set("name", "dio"); !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("Set() error = %v, want %v", err, ErrFileTooLarge)
+	}
+	if store.DiskSize() != maxSize {
+		t.Errorf("DiskSize() = %v, want %v", store.DiskSize(), maxSize)
+	}
+	store.Close()
+}
+
+func TestDiskStore_SyncNever(t *testing.T) {
+	store, err := NewDiskStoreWithOptions("test.db", Options{SyncPolicy: SyncNever})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("name", "jojo")
+	store.Close()
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if got, err := store.Get("name"); err != nil || got != "jojo" {
+		t.Errorf("Get() = %v, %v, want %v", got, err, "jojo")
+	}
+	store.Close()
+}
+
+func TestDiskStore_FileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file permissions are not supported on windows")
+	}
+	store, err := NewDiskStoreWithOptions("test.db", Options{FileMode: 0600})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Close()
+	info, err := os.Stat("test.db")
+	if err != nil {
+		t.Fatalf("failed to stat the data file: %v", err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("file mode = %v, want %v", info.Mode().Perm(), os.FileMode(0600))
+	}
+}
+
+func TestDiskStore_CorruptionMode(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("a", "1")
+	store.Set("b", "2")
+	store.Set("c", "3")
+	store.Close()
+	data, err := os.ReadFile("test.db")
+	if err != nil {
+		t.Fatalf("failed to read the file: %v", err)
+	}
+	recordSize := headerSize + 2
+
+	corruptions := map[string]func([]byte){
+		"value": func(data []byte) {
+			data[2*recordSize-1] ^= 0x01
+		},
+		// a key_size claiming more bytes than the file has, which must not be taken
+		// for a partial record at the end of the file
+		"header": func(data []byte) {
+			data[recordSize+12] = 0xff
+		},
+	}
+	for name, corrupt := range corruptions {
+		tests := []struct {
+			mode     CorruptionMode
+			keys     []string
+			fileSize int64
+		}{
+			{TruncateAtCorruption, []string{"a"}, int64(recordSize)},
+			{SkipCorruptRecords, []string{"a", "c"}, int64(len(data))},
+		}
+		for _, tt := range tests {
+			corrupted := append([]byte(nil), data...)
+			corrupt(corrupted)
+			if err := os.WriteFile("test.db", corrupted, 0644); err != nil {
+				t.Fatalf("failed to write the file: %v", err)
+			}
+			if _, err := NewDiskStore("test.db"); !errors.Is(err, ErrChecksumMismatch) {
+				t.Errorf("NewDiskStore() with corrupt %v error = %v, want %v", name, err, ErrChecksumMismatch)
+			}
+
+			var logs bytes.Buffer
+			store, err := NewDiskStoreWithOptions("test.db", Options{CorruptionMode: tt.mode, Logger: log.New(&logs, "", 0)})
+			if err != nil {
+				t.Fatalf("NewDiskStore() with corrupt %v, mode %v error = %v", name, tt.mode, err)
+			}
+			keys := store.Keys()
+			sort.Strings(keys)
+			if !reflect.DeepEqual(keys, tt.keys) {
+				t.Errorf("Keys() with corrupt %v, mode %v = %v, want %v", name, tt.mode, keys, tt.keys)
+			}
+			if store.DiskSize() != tt.fileSize {
+				t.Errorf("DiskSize() with corrupt %v, mode %v = %v, want %v", name, tt.mode, store.DiskSize(), tt.fileSize)
+			}
+			if logs.Len() == 0 {
+				t.Errorf("corrupt %v with mode %v was not logged", name, tt.mode)
+			}
+			store.Close()
+		}
+	}
+}
+
+func TestCompactionWindow_contains(t *testing.T) {
+	at := func(hour, min int) time.Time {
+		return time.Date(2022, 10, 9, hour, min, 0, 0, time.Local)
+	}
+	tests := []struct {
+		window CompactionWindow
+		t      time.Time
+		want   bool
+	}{
+		{CompactionWindow{}, at(12, 0), true},
+		{CompactionWindow{2 * time.Hour, 5 * time.Hour}, at(1, 59), false},
+		{CompactionWindow{2 * time.Hour, 5 * time.Hour}, at(2, 0), true},
+		{CompactionWindow{2 * time.Hour, 5 * time.Hour}, at(4, 59), true},
+		{CompactionWindow{2 * time.Hour, 5 * time.Hour}, at(5, 0), false},
+		{CompactionWindow{22 * time.Hour, 3 * time.Hour}, at(23, 30), true},
+		{CompactionWindow{22 * time.Hour, 3 * time.Hour}, at(0, 30), true},
+		{CompactionWindow{22 * time.Hour, 3 * time.Hour}, at(12, 0), false},
+	}
+	for _, tt := range tests {
+		if got := tt.window.contains(tt.t); got != tt.want {
+			t.Errorf("%+v.contains(%v) = %v, want %v", tt.window, tt.t.Format("15:04"), got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package caskdb
+
+import "hash/maphash"
+
+// packedIndex is an Index which keeps everything in a few large arrays without any
+// pointers in them: the slots of an open addressing hash table, each with the hash of
+// its key, where the key is in the arena, and the fixed size KeyEntry, and the arena,
+// which has all the keys back to back. The garbage collector does not need to scan
+// the memory without pointers, so unlike a map[string]KeyEntry with its string
+// header pointing to every key, the index adds next to nothing to the GC work, and
+// the memory per key is the key itself and a slot. The arrays are allocated on the
+// Go heap all the same; the GC just never looks inside them.
+//
+// The table uses linear probing with the backward shift deletion, which needs no
+// tombstones, and grows when it is three quarters full. The keys of the deleted slots
+// are left in the arena, until the garbage there outweighs the live keys and the
+// arena is packed again.
+type packedIndex struct {
+	seed  maphash.Seed
+	slots []packedSlot
+	arena []byte
+	count int
+	// garbage is the bytes of the arena taken by the deleted keys
+	garbage int
+}
+
+// packedSlot is a slot of the table; a zero hash means it is empty. The offset of
+// the key is 64 bits wide, since the arena of a store with a few hundred million
+// keys can well outgrow 4 GiB.
+type packedSlot struct {
+	hash   uint64
+	keyOff uint64
+	keyLen uint32
+	entry  KeyEntry
+}
+
+// packedMinSlots is the size of the table of an empty packedIndex.
+const packedMinSlots = 16
+
+// NewPackedIndex returns an empty Index, to be used as Options.NewIndex, which keeps
+// the keys and their entries in flat arrays the garbage collector does not have to
+// scan. With tens of millions of keys, this cuts both the memory and the GC pauses a
+// lot, for a little more CPU per lookup.
+func NewPackedIndex() Index {
+	return &packedIndex{seed: maphash.MakeSeed(), slots: make([]packedSlot, packedMinSlots)}
+}
+
+// hash returns the hash of the key, which is never 0.
+func (p *packedIndex) hash(key string) uint64 {
+	return maphash.String(p.seed, key) | 1
+}
+
+func (p *packedIndex) key(s *packedSlot) string {
+	return string(p.arena[s.keyOff : s.keyOff+uint64(s.keyLen)])
+}
+
+// find returns the position of the key's slot, and whether the key is there. If it is
+// not, the position is the empty slot the key would go to.
+func (p *packedIndex) find(key string, hash uint64) (int, bool) {
+	mask := len(p.slots) - 1
+	for i := int(hash) & mask; ; i = (i + 1) & mask {
+		s := &p.slots[i]
+		if s.hash == 0 {
+			return i, false
+		}
+		if s.hash == hash && int(s.keyLen) == len(key) && string(p.arena[s.keyOff:s.keyOff+uint64(s.keyLen)]) == key {
+			return i, true
+		}
+	}
+}
+
+func (p *packedIndex) Put(key string, keyEntry KeyEntry) {
+	hash := p.hash(key)
+	i, ok := p.find(key, hash)
+	if ok {
+		p.slots[i].entry = keyEntry
+		return
+	}
+	if (p.count+1)*4 > len(p.slots)*3 {
+		p.resize(len(p.slots) * 2)
+		i, _ = p.find(key, hash)
+	}
+	p.slots[i] = packedSlot{hash: hash, keyOff: uint64(len(p.arena)), keyLen: uint32(len(key)), entry: keyEntry}
+	p.arena = append(p.arena, key...)
+	p.count++
+}
+
+func (p *packedIndex) Get(key string) (KeyEntry, bool) {
+	i, ok := p.find(key, p.hash(key))
+	if !ok {
+		return KeyEntry{}, false
+	}
+	return p.slots[i].entry, true
+}
+
+func (p *packedIndex) Delete(key string) {
+	i, ok := p.find(key, p.hash(key))
+	if !ok {
+		return
+	}
+	p.garbage += int(p.slots[i].keyLen)
+	p.count--
+	// shift the slots after it back, for as long as they are not in their home slot
+	// already, so that no probe sequence is broken by the hole
+	mask := len(p.slots) - 1
+	for j := (i + 1) & mask; p.slots[j].hash != 0; j = (j + 1) & mask {
+		home := int(p.slots[j].hash) & mask
+		if (j > i && (home <= i || home > j)) || (j < i && home <= i && home > j) {
+			p.slots[i] = p.slots[j]
+			i = j
+		}
+	}
+	p.slots[i] = packedSlot{}
+	if p.garbage > len(p.arena)/2 && p.garbage > 4096 {
+		p.resize(len(p.slots))
+	}
+}
+
+// resize rebuilds the table with the given number of slots, which is a power of two,
+// and packs the arena on the way.
+func (p *packedIndex) resize(size int) {
+	old, oldArena := p.slots, p.arena
+	p.slots = make([]packedSlot, size)
+	p.arena = make([]byte, 0, len(oldArena)-p.garbage)
+	p.garbage = 0
+	mask := size - 1
+	for _, s := range old {
+		if s.hash == 0 {
+			continue
+		}
+		i := int(s.hash) & mask
+		for p.slots[i].hash != 0 {
+			i = (i + 1) & mask
+		}
+		key := oldArena[s.keyOff : s.keyOff+uint64(s.keyLen)]
+		s.keyOff = uint64(len(p.arena))
+		p.arena = append(p.arena, key...)
+		p.slots[i] = s
+	}
+}
+
+func (p *packedIndex) Range(fn func(key string, keyEntry KeyEntry) bool) {
+	for i := range p.slots {
+		s := &p.slots[i]
+		if s.hash != 0 && !fn(p.key(s), s.entry) {
+			return
+		}
+	}
+}
+
+func (p *packedIndex) Len() int {
+	return p.count
+}
@@ -0,0 +1,82 @@
+package caskdb
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+	"unsafe"
+)
+
+func TestPackedIndex(t *testing.T) {
+	idx := NewPackedIndex().(*packedIndex)
+	want := make(map[string]KeyEntry)
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 50000; i++ {
+		key := fmt.Sprintf("key-%d", r.Intn(2000))
+		if r.Intn(2) == 0 {
+			idx.Delete(key)
+			delete(want, key)
+		} else {
+			keyEntry := KeyEntry{Offset: uint32(i)}
+			idx.Put(key, keyEntry)
+			want[key] = keyEntry
+		}
+	}
+	if idx.Len() != len(want) {
+		t.Errorf("Len() = %v, want %v", idx.Len(), len(want))
+	}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		got, ok := idx.Get(key)
+		if wantEntry, wantOK := want[key]; ok != wantOK || got != wantEntry {
+			t.Errorf("Get(%v) = %v, %v, want %v, %v", key, got, ok, wantEntry, wantOK)
+		}
+	}
+	visited := 0
+	idx.Range(func(key string, keyEntry KeyEntry) bool {
+		visited++
+		if want[key] != keyEntry {
+			t.Errorf("Range() gave %v for %v, want %v", keyEntry, key, want[key])
+		}
+		return true
+	})
+	if visited != len(want) {
+		t.Errorf("Range() visited %v keys, want %v", visited, len(want))
+	}
+	// the arena is packed once the deleted keys take up most of it
+	if idx.garbage > len(idx.arena)/2 && idx.garbage > 4096 {
+		t.Errorf("arena has %v bytes of garbage out of %v", idx.garbage, len(idx.arena))
+	}
+}
+
+func TestPackedSlotSize(t *testing.T) {
+	// the 64 bit key offset fits in the padding, so the memory estimate still holds
+	if got := unsafe.Sizeof(packedSlot{}); got != packedSlotSize {
+		t.Errorf("Sizeof(packedSlot) = %v, want %v", got, packedSlotSize)
+	}
+}
+
+func TestDiskStore_PackedIndex(t *testing.T) {
+	store, err := NewDiskStoreWithOptions("test.db", Options{NewIndex: NewPackedIndex})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("name", "jojo")
+	store.Set("stand", "star platinum")
+	store.Delete("stand")
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions("test.db", Options{NewIndex: NewPackedIndex})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if got, err := store.Get("name"); err != nil || got != "jojo" {
+		t.Errorf("Get(name) = %v, %v, want jojo", got, err)
+	}
+	if store.Has("stand") || store.Len() != 1 {
+		t.Errorf("Len() = %v, want only name to be left", store.Len())
+	}
+}
@@ -0,0 +1,83 @@
+package caskdb
+
+import (
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strings"
+)
+
+var (
+	// ErrInvalidCursor is returned by ListPage for a cursor it did not hand out
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrInvalidLimit is returned by ListPage when the limit is not positive
+	ErrInvalidLimit = errors.New("limit must be positive")
+)
+
+// ListPage returns up to limit keys in key order, starting from the cursor, along with
+// the cursor of the next page. Pass an empty cursor to get the first page; an empty
+// nextCursor means there are no more keys. Unlike an Iterator, nothing is held open
+// between the pages, so a frontend can hand the cursor to its client and continue
+// from it in a later request. The keys written or deleted in between the pages show
+// up, or not, depending on where they fall relative to the cursor.
+//
+// The cursor is opaque, URL safe text. With Options.SortedIndex a page costs
+// O(log n + limit); without it, every page has to sort the keys of keyDir.
+func (d *DiskStore) ListPage(cursor string, limit int) ([]string, string, error) {
+	return d.ListPageWithPrefix("", cursor, limit)
+}
+
+// ListPageWithPrefix is the same as ListPage, but only lists the keys which start
+// with the prefix. The cursors are only good for the same prefix.
+func (d *DiskStore) ListPageWithPrefix(prefix string, cursor string, limit int) ([]string, string, error) {
+	if limit <= 0 {
+		return nil, "", ErrInvalidLimit
+	}
+	start, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, "", ErrInvalidCursor
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	keys := d.pageKeys(prefix, string(start), limit+1)
+	if len(keys) <= limit {
+		return keys, "", nil
+	}
+	// the next page starts right after the last key of this one; appending a zero
+	// byte gives the smallest key which sorts after it
+	keys = keys[:limit]
+	next := keys[limit-1] + "\x00"
+	return keys, base64.RawURLEncoding.EncodeToString([]byte(next)), nil
+}
+
+// pageKeys returns up to limit live keys with the prefix which are equal to or greater
+// than start, in order.
+func (d *DiskStore) pageKeys(prefix string, start string, limit int) []string {
+	if start < prefix {
+		start = prefix
+	}
+	now := unixNow()
+	var keys []string
+	if d.sorted != nil {
+		for i := sort.SearchStrings(d.sorted.keys, start); i < len(d.sorted.keys) && len(keys) < limit; i++ {
+			key := d.sorted.keys[i]
+			if !strings.HasPrefix(key, prefix) {
+				break
+			}
+			if keyEntry, _ := d.keyDir.get(key); !keyEntry.isExpired(now) {
+				keys = append(keys, key)
+			}
+		}
+		return keys
+	}
+	d.keyDir.forEachPrefix(prefix, func(key string, keyEntry KeyEntry) {
+		if key >= start && !keyEntry.isExpired(now) {
+			keys = append(keys, key)
+		}
+	})
+	sort.Strings(keys)
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
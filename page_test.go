@@ -0,0 +1,80 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiskStore_ListPage(t *testing.T) {
+	for _, opts := range []Options{{}, {SortedIndex: true}} {
+		store, err := NewDiskStoreWithOptions("test.db", opts)
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		for _, key := range []string{"e", "", "c", "a", "d", "b"} {
+			store.Set(key, "v")
+		}
+		store.Delete("d")
+
+		var pages [][]string
+		cursor := ""
+		for {
+			keys, next, err := store.ListPage(cursor, 2)
+			if err != nil {
+				t.Fatalf("ListPage() error = %v (options %+v)", err, opts)
+			}
+			pages = append(pages, keys)
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		want := [][]string{{"", "a"}, {"b", "c"}, {"e"}}
+		if !reflect.DeepEqual(pages, want) {
+			t.Errorf("ListPage() pages = %q, want %q (options %+v)", pages, want, opts)
+		}
+
+		if _, _, err := store.ListPage("", 0); !errors.Is(err, ErrInvalidLimit) {
+			t.Errorf("ListPage() error = %v, want %v", err, ErrInvalidLimit)
+		}
+		if _, _, err := store.ListPage("not a cursor!", 1); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("ListPage() error = %v, want %v", err, ErrInvalidCursor)
+		}
+		store.Close()
+		os.Remove("test.db")
+	}
+}
+
+func TestDiskStore_ListPageWithPrefix(t *testing.T) {
+	for _, opts := range []Options{{}, {SortedIndex: true}} {
+		store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), opts)
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		for _, key := range []string{"book:3", "author:1", "book:1", "books", "book:2", "c"} {
+			store.Set(key, "v")
+		}
+
+		var pages [][]string
+		cursor := ""
+		for {
+			keys, next, err := store.ListPageWithPrefix("book:", cursor, 2)
+			if err != nil {
+				t.Fatalf("ListPageWithPrefix() error = %v (options %+v)", err, opts)
+			}
+			pages = append(pages, keys)
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+		want := [][]string{{"book:1", "book:2"}, {"book:3"}}
+		if !reflect.DeepEqual(pages, want) {
+			t.Errorf("ListPageWithPrefix() pages = %q, want %q (options %+v)", pages, want, opts)
+		}
+		store.Close()
+	}
+}
@@ -0,0 +1,35 @@
+package caskdb
+
+import "sync"
+
+// maxPooledBuffer is the capacity of the largest buffer put back in the pool, so that
+// a few huge values do not keep their buffers alive forever.
+const maxPooledBuffer = 64 << 10
+
+// bufferPool recycles the buffers the records are encoded into on the writes and read
+// into on the reads, which are not needed once the call returns. It keeps pointers,
+// so that putting a slice back does not allocate.
+var bufferPool = sync.Pool{
+	New: func() any {
+		buf := make([]byte, 0, 512)
+		return &buf
+	},
+}
+
+// getBuffer returns an empty buffer of at least the given capacity from the pool. It
+// must be handed back with putBuffer once the bytes are not referenced any more.
+func getBuffer(size int) *[]byte {
+	buf := bufferPool.Get().(*[]byte)
+	if cap(*buf) < size {
+		*buf = make([]byte, 0, size)
+	}
+	*buf = (*buf)[:0]
+	return buf
+}
+
+func putBuffer(buf *[]byte) {
+	if cap(*buf) > maxPooledBuffer {
+		return
+	}
+	bufferPool.Put(buf)
+}
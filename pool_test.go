@@ -0,0 +1,32 @@
+package caskdb
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestGetBuffer(t *testing.T) {
+	buf := getBuffer(1000)
+	if len(*buf) != 0 || cap(*buf) < 1000 {
+		t.Errorf("getBuffer(1000) = len %v, cap %v", len(*buf), cap(*buf))
+	}
+	*buf = append(*buf, "dirty"...)
+	putBuffer(buf)
+	if buf := getBuffer(10); len(*buf) != 0 {
+		t.Errorf("getBuffer(10) = %q, want an empty buffer", *buf)
+	}
+}
+
+func TestDiskStore_GetAllocs(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("name", "jojo")
+	// the record is read into a pooled buffer, so the only allocation is the string
+	// returned
+	if allocs := testing.AllocsPerRun(100, func() { store.Get("name") }); allocs > 1 {
+		t.Errorf("Get() made %v allocations, want 1", allocs)
+	}
+}
@@ -0,0 +1,47 @@
+package caskdb
+
+import "os"
+
+// preallocating reports whether the active files are preallocated, see
+// Options.Preallocate.
+func (d *DiskStore) preallocating() bool {
+	return d.opts.Preallocate && d.opts.MaxSegmentSize > 0
+}
+
+// openWriter opens the write handle of the data file. The records are appended with
+// O_APPEND, unless the files are preallocated: the end of the file is past the
+// records then, so they are written at the end of the records instead, see
+// appendFile.
+func (d *DiskStore) openWriter(name string) (*os.File, error) {
+	if d.preallocating() {
+		return os.OpenFile(name, os.O_WRONLY, d.opts.FileMode)
+	}
+	return os.OpenFile(name, os.O_APPEND|os.O_WRONLY, d.opts.FileMode)
+}
+
+// preallocate extends the active file to Options.MaxSegmentSize, so that the appends
+// do not have to allocate the blocks of the file one by one, which also keeps the file
+// in one piece on the disk. The space after the records reads as zeros, which the
+// startup scan takes for the end of the log. A failure is only logged, since the file
+// works all the same without it.
+func (d *DiskStore) preallocate() {
+	if !d.preallocating() || int64(d.currentOffset) >= d.opts.MaxSegmentSize {
+		return
+	}
+	if err := allocateFile(d.writeFileHandle, d.opts.MaxSegmentSize); err != nil {
+		d.opts.Logger.Printf("caskdb: failed to preallocate data file %d: %v", d.activeID, err)
+	}
+}
+
+// trimActive truncates the active file to the end of the records flushed to it,
+// dropping the padding of the direct IO writes or the preallocated space, if any. It
+// is called before the file is sealed, and on Close.
+func (d *DiskStore) trimActive() error {
+	if d.direct != nil {
+		return d.closeDirect()
+	}
+	if d.writeFileHandle == nil || !d.preallocating() {
+		return nil
+	}
+	return d.writeFileHandle.Truncate(int64(d.currentOffset) - int64(len(d.wbuf)))
+}
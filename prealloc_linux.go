@@ -0,0 +1,17 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// allocateFile extends the file to size bytes, with the blocks allocated on the disk
+// by fallocate, or as a sparse file if the file system cannot fallocate.
+func allocateFile(f *os.File, size int64) error {
+	err := syscall.Fallocate(int(f.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) {
+		return f.Truncate(size)
+	}
+	return err
+}
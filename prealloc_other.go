@@ -0,0 +1,11 @@
+//go:build !linux
+
+package caskdb
+
+import "os"
+
+// allocateFile extends the file to size bytes. Without fallocate, the file is only
+// made sparse, which still saves growing its size on every append.
+func allocateFile(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
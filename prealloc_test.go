@@ -0,0 +1,64 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_Preallocate(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "test.db")
+	const segmentSize = 64 << 10
+	opts := Options{Preallocate: true, MaxSegmentSize: segmentSize, SyncPolicy: SyncNever}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	value := strings.Repeat("v", 1000)
+	for i := 0; i < 100; i++ {
+		if err := store.Set(fmt.Sprint(i), value); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	if store.activeID == 0 {
+		t.Fatalf("the store did not rotate")
+	}
+	if info, _ := os.Stat(segmentName(fileName, store.activeID)); info.Size() != segmentSize {
+		t.Errorf("the active file is %v bytes, want it preallocated to %v", info.Size(), segmentSize)
+	}
+	// the sealed files end with their last record
+	if data, _ := os.ReadFile(fileName); len(data) == segmentSize || data[len(data)-1] != 'v' {
+		t.Errorf("the sealed file is %v bytes, want it trimmed", len(data))
+	}
+	if got, err := store.Get("99"); err != nil || got != value {
+		t.Errorf("Get(99) = %v bytes, %v", len(got), err)
+	}
+	if err := store.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+
+	// a crash leaves the preallocated space, which the scan skips
+	crashed := filepath.Join(t.TempDir(), "test.db")
+	fileIDs, _ := listSegments(fileName)
+	for _, fileID := range fileIDs {
+		data, _ := os.ReadFile(segmentName(fileName, fileID))
+		os.WriteFile(segmentName(crashed, fileID), data, 0644)
+	}
+	store.Close()
+	for _, name := range []string{fileName, crashed} {
+		store, err := NewDiskStoreWithOptions(name, opts)
+		if err != nil {
+			t.Fatalf("failed to reopen disk store: %v", err)
+		}
+		if store.Len() != 100 || len(store.Quarantine()) != 0 {
+			t.Errorf("Len() = %v, Quarantine() = %v after reopening", store.Len(), store.Quarantine())
+		}
+		if err := store.Set("next", "one"); err != nil {
+			t.Errorf("Set() after reopening error = %v", err)
+		}
+		store.Close()
+	}
+}
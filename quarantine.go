@@ -0,0 +1,56 @@
+package caskdb
+
+import "time"
+
+// QuarantineEntry describes a damaged part of the data file, found either while
+// opening the store or while reading a record back.
+type QuarantineEntry struct {
+	// FileID is the file ID of the data file the damaged bytes are in
+	FileID uint32
+	// Offset is the byte offset of the damaged bytes in the data file
+	Offset int64
+	// Size is the number of the damaged bytes
+	Size int64
+	// Key is the key the damaged record belongs to, if it is known; the keys found by
+	// the startup scan are not, since a damaged record cannot be trusted to have one
+	Key string
+	// Err tells what is wrong with the bytes: ErrChecksumMismatch, ErrCorruptRecord
+	// or ErrPartialRecord
+	Err error
+	// Discarded is set when the bytes have been truncated off the file, as per the
+	// recovery and Options.CorruptionMode; otherwise they are still in the file
+	Discarded bool
+	// DetectedAt is when the damage was first found
+	DetectedAt time.Time
+}
+
+// Quarantine returns the report of all the damaged records found since the store was
+// opened, ordered by when they were found. The store keeps serving the healthy
+// records; the report lets the operators decide whether to repair the file or to
+// restore it from a backup. A record is reported once, however many times it is read.
+func (d *DiskStore) Quarantine() []QuarantineEntry {
+	d.quarantineMu.Lock()
+	defer d.quarantineMu.Unlock()
+	return append([]QuarantineEntry(nil), d.quarantine...)
+}
+
+// quarantineRecord adds the damaged bytes to the quarantine report, unless they are
+// reported already. The reads find the damaged records too, so it has its own lock.
+func (d *DiskStore) quarantineRecord(fileID uint32, offset int64, size int64, key string, err error, discarded bool) {
+	d.quarantineMu.Lock()
+	defer d.quarantineMu.Unlock()
+	for _, e := range d.quarantine {
+		if e.FileID == fileID && e.Offset == offset {
+			return
+		}
+	}
+	d.quarantine = append(d.quarantine, QuarantineEntry{
+		FileID:     fileID,
+		Offset:     offset,
+		Size:       size,
+		Key:        key,
+		Err:        err,
+		Discarded:  discarded,
+		DetectedAt: timeNow(),
+	})
+}
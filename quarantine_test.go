@@ -0,0 +1,79 @@
+package caskdb
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"testing"
+)
+
+func TestDiskStore_QuarantineOnOpen(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("a", "1")
+	store.Set("b", "2")
+	store.Set("c", "3")
+	store.Close()
+	recordSize := int64(headerSize + 2)
+
+	data, err := os.ReadFile("test.db")
+	if err != nil {
+		t.Fatalf("failed to read the file: %v", err)
+	}
+	data[2*recordSize-1] ^= 0x01
+	data = append(data, encodeHeader(10, 0, 1, 100)...)
+	if err := os.WriteFile("test.db", data, 0644); err != nil {
+		t.Fatalf("failed to write the file: %v", err)
+	}
+
+	opts := Options{CorruptionMode: SkipCorruptRecords, Logger: log.New(io.Discard, "", 0)}
+	store, err = NewDiskStoreWithOptions("test.db", opts)
+	if err != nil {
+		t.Fatalf("failed to open disk store: %v", err)
+	}
+	report := store.Quarantine()
+	if len(report) != 2 {
+		t.Fatalf("Quarantine() = %+v, want 2 entries", report)
+	}
+	if e := report[0]; e.Offset != recordSize || e.Size != recordSize || !errors.Is(e.Err, ErrChecksumMismatch) || e.Discarded {
+		t.Errorf("Quarantine()[0] = %+v, want the skipped record of b", e)
+	}
+	if e := report[1]; e.Offset != 3*recordSize || e.Size != headerSize || !errors.Is(e.Err, ErrPartialRecord) || !e.Discarded {
+		t.Errorf("Quarantine()[1] = %+v, want the discarded partial record", e)
+	}
+	store.Close()
+}
+
+func TestDiskStore_QuarantineOnGet(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("name", "jojo")
+	if report := store.Quarantine(); len(report) != 0 {
+		t.Errorf("Quarantine() = %+v, want none", report)
+	}
+
+	f, err := os.OpenFile("test.db", os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatalf("failed to open the file: %v", err)
+	}
+	f.WriteAt([]byte("J"), int64(headerSize+len("name")))
+	f.Close()
+
+	store.Get("name")
+	store.Get("name")
+	report := store.Quarantine()
+	if len(report) != 1 {
+		t.Fatalf("Quarantine() = %+v, want 1 entry", report)
+	}
+	if e := report[0]; e.Key != "name" || e.Offset != 0 || !errors.Is(e.Err, ErrChecksumMismatch) || e.DetectedAt.IsZero() {
+		t.Errorf("Quarantine()[0] = %+v, want the record of name", e)
+	}
+	store.Close()
+}
@@ -0,0 +1,324 @@
+package caskdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrInvalidRaftCommand is returned by FSM.Apply for a command which was not written
+// by a RaftStore.
+var ErrInvalidRaftCommand = errors.New("invalid raft command")
+
+// Raft is a node of a Raft cluster, which a RaftStore replicates its writes through:
+// it commits the commands to the log of the cluster, and applies them to the FSM of
+// each node, in the same order. The package has no Raft of its own; hashicorp/raft,
+// for one, takes an adapter of a few lines:
+//
+//	type node struct{ r *raft.Raft }
+//
+//	func (n node) Apply(cmd []byte, timeout time.Duration) error {
+//		f := n.r.Apply(cmd, timeout)
+//		if err := f.Error(); err != nil {
+//			return err
+//		}
+//		err, _ := f.Response().(error)
+//		return err
+//	}
+//
+//	func (n node) Barrier(timeout time.Duration) error {
+//		return n.r.Barrier(timeout).Error()
+//	}
+type Raft interface {
+	// Apply commits the command to the log, and returns once it has been applied to
+	// the FSM of this node, with the error FSM.Apply returned. It fails on a node
+	// which is not the leader.
+	Apply(cmd []byte, timeout time.Duration) error
+	// Barrier returns once all the commands committed before it have been applied to
+	// the FSM of this node. It fails on a node which is not the leader.
+	Barrier(timeout time.Duration) error
+}
+
+// RaftStore is a DiskStore whose writes go through the log of a Raft cluster, which
+// each node of applies to a DiskStore of its own, with an FSM. A write returns once
+// a majority of the nodes has it, so it is not lost with the leader, and the reads of
+// Get see all the writes which returned before, on any node: they are linearizable.
+//
+// The writes and the reads of Get go to the leader; on the other nodes, they fail
+// with the error of the Raft, and the application has to forward them to the leader.
+// The local store, see Store, can be read from on any node, as a replica which lags a
+// moment behind. It must not be written to other than by the FSM.
+type RaftStore struct {
+	store *DiskStore
+	raft  Raft
+	opts  RaftOptions
+}
+
+// RaftOptions are the options of a RaftStore.
+type RaftOptions struct {
+	// Timeout is how long a write, or a read of Get, waits for the log. Defaults to
+	// 10s.
+	Timeout time.Duration
+}
+
+// defaultRaftTimeout is the default of RaftOptions.Timeout.
+const defaultRaftTimeout = 10 * time.Second
+
+// NewRaftStore returns a RaftStore of the store, which the FSM of the raft node is
+// an FSM of, see NewFSM.
+func NewRaftStore(store *DiskStore, raft Raft, opts RaftOptions) *RaftStore {
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultRaftTimeout
+	}
+	return &RaftStore{store: store, raft: raft, opts: opts}
+}
+
+// Store returns the local store, which the FSM applies the log to.
+func (s *RaftStore) Store() *DiskStore {
+	return s.store
+}
+
+// Set sets the key to the value, on all the nodes.
+func (s *RaftStore) Set(key string, value string) error {
+	return s.apply(LogRecord{Op: LogSet, Key: key, Value: []byte(value)}, 0)
+}
+
+// SetWithTTL is the same as Set, but the key expires after the ttl. The expiry is
+// fixed by the node the write is made on, so that it is the same on all of them.
+func (s *RaftStore) SetWithTTL(key string, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return s.apply(LogRecord{Op: LogSet, Key: key, Value: []byte(value)}, expiryAfter(ttl))
+}
+
+// Delete deletes the key, on all the nodes.
+func (s *RaftStore) Delete(key string) error {
+	return s.apply(LogRecord{Op: LogDelete, Key: key}, 0)
+}
+
+// Get returns the value of the key, as of all the writes committed before it.
+func (s *RaftStore) Get(key string) (string, error) {
+	if err := s.raft.Barrier(s.opts.Timeout); err != nil {
+		return "", err
+	}
+	return s.store.Get(key)
+}
+
+func (s *RaftStore) apply(r LogRecord, expiry uint32) error {
+	// the timestamps are the leader's, so that the nodes write the same records
+	r.Timestamp = time.Unix(int64(unixNow()), 0)
+	if expiry != 0 {
+		r.Expiry = time.Unix(int64(expiry), 0)
+	}
+	return s.raft.Apply(encodeRaftCommand([]LogRecord{r}), s.opts.Timeout)
+}
+
+// raftCommandVersion is the first byte of the commands, so that the format can be
+// changed later on.
+const raftCommandVersion = 1
+
+// encodeRaftCommand encodes the records as a command of the log: each of them is the
+// op, the timestamp and the expiry, as uvarints, and the key and the value, after
+// their lengths.
+func encodeRaftCommand(records []LogRecord) []byte {
+	cmd := []byte{raftCommandVersion}
+	for _, r := range records {
+		var expiry uint64
+		if !r.Expiry.IsZero() {
+			expiry = uint64(r.Expiry.Unix())
+		}
+		cmd = append(cmd, byte(r.Op))
+		cmd = binary.AppendUvarint(cmd, uint64(r.Timestamp.Unix()))
+		cmd = binary.AppendUvarint(cmd, expiry)
+		cmd = binary.AppendUvarint(cmd, uint64(len(r.Key)))
+		cmd = append(cmd, r.Key...)
+		cmd = binary.AppendUvarint(cmd, uint64(len(r.Value)))
+		cmd = append(cmd, r.Value...)
+	}
+	return cmd
+}
+
+// decodeRaftCommand decodes the records of a command of encodeRaftCommand.
+func decodeRaftCommand(cmd []byte) ([]LogRecord, error) {
+	if len(cmd) == 0 || cmd[0] != raftCommandVersion {
+		return nil, ErrInvalidRaftCommand
+	}
+	cmd = cmd[1:]
+	uvarint := func() (uint64, bool) {
+		v, n := binary.Uvarint(cmd)
+		if n <= 0 {
+			return 0, false
+		}
+		cmd = cmd[n:]
+		return v, true
+	}
+	field := func() ([]byte, bool) {
+		size, ok := uvarint()
+		if !ok || size > uint64(len(cmd)) {
+			return nil, false
+		}
+		b := cmd[:size]
+		cmd = cmd[size:]
+		return b, true
+	}
+	var records []LogRecord
+	for len(cmd) > 0 {
+		op := LogOp(cmd[0])
+		cmd = cmd[1:]
+		timestamp, ok1 := uvarint()
+		expiry, ok2 := uvarint()
+		key, ok3 := field()
+		value, ok4 := field()
+		if op > LogDelete || !ok1 || !ok2 || !ok3 || !ok4 {
+			return nil, ErrInvalidRaftCommand
+		}
+		r := LogRecord{Op: op, Key: string(key), Timestamp: time.Unix(int64(timestamp), 0)}
+		if op == LogSet {
+			r.Value = value
+		}
+		if expiry != 0 {
+			r.Expiry = time.Unix(int64(expiry), 0)
+		}
+		records = append(records, r)
+	}
+	return records, nil
+}
+
+// FSM is the state machine of a node of a RaftStore: it applies the commands of the
+// log to the store of the node, and takes the snapshots of the store which the Raft
+// truncates its log with, and restores them, as WriteSnapshot and RestoreSnapshot do.
+// Its methods are the ones of the FSM of hashicorp/raft, but for the types of the
+// package, so that it takes an adapter as well:
+//
+//	type fsm struct{ f *caskdb.FSM }
+//
+//	func (m fsm) Apply(l *raft.Log) interface{} { return m.f.Apply(l.Data) }
+//
+//	func (m fsm) Snapshot() (raft.FSMSnapshot, error) {
+//		s, err := m.f.Snapshot()
+//		return snapshot{s}, err
+//	}
+//
+//	func (m fsm) Restore(r io.ReadCloser) error {
+//		defer r.Close()
+//		return m.f.Restore(r)
+//	}
+//
+//	type snapshot struct{ *caskdb.FSMSnapshot }
+//
+//	func (s snapshot) Persist(sink raft.SnapshotSink) error {
+//		if err := s.FSMSnapshot.Persist(sink); err != nil {
+//			sink.Cancel()
+//			return err
+//		}
+//		return sink.Close()
+//	}
+//
+// The store keeps the commands applied once they are, so a Raft which replays its
+// log from the last snapshot after a restart applies some of them again. That does
+// no harm, since they set and delete the keys to what they were.
+type FSM struct {
+	store *DiskStore
+}
+
+// NewFSM returns the FSM which applies the log to the store.
+func NewFSM(store *DiskStore) *FSM {
+	return &FSM{store: store}
+}
+
+// Apply applies the command to the store. An error of the store, rather than of the
+// command, leaves the node behind the others; see DiskStore.Failed.
+func (f *FSM) Apply(cmd []byte) error {
+	records, err := decodeRaftCommand(cmd)
+	if err != nil {
+		return err
+	}
+	return f.store.ApplyLog(records)
+}
+
+// Snapshot takes a snapshot of the store, as it is when it is called, which is
+// written with FSMSnapshot.Persist while the commands after it are applied. The
+// compactions of the store wait until it is released.
+func (f *FSM) Snapshot() (*FSMSnapshot, error) {
+	s, err := f.store.beginSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return &FSMSnapshot{s: s}, nil
+}
+
+// Restore replaces the contents of the store with the snapshot which Persist wrote:
+// it is restored next to the store first, and then the keys which are not in it are
+// deleted and the others set to the values they have in it, with their timestamps,
+// expiries and metadata. The reads of the store see it half restored until it
+// returns.
+func (f *FSM) Restore(r io.Reader) error {
+	dir, err := os.MkdirTemp(filepath.Dir(f.store.fileName), filepath.Base(f.store.fileName)+".restore-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	fileName := filepath.Join(dir, filepath.Base(f.store.fileName))
+	if _, err := RestoreSnapshot(r, fileName); err != nil {
+		return err
+	}
+	opts := f.store.opts
+	opts.ReadOnly = true
+	snapshot, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		return err
+	}
+	defer snapshot.Close()
+
+	var gone []string
+	for _, key := range f.store.Keys() {
+		if !snapshot.Has(key) {
+			gone = append(gone, key)
+		}
+	}
+	if err := f.store.DeleteMulti(gone); err != nil {
+		return err
+	}
+	records := make([]LogRecord, 0, restoreBatch)
+	for _, key := range snapshot.Keys() {
+		value, meta, err := snapshot.GetWithMeta(key)
+		if errors.Is(err, ErrKeyNotFound) {
+			// it expired meanwhile
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		records = append(records, LogRecord{Op: LogSet, Key: key, Value: []byte(value), Metadata: meta.Metadata, Timestamp: meta.Timestamp, Expiry: meta.Expiry})
+		if len(records) == cap(records) {
+			if err := f.store.ApplyLog(records); err != nil {
+				return err
+			}
+			records = records[:0]
+		}
+	}
+	return f.store.ApplyLog(records)
+}
+
+// restoreBatch is the number of keys FSM.Restore sets with a single write.
+const restoreBatch = 256
+
+// FSMSnapshot is a snapshot of the store of an FSM, see FSM.Snapshot.
+type FSMSnapshot struct {
+	s *storeSnapshot
+}
+
+// Persist writes the snapshot to w, in the format of WriteSnapshot.
+func (s *FSMSnapshot) Persist(w io.Writer) error {
+	return s.s.writeTo(w)
+}
+
+// Release releases the snapshot, once it has been persisted or has failed to, which
+// lets the compactions of the store run again.
+func (s *FSMSnapshot) Release() {
+	s.s.release()
+}
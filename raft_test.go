@@ -0,0 +1,142 @@
+package caskdb
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errNotLeader = errors.New("node is not the leader")
+
+// localRaft is a Raft of nodes in the same process, which applies the commands to
+// all of their FSMs at once.
+type localRaft struct {
+	mu       sync.Mutex
+	fsms     []*FSM
+	follower bool
+}
+
+func (r *localRaft) Apply(cmd []byte, timeout time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.follower {
+		return errNotLeader
+	}
+	var err error
+	for i, fsm := range r.fsms {
+		if applyErr := fsm.Apply(cmd); i == 0 {
+			err = applyErr
+		}
+	}
+	return err
+}
+
+func (r *localRaft) Barrier(timeout time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.follower {
+		return errNotLeader
+	}
+	return nil
+}
+
+func TestRaftStore(t *testing.T) {
+	dir := t.TempDir()
+	var stores []*DiskStore
+	for _, name := range []string{"node1.db", "node2.db"} {
+		store, err := NewDiskStore(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		defer store.Close()
+		stores = append(stores, store)
+	}
+	raft := &localRaft{fsms: []*FSM{NewFSM(stores[0]), NewFSM(stores[1])}}
+	s := NewRaftStore(stores[0], raft, RaftOptions{})
+
+	s.Set("book:1", "dune")
+	s.Set("book:2", "emma")
+	s.SetWithTTL("session", "jojo", time.Hour)
+	s.Delete("book:1")
+	if got, err := s.Get("book:2"); err != nil || got != "emma" {
+		t.Errorf("Get(book:2) = %v, %v, want emma", got, err)
+	}
+	checkReplica(t, stores[0], stores[1])
+	if ttl, err := stores[1].TTL("session"); err != nil || ttl <= 59*time.Minute {
+		t.Errorf("node 2 TTL(session) = %v, %v, want an hour", ttl, err)
+	}
+	if err := s.SetWithTTL("session", "jojo", 0); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("SetWithTTL() with no ttl error = %v, want %v", err, ErrInvalidTTL)
+	}
+	if err := raft.fsms[0].Apply([]byte("set book:1 dune")); !errors.Is(err, ErrInvalidRaftCommand) {
+		t.Errorf("Apply() of a bad command error = %v, want %v", err, ErrInvalidRaftCommand)
+	}
+
+	raft.follower = true
+	if err := s.Set("book:3", "ulysses"); !errors.Is(err, errNotLeader) {
+		t.Errorf("Set() on a follower error = %v, want %v", err, errNotLeader)
+	}
+	if _, err := s.Get("book:2"); !errors.Is(err, errNotLeader) {
+		t.Errorf("Get() on a follower error = %v, want %v", err, errNotLeader)
+	}
+}
+
+func TestFSM_Snapshot(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{Format: FormatV2, MaxSegmentSize: 64, MergeOperator: joinOperator}
+	store, err := NewDiskStoreWithOptions(filepath.Join(dir, "node1.db"), opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	other, err := NewDiskStoreWithOptions(filepath.Join(dir, "node2.db"), opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer other.Close()
+	fillSegments(t, store)
+	store.SetWithMeta("doc", "{}", Metadata{ContentType: "application/json"})
+	other.Set("k0", "stale")
+	other.Set("gone", "x")
+
+	fsm := NewFSM(store)
+	snapshot, err := fsm.Snapshot()
+	if err != nil {
+		t.Fatalf("Snapshot() error = %v", err)
+	}
+	// the snapshot is of the store as it was when it was taken
+	want := map[string]string{}
+	for _, key := range store.Keys() {
+		want[key], _ = store.Get(key)
+	}
+	store.Set("later", "write")
+	var buf bytes.Buffer
+	if err := snapshot.Persist(&buf); err != nil {
+		t.Fatalf("Persist() error = %v", err)
+	}
+	snapshot.Release()
+	if _, err := store.Compact(); err != nil {
+		t.Errorf("Compact() after Release error = %v", err)
+	}
+
+	if err := NewFSM(other).Restore(&buf); err != nil {
+		t.Fatalf("Restore() error = %v", err)
+	}
+	if other.Len() != len(want) {
+		t.Errorf("restored keys = %v, want %v", other.Keys(), want)
+	}
+	for key, value := range want {
+		if got, err := other.Get(key); err != nil || got != value {
+			t.Errorf("restored Get(%v) = %v, %v, want %v", key, got, err, value)
+		}
+	}
+	if _, meta, err := other.GetWithMeta("doc"); err != nil || meta.ContentType != "application/json" {
+		t.Errorf("restored GetWithMeta(doc) = %+v, %v, want the content type", meta, err)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "node2.db.restore-*")); len(matches) != 0 {
+		t.Errorf("Restore() left %v", matches)
+	}
+}
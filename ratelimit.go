@@ -0,0 +1,88 @@
+package caskdb
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket which throttles the IO of the compaction, so that it
+// does not starve the reads and writes of the users. The bucket fills at rate bytes
+// per second, up to one second's worth of bytes. A caller takes the bytes it is about
+// to read or write, going into debt if there are not enough of them, and sleeps until
+// the debt is paid off.
+type rateLimiter struct {
+	mu sync.Mutex
+	// rate is the number of bytes per second; 0 or less means no limit
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{rate: rate}
+}
+
+// refill adds the tokens earned since the last call. The caller must hold the lock.
+func (l *rateLimiter) refill(now time.Time) {
+	if l.rate > 0 {
+		l.tokens += now.Sub(l.last).Seconds() * float64(l.rate)
+		if l.tokens > float64(l.rate) {
+			l.tokens = float64(l.rate)
+		}
+	}
+	l.last = now
+}
+
+// setRate changes the rate. The new rate applies to the calls to wait made from now
+// on.
+func (l *rateLimiter) setRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.refill(time.Now())
+	if l.rate <= 0 {
+		// the bucket starts full, just like a new one
+		l.tokens = float64(rate)
+	}
+	l.rate = rate
+}
+
+// wait blocks until n bytes may go through.
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+	l.refill(time.Now())
+	l.tokens -= float64(n)
+	var delay time.Duration
+	if l.tokens < 0 {
+		delay = time.Duration(-l.tokens / float64(l.rate) * float64(time.Second))
+	}
+	l.mu.Unlock()
+	time.Sleep(delay)
+}
+
+// throttledReader passes the reads of r through the rateLimiter.
+type throttledReader struct {
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	t.limiter.wait(n)
+	return n, err
+}
+
+// throttledWriter passes the writes to w through the rateLimiter.
+type throttledWriter struct {
+	w       io.Writer
+	limiter *rateLimiter
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	t.limiter.wait(len(p))
+	return t.w.Write(p)
+}
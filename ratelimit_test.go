@@ -0,0 +1,56 @@
+package caskdb
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_rateLimiter(t *testing.T) {
+	l := newRateLimiter(0)
+	start := time.Now()
+	l.wait(1 << 30)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("wait() without a limit took %v", elapsed)
+	}
+
+	l.setRate(10000)
+	start = time.Now()
+	// the full bucket lets the first second's worth through right away
+	l.wait(10000)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("wait() of a full bucket took %v", elapsed)
+	}
+	l.wait(2000)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("wait() of an empty bucket took %v, want about 200ms", elapsed)
+	}
+
+	l.setRate(0)
+	start = time.Now()
+	l.wait(1 << 30)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("wait() after removing the limit took %v", elapsed)
+	}
+}
+
+func TestDiskStore_CompactionRateLimit(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	recordSize := int64(headerSize + len("k0") + len("v0"))
+	store, err := NewDiskStoreWithOptions(fileName, Options{MaxSegmentSize: 2 * recordSize, MergeOperator: joinOperator})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	fillSegments(t, store)
+	// the compaction reads all the records, which the full bucket covers, and then
+	// has to wait to write the four live ones
+	store.SetCompactionRateLimit(store.DiskSize())
+	stats, err := store.Compact()
+	if err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if stats.Duration < 100*time.Millisecond {
+		t.Errorf("Compact() took %v, want at least 100ms", stats.Duration)
+	}
+}
@@ -0,0 +1,505 @@
+package caskdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+)
+
+var (
+	// ErrUnknownFormat is returned when a data file has a file header with a format
+	// version, or a flag, this version of caskdb does not know, e.g. one written by a
+	// newer release.
+	ErrUnknownFormat = errors.New("unknown data file format")
+	// ErrCorruptFileHeader is returned when a data file starts with the magic of the
+	// file header, but the rest of the header does not match its checksum.
+	ErrCorruptFileHeader = errors.New("corrupt data file header")
+)
+
+// Format is the layout of the records in a data file, see Options.Format. The
+// format is fixed when a file is created, so the files of a store may be in
+// different formats; each file is read in its own.
+type Format int
+
+const (
+	// FormatV1 is the original layout of the records, with the fixed header of
+	// headerSize bytes. Its data files start right with the first record, which is how
+	// all the stores written before there were formats look.
+	FormatV1 Format = iota + 1
+	// FormatV2 stores the expiry and the sizes in the header as varints, see
+	// appendHeader. Its data files start with the file header, see fileMagic.
+	FormatV2
+)
+
+// fileMagic starts the file header of the data files in the formats after FormatV1:
+//
+//	┌─────────────────┬─────────────┬───────────┬──────────────┬──────────┐
+//	│ "CASK" magic(4B)│ version(2B) │ flags(2B) │ created(4B)  │ crc(4B)  │
+//	└─────────────────┴─────────────┴───────────┴──────────────┴──────────┘
+//
+// version is the Format of the records which follow, flags are the features the
+// records may use (see fileCompressed), created is the unix timestamp of when the
+// file was created, and crc is the checksum of the rest of the header. A file whose
+// version or flags are unknown is not opened, rather than misread, which is what
+// lets the formats evolve; the rest of the header is only checked once the version
+// is known, since another version may lay it out differently.
+//
+// A FormatV1 file has no file header, and is told apart by not starting with the
+// magic; since it starts with a crc instead, a FormatV1 file could start with the
+// magic by chance, but only one in 2^32 of them.
+const fileMagic = "CASK"
+
+const fileHeaderSize = 16
+
+// The flags of the file header. fileCompressed is set on the files whose values may
+// be compressed, and fileDictionary on the ones which have a compression dictionary,
+// see dictionaryName, without which their values cannot be read. fileEncrypted is set
+// on the files whose values may be encrypted, see Options.EncryptionKeys.
+const (
+	fileCompressed uint16 = 1 << 0
+	fileDictionary uint16 = 1 << 1
+	fileEncrypted  uint16 = 1 << 2
+	knownFileFlags        = fileCompressed | fileDictionary | fileEncrypted
+)
+
+// The sizes of the record headers of FormatV2; it takes 12 bytes for a record with a
+// key and a value shorter than 128 bytes, which never expires. maxHeaderSize is the
+// largest header of any format, up to the metadata, which is what the buffers for
+// the records are sized for, and is enough to decode a header.
+const (
+	minHeaderSizeV2 = 4 + 1 + 4 + 3
+	maxHeaderSize   = 4 + 1 + 4 + 4*binary.MaxVarintLen32 + 1
+)
+
+// The record flags of FormatV2, which has them in a byte of their own rather than in
+// value_size. flagCompression has the Compression the value is compressed with, if
+// any; only FormatV2 can have the compressed values.
+const (
+	flagTombstone   byte = 1 << 0
+	flagMerge       byte = 1 << 1
+	flagCompression byte = 3 << 2
+	// flagValuePointer is set on the records whose value is a valuePointer to the
+	// actual value in the value log
+	flagValuePointer byte = 1 << 4
+	// flagMetadata is set on the records whose header ends with the Metadata of the
+	// value, see appendHeader
+	flagMetadata byte = 1 << 5
+	// flagEncrypted is set on the records whose value is encrypted, with the key
+	// whose ID the header has, see appendHeader
+	flagEncrypted byte = 1 << 6
+)
+
+// recordHeader is the decoded header of a record, in any format.
+type recordHeader struct {
+	timestamp uint32
+	expiry    uint32
+	keySize   uint32
+	// valueSize has the record flags in its top bits, as value_size of FormatV1 does
+	valueSize uint32
+	// flags has the flags of FormatV2 which do not fit in valueSize
+	flags byte
+	// keyID is the ID of the EncryptionKey the value is encrypted with; 0 if it is not
+	keyID uint32
+	// length is the size of the header itself, and metaSize of the metadata it ends
+	// with
+	length   int
+	metaSize int
+}
+
+// pointer reports whether the record's value is a valuePointer.
+func (h recordHeader) pointer() bool {
+	return h.flags&flagValuePointer != 0
+}
+
+// compression returns the Compression of the record's value.
+func (h recordHeader) compression() Compression {
+	return Compression(h.flags&flagCompression) >> 2
+}
+
+// recordSize returns the size of the whole record.
+func (h recordHeader) recordSize() int64 {
+	return int64(h.length) + int64(h.keySize) + int64(valueLength(h.valueSize))
+}
+
+func (f Format) String() string {
+	return fmt.Sprintf("v%d", int(f))
+}
+
+// fileHeader returns the file header a new data file of the format starts with,
+// with the given flags; none for FormatV1, which cannot have any.
+func (f Format) fileHeader(flags uint16) []byte {
+	if f == FormatV1 {
+		return nil
+	}
+	header := make([]byte, 0, fileHeaderSize)
+	header = append(header, fileMagic...)
+	header = binary.BigEndian.AppendUint16(header, uint16(f))
+	header = binary.BigEndian.AppendUint16(header, flags)
+	header = binary.BigEndian.AppendUint32(header, unixNow())
+	return binary.BigEndian.AppendUint32(header, crc32.ChecksumIEEE(header))
+}
+
+// dataOffset returns the offset of the first record in a data file of the format,
+// right after its file header.
+func (f Format) dataOffset() int64 {
+	if f == FormatV1 {
+		return 0
+	}
+	return fileHeaderSize
+}
+
+// minHeaderSize returns the size of the smallest record header of the format.
+func (f Format) minHeaderSize() int {
+	if f == FormatV2 {
+		return minHeaderSizeV2
+	}
+	return headerSize
+}
+
+// readFileHeader returns the format of the data file, and the flags of its file
+// header, after validating it.
+func readFileHeader(f *os.File) (Format, uint16, error) {
+	header := make([]byte, fileHeaderSize)
+	if _, err := f.ReadAt(header, 0); err == io.EOF {
+		return FormatV1, 0, nil
+	} else if err != nil {
+		return 0, 0, err
+	}
+	if string(header[:len(fileMagic)]) != fileMagic {
+		return FormatV1, 0, nil
+	}
+	if version := Format(binary.BigEndian.Uint16(header[4:6])); version != FormatV2 {
+		return 0, 0, fmt.Errorf("%w: version %d", ErrUnknownFormat, version)
+	}
+	if binary.BigEndian.Uint32(header[12:16]) != crc32.ChecksumIEEE(header[:12]) {
+		return 0, 0, ErrCorruptFileHeader
+	}
+	flags := binary.BigEndian.Uint16(header[6:8])
+	if flags&^knownFileFlags != 0 {
+		return 0, 0, fmt.Errorf("%w: flags %#x", ErrUnknownFormat, flags)
+	}
+	return FormatV2, flags, nil
+}
+
+// readFormat is the same as readFileHeader, but returns the format alone.
+func readFormat(f *os.File) (Format, error) {
+	format, _, err := readFileHeader(f)
+	return format, err
+}
+
+// appendHeader encodes the record header of the format at the end of dst, leaving
+// the crc field zero, see setChecksum. valueSize has the record flags in its top
+// bits, whatever the format, and flags has the other flags of FormatV2. meta is the
+// encoded Metadata of the value, and keyID the ID of the EncryptionKey the value is
+// encrypted with, if not 0, which only FormatV2 can have.
+//
+// The header of FormatV2 has the fields of FormatV1, but the expiry, which is 0 for
+// the keys that never expire, and the sizes, which are small for most of the records,
+// are stored as varints (see encoding/binary), and the record flags get a byte of
+// their own:
+//
+//	┌─────────┬───────────┬───────────────┬──────────────┬────────────────┬──────────────────┐
+//	│ crc(4B) │ flags(1B) │ timestamp(4B) │ expiry(1-5B) │ key_size(1-5B) │ value_size(1-5B) │
+//	└─────────┴───────────┴───────────────┴──────────────┴────────────────┴──────────────────┘
+//
+// With flagEncrypted, the header goes on with key_id(1-5B), and then with
+// flagMetadata, with meta_size(1B) and the metadata. As in FormatV1, the crc covers
+// everything after it.
+func (f Format) appendHeader(dst []byte, timestamp uint32, expiry uint32, keySize uint32, valueSize uint32, flags byte, keyID uint32, meta []byte) []byte {
+	if f != FormatV2 {
+		return appendHeader(dst, timestamp, expiry, keySize, valueSize)
+	}
+	if isTombstone(valueSize) {
+		flags |= flagTombstone
+	}
+	if isMergeOperand(valueSize) {
+		flags |= flagMerge
+	}
+	if keyID != 0 {
+		flags |= flagEncrypted
+	}
+	if len(meta) > 0 {
+		flags |= flagMetadata
+	}
+	dst = binary.BigEndian.AppendUint32(dst, 0)
+	dst = append(dst, flags)
+	dst = binary.BigEndian.AppendUint32(dst, timestamp)
+	dst = binary.AppendUvarint(dst, uint64(expiry))
+	dst = binary.AppendUvarint(dst, uint64(keySize))
+	dst = binary.AppendUvarint(dst, uint64(valueLength(valueSize)))
+	if keyID != 0 {
+		dst = binary.AppendUvarint(dst, uint64(keyID))
+	}
+	if len(meta) > 0 {
+		dst = append(dst, byte(len(meta)))
+		dst = append(dst, meta...)
+	}
+	return dst
+}
+
+// headerSize returns the size of the record header of the format with the given
+// fields.
+func (f Format) headerSize(expiry uint32, keySize uint32, valueSize uint32) int {
+	if f != FormatV2 {
+		return headerSize
+	}
+	return 4 + 1 + 4 + uvarintSize(uint64(expiry)) + uvarintSize(uint64(keySize)) + uvarintSize(uint64(valueLength(valueSize)))
+}
+
+func uvarintSize(v uint64) int {
+	n := 1
+	for ; v >= 0x80; v >>= 7 {
+		n++
+	}
+	return n
+}
+
+// decodeHeader decodes the record header at the start of data, which may go on with
+// the rest of the record. It returns ErrCorruptRecord if data does not start with a
+// whole header of the format.
+func (f Format) decodeHeader(data []byte) (recordHeader, error) {
+	if f != FormatV2 {
+		if len(data) < headerSize {
+			return recordHeader{}, ErrCorruptRecord
+		}
+		timestamp, expiry, keySize, valueSize, _ := decodeHeader(data[:headerSize])
+		return recordHeader{timestamp: timestamp, expiry: expiry, keySize: keySize, valueSize: valueSize, length: headerSize}, nil
+	}
+	if len(data) < minHeaderSizeV2 || data[4]&^(flagTombstone|flagMerge|flagCompression|flagValuePointer|flagMetadata|flagEncrypted) != 0 {
+		return recordHeader{}, ErrCorruptRecord
+	}
+	h := recordHeader{timestamp: binary.BigEndian.Uint32(data[5:9]), flags: data[4] &^ (flagTombstone | flagMerge), length: 9}
+	var fields [3]uint32
+	for i := range fields {
+		v, n := binary.Uvarint(data[h.length:])
+		if n <= 0 || v > math.MaxUint32 {
+			return recordHeader{}, ErrCorruptRecord
+		}
+		fields[i] = uint32(v)
+		h.length += n
+	}
+	h.expiry, h.keySize, h.valueSize = fields[0], fields[1], fields[2]
+	if data[4]&flagEncrypted != 0 {
+		v, n := binary.Uvarint(data[h.length:])
+		if n <= 0 || v == 0 || v > math.MaxUint32 {
+			return recordHeader{}, ErrCorruptRecord
+		}
+		h.keyID = uint32(v)
+		h.length += n
+	}
+	if data[4]&flagMetadata != 0 {
+		// the metadata itself does not have to be in data
+		if h.length >= len(data) {
+			return recordHeader{}, ErrCorruptRecord
+		}
+		h.metaSize = int(data[h.length])
+		h.length += 1 + h.metaSize
+	}
+	if h.valueSize&recordFlags != 0 || !h.compression().known() {
+		// the flags have to fit in value_size once decoded
+		return recordHeader{}, ErrCorruptRecord
+	}
+	if data[4]&flagTombstone != 0 {
+		h.valueSize |= tombstoneFlag
+	}
+	if data[4]&flagMerge != 0 {
+		h.valueSize |= mergeFlag
+	}
+	return h, nil
+}
+
+// appendRecord encodes a whole record of the format at the end of dst.
+func (f Format) appendRecord(dst []byte, timestamp uint32, expiry uint32, valueSize uint32, key string, value string) []byte {
+	start := len(dst)
+	dst = f.appendHeader(dst, timestamp, expiry, uint32(len(key)), valueSize, 0, 0, nil)
+	dst = append(dst, key...)
+	dst = append(dst, value...)
+	setChecksum(dst[start:])
+	return dst
+}
+
+// appendKV is the same as the appendKV of FormatV1, but in the format.
+func (f Format) appendKV(dst []byte, timestamp uint32, expiry uint32, key string, value string) []byte {
+	return f.appendRecord(dst, timestamp, expiry, uint32(len(value)), key, value)
+}
+
+// appendKVBytes is the same as appendKV, but takes the value as bytes.
+func (f Format) appendKVBytes(dst []byte, timestamp uint32, expiry uint32, key string, value []byte) []byte {
+	return f.appendValue(dst, timestamp, expiry, key, value, NoCompression, 0, nil)
+}
+
+// appendValue is the same as appendKVBytes, but the value is already compressed with
+// the given Compression, and encrypted with the key of keyID, if not 0, and has the
+// encoded Metadata meta, which only FormatV2 can have.
+func (f Format) appendValue(dst []byte, timestamp uint32, expiry uint32, key string, value []byte, compression Compression, keyID uint32, meta []byte) []byte {
+	start := len(dst)
+	dst = f.appendHeader(dst, timestamp, expiry, uint32(len(key)), uint32(len(value)), byte(compression)<<2, keyID, meta)
+	dst = append(dst, key...)
+	dst = append(dst, value...)
+	setChecksum(dst[start:])
+	return dst
+}
+
+// appendPointer is the same as appendKV, but for a record whose value is in the
+// value log, which only FormatV2 can have; pointer is the encoded valuePointer, and
+// meta the encoded Metadata of the value.
+func (f Format) appendPointer(dst []byte, timestamp uint32, expiry uint32, key string, pointer []byte, meta []byte) []byte {
+	start := len(dst)
+	dst = f.appendHeader(dst, timestamp, expiry, uint32(len(key)), uint32(len(pointer)), flagValuePointer, 0, meta)
+	dst = append(dst, key...)
+	dst = append(dst, pointer...)
+	setChecksum(dst[start:])
+	return dst
+}
+
+// appendTombstone is the same as appendKV, but for a tombstone.
+func (f Format) appendTombstone(dst []byte, timestamp uint32, key string) []byte {
+	return f.appendRecord(dst, timestamp, 0, tombstoneFlag, key, "")
+}
+
+// appendMergeOperand is the same as appendKV, but for a merge operand.
+func (f Format) appendMergeOperand(dst []byte, timestamp uint32, expiry uint32, key string, operand string) []byte {
+	return f.appendRecord(dst, timestamp, expiry, uint32(len(operand))|mergeFlag, key, operand)
+}
+
+// verifyRecord is the same as the verifyRecord of FormatV1, but for a record of the
+// format.
+func (f Format) verifyRecord(record []byte) error {
+	if len(record) < f.minHeaderSize() {
+		return ErrCorruptRecord
+	}
+	if err := verifyChecksum(record); err != nil {
+		return err
+	}
+	h, err := f.decodeHeader(record)
+	if err != nil {
+		return err
+	}
+	if h.recordSize() != int64(len(record)) {
+		return ErrCorruptRecord
+	}
+	return nil
+}
+
+// decodeKVBytes is the same as the decodeKVBytes of FormatV1, but for a record of the
+// format.
+func (f Format) decodeKVBytes(record []byte) (uint32, string, []byte) {
+	h, _ := f.decodeHeader(record)
+	key := record[h.length : h.length+int(h.keySize)]
+	if isTombstone(h.valueSize) {
+		return h.timestamp, string(key), nil
+	}
+	return h.timestamp, string(key), record[h.length+int(h.keySize) : h.recordSize()]
+}
+
+// decodeKV is the same as decodeKVBytes, but returns the value as a string.
+func (f Format) decodeKV(record []byte) (uint32, string, string) {
+	timestamp, key, value := f.decodeKVBytes(record)
+	return timestamp, key, string(value)
+}
+
+// value returns the value of a verified record of the format, decrypting it with the
+// keys if it is encrypted, and decompressing it if it is compressed, with the
+// dictionary of its data file if it has one; only then it is not a slice of the
+// record. A value which fails to decrypt or decompress is reported as
+// ErrCorruptRecord, and one encrypted with a key which is not in keys as
+// ErrUnknownEncryptionKey.
+func (f Format) value(record []byte, dict []byte, keys *keyRing) ([]byte, error) {
+	h, _ := f.decodeHeader(record)
+	value := f.decodeValue(record)
+	if value == nil {
+		return nil, nil
+	}
+	if h.keyID != 0 {
+		_, key, _ := f.decodeKVBytes(record)
+		var err error
+		if value, err = keys.open(h.keyID, key, value); err != nil {
+			return nil, err
+		}
+	}
+	if h.compression() == NoCompression {
+		return value, nil
+	}
+	return decompressValue(h.compression(), value, dict)
+}
+
+// metadata returns the encoded Metadata of a verified record of the format, if it
+// has any.
+func (f Format) metadata(record []byte) []byte {
+	h, _ := f.decodeHeader(record)
+	if h.metaSize == 0 {
+		return nil
+	}
+	return record[h.length-h.metaSize : h.length]
+}
+
+// decodeValue is the same as the decodeValue of FormatV1, but for a record of the
+// format. A compressed value is returned as it is stored, see value.
+func (f Format) decodeValue(record []byte) []byte {
+	h, _ := f.decodeHeader(record)
+	if isTombstone(h.valueSize) {
+		return nil
+	}
+	return record[h.length+int(h.keySize) : h.recordSize()]
+}
+
+// fileFormat returns the format of the data file.
+func (d *DiskStore) fileFormat(fileID uint32) Format {
+	d.filesMu.RLock()
+	defer d.filesMu.RUnlock()
+	return d.formats[fileID]
+}
+
+// fileHeaderFlags returns the flags of the file header of a new data file written
+// with the options.
+func (d *DiskStore) fileHeaderFlags() uint16 {
+	if d.opts.Format != FormatV2 {
+		return 0
+	}
+	var flags uint16
+	if d.opts.Compression != NoCompression {
+		flags |= fileCompressed
+	}
+	if d.encrypting() {
+		flags |= fileEncrypted
+	}
+	return flags
+}
+
+// startFile makes the new active file one of Options.Format, by writing its file
+// header, if any. The file must be empty.
+func (d *DiskStore) startFile() error {
+	flags := d.fileHeaderFlags()
+	if header := d.opts.Format.fileHeader(flags); len(header) > 0 {
+		n, err := d.appendFile(header)
+		d.currentOffset += uint32(n)
+		if err != nil {
+			return d.fail(err)
+		}
+	}
+	d.filesMu.Lock()
+	d.formats[d.activeID] = d.opts.Format
+	d.fileFlags[d.activeID] = flags
+	d.filesMu.Unlock()
+	return nil
+}
+
+// adoptFormat makes sure the records are appended in Options.Format once the store is
+// open. An empty active file is simply started in the format; otherwise, if it is in
+// another one, or its file header lacks a flag the writes need, it is sealed, so that
+// the writes go to a new file in the format.
+func (d *DiskStore) adoptFormat() error {
+	switch {
+	case d.currentOffset == 0:
+		return d.startFile()
+	case d.formats[d.activeID] != d.opts.Format:
+		return d.rotate()
+	case d.fileHeaderFlags()&^d.fileFlags[d.activeID] != 0:
+		return d.rotate()
+	}
+	return nil
+}
@@ -0,0 +1,281 @@
+package caskdb
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFormat_appendKV(t *testing.T) {
+	tests := []struct {
+		expiry     uint32
+		key        string
+		value      string
+		headerSize int
+	}{
+		{0, "hello", "world", 12},
+		{0, "", "", 12},
+		{2000000000, "hello", "world", 16},
+		{0, strings.Repeat("k", 128), strings.Repeat("v", 16384), 15},
+	}
+	for _, tt := range tests {
+		data := FormatV2.appendKV(nil, 10, tt.expiry, tt.key, tt.value)
+		if len(data) != tt.headerSize+len(tt.key)+len(tt.value) {
+			t.Errorf("appendKV() size = %v, want %v", len(data), tt.headerSize+len(tt.key)+len(tt.value))
+		}
+		if err := FormatV2.verifyRecord(data); err != nil {
+			t.Fatalf("verifyRecord() = %v, want nil", err)
+		}
+		h, err := FormatV2.decodeHeader(data)
+		if err != nil || h.timestamp != 10 || h.expiry != tt.expiry || h.length != tt.headerSize {
+			t.Errorf("decodeHeader() = %+v, %v, want timestamp 10, expiry %v, length %v", h, err, tt.expiry, tt.headerSize)
+		}
+		if _, key, value := FormatV2.decodeKV(data); key != tt.key || value != tt.value {
+			t.Errorf("decodeKV() = %v, %v, want %v, %v", key, value, tt.key, tt.value)
+		}
+		if value := FormatV2.decodeValue(data); string(value) != tt.value {
+			t.Errorf("decodeValue() = %q, want %q", value, tt.value)
+		}
+	}
+}
+
+func TestFormat_flags(t *testing.T) {
+	tombstone := FormatV2.appendTombstone(nil, 10, "hello")
+	if h, _ := FormatV2.decodeHeader(tombstone); !isTombstone(h.valueSize) || valueLength(h.valueSize) != 0 {
+		t.Errorf("appendTombstone() value_size = %#x, want a tombstone", h.valueSize)
+	}
+	if value := FormatV2.decodeValue(tombstone); value != nil {
+		t.Errorf("decodeValue() of a tombstone = %q, want nil", value)
+	}
+	operand := FormatV2.appendMergeOperand(nil, 10, 20, "tags", "go")
+	if h, _ := FormatV2.decodeHeader(operand); !isMergeOperand(h.valueSize) || valueLength(h.valueSize) != 2 || h.expiry != 20 {
+		t.Errorf("appendMergeOperand() = %+v, want a merge operand of length 2", h)
+	}
+	unknown := append([]byte(nil), tombstone...)
+	unknown[4] |= 0x80
+	if _, err := FormatV2.decodeHeader(unknown); err != ErrCorruptRecord {
+		t.Errorf("decodeHeader() with an unknown flag error = %v, want %v", err, ErrCorruptRecord)
+	}
+}
+
+func TestFormat_decodeHeaderInvalid(t *testing.T) {
+	data := FormatV2.appendKV(nil, 10, 0, "hello", "world")
+	if _, err := FormatV2.decodeHeader(data[:minHeaderSizeV2-1]); err != ErrCorruptRecord {
+		t.Errorf("decodeHeader() of a short header error = %v, want %v", err, ErrCorruptRecord)
+	}
+	// a varint which never ends
+	overlong := append(data[:9:9], 0xff, 0xff, 0xff, 0xff, 0xff, 0xff)
+	if _, err := FormatV2.decodeHeader(overlong); err != ErrCorruptRecord {
+		t.Errorf("decodeHeader() of an overlong varint error = %v, want %v", err, ErrCorruptRecord)
+	}
+	if err := FormatV2.verifyRecord(append(data, 0)); err != ErrCorruptRecord && err != ErrChecksumMismatch {
+		t.Errorf("verifyRecord() of a longer record = %v, want an error", err)
+	}
+}
+
+func TestDiskStore_FormatV2(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{Format: FormatV2})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("hamlet", "shakespeare")
+	store.Set("dune", "frank herbert")
+	store.Delete("dune")
+	store.SetWithTTL("session", "token", time.Hour)
+	if size, err := store.SizeOf("hamlet"); err != nil || size != len("shakespeare") {
+		t.Errorf("SizeOf() = %v, %v, want %v", size, err, len("shakespeare"))
+	}
+	if got, err := store.GetRange("hamlet", 5, 3); err != nil || string(got) != "spe" {
+		t.Errorf("GetRange() = %q, %v, want spe", got, err)
+	}
+	store.Close()
+
+	data, err := os.ReadFile(fileName)
+	if err != nil {
+		t.Fatalf("failed to read the data file: %v", err)
+	}
+	if !bytes.HasPrefix(data, []byte(fileMagic)) {
+		t.Errorf("data file starts with %q, want the file header", data[:fileHeaderSize])
+	}
+	// the headers would take 4*20 bytes in FormatV1; the expiry takes 5 bytes as a varint
+	wantSize := fileHeaderSize + 3*12 + 16 + len("hamlet") + len("shakespeare") + 2*len("dune") + len("frank herbert") + len("session") + len("token")
+	if len(data) != wantSize {
+		t.Errorf("data file size = %v, want %v", len(data), wantSize)
+	}
+
+	store, err = NewDiskStoreWithOptions(fileName, Options{Format: FormatV2})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if got, err := store.Get("hamlet"); err != nil || got != "shakespeare" {
+		t.Errorf("Get(hamlet) = %v, %v, want shakespeare", got, err)
+	}
+	if _, err := store.Get("dune"); err != ErrKeyNotFound {
+		t.Errorf("Get(dune) error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
+
+func TestDiskStore_FormatV2TruncatedTail(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{Format: FormatV2})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("name", "jojo")
+	store.Set("othello", "shakespeare")
+	store.Close()
+	info, _ := os.Stat(fileName)
+	if err := os.Truncate(fileName, info.Size()-3); err != nil {
+		t.Fatalf("failed to truncate the data file: %v", err)
+	}
+
+	store, err = NewDiskStoreWithOptions(fileName, Options{Format: FormatV2})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if got, err := store.Get("name"); err != nil || got != "jojo" {
+		t.Errorf("Get(name) = %v, %v, want jojo", got, err)
+	}
+	if store.Has("othello") {
+		t.Errorf("Has(othello) = true, want the partial record discarded")
+	}
+	if err := store.Set("othello", "shakespeare"); err != nil {
+		t.Errorf("Set() after the recovery error = %v", err)
+	}
+}
+
+func TestDiskStore_FormatSwitch(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("k0", "v0")
+	store.Set("k1", "v1")
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, Options{Format: FormatV2})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	store.Set("k2", "v2")
+	// the FormatV1 file is sealed, and the writes go to a new one
+	if _, meta, _ := store.GetWithMeta("k2"); meta.FileID != 1 || meta.Offset != fileHeaderSize {
+		t.Errorf("GetWithMeta() file ID, offset = %v, %v, want 1, %v", meta.FileID, meta.Offset, fileHeaderSize)
+	}
+	if got, err := store.Get("k0"); err != nil || got != "v0" {
+		t.Errorf("Get(k0) = %v, %v, want v0", got, err)
+	}
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if _, err := os.Stat(segmentName(fileName, 1)); !os.IsNotExist(err) {
+		t.Errorf("data file 1 is still there after Compact(): %v", err)
+	}
+	_, meta, _ := store.GetWithMeta("k0")
+	if format := store.fileFormat(meta.FileID); format != FormatV2 {
+		t.Errorf("compacted data file is in %v, want %v", format, FormatV2)
+	}
+	store.Close()
+
+	// and back, with the files in FormatV2 read as such
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	for _, key := range []string{"k0", "k1", "k2"} {
+		if got, err := store.Get(key); err != nil || got != "v"+key[1:] {
+			t.Errorf("Get(%v) = %v, %v, want %v", key, got, err, "v"+key[1:])
+		}
+	}
+}
+
+func TestDiskStore_UnknownFormat(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	header := FormatV2.fileHeader(0)
+	header[5] = 9
+	if err := os.WriteFile(fileName, header, 0644); err != nil {
+		t.Fatalf("failed to write the data file: %v", err)
+	}
+	if _, err := NewDiskStore(fileName); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("NewDiskStore() error = %v, want %v", err, ErrUnknownFormat)
+	}
+	if _, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{Format: 9}); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("NewDiskStoreWithOptions() with format 9 error = %v, want %v", err, ErrUnknownFormat)
+	}
+}
+
+func TestReadFileHeader(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	readHeader := func(header []byte) (Format, uint16, error) {
+		if err := os.WriteFile(fileName, header, 0644); err != nil {
+			t.Fatalf("failed to write the data file: %v", err)
+		}
+		f, err := os.Open(fileName)
+		if err != nil {
+			t.Fatalf("failed to open the data file: %v", err)
+		}
+		defer f.Close()
+		return readFileHeader(f)
+	}
+
+	header := FormatV2.fileHeader(fileCompressed)
+	if created := binary.BigEndian.Uint32(header[8:12]); created == 0 || created > unixNow() {
+		t.Errorf("fileHeader() created = %v, want about %v", created, unixNow())
+	}
+	if format, flags, err := readHeader(header); err != nil || format != FormatV2 || flags != fileCompressed {
+		t.Errorf("readFileHeader() = %v, %#x, %v, want %v, %#x", format, flags, err, FormatV2, fileCompressed)
+	}
+	if format, _, err := readHeader([]byte("not a caskdb file at all")); err != nil || format != FormatV1 {
+		t.Errorf("readFileHeader() without the magic = %v, %v, want %v", format, err, FormatV1)
+	}
+	corrupt := append([]byte(nil), header...)
+	corrupt[9] ^= 1
+	if _, _, err := readHeader(corrupt); err != ErrCorruptFileHeader {
+		t.Errorf("readFileHeader() of a corrupt header error = %v, want %v", err, ErrCorruptFileHeader)
+	}
+	unknown := FormatV2.fileHeader(1 << 15)
+	if _, _, err := readHeader(unknown); !errors.Is(err, ErrUnknownFormat) {
+		t.Errorf("readFileHeader() with an unknown flag error = %v, want %v", err, ErrUnknownFormat)
+	}
+}
+
+func TestDiskStore_FileHeaderFlags(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{Format: FormatV2})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("k0", "v0")
+	store.Close()
+
+	// the records written with the compression go to a file flagged for it
+	store, err = NewDiskStoreWithOptions(fileName, Options{Format: FormatV2, Compression: Snappy})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	store.Set("k1", "v1")
+	_, meta, _ := store.GetWithMeta("k1")
+	if meta.FileID != 1 || store.fileFlags[1] != fileCompressed || store.fileFlags[0] != 0 {
+		t.Errorf("file ID, flags = %v, %#x, want 1, %#x", meta.FileID, store.fileFlags[meta.FileID], fileCompressed)
+	}
+	store.Close()
+
+	// a data file whose dictionary is missing is not opened
+	header := FormatV2.fileHeader(fileCompressed | fileDictionary)
+	if err := os.WriteFile(segmentName(fileName, 2), header, 0644); err != nil {
+		t.Fatalf("failed to write the data file: %v", err)
+	}
+	if _, err := NewDiskStore(fileName); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("NewDiskStore() without the dictionary error = %v, want %v", err, os.ErrNotExist)
+	}
+}
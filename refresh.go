@@ -0,0 +1,298 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// errRefreshMmap is returned by Refresh for a store with Options.MmapReads.
+var errRefreshMmap = errors.New("refresh needs a store without MmapReads")
+
+// Refresh catches up a read-only store with what the store which has the files open
+// for writing, most likely in another process, wrote to them since it was opened or
+// last refreshed: it scans the records appended to the data files since, and applies
+// them to keyDir, as the open does. That is how a reporting job reads the data of a
+// live store without going through a server; see Options.RefreshInterval to refresh
+// the store in the background. Once a compaction of the writer has removed some of
+// the data files, keyDir is loaded from all of them again instead, while the reads
+// go on with the old one.
+//
+// The store sees the writes once they are in the files, which with
+// Options.WriteBufferSize may be a while after they were made. A read which races a
+// compaction of the writer may fail, for the record the compaction removed, until the
+// next refresh. Refresh does nothing for a store which is not read-only, which has
+// all of its writes already, and fails for one with Options.MmapReads, since the
+// mappings of the files the writer truncates would fault.
+func (d *DiskStore) Refresh() error {
+	if !d.opts.ReadOnly {
+		return nil
+	}
+	if d.opts.MmapReads {
+		return errRefreshMmap
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	select {
+	case <-d.closed:
+		return os.ErrClosed
+	default:
+	}
+	fileIDs, err := listSegments(d.fileName)
+	if err != nil {
+		return err
+	}
+	rewritten, err := d.rewritten(fileIDs)
+	if err != nil {
+		return err
+	}
+	if rewritten {
+		err = d.reload()
+	} else {
+		err = d.catchUp(fileIDs)
+	}
+	// the changefeeds of the store read on
+	d.notifyLog()
+	return err
+}
+
+// rewritten reports whether a compaction of the writer has removed or truncated any
+// of the data files of the store. The caller must hold mu.
+func (d *DiskStore) rewritten(fileIDs []uint32) (bool, error) {
+	onDisk := make(map[uint32]bool, len(fileIDs))
+	for _, fileID := range fileIDs {
+		onDisk[fileID] = true
+	}
+	for fileID := range d.readers {
+		if !onDisk[fileID] {
+			return true, nil
+		}
+	}
+	// the first data file is truncated to nothing rather than removed
+	info, err := d.readers[0].Stat()
+	if err != nil {
+		return false, err
+	}
+	end := d.formats[0].dataOffset()
+	if d.activeID == 0 {
+		end = int64(d.currentOffset)
+	}
+	return info.Size() < end || info.Size() == 0 && d.live[0] > 0, nil
+}
+
+// catchUp scans the records appended to the active file since the last refresh, and
+// the data files started after it. The caller must hold mu.
+func (d *DiskStore) catchUp(fileIDs []uint32) error {
+	if err := d.refreshValueLogs(); err != nil {
+		return err
+	}
+	// the last record of the active file may be still being written, rather than cut
+	// off by a crash
+	d.refreshing = true
+	defer func() { d.refreshing = false }()
+	for _, fileID := range fileIDs {
+		if fileID < d.activeID {
+			continue
+		}
+		from := int64(d.currentOffset)
+		if fileID > d.activeID {
+			opened, err := d.openRefreshed(fileID)
+			if err != nil {
+				return fmt.Errorf("data file %d: %w", fileID, err)
+			}
+			if !opened {
+				break
+			}
+			from = 0
+		}
+		end, _, err := d.scanKeyDir(fileID, from, d.applyRecord)
+		if err != nil {
+			return fmt.Errorf("data file %d: %w", fileID, err)
+		}
+		d.activeID, d.currentOffset = fileID, uint32(end)
+	}
+	return nil
+}
+
+// openRefreshed opens a data file the writer started since the last refresh, and
+// reports whether it did; a file whose header is yet to be written is left for the
+// next refresh. The caller must hold mu.
+func (d *DiskStore) openRefreshed(fileID uint32) (bool, error) {
+	f, err := os.Open(segmentName(d.fileName, fileID))
+	if err != nil {
+		return false, err
+	}
+	info, err := f.Stat()
+	if err != nil || info.Size() < fileHeaderSize {
+		f.Close()
+		return false, err
+	}
+	format, flags, err := readFileHeader(f)
+	var dict []byte
+	if err == nil && flags&fileDictionary != 0 {
+		dict, err = os.ReadFile(dictionaryName(d.fileName, fileID))
+	}
+	if err != nil {
+		f.Close()
+		return false, err
+	}
+	d.filesMu.Lock()
+	d.readers[fileID] = f
+	d.formats[fileID], d.fileFlags[fileID] = format, flags
+	if dict != nil {
+		d.dicts[fileID] = dict
+	}
+	d.filesMu.Unlock()
+	return true, nil
+}
+
+// refreshValueLogs opens the value log files the writer started since the last
+// refresh, and closes the ones its collection removed, whose values it has moved to
+// the records appended to the data files. The caller must hold mu.
+func (d *DiskStore) refreshValueLogs() error {
+	logIDs, err := listValueLogs(d.fileName)
+	if err != nil {
+		return err
+	}
+	onDisk := make(map[uint32]bool, len(logIDs))
+	for _, logID := range logIDs {
+		onDisk[logID] = true
+		d.filesMu.RLock()
+		_, ok := d.vlogs[logID]
+		d.filesMu.RUnlock()
+		if ok {
+			continue
+		}
+		f, err := os.Open(valueLogName(d.fileName, logID))
+		if err != nil {
+			return err
+		}
+		d.filesMu.Lock()
+		d.vlogs[logID] = f
+		d.filesMu.Unlock()
+	}
+	d.filesMu.Lock()
+	defer d.filesMu.Unlock()
+	for logID, f := range d.vlogs {
+		if !onDisk[logID] {
+			f.Close()
+			delete(d.vlogs, logID)
+		}
+	}
+	return nil
+}
+
+// reload loads keyDir from the data files again, into a store of its own, and
+// switches the store over to its keyDir and files. The reads go on meanwhile: the
+// new files are added first, the shards of keyDir are replaced one by one, and the
+// files which are gone are closed last. The caller must hold mu.
+func (d *DiskStore) reload() error {
+	opts := d.opts
+	opts.RefreshInterval, opts.OpenProgress = 0, nil
+	fresh, err := NewDiskStoreWithOptions(d.fileName, opts)
+	if err != nil {
+		return err
+	}
+	d.filesMu.Lock()
+	for fileID, f := range fresh.readers {
+		if _, ok := d.readers[fileID]; ok {
+			f.Close()
+		} else {
+			d.readers[fileID] = f
+		}
+		d.formats[fileID], d.fileFlags[fileID] = fresh.formats[fileID], fresh.fileFlags[fileID]
+		if dict, ok := fresh.dicts[fileID]; ok {
+			d.dicts[fileID] = dict
+		} else {
+			delete(d.dicts, fileID)
+		}
+	}
+	for logID, f := range fresh.vlogs {
+		if _, ok := d.vlogs[logID]; ok {
+			f.Close()
+		} else {
+			d.vlogs[logID] = f
+		}
+	}
+	d.filesMu.Unlock()
+
+	// the runs of NewDiskIndex are in the directory of fresh, which the store takes
+	// over, while its own goes away along with the old keyDir
+	for i := range fresh.keyDir.shards {
+		if x, ok := fresh.keyDir.shards[i].entries.(*diskIndex); ok {
+			x.files = &d.indexFiles
+		}
+	}
+	d.keyDir.replace(fresh.keyDir)
+	d.live, d.sorted = fresh.live, fresh.sorted
+	if fresh.indexFiles.dir != "" {
+		d.indexFiles.close()
+		d.indexFiles.dir = fresh.indexFiles.dir
+	}
+
+	if d.removedEnds == nil {
+		d.removedEnds = make(map[uint32]int64)
+	}
+	d.filesMu.Lock()
+	for fileID, f := range d.readers {
+		if _, ok := fresh.readers[fileID]; ok {
+			continue
+		}
+		// ReadLog goes on from the end of a removed file, as it does in the writer
+		if info, err := f.Stat(); err == nil {
+			d.removedEnds[fileID] = info.Size()
+		}
+		f.Close()
+		delete(d.readers, fileID)
+		delete(d.formats, fileID)
+		delete(d.fileFlags, fileID)
+		delete(d.dicts, fileID)
+	}
+	for logID, f := range d.vlogs {
+		if _, ok := fresh.vlogs[logID]; !ok {
+			f.Close()
+			delete(d.vlogs, logID)
+		}
+	}
+	d.filesMu.Unlock()
+	d.activeID, d.currentOffset = fresh.activeID, fresh.currentOffset
+	return nil
+}
+
+// startRefresher starts the background goroutine of Options.RefreshInterval, which
+// refreshes the store every interval. The errors are reported to the Logger, and the
+// refresh is retried at the next tick. It keeps running until Close.
+func (d *DiskStore) startRefresher(interval time.Duration) {
+	stop, done := make(chan struct{}), make(chan struct{})
+	d.refresherStop, d.refresherDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := d.Refresh(); err != nil && !errors.Is(err, os.ErrClosed) {
+					d.opts.Logger.Printf("caskdb: failed to refresh %s: %v", d.fileName, err)
+				}
+			}
+		}
+	}()
+}
+
+// stopRefresher stops the background refresher, if it is running, and waits for it to
+// exit.
+func (d *DiskStore) stopRefresher() {
+	d.mu.Lock()
+	stop, done := d.refresherStop, d.refresherDone
+	d.refresherStop, d.refresherDone = nil, nil
+	d.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,152 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDiskStore_Refresh(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{Format: FormatV2, MaxSegmentSize: 64, ValueLogThreshold: 1024, MergeOperator: joinOperator}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.Set("k0", "v0")
+	readOpts := opts
+	readOpts.ReadOnly = true
+	reader, err := NewDiskStoreWithOptions(fileName, readOpts)
+	if err != nil {
+		t.Fatalf("failed to open the store read-only: %v", err)
+	}
+	defer reader.Close()
+	refresh := func() {
+		t.Helper()
+		if err := reader.Refresh(); err != nil {
+			t.Fatalf("Refresh() error = %v", err)
+		}
+	}
+
+	changes, err := reader.Changes(reader.LogEnd())
+	if err != nil {
+		t.Fatalf("Changes() error = %v", err)
+	}
+	store.Set("book", "dune")
+	if reader.Has("book") {
+		t.Errorf("Has(book) = true before Refresh")
+	}
+	refresh()
+	if got, err := reader.Get("book"); err != nil || got != "dune" {
+		t.Errorf("Get(book) = %v, %v, want dune", got, err)
+	}
+	if e := nextChange(t, changes); e.Key != "book" {
+		t.Errorf("Changes() event = %+v, want book", e)
+	}
+
+	// the writes to the new data files and the value log are picked up as well
+	fillSegments(t, store)
+	store.Set("big", string(make([]byte, 2048)))
+	refresh()
+	checkReplica(t, store, reader)
+
+	// a compaction of the writer reloads keyDir, and the writes go on from there
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	store.Delete("book")
+	refresh()
+	checkReplica(t, store, reader)
+	if len(reader.removedEnds) == 0 {
+		t.Errorf("Refresh() after a compaction kept the removed files")
+	}
+	store.Set("k4", "v6")
+	refresh()
+	checkReplica(t, store, reader)
+
+	if err := store.Refresh(); err != nil {
+		t.Errorf("Refresh() of a writable store error = %v, want nil", err)
+	}
+	mmapOpts := readOpts
+	mmapOpts.MmapReads = true
+	mapped, err := NewDiskStoreWithOptions(fileName, mmapOpts)
+	if err != nil {
+		t.Fatalf("failed to open the store read-only: %v", err)
+	}
+	defer mapped.Close()
+	if err := mapped.Refresh(); err == nil {
+		t.Errorf("Refresh() with MmapReads error = nil, want an error")
+	}
+}
+
+func TestOptions_RefreshInterval(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	reader, err := NewDiskStoreWithOptions(fileName, Options{ReadOnly: true, RefreshInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("failed to open the store read-only: %v", err)
+	}
+	defer reader.Close()
+	store.Set("book", "dune")
+	for deadline := time.Now().Add(5 * time.Second); !reader.Has("book"); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for the background refresh")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDiskStore_RefreshDiskIndex(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{SyncPolicy: SyncNever})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	// a few runs for each shard of keyDir
+	const keys = 20000
+	b := NewWriteBatch()
+	for i := 0; i < keys; i++ {
+		b.Set(fmt.Sprintf("user:%05d", i), fmt.Sprint(i))
+	}
+	if err := store.Commit(b); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	root := t.TempDir()
+	reader, err := NewDiskStoreWithOptions(fileName, Options{ReadOnly: true, NewIndex: NewDiskIndex(root, 0)})
+	if err != nil {
+		t.Fatalf("failed to open the store read-only: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		// a compaction rewrites the files, so that Refresh loads keyDir anew
+		store.Set("round", fmt.Sprint(i))
+		if _, err := store.Compact(); err != nil {
+			t.Fatalf("Compact() error = %v", err)
+		}
+		if err := reader.Refresh(); err != nil {
+			t.Fatalf("Refresh() error = %v", err)
+		}
+		if got, err := reader.Get("round"); err != nil || got != fmt.Sprint(i) {
+			t.Errorf("Get(round) = %v, %v, want %v", got, err, i)
+		}
+		if got, err := reader.Get("user:12345"); err != nil || got != "12345" {
+			t.Errorf("Get(user:12345) = %v, %v, want 12345", got, err)
+		}
+		if entries, _ := os.ReadDir(root); len(entries) != 1 {
+			t.Errorf("the index directory has %v entries after Refresh(), want 1", len(entries))
+		}
+	}
+	if err := reader.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 0 {
+		t.Errorf("Close() left %v entries in the index directory", len(entries))
+	}
+}
@@ -0,0 +1,315 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+// ErrPositionUnavailable is returned by ReadLog for a position which is not in the
+// log: one in a data file which has been compacted away, or past its end.
+var ErrPositionUnavailable = errors.New("log position is not available")
+
+// Position is a position in the log of a DiskStore, which is its data files in the
+// order of their file IDs: the offset of a record in one of them. The zero Position
+// is the start of the log.
+type Position struct {
+	FileID uint32
+	Offset int64
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%d:%d", p.FileID, p.Offset)
+}
+
+// LogOp is what a LogRecord does to its key.
+type LogOp uint8
+
+const (
+	// LogSet sets the key to the value
+	LogSet LogOp = iota
+	// LogDelete deletes the key; it is a tombstone
+	LogDelete
+	// LogMerge adds the value to the merge operands of the key, see Merge
+	LogMerge
+)
+
+// LogRecord is a record of the log, as ReadLog returns it. The value is the one the
+// reads return: decrypted, decompressed and read from the value log, if it was in
+// any of them.
+type LogRecord struct {
+	Op       LogOp
+	Key      string
+	Value    []byte
+	Metadata Metadata
+	// Timestamp is when the record was written, with a granularity of one second
+	Timestamp time.Time
+	// Expiry is when the key expires; the zero time if it never expires
+	Expiry time.Time
+	// Next is the position right after the record, to read the log on from
+	Next Position
+}
+
+// ReadLog returns up to limit records of the log from the position since on, along
+// with the position to read the next ones from, which is since if there are none
+// yet. It is how a replica follows the store: it applies the records to a store of
+// its own with ApplyLog, and keeps reading from the position returned; the server
+// package does so over the network.
+//
+// The log has the latest records of the keys rather than all of the history, since
+// the compactions rewrite the live records of their data files into a new one and
+// remove them. A replica which has not read past the rewritten records reads them
+// again, which does no harm, as they are the latest ones of their keys. A position in
+// a removed file is ErrPositionUnavailable though, since the records after it may
+// have been dropped, like the tombstones; the replica has to start over from the
+// zero Position with an empty store then. The exception is the position at the end
+// of the removed file, which the log goes on from, as long as the store has not been
+// reopened since.
+func (d *DiskStore) ReadLog(since Position, limit int) ([]LogRecord, Position, error) {
+	if limit <= 0 {
+		return nil, since, ErrInvalidLimit
+	}
+	// the files can neither be compacted away nor appended to while they are read
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	select {
+	case <-d.closed:
+		return nil, since, os.ErrClosed
+	default:
+	}
+	fileID, offset, err := d.logStart(since)
+	if err != nil {
+		return nil, since, err
+	}
+	var records []LogRecord
+	next := since
+	for len(records) < limit {
+		end, err := d.logFileEnd(fileID)
+		if err != nil {
+			return records, next, err
+		}
+		if offset >= end {
+			if fileID == d.activeID {
+				break
+			}
+			fileID = d.nextFileID(fileID)
+			offset = d.formats[fileID].dataOffset()
+			continue
+		}
+		r, size, ok, err := d.readLogRecord(fileID, offset, end)
+		if err != nil {
+			return records, next, fmt.Errorf("data file %d, record at offset %d: %w", fileID, offset, err)
+		}
+		offset += size
+		next = Position{FileID: fileID, Offset: offset}
+		if ok {
+			r.Next = next
+			records = append(records, r)
+		}
+	}
+	return records, next, nil
+}
+
+// logStart returns the data file and the offset in it the log is read from at the
+// position. The caller must hold mu.
+func (d *DiskStore) logStart(since Position) (uint32, int64, error) {
+	if _, ok := d.readers[since.FileID]; ok {
+		end, err := d.logFileEnd(since.FileID)
+		if err != nil {
+			return 0, 0, err
+		}
+		if since.Offset <= end {
+			if start := d.formats[since.FileID].dataOffset(); since.Offset < start {
+				return since.FileID, start, nil
+			}
+			return since.FileID, since.Offset, nil
+		}
+	}
+	// the first data file is truncated rather than removed by the compactions, so it
+	// may be shorter than the position as well
+	if end, ok := d.removedEnds[since.FileID]; ok && end == since.Offset && since.FileID < d.activeID {
+		fileID := d.nextFileID(since.FileID)
+		return fileID, d.formats[fileID].dataOffset(), nil
+	}
+	return 0, 0, fmt.Errorf("%w: %v", ErrPositionUnavailable, since)
+}
+
+// logFileEnd returns the end of the last record of the data file: the active one is
+// appended to, and may be followed by the padding of Options.DirectIO and the
+// preallocated space, while its records in the write buffer are not there yet. The
+// caller must hold mu.
+func (d *DiskStore) logFileEnd(fileID uint32) (int64, error) {
+	if fileID == d.activeID {
+		return int64(d.currentOffset) - int64(len(d.wbuf)), nil
+	}
+	info, err := d.readers[fileID].Stat()
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// nextFileID returns the ID of the first data file after the one with fileID, which
+// must be before the active file. The caller must hold mu.
+func (d *DiskStore) nextFileID(fileID uint32) uint32 {
+	next := d.activeID
+	for id := range d.readers {
+		if id > fileID && id < next {
+			next = id
+		}
+	}
+	return next
+}
+
+// readLogRecord reads the record at the offset of the data file, which ends at end,
+// and returns it along with its size. A record whose value has been dropped from the
+// value log is not returned, since the value has been moved, to a later record of the
+// key. The caller must hold mu.
+func (d *DiskStore) readLogRecord(fileID uint32, offset int64, end int64) (LogRecord, int64, bool, error) {
+	format := d.formats[fileID]
+	headerSize := int64(maxHeaderSize)
+	if end-offset < headerSize {
+		headerSize = end - offset
+	}
+	header := make([]byte, headerSize)
+	if err := d.readAt(fileID, header, offset); err != nil {
+		return LogRecord{}, 0, false, err
+	}
+	h, err := format.decodeHeader(header)
+	if err != nil {
+		return LogRecord{}, 0, false, err
+	}
+	size := h.recordSize()
+	if offset+size > end {
+		return LogRecord{}, 0, false, ErrCorruptRecord
+	}
+	record := make([]byte, size)
+	if err := d.readAt(fileID, record, offset); err != nil {
+		return LogRecord{}, 0, false, err
+	}
+	if err := format.verifyRecord(record); err != nil {
+		return LogRecord{}, 0, false, err
+	}
+	r := LogRecord{
+		Key:       string(record[h.length : h.length+int(h.keySize)]),
+		Timestamp: time.Unix(int64(h.timestamp), 0),
+	}
+	if h.expiry != 0 {
+		r.Expiry = time.Unix(int64(h.expiry), 0)
+	}
+	switch {
+	case isTombstone(h.valueSize):
+		r.Op = LogDelete
+		return r, size, true, nil
+	case isMergeOperand(h.valueSize):
+		r.Op = LogMerge
+	default:
+		if r.Metadata, err = decodeMetadata(format.metadata(record)); err != nil {
+			return LogRecord{}, 0, false, err
+		}
+	}
+	if r.Value, err = format.value(record, d.dictionary(fileID), d.keys.Load()); err != nil {
+		return LogRecord{}, 0, false, err
+	}
+	if !h.pointer() {
+		return r, size, true, nil
+	}
+	p, err := decodePointer(r.Value)
+	if err != nil {
+		return LogRecord{}, 0, false, err
+	}
+	if _, ok := d.vlogs[p.logID]; !ok {
+		return LogRecord{}, size, false, nil
+	}
+	if r.Value, err = d.readValueLog(p); err != nil {
+		return LogRecord{}, 0, false, err
+	}
+	return r, size, true, nil
+}
+
+// ApplyLog writes the records read from the log of another store by ReadLog to the
+// store, the way a replica follows the other store. The records keep their
+// timestamps, expiries and metadata, while the values are stored as per the options
+// of this store, compressed or encrypted or not. They are written with a single write
+// and fsync, as Commit does, so either all of them are applied or none. The
+// LogMerge records need the same Options.MergeOperator as the other store has.
+func (d *DiskStore) ApplyLog(records []LogRecord) error {
+	metas := make([][]byte, len(records))
+	for i, r := range records {
+		if r.Op == LogMerge && d.opts.MergeOperator == nil {
+			return ErrNoMergeOperator
+		}
+		if err := checkValueSize(len(r.Value)); err != nil {
+			return err
+		}
+		encoded, err := r.Metadata.encode()
+		if err != nil {
+			return err
+		}
+		if encoded != nil && d.opts.Format != FormatV2 {
+			return ErrMetadataUnsupported
+		}
+		metas[i] = encoded
+	}
+	if len(records) == 0 {
+		return nil
+	}
+	return d.exec(func() error {
+		return d.applyLog(records, metas)
+	})
+}
+
+func (d *DiskStore) applyLog(records []LogRecord, metas [][]byte) error {
+	size := 0
+	for i, r := range records {
+		size += maxHeaderSize + len(metas[i]) + len(r.Key) + len(r.Value)
+	}
+	entries := make([]KeyEntry, len(records))
+	pooled := getBuffer(size)
+	defer putBuffer(pooled)
+	buf := *pooled
+	for i, r := range records {
+		timestamp, expiry := unixNow(), uint32(0)
+		if !r.Timestamp.IsZero() {
+			timestamp = uint32(r.Timestamp.Unix())
+		}
+		if !r.Expiry.IsZero() {
+			expiry = uint32(r.Expiry.Unix())
+		}
+		start := len(buf)
+		switch r.Op {
+		case LogDelete:
+			buf = d.opts.Format.appendTombstone(buf, timestamp, r.Key)
+		case LogMerge:
+			buf = d.appendMergeOperand(buf, timestamp, expiry, r.Key, string(r.Value))
+		default:
+			encoded, err := d.appendEntry(buf, timestamp, expiry, r.Key, r.Value, metas[i])
+			if err != nil {
+				return err
+			}
+			buf = encoded
+		}
+		// the offsets are relative to the start of the records, until they are written
+		entries[i] = NewKeyEntry(timestamp, uint32(start), uint32(len(buf)-start))
+		entries[i].Expiry = expiry
+	}
+	*pooled = buf
+	fileID, offset, err := d.write(buf)
+	if err != nil {
+		return err
+	}
+	for i, r := range records {
+		entries[i].FileID = fileID
+		entries[i].Offset += offset
+		switch r.Op {
+		case LogDelete:
+			d.deferRecord(r.Key, KeyEntry{}, scanRemove)
+		case LogMerge:
+			d.deferRecord(r.Key, entries[i], scanOperand)
+		default:
+			d.deferRecord(r.Key, entries[i], scanPut)
+		}
+	}
+	return d.flushBuffer()
+}
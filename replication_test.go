@@ -0,0 +1,147 @@
+package caskdb
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// replicate applies the log of the store from the position on to the replica, and
+// returns the position it got to.
+func replicate(t *testing.T, store *DiskStore, replica *DiskStore, since Position) Position {
+	t.Helper()
+	for {
+		records, next, err := store.ReadLog(since, 2)
+		if err != nil {
+			t.Fatalf("ReadLog(%v) error = %v", since, err)
+		}
+		if len(records) == 0 {
+			return next
+		}
+		if err := replica.ApplyLog(records); err != nil {
+			t.Fatalf("ApplyLog() error = %v", err)
+		}
+		since = next
+	}
+}
+
+// checkReplica checks that the replica has the same keys and values as the store.
+func checkReplica(t *testing.T, store *DiskStore, replica *DiskStore) {
+	t.Helper()
+	keys := store.Keys()
+	if replica.Len() != len(keys) {
+		t.Errorf("replica has %d keys, want %d", replica.Len(), len(keys))
+	}
+	for _, key := range keys {
+		want, _ := store.Get(key)
+		if got, err := replica.Get(key); err != nil || got != want {
+			t.Errorf("replica Get(%v) = %v, %v, want %v", key, got, err, want)
+		}
+	}
+}
+
+func TestDiskStore_ReadLog(t *testing.T) {
+	dir := t.TempDir()
+	recordSize := int64(headerSize + len("k0") + len("v0"))
+	opts := Options{MaxSegmentSize: 2 * recordSize, MergeOperator: joinOperator}
+	store, err := NewDiskStoreWithOptions(filepath.Join(dir, "test.db"), opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	replica, err := NewDiskStoreWithOptions(filepath.Join(dir, "replica.db"), Options{Format: FormatV2, MergeOperator: joinOperator})
+	if err != nil {
+		t.Fatalf("failed to create the replica: %v", err)
+	}
+	defer replica.Close()
+
+	fillSegments(t, store)
+	store.SetWithTTL("session", "jojo", time.Hour)
+	records, _, err := store.ReadLog(Position{}, 100)
+	if err != nil || len(records) != 10 {
+		t.Fatalf("ReadLog() = %d records, %v, want 10", len(records), err)
+	}
+	if r := records[6]; r.Op != LogDelete || r.Key != "k1" || r.Value != nil {
+		t.Errorf("ReadLog() record 6 = %+v, want the tombstone of k1", r)
+	}
+	if r := records[7]; r.Op != LogMerge || r.Key != "tags" || string(r.Value) != "a" {
+		t.Errorf("ReadLog() record 7 = %+v, want the merge operand a", r)
+	}
+	if r := records[9]; r.Op != LogSet || string(r.Value) != "jojo" || r.Expiry.IsZero() || r.Timestamp.IsZero() {
+		t.Errorf("ReadLog() record 9 = %+v, want session with an expiry", r)
+	}
+
+	pos := replicate(t, store, replica, Position{})
+	checkReplica(t, store, replica)
+	if ttl, err := replica.TTL("session"); err != nil || ttl <= 59*time.Minute {
+		t.Errorf("replica TTL(session) = %v, %v, want an hour", ttl, err)
+	}
+	if records, next, err := store.ReadLog(pos, 100); err != nil || len(records) != 0 || next != pos {
+		t.Errorf("ReadLog() at the end = %d records, %v, %v, want none at %v", len(records), next, err, pos)
+	}
+
+	// the writes after the position are read from it
+	store.Set("k0", "v6")
+	store.Delete("k3")
+	pos = replicate(t, store, replica, pos)
+	checkReplica(t, store, replica)
+
+	// the end of a compacted file is a position the log goes on from, while the ones
+	// before it are not
+	behind := records[0].Next
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	store.Set("k4", "v7")
+	pos = replicate(t, store, replica, pos)
+	checkReplica(t, store, replica)
+	if _, _, err := store.ReadLog(behind, 1); !errors.Is(err, ErrPositionUnavailable) {
+		t.Errorf("ReadLog() of a compacted position error = %v, want %v", err, ErrPositionUnavailable)
+	}
+	if _, _, err := store.ReadLog(Position{FileID: pos.FileID, Offset: pos.Offset + 1}, 1); !errors.Is(err, ErrPositionUnavailable) {
+		t.Errorf("ReadLog() past the end error = %v, want %v", err, ErrPositionUnavailable)
+	}
+	if _, _, err := store.ReadLog(pos, 0); !errors.Is(err, ErrInvalidLimit) {
+		t.Errorf("ReadLog() error = %v, want %v", err, ErrInvalidLimit)
+	}
+
+	// a new replica starts over from the compacted log
+	fresh, err := NewDiskStoreWithOptions(filepath.Join(dir, "fresh.db"), Options{MergeOperator: joinOperator})
+	if err != nil {
+		t.Fatalf("failed to create the replica: %v", err)
+	}
+	defer fresh.Close()
+	replicate(t, store, fresh, Position{})
+	checkReplica(t, store, fresh)
+}
+
+func TestDiskStore_ApplyLog(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	written := time.Unix(1700000000, 0)
+	err = store.ApplyLog([]LogRecord{
+		{Op: LogSet, Key: "book", Value: []byte("dune"), Timestamp: written},
+		{Op: LogSet, Key: "author", Value: []byte("herbert")},
+		{Op: LogDelete, Key: "author"},
+	})
+	if err != nil {
+		t.Fatalf("ApplyLog() error = %v", err)
+	}
+	if _, meta, err := store.GetWithMeta("book"); err != nil || !meta.Timestamp.Equal(written) {
+		t.Errorf("GetWithMeta(book) timestamp = %v, %v, want %v", meta.Timestamp, err, written)
+	}
+	if store.Has("author") {
+		t.Errorf("ApplyLog() did not delete author")
+	}
+	if err := store.ApplyLog([]LogRecord{{Op: LogMerge, Key: "tags", Value: []byte("a")}}); !errors.Is(err, ErrNoMergeOperator) {
+		t.Errorf("ApplyLog() of a merge error = %v, want %v", err, ErrNoMergeOperator)
+	}
+	meta := []LogRecord{{Op: LogSet, Key: "page", Metadata: Metadata{ContentType: "text/html"}}}
+	if err := store.ApplyLog(meta); !errors.Is(err, ErrMetadataUnsupported) {
+		t.Errorf("ApplyLog() with metadata error = %v, want %v", err, ErrMetadataUnsupported)
+	}
+}
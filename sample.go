@@ -0,0 +1,41 @@
+package caskdb
+
+import (
+	"math/rand"
+	"time"
+)
+
+// RandomKeys returns n live keys sampled uniformly at random, without repeats. If the
+// store has n keys or fewer, all of them are returned, in random order. This is handy
+// for probabilistic eviction, like Redis does, and for spot checking the data.
+//
+// The sampling has to go over the whole of keyDir, since a Go map cannot pick a
+// random element: its iteration order is not uniformly random.
+func (d *DiskStore) RandomKeys(n int) []string {
+	if n <= 0 {
+		return nil
+	}
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	now := unixNow()
+	// reservoir sampling: the i-th live key replaces a random sampled key with the
+	// probability n/i, which keeps every key equally likely to be in the sample
+	sample := make([]string, 0, n)
+	seen := 0
+	d.keyDir.forEach(func(key string, keyEntry KeyEntry) {
+		if keyEntry.isExpired(now) {
+			return
+		}
+		seen++
+		if len(sample) < n {
+			sample = append(sample, key)
+		} else if i := r.Intn(seen); i < n {
+			sample[i] = key
+		}
+	})
+	r.Shuffle(len(sample), func(i, j int) {
+		sample[i], sample[j] = sample[j], sample[i]
+	})
+	return sample
+}
@@ -0,0 +1,54 @@
+package caskdb
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestDiskStore_RandomKeys(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	if got := store.RandomKeys(3); len(got) != 0 {
+		t.Errorf("RandomKeys() on empty store = %v, want none", got)
+	}
+	for i := 0; i < 10; i++ {
+		store.Set(strconv.Itoa(i), "v")
+	}
+	store.Delete("0")
+
+	counts := make(map[string]int)
+	for i := 0; i < 900; i++ {
+		keys := store.RandomKeys(3)
+		if len(keys) != 3 {
+			t.Fatalf("RandomKeys() = %v, want 3 keys", keys)
+		}
+		sort.Strings(keys)
+		if keys[0] == keys[1] || keys[1] == keys[2] {
+			t.Fatalf("RandomKeys() = %v, want no repeats", keys)
+		}
+		for _, key := range keys {
+			counts[key]++
+		}
+	}
+	if counts["0"] != 0 {
+		t.Errorf("RandomKeys() returned the deleted key")
+	}
+	// every key is expected 300 times; this is far off only if the sampling is broken
+	for i := 1; i < 10; i++ {
+		if c := counts[strconv.Itoa(i)]; c < 150 || c > 450 {
+			t.Errorf("RandomKeys() sampled %v %v times, want about 300", i, c)
+		}
+	}
+
+	all := store.RandomKeys(20)
+	sort.Strings(all)
+	if len(all) != 9 || all[0] != "1" || all[8] != "9" {
+		t.Errorf("RandomKeys(20) = %v, want all 9 keys", all)
+	}
+	store.Close()
+}
@@ -0,0 +1,101 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// segmentName returns the path of the data file with the given file ID. The first
+// data file is fileName itself, so a store which never rotates is a single file as
+// before; the later ones get the file ID as a suffix: books.db, books.db.000001,
+// books.db.000002 and so on.
+func segmentName(fileName string, fileID uint32) string {
+	if fileID == 0 {
+		return fileName
+	}
+	return fmt.Sprintf("%s.%06d", fileName, fileID)
+}
+
+// listSegments returns the file IDs of all the data files of the store at fileName,
+// in order. The first data file, with the file ID 0, is always included.
+func listSegments(fileName string) ([]uint32, error) {
+	entries, err := os.ReadDir(filepath.Dir(fileName))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(fileName) + "."
+	fileIDs := []uint32{0}
+	for _, entry := range entries {
+		suffix := strings.TrimPrefix(entry.Name(), prefix)
+		if entry.IsDir() || suffix == entry.Name() || len(suffix) < 6 {
+			continue
+		}
+		fileID, err := strconv.ParseUint(suffix, 10, 32)
+		if err != nil || fileID == 0 {
+			continue
+		}
+		fileIDs = append(fileIDs, uint32(fileID))
+	}
+	sort.Slice(fileIDs, func(i, j int) bool {
+		return fileIDs[i] < fileIDs[j]
+	})
+	return fileIDs, nil
+}
+
+// rotate seals the active data file and starts a new one. The sealed file is synced
+// first, whatever the SyncPolicy is, since Sync only covers the active file, and a
+// sealed file is never touched again.
+func (d *DiskStore) rotate() error {
+	return d.rotateTo(d.activeID + 1)
+}
+
+// rotateTo is the same as rotate, but the new active file gets the given file ID,
+// which must be greater than the one of the active file.
+func (d *DiskStore) rotateTo(fileID uint32) error {
+	name := segmentName(d.fileName, fileID)
+	if err := createFile(name, d.opts.FileMode); err != nil {
+		return err
+	}
+	reader, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	writer, err := d.openWriter(name)
+	if err != nil {
+		reader.Close()
+		return err
+	}
+	if d.dirty {
+		if err := d.syncFile(); err != nil {
+			reader.Close()
+			writer.Close()
+			return d.fail(fmt.Errorf("failed to sync to disk: %w", err))
+		}
+		d.dirty = false
+	}
+	// the sealed file must end with its last record, without the padding of the direct
+	// IO writes or the preallocated space
+	if err := d.trimActive(); err != nil {
+		reader.Close()
+		writer.Close()
+		return d.fail(err)
+	}
+	if err := d.writeFileHandle.Close(); err != nil {
+		reader.Close()
+		writer.Close()
+		return d.fail(err)
+	}
+	d.filesMu.Lock()
+	d.readers[fileID] = reader
+	d.filesMu.Unlock()
+	d.writeFileHandle = writer
+	d.mapFile(d.activeID)
+	d.activeID, d.currentOffset = fileID, 0
+	d.openDirect()
+	d.preallocate()
+	return d.startFile()
+}
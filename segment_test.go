@@ -0,0 +1,89 @@
+package caskdb
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func Test_segmentName(t *testing.T) {
+	if got := segmentName("books.db", 0); got != "books.db" {
+		t.Errorf("segmentName(0) = %v, want books.db", got)
+	}
+	if got := segmentName("books.db", 12); got != "books.db.000012" {
+		t.Errorf("segmentName(12) = %v, want books.db.000012", got)
+	}
+}
+
+func Test_listSegments(t *testing.T) {
+	dir := t.TempDir()
+	fileName := filepath.Join(dir, "books.db")
+	for _, name := range []string{"books.db", "books.db.000002", "books.db.000010", "books.db.1.tmp", "books.db.x", "other.db.000003"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatalf("failed to write the file: %v", err)
+		}
+	}
+	fileIDs, err := listSegments(fileName)
+	if err != nil {
+		t.Fatalf("listSegments() error = %v", err)
+	}
+	if want := []uint32{0, 2, 10}; !reflect.DeepEqual(fileIDs, want) {
+		t.Errorf("listSegments() = %v, want %v", fileIDs, want)
+	}
+}
+
+func TestDiskStore_MaxSegmentSize(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	recordSize := int64(headerSize + len("k0") + len("v0"))
+	store, err := NewDiskStoreWithOptions(fileName, Options{MaxSegmentSize: 2 * recordSize})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	for _, kv := range [][2]string{{"k0", "v0"}, {"k1", "v1"}, {"k2", "v2"}, {"k0", "v3"}, {"k3", "v4"}} {
+		if err := store.Set(kv[0], kv[1]); err != nil {
+			t.Fatalf("Set() error = %v", err)
+		}
+	}
+	store.Delete("k1")
+	if _, meta, _ := store.GetWithMeta("k3"); meta.FileID != 2 || meta.Offset != 0 {
+		t.Errorf("GetWithMeta() file ID, offset = %v, %v, want 2, 0", meta.FileID, meta.Offset)
+	}
+	for _, fileID := range []uint32{1, 2} {
+		if _, err := os.Stat(segmentName(fileName, fileID)); err != nil {
+			t.Errorf("data file %v is missing: %v", fileID, err)
+		}
+	}
+	want := map[string]string{"k0": "v3", "k2": "v2", "k3": "v4"}
+	check := func() {
+		for key, value := range want {
+			if got, err := store.Get(key); err != nil || got != value {
+				t.Errorf("Get(%v) = %v, %v, want %v", key, got, err, value)
+			}
+		}
+		if _, err := store.Get("k1"); err != ErrKeyNotFound {
+			t.Errorf("Get(k1) error = %v, want %v", err, ErrKeyNotFound)
+		}
+		got, err := store.GetMulti([]string{"k0", "k1", "k2", "k3"})
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("GetMulti() = %v, %v, want %v", got, err, want)
+		}
+	}
+	check()
+	if size := store.DiskSize(); size != 5*recordSize+int64(headerSize+len("k1")) {
+		t.Errorf("DiskSize() = %v, want %v", size, 5*recordSize+int64(headerSize+len("k1")))
+	}
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, Options{MaxSegmentSize: 2 * recordSize})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	check()
+	// the active file holds k3 and the tombstone of k1, so there is no room left
+	store.Set("k4", "v5")
+	if _, meta, _ := store.GetWithMeta("k4"); meta.FileID != 3 || meta.Offset != 0 {
+		t.Errorf("GetWithMeta() file ID, offset = %v, %v, want 3, 0", meta.FileID, meta.Offset)
+	}
+	store.Close()
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Access is what a Grant lets a user do with the keys.
+type Access uint8
+
+const (
+	// AccessRead lets the user read the keys, and see them in the listings
+	AccessRead Access = 1 << iota
+	// AccessWrite lets the user set and delete the keys
+	AccessWrite
+	// AccessReadWrite is both AccessRead and AccessWrite
+	AccessReadWrite = AccessRead | AccessWrite
+)
+
+// Grant gives a user access to the keys with the prefix; the empty prefix is all the
+// keys. The grant with the longest prefix of a key decides the access to it, so a
+// grant of a longer prefix can take away the access a shorter one gives:
+//
+//	[]Grant{{Prefix: "", Access: AccessRead}, {Prefix: "billing:", Access: 0}}
+//
+// reads all the keys but the ones of billing.
+type Grant struct {
+	Prefix string
+	Access Access
+}
+
+// User is a client of the servers, who is authenticated by the token and has the
+// access of the grants; without any, the user may not touch any key.
+type User struct {
+	// Name is for the logs and the errors only
+	Name   string
+	Token  string
+	Grants []Grant
+}
+
+// can reports whether the user has the access to the key. A nil user is the one of
+// a server without an Auth, who can do anything.
+func (u *User) can(key string, access Access) bool {
+	if u == nil {
+		return true
+	}
+	best, granted := -1, Access(0)
+	for _, g := range u.Grants {
+		if len(g.Prefix) > best && strings.HasPrefix(key, g.Prefix) {
+			best, granted = len(g.Prefix), g.Access
+		}
+	}
+	return granted&access == access
+}
+
+// canAll reports whether the user has the access to all the keys, whatever their
+// prefix, as the replication needs.
+func (u *User) canAll(access Access) bool {
+	if u == nil {
+		return true
+	}
+	if !u.can("", access) {
+		return false
+	}
+	for _, g := range u.Grants {
+		if g.Access&access != access {
+			return false
+		}
+	}
+	return true
+}
+
+// Auth authenticates the clients of the servers by their tokens, and authorises
+// their requests with the grants of the users, see the Auth of the options of each
+// server. A server without one lets every client do anything. The tokens are sent
+// in the clear, so the servers with an Auth should be served over TLS unless the
+// network is trusted.
+//
+// A single token with the access to everything is:
+//
+//	auth, err := server.NewAuth(server.User{
+//		Name:   "app",
+//		Token:  os.Getenv("CASKDB_TOKEN"),
+//		Grants: []server.Grant{{Access: server.AccessReadWrite}},
+//	})
+type Auth struct {
+	// users are looked up by the hash of their token, which keeps the time the lookup
+	// takes from telling anything about the tokens
+	users map[[sha256.Size]byte]*User
+}
+
+// errInvalidToken is returned of a token no user has.
+var errInvalidToken = errors.New("invalid token")
+
+// NewAuth returns an Auth of the users, which must each have a token of their own.
+func NewAuth(users ...User) (*Auth, error) {
+	a := &Auth{users: make(map[[sha256.Size]byte]*User, len(users))}
+	for i := range users {
+		u := users[i]
+		if u.Token == "" {
+			return nil, fmt.Errorf("user %q has no token", u.Name)
+		}
+		sum := sha256.Sum256([]byte(u.Token))
+		if _, ok := a.users[sum]; ok {
+			return nil, fmt.Errorf("user %q has the token of another user", u.Name)
+		}
+		u.Grants = append([]Grant(nil), u.Grants...)
+		a.users[sum] = &u
+	}
+	return a, nil
+}
+
+// authenticate returns the user of the token.
+func (a *Auth) authenticate(token string) (*User, error) {
+	u, ok := a.users[sha256.Sum256([]byte(token))]
+	if !ok {
+		return nil, errInvalidToken
+	}
+	return u, nil
+}
+
+// filterKeys returns the keys the user can read, in place.
+func filterKeys(u *User, keys []string) []string {
+	readable := keys[:0]
+	for _, key := range keys {
+		if u.can(key, AccessRead) {
+			readable = append(readable, key)
+		}
+	}
+	return readable
+}
@@ -0,0 +1,73 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUser_can(t *testing.T) {
+	u := &User{Grants: []Grant{
+		{Prefix: "", Access: AccessRead},
+		{Prefix: "books:", Access: AccessReadWrite},
+		{Prefix: "books:secret:", Access: 0},
+	}}
+	for _, tt := range []struct {
+		key    string
+		access Access
+		want   bool
+	}{
+		{"authors:1", AccessRead, true},
+		{"authors:1", AccessWrite, false},
+		{"books:1", AccessReadWrite, true},
+		{"books:secret:1", AccessRead, false},
+	} {
+		if got := u.can(tt.key, tt.access); got != tt.want {
+			t.Errorf("can(%v, %v) = %v, want %v", tt.key, tt.access, got, tt.want)
+		}
+	}
+	if (&User{}).can("books:1", AccessRead) {
+		t.Errorf("can() of a user without grants = true, want false")
+	}
+	var anyone *User
+	if !anyone.can("books:secret:1", AccessReadWrite) {
+		t.Errorf("can() of the nil user = false, want true")
+	}
+	if u.canAll(AccessRead) || !(&User{Grants: []Grant{{Access: AccessRead}, {Prefix: "books:", Access: AccessReadWrite}}}).canAll(AccessRead) {
+		t.Errorf("canAll() = true for a denied prefix, or false for none")
+	}
+	if got := filterKeys(u, []string{"books:1", "books:secret:1", "authors:1"}); !reflect.DeepEqual(got, []string{"books:1", "authors:1"}) {
+		t.Errorf("filterKeys() = %v, want the readable keys", got)
+	}
+}
+
+func TestNewAuth(t *testing.T) {
+	auth, err := NewAuth(User{Name: "app", Token: "s3cret"}, User{Name: "other", Token: "other"})
+	if err != nil {
+		t.Fatalf("NewAuth() error = %v", err)
+	}
+	if u, err := auth.authenticate("s3cret"); err != nil || u.Name != "app" {
+		t.Errorf("authenticate(s3cret) = %v, %v, want app", u, err)
+	}
+	if _, err := auth.authenticate("wrong"); err != errInvalidToken {
+		t.Errorf("authenticate(wrong) error = %v, want %v", err, errInvalidToken)
+	}
+	if _, err := NewAuth(User{Name: "app"}); err == nil {
+		t.Errorf("NewAuth() without a token error = nil, want an error")
+	}
+	if _, err := NewAuth(User{Name: "app", Token: "t"}, User{Name: "other", Token: "t"}); err == nil {
+		t.Errorf("NewAuth() with a shared token error = nil, want an error")
+	}
+}
+
+// testAuth has a reader of everything and a writer of the books.
+func testAuth(t *testing.T) *Auth {
+	t.Helper()
+	auth, err := NewAuth(
+		User{Name: "reader", Token: "read", Grants: []Grant{{Access: AccessRead}, {Prefix: "secret:", Access: 0}}},
+		User{Name: "writer", Token: "write", Grants: []Grant{{Prefix: "book:", Access: AccessReadWrite}}},
+	)
+	if err != nil {
+		t.Fatalf("NewAuth() error = %v", err)
+	}
+	return auth
+}
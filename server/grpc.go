@@ -0,0 +1,388 @@
+package server
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// GRPCOptions are the options of a GRPCHandler.
+type GRPCOptions struct {
+	// MaxMessageSize is the largest request message, in bytes; the larger ones fail
+	// with RESOURCE_EXHAUSTED. Defaults to 4 MiB, the same as grpc-go.
+	MaxMessageSize int
+	// Auth, if set, authenticates the calls by the token of their authorization
+	// metadata, "Bearer <token>", and authorises them; the calls without a valid
+	// token fail with UNAUTHENTICATED, and the ones on the keys the user has no
+	// access to with PERMISSION_DENIED. Scan leaves out the keys the user cannot read.
+	Auth *Auth
+}
+
+const defaultMaxMessageSize = 4 << 20
+
+// The gRPC status codes the handler returns, see
+// https://grpc.github.io/grpc/core/md_doc_statuscodes.html.
+const (
+	codeOK                 = 0
+	codeCanceled           = 1
+	codeInvalidArgument    = 3
+	codeNotFound           = 5
+	codePermissionDenied   = 7
+	codeResourceExhausted  = 8
+	codeFailedPrecondition = 9
+	codeUnimplemented      = 12
+	codeInternal           = 13
+	codeUnauthenticated    = 16
+)
+
+// errPermissionDenied is returned of the calls on the keys the user has no access to.
+var errPermissionDenied = &grpcError{codePermissionDenied, "permission denied"}
+
+// grpcError is an error with the gRPC status code it is returned with.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return e.msg
+}
+
+// GRPCHandler serves the CaskDB service of caskdb.proto, which is next to this file,
+// so that the clients generated from it for any language can use the store. It is
+// an http.Handler rather than a grpc.Server, since the module does without the
+// dependencies: gRPC runs over HTTP/2, which net/http serves, and the messages are
+// simple enough to encode without the protobuf runtime.
+//
+// The catch is that net/http only speaks HTTP/2 over TLS, so the clients have to
+// connect with TLS, rather than the plain text h2c of the examples of gRPC:
+//
+//	srv := &http.Server{Addr: ":50051", Handler: server.NewGRPCHandler(store, server.GRPCOptions{})}
+//	srv.ListenAndServeTLS("cert.pem", "key.pem")
+//
+// The compressed messages, the deadlines and the metadata of gRPC are not
+// supported; a request cancelled by its client stops a Scan.
+type GRPCHandler struct {
+	store *caskdb.DiskStore
+	opts  GRPCOptions
+}
+
+// NewGRPCHandler returns a GRPCHandler of the store.
+func NewGRPCHandler(store *caskdb.DiskStore, opts GRPCOptions) *GRPCHandler {
+	if opts.MaxMessageSize <= 0 {
+		opts.MaxMessageSize = defaultMaxMessageSize
+	}
+	return &GRPCHandler{store: store, opts: opts}
+}
+
+// grpcService is the path prefix of the methods of the service.
+const grpcService = "/caskdb.v1.CaskDB/"
+
+func (h *GRPCHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.ProtoMajor != 2 || !strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "gRPC requests must be made over HTTP/2 with the application/grpc content type", http.StatusUnsupportedMediaType)
+		return
+	}
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, "POST")
+		return
+	}
+	w.Header().Set("Content-Type", "application/grpc")
+	w.Header().Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	var user *User
+	var err error
+	if h.opts.Auth != nil {
+		if user, err = h.opts.Auth.authenticate(bearerToken(r)); err != nil {
+			err = &grpcError{codeUnauthenticated, err.Error()}
+		}
+	}
+	switch enc := r.Header.Get("Grpc-Encoding"); {
+	case err != nil:
+	case enc != "" && enc != "identity":
+		err = &grpcError{codeUnimplemented, "compression is not supported"}
+	case r.URL.Path == grpcService+"Scan":
+		err = h.scan(w, r, user)
+	default:
+		err = h.unary(w, r, user, strings.TrimPrefix(r.URL.Path, grpcService))
+	}
+	code, msg := codeOK, ""
+	if err != nil {
+		code, msg = grpcStatus(err)
+	}
+	w.Header().Set("Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		w.Header().Set("Grpc-Message", encodeGRPCMessage(msg))
+	}
+}
+
+// unary serves the methods which take a request message and return a response one.
+func (h *GRPCHandler) unary(w http.ResponseWriter, r *http.Request, user *User, method string) error {
+	var call func(user *User, req []byte) ([]byte, error)
+	switch method {
+	case "Get":
+		call = h.get
+	case "Set":
+		call = h.set
+	case "Delete":
+		call = h.delete
+	case "BatchWrite":
+		call = h.batchWrite
+	default:
+		return &grpcError{codeUnimplemented, fmt.Sprintf("unknown method %q", method)}
+	}
+	req, err := h.readMessage(r.Body)
+	if err != nil {
+		return err
+	}
+	resp, err := call(user, req)
+	if err != nil {
+		return err
+	}
+	return writeMessage(w, resp)
+}
+
+func (h *GRPCHandler) get(user *User, req []byte) ([]byte, error) {
+	var key []byte
+	err := parseProto(req, func(f protoField) error {
+		if f.num == 1 {
+			return bytesField(f, &key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !user.can(string(key), AccessRead) {
+		return nil, errPermissionDenied
+	}
+	value, err := h.store.GetBytes(string(key))
+	if err != nil {
+		return nil, err
+	}
+	return appendBytesField(nil, 1, value), nil
+}
+
+func (h *GRPCHandler) set(user *User, req []byte) ([]byte, error) {
+	var key, value []byte
+	var ttlMs int64
+	err := parseProto(req, func(f protoField) error {
+		switch f.num {
+		case 1:
+			return bytesField(f, &key)
+		case 2:
+			return bytesField(f, &value)
+		case 3:
+			if f.wireType != wireVarint {
+				return errInvalidProto
+			}
+			ttlMs = int64(f.v)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !user.can(string(key), AccessWrite) {
+		return nil, errPermissionDenied
+	}
+	switch {
+	case ttlMs < 0:
+		return nil, caskdb.ErrInvalidTTL
+	case ttlMs > 0:
+		err = h.store.SetWithTTL(string(key), string(value), time.Duration(ttlMs)*time.Millisecond)
+	default:
+		err = h.store.SetBytes(string(key), value)
+	}
+	return nil, err
+}
+
+func (h *GRPCHandler) delete(user *User, req []byte) ([]byte, error) {
+	var key []byte
+	err := parseProto(req, func(f protoField) error {
+		if f.num == 1 {
+			return bytesField(f, &key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !user.can(string(key), AccessWrite) {
+		return nil, errPermissionDenied
+	}
+	return nil, h.store.Delete(string(key))
+}
+
+func (h *GRPCHandler) batchWrite(user *User, req []byte) ([]byte, error) {
+	b := caskdb.NewWriteBatch()
+	err := parseProto(req, func(f protoField) error {
+		if f.num != 1 {
+			return nil
+		}
+		var write []byte
+		if err := bytesField(f, &write); err != nil {
+			return err
+		}
+		var key, value []byte
+		del := false
+		err := parseProto(write, func(f protoField) error {
+			switch f.num {
+			case 1:
+				return bytesField(f, &key)
+			case 2:
+				return bytesField(f, &value)
+			case 3:
+				if f.wireType != wireVarint {
+					return errInvalidProto
+				}
+				del = f.v != 0
+			}
+			return nil
+		})
+		if err == nil && !user.can(string(key), AccessWrite) {
+			return errPermissionDenied
+		}
+		if del {
+			b.Delete(string(key))
+		} else {
+			b.Set(string(key), string(value))
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return nil, h.store.Commit(b)
+}
+
+func (h *GRPCHandler) scan(w http.ResponseWriter, r *http.Request, user *User) error {
+	req, err := h.readMessage(r.Body)
+	if err != nil {
+		return err
+	}
+	var prefix []byte
+	keysOnly := false
+	err = parseProto(req, func(f protoField) error {
+		switch f.num {
+		case 1:
+			return bytesField(f, &prefix)
+		case 2:
+			if f.wireType != wireVarint {
+				return errInvalidProto
+			}
+			keysOnly = f.v != 0
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	send := func(key, value string) error {
+		if err := r.Context().Err(); err != nil {
+			return err
+		}
+		resp := appendBytesField(nil, 1, []byte(key))
+		return writeMessage(w, appendBytesField(resp, 2, []byte(value)))
+	}
+	if keysOnly {
+		// answered from keyDir alone, without reading the values
+		for _, key := range filterKeys(user, h.store.KeysWithPrefix(string(prefix))) {
+			if err := send(key, ""); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	it := h.store.IteratorWithPrefix(string(prefix))
+	defer it.Close()
+	for it.Next() {
+		if !user.can(it.Key(), AccessRead) {
+			continue
+		}
+		if err := send(it.Key(), it.Value()); err != nil {
+			return err
+		}
+	}
+	return it.Err()
+}
+
+// bytesField sets b to the value of the field, which must be length delimited.
+func bytesField(f protoField, b *[]byte) error {
+	if f.wireType != wireBytes {
+		return errInvalidProto
+	}
+	*b = f.b
+	return nil
+}
+
+// readMessage reads a message of the request, which is framed by a byte telling
+// whether it is compressed and its size, as 4 big endian bytes.
+func (h *GRPCHandler) readMessage(r io.Reader) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, &grpcError{codeInvalidArgument, "missing request message"}
+	}
+	if prefix[0] != 0 {
+		return nil, &grpcError{codeUnimplemented, "compression is not supported"}
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if uint64(size) > uint64(h.opts.MaxMessageSize) {
+		return nil, &grpcError{codeResourceExhausted, fmt.Sprintf("message of %d bytes is larger than the maximum of %d", size, h.opts.MaxMessageSize)}
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, &grpcError{codeInvalidArgument, "truncated request message"}
+	}
+	return msg, nil
+}
+
+func writeMessage(w io.Writer, msg []byte) error {
+	frame := make([]byte, 5, 5+len(msg))
+	binary.BigEndian.PutUint32(frame[1:], uint32(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+// grpcStatus returns the status code and message the error is returned with.
+func grpcStatus(err error) (int, string) {
+	var gerr *grpcError
+	switch {
+	case errors.As(err, &gerr):
+		return gerr.code, gerr.msg
+	case errors.Is(err, errInvalidProto), errors.Is(err, caskdb.ErrInvalidTTL):
+		return codeInvalidArgument, err.Error()
+	case errors.Is(err, caskdb.ErrKeyNotFound):
+		return codeNotFound, err.Error()
+	case errors.Is(err, caskdb.ErrReadOnly):
+		return codeFailedPrecondition, err.Error()
+	case errors.Is(err, caskdb.ErrFileTooLarge):
+		return codeResourceExhausted, err.Error()
+	case errors.Is(err, context.Canceled):
+		return codeCanceled, err.Error()
+	}
+	return codeInternal, err.Error()
+}
+
+// encodeGRPCMessage percent encodes the message for the Grpc-Message trailer, which
+// can only have the printable ASCII.
+func encodeGRPCMessage(msg string) string {
+	var b strings.Builder
+	for i := 0; i < len(msg); i++ {
+		if c := msg[i]; c >= ' ' && c <= '~' && c != '%' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+	"time"
+)
+
+// grpcCall makes a gRPC call to the method with the request message, and returns the
+// response messages and the status.
+func grpcCall(t *testing.T, srv *httptest.Server, method string, req []byte) ([][]byte, string, string) {
+	t.Helper()
+	return grpcCallWithToken(t, srv, method, req, "")
+}
+
+// grpcCallWithToken is the same as grpcCall, with the token in the authorization
+// metadata.
+func grpcCallWithToken(t *testing.T, srv *httptest.Server, method string, req []byte, token string) ([][]byte, string, string) {
+	t.Helper()
+	var body bytes.Buffer
+	writeMessage(&body, req)
+	httpReq, err := http.NewRequest("POST", srv.URL+grpcService+method, &body)
+	if err != nil {
+		t.Fatalf("failed to create the request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/grpc")
+	httpReq.Header.Set("TE", "trailers")
+	if token != "" {
+		httpReq.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := srv.Client().Do(httpReq)
+	if err != nil {
+		t.Fatalf("%v error = %v", method, err)
+	}
+	defer resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("%v over HTTP/%d, want HTTP/2", method, resp.ProtoMajor)
+	}
+	var msgs [][]byte
+	for {
+		var prefix [5]byte
+		if _, err := io.ReadFull(resp.Body, prefix[:]); err != nil {
+			break
+		}
+		msg := make([]byte, binary.BigEndian.Uint32(prefix[1:]))
+		if _, err := io.ReadFull(resp.Body, msg); err != nil {
+			t.Fatalf("failed to read the response message: %v", err)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs, resp.Trailer.Get("Grpc-Status"), resp.Trailer.Get("Grpc-Message")
+}
+
+func TestGRPCHandler(t *testing.T) {
+	store := newTestStore(t)
+	srv := httptest.NewUnstartedServer(NewGRPCHandler(store, GRPCOptions{MaxMessageSize: 64}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	key := func(k string) []byte { return appendBytesField(nil, 1, []byte(k)) }
+	kv := func(k, v string) []byte { return appendBytesField(key(k), 2, []byte(v)) }
+
+	if _, status, msg := grpcCall(t, srv, "Get", key("book")); status != "5" || msg != "key not found" {
+		t.Errorf("Get(book) status = %v %q, want 5 (NOT_FOUND)", status, msg)
+	}
+	if _, status, _ := grpcCall(t, srv, "Set", kv("book", "dune")); status != "0" {
+		t.Errorf("Set(book) status = %v, want 0", status)
+	}
+	msgs, status, _ := grpcCall(t, srv, "Get", key("book"))
+	if status != "0" || len(msgs) != 1 || !bytes.Equal(msgs[0], appendBytesField(nil, 1, []byte("dune"))) {
+		t.Errorf("Get(book) = %q, status %v, want dune", msgs, status)
+	}
+	session := appendTag(kv("session", "jojo"), 3, wireVarint)
+	session = binary.AppendUvarint(session, uint64(time.Hour/time.Millisecond))
+	if _, status, _ := grpcCall(t, srv, "Set", session); status != "0" {
+		t.Errorf("Set(session) status = %v, want 0", status)
+	}
+	if ttl, err := store.TTL("session"); err != nil || ttl <= 59*time.Minute {
+		t.Errorf("TTL(session) = %v, %v, want an hour", ttl, err)
+	}
+	if _, status, _ := grpcCall(t, srv, "Set", kv("book", string(make([]byte, 64)))); status != "8" {
+		t.Errorf("Set() of a large message status = %v, want 8 (RESOURCE_EXHAUSTED)", status)
+	}
+	if _, status, _ := grpcCall(t, srv, "Get", []byte{0xff}); status != "3" {
+		t.Errorf("Get() of a bad message status = %v, want 3 (INVALID_ARGUMENT)", status)
+	}
+	if _, status, _ := grpcCall(t, srv, "Watch", nil); status != "12" {
+		t.Errorf("Watch() status = %v, want 12 (UNIMPLEMENTED)", status)
+	}
+
+	batch := appendBytesField(nil, 1, kv("book:1", "emma"))
+	batch = appendBytesField(batch, 1, kv("book:2", "persuasion"))
+	batch = appendBytesField(batch, 1, append(appendTag(key("book"), 3, wireVarint), 1))
+	if _, status, _ := grpcCall(t, srv, "BatchWrite", batch); status != "0" {
+		t.Errorf("BatchWrite() status = %v, want 0", status)
+	}
+	if store.Has("book") || !store.Has("book:2") {
+		t.Errorf("BatchWrite() did not apply the writes")
+	}
+	if _, status, _ := grpcCall(t, srv, "Delete", key("book:2")); status != "0" || store.Has("book:2") {
+		t.Errorf("Delete(book:2) status = %v, want the key deleted", status)
+	}
+
+	store.Set("book:3", "sanditon")
+	msgs, status, _ = grpcCall(t, srv, "Scan", appendBytesField(nil, 1, []byte("book:")))
+	var got []string
+	for _, msg := range msgs {
+		var k, v []byte
+		parseProto(msg, func(f protoField) error {
+			if f.num == 1 {
+				k = f.b
+			} else {
+				v = f.b
+			}
+			return nil
+		})
+		got = append(got, string(k)+"="+string(v))
+	}
+	sort.Strings(got)
+	if status != "0" || len(got) != 2 || got[0] != "book:1=emma" || got[1] != "book:3=sanditon" {
+		t.Errorf("Scan(book:) = %v, status %v, want book:1 and book:3", got, status)
+	}
+}
+
+func TestGRPCHandler_auth(t *testing.T) {
+	store := newTestStore(t)
+	store.Set("book:1", "dune")
+	store.Set("secret:1", "value")
+	srv := httptest.NewUnstartedServer(NewGRPCHandler(store, GRPCOptions{Auth: testAuth(t)}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+
+	key := func(k string) []byte { return appendBytesField(nil, 1, []byte(k)) }
+	write := func(k string) []byte { return appendBytesField(nil, 1, appendBytesField(key(k), 2, []byte("v"))) }
+	for _, tt := range []struct {
+		method string
+		req    []byte
+		token  string
+		status string
+	}{
+		{"Get", key("book:1"), "", "16"},
+		{"Get", key("book:1"), "wrong", "16"},
+		{"Get", key("book:1"), "read", "0"},
+		{"Get", key("secret:1"), "read", "7"},
+		{"Set", key("book:1"), "read", "7"},
+		{"Set", key("book:2"), "write", "0"},
+		{"Delete", key("secret:1"), "write", "7"},
+		{"BatchWrite", append(write("book:3"), write("author:1")...), "write", "7"},
+	} {
+		if _, status, _ := grpcCallWithToken(t, srv, tt.method, tt.req, tt.token); status != tt.status {
+			t.Errorf("%v with %q status = %v, want %v", tt.method, tt.token, status, tt.status)
+		}
+	}
+	if store.Has("book:3") {
+		t.Errorf("BatchWrite() applied a batch with a denied write")
+	}
+
+	msgs, status, _ := grpcCallWithToken(t, srv, "Scan", append(appendTag(nil, 2, wireVarint), 1), "read")
+	if status != "0" || len(msgs) != 2 {
+		t.Errorf("Scan() = %q, status %v, want book:1 and book:2 only", msgs, status)
+	}
+}
+
+func TestGRPCHandler_notGRPC(t *testing.T) {
+	srv := httptest.NewServer(NewGRPCHandler(newTestStore(t), GRPCOptions{}))
+	defer srv.Close()
+	resp, err := http.Post(srv.URL+grpcService+"Get", "application/grpc", nil)
+	if err != nil {
+		t.Fatalf("POST error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnsupportedMediaType {
+		t.Errorf("POST over HTTP/1.1 status = %v, want %v", resp.StatusCode, http.StatusUnsupportedMediaType)
+	}
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// HTTPOptions are the options of an HTTPHandler.
+type HTTPOptions struct {
+	// MaxBodySize is the largest value a PUT can write, in bytes; the larger ones are
+	// refused with 413. Defaults to 1 MiB.
+	MaxBodySize int64
+	// MaxListLimit is the most keys a page of the list can have. Defaults to 1000.
+	MaxListLimit int
+	// Auth, if set, authenticates the requests by the token of their Authorization
+	// header, "Bearer <token>", and authorises them; the requests without a valid
+	// token fail with 401, and the ones on the keys the user has no access to with
+	// 403. The list leaves out the keys the user cannot read, so its pages can be
+	// short of the limit.
+	Auth *Auth
+}
+
+const (
+	defaultMaxBodySize  = 1 << 20
+	defaultMaxListLimit = 1000
+	// defaultListLimit is the size of a page of the list when the request has no limit
+	defaultListLimit = 100
+)
+
+// HTTPHandler serves the store as a JSON REST API, to be mounted in an HTTP server:
+//
+//	GET    /v1/keys/{key}                        the value, as the body
+//	PUT    /v1/keys/{key}[?ttl=30s]              sets the value to the body
+//	DELETE /v1/keys/{key}                        deletes the key
+//	GET    /v1/keys[?prefix=&cursor=&limit=]     a page of the keys, in key order
+//	GET    /v1/stats                             the size of the store
+//
+// The key is the rest of the path, unescaped, so it can have slashes. The value is
+// served with the content type of its metadata, if it has one, see
+// caskdb.Metadata, and with an Expires header if it expires. A page of the list is
+// {"keys": [...], "next_cursor": "..."}, where an empty next_cursor means it is the
+// last page; see DiskStore.ListPageWithPrefix. The errors are
+// {"error": "..."}, with 404 for a missing key; deleting a missing key is not an
+// error, as with DiskStore.Delete.
+//
+// The paths are absolute, so that the handler is mounted at /v1/:
+//
+//	mux.Handle("/v1/", server.NewHTTPHandler(store, server.HTTPOptions{}))
+//
+// Mounted elsewhere, it needs http.StripPrefix to take the rest of the path off.
+type HTTPHandler struct {
+	store *caskdb.DiskStore
+	opts  HTTPOptions
+}
+
+// NewHTTPHandler returns an HTTPHandler of the store.
+func NewHTTPHandler(store *caskdb.DiskStore, opts HTTPOptions) *HTTPHandler {
+	if opts.MaxBodySize <= 0 {
+		opts.MaxBodySize = defaultMaxBodySize
+	}
+	if opts.MaxListLimit <= 0 {
+		opts.MaxListLimit = defaultMaxListLimit
+	}
+	return &HTTPHandler{store: store, opts: opts}
+}
+
+func (h *HTTPHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var user *User
+	if h.opts.Auth != nil {
+		var err error
+		if user, err = h.opts.Auth.authenticate(bearerToken(r)); err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="caskdb"`)
+			writeError(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+	}
+	switch path := r.URL.Path; {
+	case strings.HasPrefix(path, "/v1/keys/") && len(path) > len("/v1/keys/"):
+		key := strings.TrimPrefix(path, "/v1/keys/")
+		access := AccessWrite
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			access = AccessRead
+		}
+		if !user.can(key, access) {
+			writeError(w, http.StatusForbidden, "forbidden")
+			return
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			h.get(w, key)
+		case http.MethodPut:
+			h.put(w, r, key)
+		case http.MethodDelete:
+			h.delete(w, key)
+		default:
+			methodNotAllowed(w, "GET, HEAD, PUT, DELETE")
+		}
+	case path == "/v1/keys" || path == "/v1/keys/":
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			methodNotAllowed(w, "GET, HEAD")
+			return
+		}
+		h.list(w, r, user)
+	case path == "/v1/stats":
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			methodNotAllowed(w, "GET, HEAD")
+			return
+		}
+		h.stats(w)
+	default:
+		writeError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func (h *HTTPHandler) get(w http.ResponseWriter, key string) {
+	value, meta, err := h.store.GetWithMeta(key)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	contentType := meta.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	if meta.Encoding != "" {
+		w.Header().Set("Content-Encoding", meta.Encoding)
+	}
+	if !meta.Expiry.IsZero() {
+		w.Header().Set("Expires", meta.Expiry.UTC().Format(http.TimeFormat))
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(value)))
+	io.WriteString(w, value)
+}
+
+func (h *HTTPHandler) put(w http.ResponseWriter, r *http.Request, key string) {
+	var ttl time.Duration
+	if s := r.URL.Query().Get("ttl"); s != "" {
+		var err error
+		if ttl, err = time.ParseDuration(s); err != nil || ttl <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid ttl")
+			return
+		}
+	}
+	value, err := io.ReadAll(http.MaxBytesReader(w, r.Body, h.opts.MaxBodySize))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, http.StatusRequestEntityTooLarge, "value is too large")
+		} else {
+			writeError(w, http.StatusBadRequest, err.Error())
+		}
+		return
+	}
+	if ttl > 0 {
+		err = h.store.SetWithTTL(key, string(value), ttl)
+	} else {
+		err = h.store.SetBytes(key, value)
+	}
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *HTTPHandler) delete(w http.ResponseWriter, key string) {
+	if err := h.store.Delete(key); err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listPage is the body of a page of the list.
+type listPage struct {
+	Keys       []string `json:"keys"`
+	NextCursor string   `json:"next_cursor"`
+}
+
+func (h *HTTPHandler) list(w http.ResponseWriter, r *http.Request, user *User) {
+	query := r.URL.Query()
+	limit := defaultListLimit
+	if s := query.Get("limit"); s != "" {
+		var err error
+		if limit, err = strconv.Atoi(s); err != nil || limit <= 0 {
+			writeError(w, http.StatusBadRequest, "invalid limit")
+			return
+		}
+	}
+	if limit > h.opts.MaxListLimit {
+		limit = h.opts.MaxListLimit
+	}
+	keys, next, err := h.store.ListPageWithPrefix(query.Get("prefix"), query.Get("cursor"), limit)
+	if err != nil {
+		writeStoreError(w, err)
+		return
+	}
+	keys = filterKeys(user, keys)
+	if keys == nil {
+		keys = []string{}
+	}
+	writeJSON(w, http.StatusOK, listPage{Keys: keys, NextCursor: next})
+}
+
+// httpStats is the body of the stats endpoint.
+type httpStats struct {
+	Keys        int                     `json:"keys"`
+	DiskSize    int64                   `json:"disk_size"`
+	Compression caskdb.CompressionStats `json:"compression"`
+}
+
+func (h *HTTPHandler) stats(w http.ResponseWriter) {
+	writeJSON(w, http.StatusOK, httpStats{
+		Keys:        h.store.Len(),
+		DiskSize:    h.store.DiskSize(),
+		Compression: h.store.CompressionStats(),
+	})
+}
+
+// bearerToken returns the token of the Authorization header of the request, empty if
+// it has none.
+func bearerToken(r *http.Request) string {
+	scheme, token, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+	return strings.TrimSpace(token)
+}
+
+func methodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+// writeStoreError writes the error of the store with the status it stands for.
+func writeStoreError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, caskdb.ErrKeyNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, caskdb.ErrInvalidCursor), errors.Is(err, caskdb.ErrInvalidLimit):
+		status = http.StatusBadRequest
+	case errors.Is(err, caskdb.ErrReadOnly):
+		status = http.StatusForbidden
+	case errors.Is(err, caskdb.ErrFileTooLarge):
+		status = http.StatusInsufficientStorage
+	}
+	writeError(w, status, err.Error())
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,152 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHTTPHandler(t *testing.T) {
+	store := newTestStore(t)
+	srv := httptest.NewServer(NewHTTPHandler(store, HTTPOptions{MaxBodySize: 16}))
+	defer srv.Close()
+
+	do := func(method, path, body string) (int, string, http.Header) {
+		t.Helper()
+		req, err := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("failed to create the request: %v", err)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%v %v error = %v", method, path, err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, strings.TrimSpace(string(b)), resp.Header
+	}
+
+	for _, tt := range []struct {
+		method, path, body string
+		status             int
+		want               string
+	}{
+		{"GET", "/v1/keys/book", "", 404, `{"error":"key not found"}`},
+		{"PUT", "/v1/keys/book", "dune", 204, ""},
+		{"GET", "/v1/keys/book", "", 200, "dune"},
+		{"PUT", "/v1/keys/books/1", "emma", 204, ""},
+		{"GET", "/v1/keys/books/1", "", 200, "emma"},
+		{"PUT", "/v1/keys/book", strings.Repeat("x", 17), 413, `{"error":"value is too large"}`},
+		{"PUT", "/v1/keys/session?ttl=1h", "jojo", 204, ""},
+		{"PUT", "/v1/keys/session?ttl=never", "jojo", 400, `{"error":"invalid ttl"}`},
+		{"DELETE", "/v1/keys/book", "", 204, ""},
+		{"DELETE", "/v1/keys/book", "", 204, ""},
+		{"POST", "/v1/keys/book", "", 405, `{"error":"method not allowed"}`},
+		{"GET", "/v1/other", "", 404, `{"error":"not found"}`},
+		{"GET", "/v1/keys?cursor=!", "", 400, `{"error":"invalid cursor"}`},
+		{"GET", "/v1/stats", "", 200, `{"keys":2,"disk_size":0,"compression":{"Compressed":0,"Incompressible":0,"RawBytes":0,"CompressedBytes":0}}`},
+	} {
+		status, body, _ := do(tt.method, tt.path, tt.body)
+		if tt.path == "/v1/stats" {
+			// the size of the data file is not known up front
+			body = strings.Replace(body, fmt.Sprintf(`"disk_size":%d`, store.DiskSize()), `"disk_size":0`, 1)
+		}
+		if status != tt.status || body != tt.want {
+			t.Errorf("%v %v = %v %v, want %v %v", tt.method, tt.path, status, body, tt.status, tt.want)
+		}
+	}
+
+	_, _, header := do("GET", "/v1/keys/session", "")
+	if header.Get("Expires") == "" || header.Get("Content-Type") != "application/octet-stream" {
+		t.Errorf("GET /v1/keys/session headers = %v, want an Expires header", header)
+	}
+}
+
+func TestHTTPHandler_auth(t *testing.T) {
+	store := newTestStore(t)
+	store.Set("book:1", "dune")
+	store.Set("secret:1", "value")
+	srv := httptest.NewServer(NewHTTPHandler(store, HTTPOptions{Auth: testAuth(t)}))
+	defer srv.Close()
+
+	for _, tt := range []struct {
+		method, path, token string
+		status              int
+	}{
+		{"GET", "/v1/keys/book:1", "", 401},
+		{"GET", "/v1/keys/book:1", "wrong", 401},
+		{"GET", "/v1/keys/book:1", "read", 200},
+		{"GET", "/v1/keys/secret:1", "read", 403},
+		{"PUT", "/v1/keys/book:1", "read", 403},
+		{"PUT", "/v1/keys/book:2", "write", 204},
+		{"DELETE", "/v1/keys/secret:1", "write", 403},
+		{"GET", "/v1/stats", "write", 200},
+	} {
+		req, _ := http.NewRequest(tt.method, srv.URL+tt.path, strings.NewReader("value"))
+		if tt.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%v %v error = %v", tt.method, tt.path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tt.status {
+			t.Errorf("%v %v with %q = %v, want %v", tt.method, tt.path, tt.token, resp.StatusCode, tt.status)
+		}
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/v1/keys", nil)
+	req.Header.Set("Authorization", "Bearer read")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /v1/keys error = %v", err)
+	}
+	var page listPage
+	json.NewDecoder(resp.Body).Decode(&page)
+	resp.Body.Close()
+	if !reflect.DeepEqual(page.Keys, []string{"book:1", "book:2"}) {
+		t.Errorf("GET /v1/keys = %v, want the keys the reader can read", page.Keys)
+	}
+}
+
+func TestHTTPHandler_list(t *testing.T) {
+	store := newTestStore(t)
+	for i := 0; i < 5; i++ {
+		store.Set(fmt.Sprintf("book:%d", i), "value")
+	}
+	store.Set("author:1", "herbert")
+	srv := httptest.NewServer(NewHTTPHandler(store, HTTPOptions{MaxListLimit: 2}))
+	defer srv.Close()
+
+	var keys []string
+	cursor := ""
+	for {
+		resp, err := http.Get(srv.URL + "/v1/keys?prefix=book:&limit=10&cursor=" + cursor)
+		if err != nil {
+			t.Fatalf("GET /v1/keys error = %v", err)
+		}
+		var page listPage
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			t.Fatalf("failed to decode the page: %v", err)
+		}
+		if len(page.Keys) > 2 {
+			t.Errorf("page = %v, want at most MaxListLimit keys", page.Keys)
+		}
+		keys = append(keys, page.Keys...)
+		if cursor = page.NextCursor; cursor == "" {
+			break
+		}
+	}
+	want := []string{"book:0", "book:1", "book:2", "book:3", "book:4"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("GET /v1/keys?prefix=book: = %v, want %v", keys, want)
+	}
+}
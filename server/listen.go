@@ -0,0 +1,59 @@
+package server
+
+import (
+	"fmt"
+	"io/fs"
+	"net"
+	"os"
+)
+
+// ListenUnix listens on a Unix domain socket at path, which the servers can serve in
+// place of a TCP listener, to skip the TCP stack and the ports when the clients are
+// on the same host, like a sidecar:
+//
+//	l, err := server.ListenUnix("/run/caskdb/resp.sock", 0660)
+//	...
+//	go srv.Serve(l)
+//
+// The HTTPHandler is served on it with http.Serve, and the GRPCHandler, which needs
+// HTTP/2 and so TLS, on the NewTLSListener of it.
+//
+// The socket gets the permissions of mode, which is how the access to it is
+// controlled. It is created with the ones of the umask and only then changed, so
+// for the clients not to get in before that, the directory it is in should be as
+// strict as mode. A socket left at path by a process which is gone is removed; one
+// which is still listened on is an error, as is any other kind of file. The socket
+// is removed when the listener is closed.
+func ListenUnix(path string, mode fs.FileMode) (net.Listener, error) {
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode.Perm()); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
+
+// removeStaleSocket removes the socket at path if nothing listens on it any more.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&fs.ModeSocket == 0 {
+		return fmt.Errorf("listen on %s: %w, and it is not a socket", path, fs.ErrExist)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("listen on %s: socket is in use", path)
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"errors"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no socket permissions on windows")
+	}
+	path := filepath.Join(t.TempDir(), "resp.sock")
+	l, err := ListenUnix(path, 0600)
+	if err != nil {
+		t.Fatalf("ListenUnix() error = %v", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("socket mode = %v, %v, want %v", info.Mode().Perm(), err, fs.FileMode(0600))
+	}
+	if _, err := ListenUnix(path, 0600); err == nil {
+		t.Errorf("ListenUnix() of a socket in use error = nil, want an error")
+	}
+
+	srv := NewRESPServer(newTestStore(t))
+	go srv.Serve(l)
+	c := dialRESP(t, "unix", path)
+	if got := c.do(t, "PING"); got != "+PONG" {
+		t.Errorf("PING over the socket = %q, want +PONG", got)
+	}
+	srv.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("socket left after Close, stat error = %v", err)
+	}
+
+	// a socket whose listener did not remove it
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	l, err = ListenUnix(path, 0660)
+	if err != nil {
+		t.Fatalf("ListenUnix() over a stale socket error = %v", err)
+	}
+	go http.Serve(l, NewHTTPHandler(newTestStore(t), HTTPOptions{}))
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(string, string) (net.Conn, error) { return net.Dial("unix", path) },
+	}}
+	resp, err := client.Get("http://caskdb/v1/stats")
+	if err != nil {
+		t.Fatalf("GET over the socket error = %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET over the socket status = %v, want 200", resp.StatusCode)
+	}
+	l.Close()
+
+	file := filepath.Join(t.TempDir(), "file")
+	os.WriteFile(file, nil, 0600)
+	if _, err := ListenUnix(file, 0600); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("ListenUnix() over a file error = %v, want %v", err, fs.ErrExist)
+	}
+}
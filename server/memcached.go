@@ -0,0 +1,351 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// MemcachedServer serves the store in the text protocol of memcached, see
+// https://github.com/memcached/memcached/blob/master/doc/protocol.txt, so that the
+// clients of memcached can use it as a cache which survives restarts. It has the
+// commands which map onto the store:
+//
+//	get <key>*
+//	set <key> <flags> <exptime> <bytes> [noreply]
+//	add <key> <flags> <exptime> <bytes> [noreply]
+//	delete <key> [noreply]
+//	incr <key> <value> [noreply]
+//	decr <key> <value> [noreply]
+//	touch <key> <exptime> [noreply]
+//	version
+//	quit
+//
+// The exptime is as in memcached: 0 never expires, up to 30 days is a number of
+// seconds from now, and larger is a unix timestamp. The store has nowhere to keep
+// the client flags, so only the 0 flags can be set, and get always returns them; the
+// clients which use the flags to tell how they serialised a value only work with the
+// plain string values. There are no CAS unique values, so gets and cas are not
+// supported either.
+//
+// The text protocol has no authentication, so there is no Auth for it either; to
+// keep out the other clients, serve it on a ListenUnix socket, or with the mutual
+// TLS of ListenTLS.
+type MemcachedServer struct {
+	store *caskdb.DiskStore
+	conns *connServer
+}
+
+// NewMemcachedServer returns a MemcachedServer of the store.
+func NewMemcachedServer(store *caskdb.DiskStore) *MemcachedServer {
+	s := &MemcachedServer{store: store}
+	s.conns = newConnServer(s.serveConn)
+	return s
+}
+
+// Serve serves the connections of the listener until the server is closed, when it
+// returns ErrServerClosed.
+func (s *MemcachedServer) Serve(l net.Listener) error {
+	return s.conns.serve(l)
+}
+
+// Close stops the server: it closes the listeners and the connections. The store is
+// left open.
+func (s *MemcachedServer) Close() error {
+	return s.conns.close()
+}
+
+// The limits of memcached on the keys and the values.
+const (
+	maxMemcachedKey   = 250
+	maxMemcachedValue = 1 << 20
+	// maxRelativeExptime is the largest exptime which is a number of seconds rather
+	// than a unix timestamp
+	maxRelativeExptime = 60 * 60 * 24 * 30
+)
+
+// memcachedVersion is the version the version command answers with.
+const memcachedVersion = "1.6.0 caskdb"
+
+// clientError is the error of a malformed command, replied as CLIENT_ERROR.
+type clientError string
+
+func (e clientError) Error() string {
+	return string(e)
+}
+
+const errBadFormat = clientError("bad command line format")
+
+func (s *MemcachedServer) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		line, err := readLine(r)
+		if errors.Is(err, errLineTooLong) {
+			// there is no telling where the next command starts
+			w.WriteString("CLIENT_ERROR line too long\r\n")
+			w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			w.WriteString("ERROR\r\n")
+		} else if quit := s.command(w, r, fields); quit {
+			w.Flush()
+			return
+		}
+		// the pipelined requests are answered in one go
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// command runs the command and writes its reply, unless it has noreply. It reports
+// whether the connection is to be closed.
+func (s *MemcachedServer) command(w *bufio.Writer, r *bufio.Reader, fields []string) bool {
+	name, args := fields[0], fields[1:]
+	noreply := false
+	switch name {
+	case "set", "add", "delete", "incr", "decr", "touch":
+		if len(args) > 0 && args[len(args)-1] == "noreply" {
+			noreply, args = true, args[:len(args)-1]
+		}
+	}
+	var reply string
+	var err error
+	switch name {
+	case "get":
+		if len(args) == 0 {
+			err = errBadFormat
+			break
+		}
+		err = s.get(w, args)
+	case "set", "add":
+		reply, err = s.storeValue(r, name, args)
+	case "delete":
+		if len(args) != 1 {
+			err = errBadFormat
+			break
+		}
+		reply = "DELETED"
+		if !s.store.Has(args[0]) {
+			reply = "NOT_FOUND"
+		} else {
+			err = s.store.Delete(args[0])
+		}
+	case "incr", "decr":
+		reply, err = s.incr(name, args)
+	case "touch":
+		reply, err = s.touch(args)
+	case "version":
+		reply = "VERSION " + memcachedVersion
+	case "quit":
+		return true
+	default:
+		reply = "ERROR"
+	}
+	var cerr clientError
+	switch {
+	case errors.As(err, &cerr):
+		reply = "CLIENT_ERROR " + err.Error()
+	case err != nil:
+		reply = "SERVER_ERROR " + err.Error()
+	}
+	if reply != "" && (!noreply || err != nil) {
+		w.WriteString(reply + "\r\n")
+	}
+	return false
+}
+
+func (s *MemcachedServer) get(w *bufio.Writer, keys []string) error {
+	for _, key := range keys {
+		value, err := s.store.GetBytes(key)
+		if errors.Is(err, caskdb.ErrKeyNotFound) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "VALUE %s 0 %d\r\n", key, len(value))
+		w.Write(value)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("END\r\n")
+	return nil
+}
+
+// storeValue runs set and add, which are followed by the data block of the value.
+func (s *MemcachedServer) storeValue(r *bufio.Reader, name string, args []string) (string, error) {
+	if len(args) != 4 {
+		return "", errBadFormat
+	}
+	size, err := strconv.Atoi(args[3])
+	if err != nil || size < 0 {
+		return "", errBadFormat
+	}
+	if size > maxMemcachedValue {
+		// the value is skipped, so that the next command can be read
+		if _, err := io.CopyN(io.Discard, r, int64(size)+2); err != nil {
+			return "", err
+		}
+		return "SERVER_ERROR object too large for cache", nil
+	}
+	data := make([]byte, size+2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return "", err
+	}
+	if data[size] != '\r' || data[size+1] != '\n' {
+		// the rest of the line goes with the value, as memcached has it
+		if data[size+1] != '\n' {
+			readLine(r)
+		}
+		return "", clientError("bad data chunk")
+	}
+	key, value := args[0], string(data[:size])
+	if err := checkMemcachedKey(key); err != nil {
+		return "", err
+	}
+	if flags, err := strconv.ParseUint(args[1], 10, 32); err != nil {
+		return "", errBadFormat
+	} else if flags != 0 {
+		return "", clientError("only the 0 flags are supported")
+	}
+	ttl, expired, err := memcachedTTL(args[2])
+	if err != nil {
+		return "", err
+	}
+
+	if name == "add" {
+		ok := false
+		switch {
+		case expired:
+			// memcached adds the value, which is gone right away
+			ok = !s.store.Has(key)
+		case ttl > 0:
+			ok, err = s.store.SetIfAbsentWithTTL(key, value, ttl)
+		default:
+			ok, err = s.store.SetIfAbsent(key, value)
+		}
+		if err != nil || !ok {
+			return "NOT_STORED", err
+		}
+		return "STORED", nil
+	}
+	switch {
+	case expired:
+		err = s.store.Delete(key)
+	case ttl > 0:
+		err = s.store.SetWithTTL(key, value, ttl)
+	default:
+		err = s.store.Set(key, value)
+	}
+	return "STORED", err
+}
+
+func (s *MemcachedServer) incr(name string, args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errBadFormat
+	}
+	delta, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		return "", clientError("invalid numeric delta argument")
+	}
+	var result uint64
+	err = s.store.Update(args[0], func(old string, exists bool) (string, error) {
+		if !exists {
+			return "", caskdb.ErrKeyNotFound
+		}
+		n, err := strconv.ParseUint(old, 10, 64)
+		if err != nil {
+			return "", clientError("cannot increment or decrement non-numeric value")
+		}
+		// as in memcached, incr wraps around and decr stops at 0
+		switch {
+		case name == "incr":
+			result = n + delta
+		case delta < n:
+			result = n - delta
+		default:
+			result = 0
+		}
+		return strconv.FormatUint(result, 10), nil
+	})
+	if errors.Is(err, caskdb.ErrKeyNotFound) {
+		return "NOT_FOUND", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(result, 10), nil
+}
+
+func (s *MemcachedServer) touch(args []string) (string, error) {
+	if len(args) != 2 {
+		return "", errBadFormat
+	}
+	ttl, expired, err := memcachedTTL(args[1])
+	if err != nil {
+		return "", err
+	}
+	if !s.store.Has(args[0]) {
+		return "NOT_FOUND", nil
+	}
+	switch {
+	case expired:
+		err = s.store.Delete(args[0])
+	case ttl > 0:
+		err = s.store.Touch(args[0], ttl)
+	default:
+		err = s.store.Persist(args[0])
+	}
+	if errors.Is(err, caskdb.ErrKeyNotFound) {
+		return "NOT_FOUND", nil
+	}
+	return "TOUCHED", err
+}
+
+// memcachedTTL returns the ttl of the exptime, 0 if it never expires, and whether it
+// has expired already, as the negative exptimes and the timestamps in the past have.
+func memcachedTTL(exptime string) (time.Duration, bool, error) {
+	n, err := strconv.ParseInt(exptime, 10, 64)
+	if err != nil {
+		return 0, false, clientError("invalid exptime argument")
+	}
+	switch {
+	case n < 0:
+		return 0, true, nil
+	case n == 0:
+		return 0, false, nil
+	case n <= maxRelativeExptime:
+		return time.Duration(n) * time.Second, false, nil
+	}
+	ttl := time.Until(time.Unix(n, 0))
+	return ttl, ttl <= 0, nil
+}
+
+// checkMemcachedKey checks the key against the rules of memcached: at most 250 bytes,
+// and no control characters or spaces.
+func checkMemcachedKey(key string) error {
+	if len(key) > maxMemcachedKey {
+		return clientError("key is too long")
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] <= ' ' || key[i] == 0x7f {
+			return clientError("invalid key")
+		}
+	}
+	return nil
+}
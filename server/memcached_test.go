@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemcachedServer(t *testing.T) {
+	store := newTestStore(t)
+	srv := NewMemcachedServer(store)
+	l := listen(t)
+	go srv.Serve(l)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	later := time.Now().Add(time.Hour).Unix()
+	for _, tt := range []struct {
+		request, want string
+	}{
+		{"get book\r\n", "END"},
+		{"set book 0 0 4\r\ndune\r\n", "STORED"},
+		{"get book missing\r\n", "VALUE book 0 4|dune|END"},
+		{"add book 0 0 4\r\nemma\r\n", "NOT_STORED"},
+		{"add author 0 0 7\r\nherbert\r\n", "STORED"},
+		{"get book author\r\n", "VALUE book 0 4|dune|VALUE author 0 7|herbert|END"},
+		{"set book 1 0 4\r\ndune\r\n", "CLIENT_ERROR only the 0 flags are supported"},
+		{"set book 0 0 4\r\ndunes\r\n", "CLIENT_ERROR bad data chunk"},
+		{"set book 0 0 4 noreply\r\ndune\r\nget book\r\n", "VALUE book 0 4|dune|END"},
+		{"set session 0 100 4\r\njojo\r\n", "STORED"},
+		{fmt.Sprintf("set lease 0 %d 4\r\njojo\r\n", later), "STORED"},
+		{"set gone 0 -1 4\r\njojo\r\nget gone\r\n", "STORED|END"},
+		{"touch session 0\r\n", "TOUCHED"},
+		{"touch missing 10\r\n", "NOT_FOUND"},
+		{"set counter 0 0 2\r\n10\r\n", "STORED"},
+		{"incr counter 5\r\n", "15"},
+		{"decr counter 20\r\n", "0"},
+		{"incr missing 1\r\n", "NOT_FOUND"},
+		{"incr book 1\r\n", "CLIENT_ERROR cannot increment or decrement non-numeric value"},
+		{"delete book\r\n", "DELETED"},
+		{"delete book\r\n", "NOT_FOUND"},
+		{"gets book\r\n", "ERROR"},
+		{"version\r\n", "VERSION " + memcachedVersion},
+	} {
+		fmt.Fprint(conn, tt.request)
+		var got []string
+		for range strings.Split(tt.want, "|") {
+			line, err := readLine(r)
+			if err != nil {
+				t.Fatalf("failed to read the reply to %q: %v", tt.request, err)
+			}
+			got = append(got, line)
+		}
+		if strings.Join(got, "|") != tt.want {
+			t.Errorf("%q = %q, want %q", tt.request, strings.Join(got, "|"), tt.want)
+		}
+	}
+	if ttl, err := store.TTL("session"); err != nil || ttl != -1 {
+		t.Errorf("TTL(session) after touch 0 = %v, %v, want none", ttl, err)
+	}
+	if ttl, err := store.TTL("lease"); err != nil || ttl < 59*time.Minute || ttl > time.Hour+time.Second {
+		t.Errorf("TTL(lease) = %v, %v, want an hour", ttl, err)
+	}
+
+	fmt.Fprint(conn, "quit\r\n")
+	if _, err := r.ReadByte(); err == nil {
+		t.Errorf("connection open after quit")
+	}
+}
+
+func TestMemcachedServer_LongLine(t *testing.T) {
+	srv := NewMemcachedServer(newTestStore(t))
+	l := listen(t)
+	go srv.Serve(l)
+	defer srv.Close()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	go fmt.Fprint(conn, "get "+strings.Repeat("a", maxLineLength))
+	if line, err := readLine(r); err != nil || line != "CLIENT_ERROR line too long" {
+		t.Errorf("reply to a long line = %q, %v, want CLIENT_ERROR line too long", line, err)
+	}
+	if _, err := r.ReadByte(); err == nil {
+		t.Errorf("the connection is still open after a long line")
+	}
+}
+
+func TestMemcachedTTL(t *testing.T) {
+	for _, tt := range []struct {
+		exptime string
+		ttl     time.Duration
+		expired bool
+	}{
+		{"0", 0, false},
+		{"-1", 0, true},
+		{"60", time.Minute, false},
+		{"2592000", 30 * 24 * time.Hour, false},
+		{"2592001", 0, true},
+	} {
+		ttl, expired, err := memcachedTTL(tt.exptime)
+		if err != nil || ttl != tt.ttl && !tt.expired || expired != tt.expired {
+			t.Errorf("memcachedTTL(%v) = %v, %v, %v, want %v, %v", tt.exptime, ttl, expired, err, tt.ttl, tt.expired)
+		}
+	}
+	if _, _, err := memcachedTTL("soon"); err == nil {
+		t.Errorf("memcachedTTL(soon) error = nil, want an error")
+	}
+}
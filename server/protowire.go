@@ -0,0 +1,96 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The protobuf wire format, see https://protobuf.dev/programming-guides/encoding/,
+// for the few messages of caskdb.proto, which are simple enough to encode by hand
+// rather than have the module depend on the protobuf runtime.
+
+// The protobuf wire types.
+const (
+	wireVarint  = 0
+	wireFixed64 = 1
+	wireBytes   = 2
+	wireFixed32 = 5
+)
+
+var errInvalidProto = errors.New("invalid protobuf message")
+
+func appendTag(dst []byte, field int, wireType int) []byte {
+	return binary.AppendUvarint(dst, uint64(field)<<3|uint64(wireType))
+}
+
+// appendBytesField appends a bytes, string or message field; the empty ones are left
+// out, as proto3 does.
+func appendBytesField(dst []byte, field int, b []byte) []byte {
+	if len(b) == 0 {
+		return dst
+	}
+	dst = appendTag(dst, field, wireBytes)
+	dst = binary.AppendUvarint(dst, uint64(len(b)))
+	return append(dst, b...)
+}
+
+// appendVarintField appends an integer or bool field; the zero ones are left out.
+func appendVarintField(dst []byte, field int, v uint64) []byte {
+	if v == 0 {
+		return dst
+	}
+	return binary.AppendUvarint(appendTag(dst, field, wireVarint), v)
+}
+
+// protoField is a field of a message, as parseProto reads it: v is the value of the
+// varint and the fixed size fields, b the one of the length delimited fields.
+type protoField struct {
+	num      int
+	wireType int
+	v        uint64
+	b        []byte
+}
+
+// parseProto calls fn with each field of the message, in the order they come in. The
+// unknown fields are for fn to skip, as protobuf does for the fields of a newer
+// version of the message.
+func parseProto(msg []byte, fn func(f protoField) error) error {
+	for len(msg) > 0 {
+		tag, n := binary.Uvarint(msg)
+		if n <= 0 || tag>>3 == 0 {
+			return errInvalidProto
+		}
+		msg = msg[n:]
+		f := protoField{num: int(tag >> 3), wireType: int(tag & 7)}
+		switch f.wireType {
+		case wireVarint:
+			if f.v, n = binary.Uvarint(msg); n <= 0 {
+				return errInvalidProto
+			}
+			msg = msg[n:]
+		case wireFixed64:
+			if len(msg) < 8 {
+				return errInvalidProto
+			}
+			f.v, msg = binary.LittleEndian.Uint64(msg), msg[8:]
+		case wireFixed32:
+			if len(msg) < 4 {
+				return errInvalidProto
+			}
+			f.v, msg = uint64(binary.LittleEndian.Uint32(msg)), msg[4:]
+		case wireBytes:
+			size, n := binary.Uvarint(msg)
+			if n <= 0 || size > uint64(len(msg)-n) {
+				return errInvalidProto
+			}
+			f.b, msg = msg[n:n+int(size)], msg[n+int(size):]
+		default:
+			// the groups, which proto3 does not have
+			return errInvalidProto
+		}
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package server
+
+import (
+	"encoding/binary"
+	"reflect"
+	"testing"
+)
+
+func TestParseProto(t *testing.T) {
+	msg := appendBytesField(nil, 1, []byte("book"))
+	msg = appendBytesField(msg, 2, nil)
+	msg = binary.AppendUvarint(appendTag(msg, 3, wireVarint), 300)
+	msg = append(appendTag(msg, 4, wireFixed32), 1, 0, 0, 0)
+	msg = append(appendTag(msg, 5, wireFixed64), 2, 0, 0, 0, 0, 0, 0, 0)
+	var got []protoField
+	err := parseProto(msg, func(f protoField) error {
+		got = append(got, f)
+		return nil
+	})
+	want := []protoField{
+		{num: 1, wireType: wireBytes, b: []byte("book")},
+		{num: 3, wireType: wireVarint, v: 300},
+		{num: 4, wireType: wireFixed32, v: 1},
+		{num: 5, wireType: wireFixed64, v: 2},
+	}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("parseProto() = %+v, %v, want %+v", got, err, want)
+	}
+
+	for _, msg := range [][]byte{
+		{0x0a, 5, 'b'},
+		{0x08},
+		{0x00, 0},
+		{0x0b},
+	} {
+		if err := parseProto(msg, func(protoField) error { return nil }); err != errInvalidProto {
+			t.Errorf("parseProto(%x) error = %v, want %v", msg, err, errInvalidProto)
+		}
+	}
+}
@@ -0,0 +1,676 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+	"github.com/avinassh/go-caskdb/internal/atomicfile"
+)
+
+// ReplicationServer is the leader of the replication: it streams the log of the
+// store, see caskdb.DiskStore.ReadLog, to the Followers which connect to it, so that
+// each of them keeps a copy of the store on a store of its own, as a warm standby.
+// The tombstones are streamed like the other records, so the deletes are replicated
+// too.
+//
+// The replication is asynchronous: the writes to the leader do not wait for the
+// followers, which get them a moment later, so a follower which takes over from a
+// leader which is lost may not have the last writes of it.
+//
+// A new follower starts from a snapshot of the store rather than from the start of
+// the log, see Bootstrap, which the server streams from caskdb.DiskStore.WriteSnapshot;
+// the compactions of the store wait while it does.
+//
+// The messages are the ReplicateRequest and ReplicateResponse of caskdb.proto, on a
+// connection of their own. With ReplicationOptions.Auth, a follower's user must be
+// able to read all the keys, and the tokens are sent in the clear, so the server
+// should be served on a listener of ListenTLS unless the network is trusted.
+type ReplicationServer struct {
+	store *caskdb.DiskStore
+	opts  ReplicationOptions
+	conns *connServer
+}
+
+// ReplicationOptions are the options of a ReplicationServer.
+type ReplicationOptions struct {
+	// Auth, if set, authenticates and authorises the followers
+	Auth *Auth
+	// BatchSize is the largest number of records in a message. Defaults to 256.
+	BatchSize int
+	// PollInterval is how often the log is checked for new records once a follower
+	// has caught up. Defaults to 100ms.
+	PollInterval time.Duration
+}
+
+// The defaults of ReplicationOptions.
+const (
+	defaultReplicationBatchSize = 256
+	defaultPollInterval         = 100 * time.Millisecond
+)
+
+const (
+	// replicationHeartbeat is how often the leader sends a message to a follower which
+	// is caught up, so that the follower can tell an idle leader from a lost one
+	replicationHeartbeat = time.Second
+	// replicationTimeout is how long either side waits for the other
+	replicationTimeout = 10 * time.Second
+	// maxReplicationMessage is the largest message either side reads
+	maxReplicationMessage = 1 << 30
+	// maxReplicationRequest is the largest request the leader reads, before the
+	// follower is authenticated
+	maxReplicationRequest = 4 << 10
+	// snapshotChunkSize is the largest chunk of a snapshot in a message
+	snapshotChunkSize = 1 << 20
+)
+
+// NewReplicationServer returns a ReplicationServer of the store.
+func NewReplicationServer(store *caskdb.DiskStore, opts ReplicationOptions) *ReplicationServer {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultReplicationBatchSize
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = defaultPollInterval
+	}
+	s := &ReplicationServer{store: store, opts: opts}
+	s.conns = newConnServer(s.serveConn)
+	return s
+}
+
+// Serve serves the connections of the listener until the server is closed, when it
+// returns ErrServerClosed.
+func (s *ReplicationServer) Serve(l net.Listener) error {
+	return s.conns.serve(l)
+}
+
+// Close stops the server: it closes the listeners and the connections. The store is
+// left open.
+func (s *ReplicationServer) Close() error {
+	return s.conns.close()
+}
+
+// replicationError is an error the leader ends the stream with, with the gRPC status
+// code of it.
+type replicationError struct {
+	code int
+	msg  string
+}
+
+func (e *replicationError) Error() string {
+	return "leader: " + e.msg
+}
+
+// Unwrap lets the followers tell the position the leader no longer has with
+// errors.Is.
+func (e *replicationError) Unwrap() error {
+	if e.code == codeFailedPrecondition {
+		return caskdb.ErrPositionUnavailable
+	}
+	return nil
+}
+
+func (s *ReplicationServer) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+	req, err := readReplicationMessage(r, maxReplicationRequest)
+	if errors.Is(err, errInvalidProto) {
+		s.send(conn, nil, caskdb.Position{}, &replicationError{codeInvalidArgument, err.Error()})
+		return
+	}
+	if err != nil {
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+	var token string
+	var pos caskdb.Position
+	snapshot := false
+	err = parseProto(req, func(f protoField) error {
+		switch f.num {
+		case 1:
+			var b []byte
+			err := bytesField(f, &b)
+			token = string(b)
+			return err
+		case 2:
+			pos.FileID = uint32(f.v)
+		case 3:
+			pos.Offset = int64(f.v)
+		case 4:
+			snapshot = f.v != 0
+		}
+		return nil
+	})
+	if err != nil {
+		s.send(conn, nil, pos, &replicationError{codeInvalidArgument, err.Error()})
+		return
+	}
+	if s.opts.Auth != nil {
+		user, err := s.opts.Auth.authenticate(token)
+		if err != nil {
+			s.send(conn, nil, pos, &replicationError{codeUnauthenticated, err.Error()})
+			return
+		}
+		if !user.canAll(AccessRead) {
+			s.send(conn, nil, pos, &replicationError{codePermissionDenied, "permission denied"})
+			return
+		}
+	}
+	if snapshot {
+		s.sendSnapshot(conn)
+		return
+	}
+
+	lastSent := time.Now()
+	for {
+		records, next, err := s.store.ReadLog(pos, s.opts.BatchSize)
+		if errors.Is(err, caskdb.ErrPositionUnavailable) {
+			s.send(conn, nil, pos, &replicationError{codeFailedPrecondition, err.Error()})
+			return
+		}
+		if err != nil {
+			s.send(conn, nil, pos, &replicationError{codeInternal, err.Error()})
+			return
+		}
+		if len(records) > 0 || next != pos || time.Since(lastSent) >= replicationHeartbeat {
+			if err := s.send(conn, records, next, nil); err != nil {
+				return
+			}
+			lastSent, pos = time.Now(), next
+		}
+		if len(records) < s.opts.BatchSize {
+			time.Sleep(s.opts.PollInterval)
+		}
+	}
+}
+
+// send sends the records and the position after them to the follower, or the error
+// which ends the stream.
+func (s *ReplicationServer) send(conn net.Conn, records []caskdb.LogRecord, next caskdb.Position, rerr *replicationError) error {
+	var msg []byte
+	for _, r := range records {
+		msg = appendBytesField(msg, 1, appendLogRecord(nil, r))
+	}
+	msg = appendVarintField(msg, 2, uint64(next.FileID))
+	msg = appendVarintField(msg, 3, uint64(next.Offset))
+	if rerr != nil {
+		msg = appendVarintField(msg, 4, uint64(rerr.code))
+		msg = appendBytesField(msg, 5, []byte(rerr.msg))
+	}
+	conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+	return writeMessage(conn, msg)
+}
+
+// sendSnapshot streams a snapshot of the store to the follower, and the position of
+// it last.
+func (s *ReplicationServer) sendSnapshot(conn net.Conn) {
+	w := bufio.NewWriterSize(snapshotWriter{conn}, snapshotChunkSize)
+	pos, err := s.store.WriteSnapshot(w)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		s.send(conn, nil, caskdb.Position{}, &replicationError{codeInternal, err.Error()})
+		return
+	}
+	s.send(conn, nil, pos, nil)
+}
+
+// snapshotWriter sends what is written to it to the follower, in the snapshot chunks
+// of the messages.
+type snapshotWriter struct {
+	conn net.Conn
+}
+
+func (w snapshotWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		chunk := p[written:]
+		if len(chunk) > snapshotChunkSize {
+			chunk = chunk[:snapshotChunkSize]
+		}
+		w.conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+		if err := writeMessage(w.conn, appendBytesField(nil, 6, chunk)); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+	}
+	return written, nil
+}
+
+// appendLogRecord appends the LogRecord message of the record.
+func appendLogRecord(dst []byte, r caskdb.LogRecord) []byte {
+	dst = appendVarintField(dst, 1, uint64(r.Op))
+	dst = appendBytesField(dst, 2, []byte(r.Key))
+	dst = appendBytesField(dst, 3, r.Value)
+	dst = appendVarintField(dst, 4, uint64(r.Timestamp.Unix()))
+	if !r.Expiry.IsZero() {
+		dst = appendVarintField(dst, 5, uint64(r.Expiry.Unix()))
+	}
+	dst = appendBytesField(dst, 6, []byte(r.Metadata.ContentType))
+	dst = appendBytesField(dst, 7, []byte(r.Metadata.Encoding))
+	return appendBytesField(dst, 8, []byte(r.Metadata.Tag))
+}
+
+// parseLogRecord parses a LogRecord message.
+func parseLogRecord(msg []byte) (caskdb.LogRecord, error) {
+	var r caskdb.LogRecord
+	var key, contentType, encoding, tag []byte
+	err := parseProto(msg, func(f protoField) error {
+		switch f.num {
+		case 1:
+			if f.v > uint64(caskdb.LogMerge) {
+				return errInvalidProto
+			}
+			r.Op = caskdb.LogOp(f.v)
+		case 2:
+			return bytesField(f, &key)
+		case 3:
+			return bytesField(f, &r.Value)
+		case 4:
+			r.Timestamp = time.Unix(int64(f.v), 0)
+		case 5:
+			r.Expiry = time.Unix(int64(f.v), 0)
+		case 6:
+			return bytesField(f, &contentType)
+		case 7:
+			return bytesField(f, &encoding)
+		case 8:
+			return bytesField(f, &tag)
+		}
+		return nil
+	})
+	r.Key = string(key)
+	r.Metadata = caskdb.Metadata{ContentType: string(contentType), Encoding: string(encoding), Tag: string(tag)}
+	return r, err
+}
+
+// readReplicationMessage reads a message of the replication stream, which is framed
+// as the ones of gRPC are, without the compression. A message larger than maxSize is
+// rejected before it is read.
+func readReplicationMessage(r io.Reader, maxSize uint32) ([]byte, error) {
+	var prefix [5]byte
+	if _, err := io.ReadFull(r, prefix[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(prefix[1:])
+	if prefix[0] != 0 || size > maxSize {
+		return nil, errInvalidProto
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// Follower follows a ReplicationServer: it applies the records of the log of the
+// leader to its store, with caskdb.DiskStore.ApplyLog, as they are written. The store
+// should not be written to by anything else, or it would no longer be a copy of the
+// leader's; it can be read from, as a standby which lags a moment behind.
+//
+// The follower keeps its position in the log of the leader in a file, so that it
+// resumes from there after a restart, and after the connection is lost:
+//
+//	f, err := server.NewFollower(store, "leader:7000", server.FollowerOptions{
+//		PositionFile: "books.db.position",
+//	})
+//	...
+//	err = f.Run(ctx)
+//
+// The position is saved after its records are applied and synced to the disk,
+// whatever the SyncPolicy of the store, so that the position never runs ahead of the
+// records which survive a crash. The records are applied along with a record of
+// FollowerPositionKey, which has the positions the follower moves from and to, in
+// the same write, so that a crash between the apply and the save of the position
+// does not get them applied again, which would add the merge operands twice: on a
+// restart, if the store has the records applied from the saved position, the
+// follower goes on from the end of them instead.
+//
+// A new follower is best started with Bootstrap, which restores a snapshot of the
+// leader as the store and saves its position, rather than from the start of the log.
+type Follower struct {
+	store *caskdb.DiskStore
+	addr  string
+	opts  FollowerOptions
+
+	mu  sync.Mutex
+	pos caskdb.Position
+}
+
+// FollowerPositionKey is the key the Follower keeps its last applied batch in, in the
+// store it applies the log to, as "<from> <to>" positions. It is a key like any other
+// of the store, so it shows up in Keys and the iterations over the store.
+const FollowerPositionKey = "\x00caskdb:follower-position"
+
+// FollowerOptions are the options of a Follower.
+type FollowerOptions struct {
+	// PositionFile is the file the position in the log of the leader is kept in. It
+	// is required; a follower without one starts from the start of the log, which is
+	// only right for an empty store.
+	PositionFile string
+	// Token is sent to the leader, for a ReplicationServer with an Auth
+	Token string
+	// Dial connects to the leader. Defaults to dialing TCP; see tls.Dialer for a
+	// leader served over TLS.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+	// RetryInterval is how long the follower waits before it reconnects to the
+	// leader the first time, which doubles on each failure after, up to a minute.
+	// Defaults to a second.
+	RetryInterval time.Duration
+	// Logger, if set, receives the errors the follower recovers from by reconnecting
+	Logger *log.Logger
+}
+
+// maxRetryInterval is the longest a Follower waits between the connections.
+const maxRetryInterval = time.Minute
+
+// NewFollower returns a Follower which applies the log of the leader at addr to the
+// store, from the position in FollowerOptions.PositionFile, or from the end of the
+// records applied from there, see FollowerPositionKey. A missing file is the start
+// of the log.
+func NewFollower(store *caskdb.DiskStore, addr string, opts FollowerOptions) (*Follower, error) {
+	if opts.PositionFile == "" {
+		return nil, errors.New("follower needs a position file")
+	}
+	if opts.Dial == nil {
+		var dialer net.Dialer
+		opts.Dial = dialer.DialContext
+	}
+	if opts.RetryInterval <= 0 {
+		opts.RetryInterval = time.Second
+	}
+	f := &Follower{store: store, addr: addr, opts: opts}
+	data, err := os.ReadFile(opts.PositionFile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if _, err := fmt.Sscanf(string(data), "%d:%d", &f.pos.FileID, &f.pos.Offset); err != nil {
+			return nil, fmt.Errorf("invalid position file %s: %w", opts.PositionFile, err)
+		}
+	}
+	value, err := store.Get(FollowerPositionKey)
+	if errors.Is(err, caskdb.ErrKeyNotFound) {
+		return f, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var from, to caskdb.Position
+	if _, err := fmt.Sscanf(value, "%d:%d %d:%d", &from.FileID, &from.Offset, &to.FileID, &to.Offset); err != nil {
+		return nil, fmt.Errorf("invalid %q in the store: %w", FollowerPositionKey, err)
+	}
+	if from == f.pos {
+		// the last batch was applied, but its position was not saved
+		f.pos = to
+	}
+	return f, nil
+}
+
+// Position returns the position in the log of the leader the follower has applied
+// the records up to.
+func (f *Follower) Position() caskdb.Position {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.pos
+}
+
+// Run follows the leader until the context is done, reconnecting whenever the
+// connection is lost. It returns the error of the context then, or the one which
+// reconnecting does not fix: the leader turning the follower away, a position the
+// leader no longer has, which is caskdb.ErrPositionUnavailable, or a failure of the
+// store to apply the records. The follower has to start over from a new Bootstrap
+// after ErrPositionUnavailable.
+func (f *Follower) Run(ctx context.Context) error {
+	delay := f.opts.RetryInterval
+	for {
+		applied, err := f.follow(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		var rerr *replicationError
+		if errors.Is(err, errApply) || errors.As(err, &rerr) && rerr.code != codeInternal {
+			return err
+		}
+		if f.opts.Logger != nil {
+			f.opts.Logger.Printf("caskdb: replication from %s: %v", f.addr, err)
+		}
+		if applied {
+			delay = f.opts.RetryInterval
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxRetryInterval {
+			delay = maxRetryInterval
+		}
+	}
+}
+
+// errApply wraps the errors of the store the follower fails to apply the records to.
+var errApply = errors.New("failed to apply the log")
+
+// follow streams the log from the leader over a connection, until it fails, and
+// reports whether it got any message.
+func (f *Follower) follow(ctx context.Context) (bool, error) {
+	conn, err := f.opts.Dial(ctx, "tcp", f.addr)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+
+	pos := f.Position()
+	req := appendBytesField(nil, 1, []byte(f.opts.Token))
+	req = appendVarintField(req, 2, uint64(pos.FileID))
+	req = appendVarintField(req, 3, uint64(pos.Offset))
+	conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+	if err := writeMessage(conn, req); err != nil {
+		return false, err
+	}
+	r := bufio.NewReader(conn)
+	received := false
+	for {
+		conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+		msg, err := readReplicationMessage(r, maxReplicationMessage)
+		if err != nil {
+			return received, err
+		}
+		received = true
+		var records []caskdb.LogRecord
+		next := pos
+		var rerr replicationError
+		err = parseProto(msg, func(pf protoField) error {
+			switch pf.num {
+			case 1:
+				if pf.wireType != wireBytes {
+					return errInvalidProto
+				}
+				record, err := parseLogRecord(pf.b)
+				records = append(records, record)
+				return err
+			case 2:
+				next.FileID = uint32(pf.v)
+			case 3:
+				next.Offset = int64(pf.v)
+			case 4:
+				rerr.code = int(pf.v)
+			case 5:
+				rerr.msg = string(pf.b)
+			}
+			return nil
+		})
+		if err != nil {
+			return received, err
+		}
+		if rerr.code != codeOK {
+			return received, &rerr
+		}
+		if next != pos {
+			records = append(records, caskdb.LogRecord{
+				Op:    caskdb.LogSet,
+				Key:   FollowerPositionKey,
+				Value: []byte(pos.String() + " " + next.String()),
+			})
+		}
+		if err := f.store.ApplyLog(records); err != nil {
+			return received, fmt.Errorf("%w: %v", errApply, err)
+		}
+		if next != pos {
+			// a position saved ahead of the records lost in a crash would skip them
+			if err := f.store.Sync(); err != nil {
+				return received, fmt.Errorf("%w: %v", errApply, err)
+			}
+			if err := f.savePosition(next); err != nil {
+				return received, fmt.Errorf("%w: %v", errApply, err)
+			}
+			pos = next
+		}
+	}
+}
+
+// savePosition saves the position to the position file, and makes it the one the
+// follower is at.
+func (f *Follower) savePosition(pos caskdb.Position) error {
+	if err := writePosition(f.opts.PositionFile, pos); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	f.pos = pos
+	f.mu.Unlock()
+	return nil
+}
+
+// writePosition writes the position to the position file, replacing it in one go,
+// durably.
+func writePosition(positionFile string, pos caskdb.Position) error {
+	return atomicfile.WriteFile(positionFile, []byte(pos.String()+"\n"), 0644)
+}
+
+// closeOnDone closes the connection once the context is done, so that the reads and
+// writes on it return, until the function it returns is called.
+func closeOnDone(ctx context.Context, conn net.Conn) func() {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// Bootstrap starts a new follower of the leader at addr: it restores a snapshot of
+// the leader's store as a store at fileName, which must not exist, with
+// caskdb.RestoreSnapshot, and saves the position of the snapshot to
+// FollowerOptions.PositionFile. The store is then opened, with the same options as
+// the leader's, and followed from there with NewFollower and the same options:
+//
+//	err := server.Bootstrap(ctx, "leader:7000", "books.db", opts)
+//	...
+//	store, err := caskdb.NewDiskStore("books.db")
+//	...
+//	f, err := server.NewFollower(store, "leader:7000", opts)
+//
+// That takes the live records of the leader only, rather than all the history of
+// its log, which the compactions have dropped most of anyway. A snapshot which fails
+// leaves nothing at fileName.
+func Bootstrap(ctx context.Context, addr string, fileName string, opts FollowerOptions) error {
+	if opts.PositionFile == "" {
+		return errors.New("follower needs a position file")
+	}
+	if opts.Dial == nil {
+		var dialer net.Dialer
+		opts.Dial = dialer.DialContext
+	}
+	conn, err := opts.Dial(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer closeOnDone(ctx, conn)()
+
+	req := appendBytesField(nil, 1, []byte(opts.Token))
+	req = appendVarintField(req, 4, 1)
+	conn.SetWriteDeadline(time.Now().Add(replicationTimeout))
+	if err := writeMessage(conn, req); err != nil {
+		return err
+	}
+	type result struct {
+		pos caskdb.Position
+		err error
+	}
+	pr, pw := io.Pipe()
+	restored := make(chan result, 1)
+	go func() {
+		pos, err := caskdb.RestoreSnapshot(pr, fileName)
+		// the chunks after an error go nowhere
+		pr.CloseWithError(err)
+		restored <- result{pos, err}
+	}()
+	err = receiveSnapshot(conn, pw)
+	pw.CloseWithError(err)
+	// a snapshot which is restored is complete, whatever came after it
+	res := <-restored
+	if res.err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			err = res.err
+		}
+		return err
+	}
+	return writePosition(opts.PositionFile, res.pos)
+}
+
+// receiveSnapshot writes the snapshot chunks the leader sends to w, until the last
+// message. It stops early, without an error, once w fails, which is the restore
+// failing.
+func receiveSnapshot(conn net.Conn, w io.Writer) error {
+	r := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(replicationTimeout))
+		msg, err := readReplicationMessage(r, maxReplicationMessage)
+		if err != nil {
+			return err
+		}
+		var chunk []byte
+		var rerr replicationError
+		err = parseProto(msg, func(pf protoField) error {
+			switch pf.num {
+			case 4:
+				rerr.code = int(pf.v)
+			case 5:
+				rerr.msg = string(pf.b)
+			case 6:
+				return bytesField(pf, &chunk)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if rerr.code != codeOK {
+			return &rerr
+		}
+		if chunk == nil {
+			return nil
+		}
+		if _, err := w.Write(chunk); err != nil {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,275 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// startReplication serves the replication of the store on a free port, and returns
+// its address.
+func startReplication(t *testing.T, store *caskdb.DiskStore, opts ReplicationOptions) string {
+	t.Helper()
+	srv := NewReplicationServer(store, opts)
+	l := listen(t)
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return l.Addr().String()
+}
+
+// waitFor polls the condition until it holds, and fails the test if it does not in
+// a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %v", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestFollower(t *testing.T) {
+	leader := newTestStore(t)
+	addr := startReplication(t, leader, ReplicationOptions{BatchSize: 2, PollInterval: 10 * time.Millisecond})
+	replica := newTestStore(t)
+	positionFile := filepath.Join(t.TempDir(), "position")
+
+	run := func() (*Follower, context.CancelFunc, chan error) {
+		f, err := NewFollower(replica, addr, FollowerOptions{PositionFile: positionFile})
+		if err != nil {
+			t.Fatalf("NewFollower() error = %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- f.Run(ctx) }()
+		return f, cancel, done
+	}
+	stop := func(cancel context.CancelFunc, done chan error) {
+		cancel()
+		if err := <-done; !errors.Is(err, context.Canceled) {
+			t.Errorf("Run() error = %v, want %v", err, context.Canceled)
+		}
+	}
+
+	leader.Set("book:1", "dune")
+	leader.Set("book:2", "emma")
+	leader.SetWithTTL("session", "jojo", time.Hour)
+	leader.Delete("book:1")
+	f, cancel, done := run()
+	waitFor(t, "the replica to catch up", func() bool { return replica.Has("session") })
+	if replica.Has("book:1") || !replica.Has("book:2") {
+		t.Errorf("replica keys = %v, want book:2 and session", replica.Keys())
+	}
+	if ttl, err := replica.TTL("session"); err != nil || ttl <= 59*time.Minute {
+		t.Errorf("replica TTL(session) = %v, %v, want an hour", ttl, err)
+	}
+	leader.Set("book:3", "persuasion")
+	waitFor(t, "the write to be replicated", func() bool { return replica.Has("book:3") })
+	stop(cancel, done)
+	if f.Position() == (caskdb.Position{}) {
+		t.Errorf("Position() = %v, want past the start", f.Position())
+	}
+
+	// a new follower resumes from the saved position
+	leader.Delete("book:2")
+	f, cancel, done = run()
+	waitFor(t, "the delete to be replicated", func() bool { return !replica.Has("book:2") })
+	stop(cancel, done)
+	if got, _ := replica.Get("book:3"); got != "persuasion" || replica.Len() != 3 || !replica.Has(FollowerPositionKey) {
+		t.Errorf("replica keys = %q, want book:3, session and the position", replica.Keys())
+	}
+
+	if _, err := NewFollower(replica, addr, FollowerOptions{}); err == nil {
+		t.Errorf("NewFollower() without a position file error = nil, want an error")
+	}
+}
+
+func TestFollower_Restart(t *testing.T) {
+	join := func(key string, base string, exists bool, operands []string) (string, error) {
+		return strings.Join(append([]string{base}, operands...), "+"), nil
+	}
+	leader, err := caskdb.NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), caskdb.Options{MergeOperator: join})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer leader.Close()
+	addr := startReplication(t, leader, ReplicationOptions{PollInterval: 10 * time.Millisecond})
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	positionFile := filepath.Join(t.TempDir(), "position")
+	replica, err := caskdb.NewDiskStoreWithOptions(fileName, caskdb.Options{MergeOperator: join})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer func() { replica.Close() }()
+	follow := func(want string) {
+		t.Helper()
+		f, err := NewFollower(replica, addr, FollowerOptions{PositionFile: positionFile})
+		if err != nil {
+			t.Fatalf("NewFollower() error = %v", err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() { done <- f.Run(ctx) }()
+		waitFor(t, "the replica to catch up", func() bool {
+			got, _ := replica.Get("log")
+			return got == want
+		})
+		cancel()
+		<-done
+	}
+
+	leader.Set("log", "a")
+	leader.Merge("log", "b")
+	follow("a+b")
+	saved, err := os.ReadFile(positionFile)
+	if err != nil {
+		t.Fatalf("failed to read the position file: %v", err)
+	}
+	leader.Merge("log", "c")
+	follow("a+b+c")
+
+	// a crash after the apply, before the position is saved, leaves the position
+	// file behind the store
+	replica.Close()
+	if err := os.WriteFile(positionFile, saved, 0644); err != nil {
+		t.Fatalf("failed to write the position file: %v", err)
+	}
+	replica, err = caskdb.NewDiskStoreWithOptions(fileName, caskdb.Options{MergeOperator: join})
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	leader.Merge("log", "d")
+	follow("a+b+c+d")
+	if got, err := replica.Get("log"); err != nil || got != "a+b+c+d" {
+		t.Errorf("replica Get(log) = %v, %v, want a+b+c+d", got, err)
+	}
+}
+
+func TestFollower_errors(t *testing.T) {
+	leader := newTestStore(t)
+	addr := startReplication(t, leader, ReplicationOptions{Auth: testAuth(t)})
+	full, err := NewAuth(User{Name: "replica", Token: "replica", Grants: []Grant{{Access: AccessRead}}})
+	if err != nil {
+		t.Fatalf("NewAuth() error = %v", err)
+	}
+	open := startReplication(t, leader, ReplicationOptions{Auth: full})
+
+	for _, tt := range []struct {
+		name  string
+		addr  string
+		token string
+		// position is saved to the position file first
+		position caskdb.Position
+		status   int
+	}{
+		{"no token", addr, "", caskdb.Position{}, codeUnauthenticated},
+		{"denied prefix", addr, "read", caskdb.Position{}, codePermissionDenied},
+		{"unknown position", open, "replica", caskdb.Position{FileID: 7, Offset: 100}, codeFailedPrecondition},
+	} {
+		positionFile := filepath.Join(t.TempDir(), "position")
+		f, err := NewFollower(newTestStore(t), tt.addr, FollowerOptions{PositionFile: positionFile, Token: tt.token})
+		if err != nil {
+			t.Fatalf("NewFollower() error = %v", err)
+		}
+		f.savePosition(tt.position)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = f.Run(ctx)
+		cancel()
+		var rerr *replicationError
+		if !errors.As(err, &rerr) || rerr.code != tt.status {
+			t.Errorf("%v: Run() error = %v, want the status %v", tt.name, err, tt.status)
+		}
+		if tt.status == codeFailedPrecondition && !errors.Is(err, caskdb.ErrPositionUnavailable) {
+			t.Errorf("%v: Run() error = %v, want %v", tt.name, err, caskdb.ErrPositionUnavailable)
+		}
+	}
+}
+
+func TestReplicationServer_largeRequest(t *testing.T) {
+	addr := startReplication(t, newTestStore(t), ReplicationOptions{Auth: testAuth(t)})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	// a request of a gigabyte is turned down on its prefix, rather than waited for
+	conn.Write([]byte{0, 0x3f, 0xff, 0xff, 0xff})
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	msg, err := readReplicationMessage(conn, maxReplicationMessage)
+	if err != nil {
+		t.Fatalf("failed to read the reply: %v", err)
+	}
+	var code int
+	parseProto(msg, func(f protoField) error {
+		if f.num == 4 {
+			code = int(f.v)
+		}
+		return nil
+	})
+	if code != codeInvalidArgument {
+		t.Errorf("reply to a large request status = %v, want %v", code, codeInvalidArgument)
+	}
+}
+
+func TestBootstrap(t *testing.T) {
+	leader := newTestStore(t)
+	auth, err := NewAuth(User{Name: "replica", Token: "replica", Grants: []Grant{{Access: AccessRead}}})
+	if err != nil {
+		t.Fatalf("NewAuth() error = %v", err)
+	}
+	addr := startReplication(t, leader, ReplicationOptions{Auth: auth, PollInterval: 10 * time.Millisecond})
+	dir := t.TempDir()
+	opts := FollowerOptions{PositionFile: filepath.Join(dir, "position"), Token: "replica"}
+
+	leader.Set("book:1", "dune")
+	leader.Set("book:1", "emma")
+	leader.Set("book:2", "persuasion")
+	leader.Delete("book:2")
+	if _, err := leader.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	fileName := filepath.Join(dir, "replica.db")
+	var rerr *replicationError
+	if err := Bootstrap(ctx, addr, fileName, FollowerOptions{PositionFile: opts.PositionFile}); !errors.As(err, &rerr) || rerr.code != codeUnauthenticated {
+		t.Errorf("Bootstrap() without a token error = %v, want the status %v", err, codeUnauthenticated)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "*")); len(matches) != 0 {
+		t.Errorf("Bootstrap() without a token left %v", matches)
+	}
+	if err := Bootstrap(ctx, addr, fileName, opts); err != nil {
+		t.Fatalf("Bootstrap() error = %v", err)
+	}
+	replica, err := caskdb.NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to open the bootstrapped store: %v", err)
+	}
+	defer replica.Close()
+	if got, _ := replica.Get("book:1"); got != "emma" || replica.Len() != 1 {
+		t.Errorf("bootstrapped keys = %v, want book:1", replica.Keys())
+	}
+
+	// the follower carries on from the snapshot
+	f, err := NewFollower(replica, addr, opts)
+	if err != nil {
+		t.Fatalf("NewFollower() error = %v", err)
+	}
+	if f.Position() != leader.LogEnd() {
+		t.Errorf("Position() = %v, want the end of the log %v", f.Position(), leader.LogEnd())
+	}
+	leader.Set("book:3", "ulysses")
+	done := make(chan error, 1)
+	go func() { done <- f.Run(ctx) }()
+	waitFor(t, "the write to be replicated", func() bool { return replica.Has("book:3") })
+	cancel()
+	<-done
+}
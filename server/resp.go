@@ -0,0 +1,641 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// RESPServer serves the store in RESP, the protocol of Redis, see
+// https://redis.io/docs/reference/protocol-spec/, so that any Redis client can talk
+// to it. It speaks RESP2, and has the subset of the commands which map onto the
+// store:
+//
+//	PING [message]
+//	GET key
+//	SET key value [EX seconds | PX milliseconds] [NX]
+//	DEL key [key ...]
+//	EXISTS key [key ...]
+//	EXPIRE key seconds
+//	PERSIST key
+//	TTL key
+//	SCAN cursor [MATCH pattern] [COUNT count]
+//	AUTH [username] token
+//	QUIT
+//
+// The other commands are answered with an error. There is a single database, and
+// the values are strings, which is all the store has.
+//
+// With RESPOptions.Auth, the clients have to AUTH with their token before anything
+// else, as with the requirepass of Redis; the username is ignored, since the token
+// tells the user. The commands on the keys the user has no access to fail with
+// NOPERM, and SCAN leaves them out.
+type RESPServer struct {
+	store *caskdb.DiskStore
+	opts  RESPOptions
+	conns *connServer
+}
+
+// RESPOptions are the options of a RESPServer.
+type RESPOptions struct {
+	// Auth, if set, authenticates and authorises the clients
+	Auth *Auth
+}
+
+// NewRESPServer returns a RESPServer of the store.
+func NewRESPServer(store *caskdb.DiskStore) *RESPServer {
+	return NewRESPServerWithOptions(store, RESPOptions{})
+}
+
+// NewRESPServerWithOptions returns a RESPServer of the store with the options.
+func NewRESPServerWithOptions(store *caskdb.DiskStore, opts RESPOptions) *RESPServer {
+	s := &RESPServer{store: store, opts: opts}
+	s.conns = newConnServer(s.serveConn)
+	return s
+}
+
+// Serve serves the connections of the listener until the server is closed, when it
+// returns ErrServerClosed.
+func (s *RESPServer) Serve(l net.Listener) error {
+	return s.conns.serve(l)
+}
+
+// Close stops the server: it closes the listeners and the connections. The store is
+// left open.
+func (s *RESPServer) Close() error {
+	return s.conns.close()
+}
+
+// The limits of a request, the same as Redis has. maxLineLength bounds a line, an
+// inline command or the header of a bulk string, which is buffered whole before it
+// is parsed; the memcached protocol has it too.
+const (
+	maxBulkLength = 512 << 20
+	maxArgs       = 1 << 20
+	maxLineLength = 64 << 10
+)
+
+// errProtocol is returned for a request which is not valid RESP; the connection is
+// closed after the error is sent, since there is no telling where the next request
+// starts.
+var errProtocol = errors.New("protocol error")
+
+// errLineTooLong is returned by readLine for a line longer than maxLineLength. The
+// connection is closed then, as for errProtocol.
+var errLineTooLong = fmt.Errorf("%w: too big inline request", errProtocol)
+
+// respSession is the state of a connection.
+type respSession struct {
+	// authenticated is whether the client may run the commands, and user who it is,
+	// nil without an Auth
+	authenticated bool
+	user          *User
+}
+
+func (s *RESPServer) serveConn(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	w := &respWriter{bufio.NewWriter(conn)}
+	session := &respSession{authenticated: s.opts.Auth == nil}
+	for {
+		args, err := readRequest(r)
+		if errors.Is(err, errProtocol) {
+			w.error("ERR " + err.Error())
+			w.Flush()
+			return
+		}
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := s.command(w, session, args)
+		// the pipelined requests are answered in one go
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// readRequest reads a request, which is an array of bulk strings, or an inline
+// command, which is a line of arguments separated by spaces.
+func readRequest(r *bufio.Reader) ([]string, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != '*' {
+		return strings.Fields(line), nil
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxArgs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errProtocol)
+	}
+	if n < 0 {
+		// a null array, which Redis skips as it does an empty one
+		return nil, nil
+	}
+	args := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := readLine(r)
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected '$', got '%.1s'", errProtocol, line)
+		}
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 || size > maxBulkLength {
+			return nil, fmt.Errorf("%w: invalid bulk length", errProtocol)
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", errProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+// readLine reads a line ending with CRLF, or just LF, as Redis takes for the inline
+// commands, and returns it without the line ending. A line longer than maxLineLength,
+// line ending included, is not read any further, and errLineTooLong is returned, so
+// that a client which never ends its line cannot make the server buffer it all.
+func readLine(r *bufio.Reader) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if err == bufio.ErrBufferFull {
+			// a line of the full length would have ended by now
+			if len(line) >= maxLineLength {
+				return "", errLineTooLong
+			}
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && len(line) > 0 {
+				return "", io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+		if len(line) > maxLineLength {
+			return "", errLineTooLong
+		}
+		return strings.TrimSuffix(string(line[:len(line)-1]), "\r"), nil
+	}
+}
+
+// respWriter writes the replies of RESP2.
+type respWriter struct {
+	*bufio.Writer
+}
+
+func (w *respWriter) simple(s string) {
+	w.WriteString("+" + s + "\r\n")
+}
+
+func (w *respWriter) error(msg string) {
+	// a message cannot span lines
+	w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(msg) + "\r\n")
+}
+
+func (w *respWriter) integer(n int64) {
+	w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+func (w *respWriter) bulk(s string) {
+	w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n")
+	w.WriteString(s)
+	w.WriteString("\r\n")
+}
+
+func (w *respWriter) null() {
+	w.WriteString("$-1\r\n")
+}
+
+func (w *respWriter) array(n int) {
+	w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+// command runs the command of the request and writes its reply. It reports whether
+// the connection is to be closed.
+func (s *RESPServer) command(w *respWriter, session *respSession, args []string) bool {
+	name := strings.ToUpper(args[0])
+	args = args[1:]
+	cmd, ok := respCommands[name]
+	if !ok {
+		w.error(fmt.Sprintf("ERR unknown command '%s'", strings.ToLower(name)))
+		return false
+	}
+	if len(args) < cmd.min || cmd.max >= 0 && len(args) > cmd.max {
+		w.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return false
+	}
+	if name == "AUTH" {
+		s.auth(w, session, args)
+		return false
+	}
+	if !session.authenticated && name != "QUIT" {
+		w.error("NOAUTH Authentication required.")
+		return false
+	}
+	if cmd.access != 0 {
+		keys := args[:1]
+		if cmd.multiKey {
+			keys = args
+		}
+		for _, key := range keys {
+			if !session.user.can(key, cmd.access) {
+				w.error("NOPERM this user has no permissions to access one of the keys used as arguments")
+				return false
+			}
+		}
+	}
+	switch name {
+	case "PING":
+		if len(args) == 1 {
+			w.bulk(args[0])
+		} else {
+			w.simple("PONG")
+		}
+	case "QUIT":
+		w.simple("OK")
+		return true
+	case "GET":
+		value, err := s.store.Get(args[0])
+		if errors.Is(err, caskdb.ErrKeyNotFound) {
+			w.null()
+		} else if err != nil {
+			w.error("ERR " + err.Error())
+		} else {
+			w.bulk(value)
+		}
+	case "SET":
+		s.set(w, args)
+	case "DEL":
+		var n int64
+		for _, key := range args {
+			if !s.store.Has(key) {
+				continue
+			}
+			if err := s.store.Delete(key); err != nil {
+				w.error("ERR " + err.Error())
+				return false
+			}
+			n++
+		}
+		w.integer(n)
+	case "EXISTS":
+		var n int64
+		for _, key := range args {
+			if s.store.Has(key) {
+				n++
+			}
+		}
+		w.integer(n)
+	case "EXPIRE":
+		seconds, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			w.error("ERR value is not an integer or out of range")
+			return false
+		}
+		if seconds <= 0 {
+			// an expiry in the past deletes the key, as in Redis
+			s.reply(w, s.store.Has(args[0]), s.store.Delete(args[0]))
+			return false
+		}
+		ttl, ok := expireDuration(seconds, time.Second)
+		if !ok {
+			w.error("ERR invalid expire time in 'expire' command")
+			return false
+		}
+		err = s.store.Touch(args[0], ttl)
+		s.reply(w, err == nil, err)
+	case "PERSIST":
+		ttl, err := s.store.TTL(args[0])
+		if err == nil && ttl != caskdb.NoTTL {
+			err = s.store.Persist(args[0])
+			s.reply(w, err == nil, err)
+		} else {
+			s.reply(w, false, err)
+		}
+	case "TTL":
+		ttl, err := s.store.TTL(args[0])
+		switch {
+		case errors.Is(err, caskdb.ErrKeyNotFound):
+			w.integer(-2)
+		case err != nil:
+			w.error("ERR " + err.Error())
+		case ttl == caskdb.NoTTL:
+			w.integer(-1)
+		default:
+			// the store rounds the expiries up to the second, which this takes back
+			w.integer(int64(ttl / time.Second))
+		}
+	case "SCAN":
+		s.scan(w, session, args)
+	}
+	return false
+}
+
+// respCommand describes the arguments of a command.
+type respCommand struct {
+	// min and max are the number of arguments the command takes, command name aside;
+	// a max of -1 means any number
+	min, max int
+	// access is the access the command needs to its key, the first argument, or to
+	// all of them with multiKey; 0 for the commands without keys
+	access   Access
+	multiKey bool
+}
+
+var respCommands = map[string]respCommand{
+	"PING":    {0, 1, 0, false},
+	"QUIT":    {0, 0, 0, false},
+	"AUTH":    {1, 2, 0, false},
+	"GET":     {1, 1, AccessRead, false},
+	"SET":     {2, -1, AccessWrite, false},
+	"DEL":     {1, -1, AccessWrite, true},
+	"EXISTS":  {1, -1, AccessRead, true},
+	"EXPIRE":  {2, 2, AccessWrite, false},
+	"PERSIST": {1, 1, AccessWrite, false},
+	"TTL":     {1, 1, AccessRead, false},
+	"SCAN":    {1, -1, 0, false},
+}
+
+// auth answers AUTH, whose last argument is the token.
+func (s *RESPServer) auth(w *respWriter, session *respSession, args []string) {
+	if s.opts.Auth == nil {
+		w.error("ERR AUTH called without any password configured for the default user. Are you sure your configuration is correct?")
+		return
+	}
+	user, err := s.opts.Auth.authenticate(args[len(args)-1])
+	if err != nil {
+		w.error("WRONGPASS invalid username-password pair or user is disabled.")
+		return
+	}
+	session.authenticated, session.user = true, user
+	w.simple("OK")
+}
+
+// reply writes the integer reply of the commands which answer whether they did
+// anything: 1 if done, 0 if not, for a missing key, or an error.
+func (s *RESPServer) reply(w *respWriter, done bool, err error) {
+	switch {
+	case errors.Is(err, caskdb.ErrKeyNotFound):
+		w.integer(0)
+	case err != nil:
+		w.error("ERR " + err.Error())
+	case done:
+		w.integer(1)
+	default:
+		w.integer(0)
+	}
+}
+
+// expireDuration returns the expire time of n units as a duration, and false if it
+// does not fit in one, which Redis turns down as an invalid expire time as well.
+func expireDuration(n int64, unit time.Duration) (time.Duration, bool) {
+	if n > math.MaxInt64/int64(unit) {
+		return 0, false
+	}
+	return time.Duration(n) * unit, true
+}
+
+func (s *RESPServer) set(w *respWriter, args []string) {
+	key, value := args[0], args[1]
+	var ttl time.Duration
+	nx := false
+	for i := 2; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); {
+		case option == "NX":
+			nx = true
+		case (option == "EX" || option == "PX") && i+1 < len(args) && ttl == 0:
+			n, err := strconv.ParseInt(args[i+1], 10, 64)
+			if err != nil {
+				w.error("ERR value is not an integer or out of range")
+				return
+			}
+			unit := time.Second
+			if option == "PX" {
+				unit = time.Millisecond
+			}
+			var ok bool
+			if ttl, ok = expireDuration(n, unit); !ok || n <= 0 {
+				w.error("ERR invalid expire time in 'set' command")
+				return
+			}
+			i++
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+	var err error
+	switch {
+	case nx:
+		ok := false
+		if ttl > 0 {
+			ok, err = s.store.SetIfAbsentWithTTL(key, value, ttl)
+		} else {
+			ok, err = s.store.SetIfAbsent(key, value)
+		}
+		if err == nil && !ok {
+			w.null()
+			return
+		}
+	case ttl > 0:
+		err = s.store.SetWithTTL(key, value, ttl)
+	default:
+		err = s.store.Set(key, value)
+	}
+	if err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	w.simple("OK")
+}
+
+// scan answers SCAN. The cursor stands for the key at which the next call starts,
+// see caskdb.DiskStore.ListPageWithPrefix, so that the keys set or deleted during
+// the iteration do not move it; 0 starts the iteration, and is returned at its end.
+// As with Redis, a key which is there for the whole iteration is returned. COUNT is
+// the number of keys looked at, of which MATCH keeps the ones matching its pattern.
+func (s *RESPServer) scan(w *respWriter, session *respSession, args []string) {
+	cursor, ok := parseScanCursor(args[0])
+	if !ok {
+		w.error("ERR invalid cursor")
+		return
+	}
+	pattern, count := "*", 10
+	for i := 1; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			w.error("ERR syntax error")
+			return
+		}
+		var err error
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			if count, err = strconv.Atoi(args[i+1]); err != nil || count < 1 {
+				w.error("ERR syntax error")
+				return
+			}
+		default:
+			w.error("ERR syntax error")
+			return
+		}
+	}
+	keys, next, err := s.store.ListPageWithPrefix(literalPrefix(pattern), cursor, count)
+	if errors.Is(err, caskdb.ErrInvalidCursor) {
+		w.error("ERR invalid cursor")
+		return
+	}
+	if err != nil {
+		w.error("ERR " + err.Error())
+		return
+	}
+	var page []string
+	for _, key := range keys {
+		if matchGlob(pattern, key) {
+			page = append(page, key)
+		}
+	}
+	page = filterKeys(session.user, page)
+	w.array(2)
+	w.bulk(formatScanCursor(next))
+	w.array(len(page))
+	for _, key := range page {
+		w.bulk(key)
+	}
+}
+
+// formatScanCursor turns the cursor of ListPageWithPrefix into the one of SCAN,
+// which the Redis clients take for an unsigned integer: the decimal form of its
+// bytes, after a leading 1 which keeps the number from being 0. The end of the
+// iteration is 0.
+func formatScanCursor(cursor string) string {
+	if cursor == "" {
+		return "0"
+	}
+	return new(big.Int).SetBytes(append([]byte{1}, cursor...)).String()
+}
+
+// parseScanCursor is the reverse of formatScanCursor.
+func parseScanCursor(s string) (string, bool) {
+	if s == "0" {
+		return "", true
+	}
+	n, ok := new(big.Int).SetString(s, 10)
+	if !ok || n.Sign() <= 0 {
+		return "", false
+	}
+	b := n.Bytes()
+	if b[0] != 1 {
+		return "", false
+	}
+	return string(b[1:]), true
+}
+
+// literalPrefix returns the start of the glob pattern which has no special
+// characters, which all the keys it matches start with.
+func literalPrefix(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// matchGlob reports whether s matches the glob pattern of Redis: * matches any
+// sequence of bytes, ? any single byte, [abc], [a-z] and [^a] a byte of the class,
+// and \ escapes the next byte.
+func matchGlob(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if matchGlob(pattern[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			matched, rest := matchClass(pattern[1:], s[0])
+			if !matched {
+				return false
+			}
+			pattern, s = rest, s[1:]
+		default:
+			if pattern[0] == '\\' && len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+			pattern, s = pattern[1:], s[1:]
+		}
+	}
+	return len(s) == 0
+}
+
+// matchClass matches the byte against the class which the pattern starts with,
+// right after its [, and returns the rest of the pattern after the class. An
+// unterminated class goes on to the end of the pattern, as in Redis.
+func matchClass(pattern string, c byte) (bool, string) {
+	negate := len(pattern) > 0 && pattern[0] == '^'
+	if negate {
+		pattern = pattern[1:]
+	}
+	matched := false
+	for len(pattern) > 0 && pattern[0] != ']' {
+		switch {
+		case pattern[0] == '\\' && len(pattern) > 1:
+			matched = matched || pattern[1] == c
+			pattern = pattern[2:]
+		case len(pattern) > 2 && pattern[1] == '-' && pattern[2] != ']':
+			lo, hi := pattern[0], pattern[2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || lo <= c && c <= hi
+			pattern = pattern[3:]
+		default:
+			matched = matched || pattern[0] == c
+			pattern = pattern[1:]
+		}
+	}
+	if len(pattern) > 0 {
+		pattern = pattern[1:]
+	}
+	return matched != negate, pattern
+}
@@ -0,0 +1,326 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	caskdb "github.com/avinassh/go-caskdb"
+)
+
+// newTestStore returns a store in a temporary directory, closed with the test.
+func newTestStore(t *testing.T) *caskdb.DiskStore {
+	t.Helper()
+	store, err := caskdb.NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// listen returns a listener on a free port of the loopback interface.
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	return l
+}
+
+// respClient sends the commands as RESP arrays and reads back the replies, which
+// it returns in the inline form of redis-cli: the arrays are flattened, and nil is
+// "(nil)".
+type respClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialRESP(t *testing.T, network, addr string) *respClient {
+	t.Helper()
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &respClient{conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *respClient) send(args ...string) {
+	fmt.Fprintf(c.conn, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(c.conn, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+}
+
+func (c *respClient) do(t *testing.T, args ...string) string {
+	t.Helper()
+	c.send(args...)
+	return c.read(t)
+}
+
+func (c *respClient) read(t *testing.T) string {
+	t.Helper()
+	line, err := readLine(c.r)
+	if err != nil {
+		t.Fatalf("failed to read the reply: %v", err)
+	}
+	switch line[0] {
+	case '$':
+		if line == "$-1" {
+			return "(nil)"
+		}
+		value, err := readLine(c.r)
+		if err != nil {
+			t.Fatalf("failed to read the reply: %v", err)
+		}
+		return value
+	case '*':
+		var n int
+		fmt.Sscanf(line[1:], "%d", &n)
+		items := make([]string, n)
+		for i := range items {
+			items[i] = c.read(t)
+		}
+		return "[" + strings.Join(items, " ") + "]"
+	}
+	return line
+}
+
+func startRESP(t *testing.T, store *caskdb.DiskStore) *respClient {
+	t.Helper()
+	srv := NewRESPServer(store)
+	l := listen(t)
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return dialRESP(t, "tcp", l.Addr().String())
+}
+
+func TestRESPServer(t *testing.T) {
+	store := newTestStore(t)
+	c := startRESP(t, store)
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"PING"}, "+PONG"},
+		{[]string{"ping", "hello"}, "hello"},
+		{[]string{"GET", "book"}, "(nil)"},
+		{[]string{"SET", "book", "dune"}, "+OK"},
+		{[]string{"GET", "book"}, "dune"},
+		{[]string{"SET", "book", "emma", "NX"}, "(nil)"},
+		{[]string{"SET", "author", "herbert", "nx"}, "+OK"},
+		{[]string{"SET", "book", "dune", "EX", "0"}, "-ERR invalid expire time in 'set' command"},
+		{[]string{"SET", "book", "dune", "EX", "9223372037"}, "-ERR invalid expire time in 'set' command"},
+		{[]string{"SET", "book", "dune", "PX", "9223372036855"}, "-ERR invalid expire time in 'set' command"},
+		{[]string{"SET", "book", "dune", "NX", "EX", "10"}, "(nil)"},
+		{[]string{"SET", "lock", "a", "NX", "EX", "10"}, "+OK"},
+		{[]string{"TTL", "lock"}, ":9|:10"},
+		{[]string{"DEL", "lock"}, ":1"},
+		{[]string{"SET", "book", "dune", "XX"}, "-ERR syntax error"},
+		{[]string{"EXISTS", "book", "author", "missing"}, ":2"},
+		{[]string{"TTL", "book"}, ":-1"},
+		{[]string{"TTL", "missing"}, ":-2"},
+		{[]string{"SET", "session", "jojo", "EX", "100"}, "+OK"},
+		{[]string{"TTL", "session"}, ":99|:100"},
+		{[]string{"PERSIST", "session"}, ":1"},
+		{[]string{"PERSIST", "session"}, ":0"},
+		{[]string{"TTL", "session"}, ":-1"},
+		{[]string{"EXPIRE", "session", "50"}, ":1"},
+		{[]string{"TTL", "session"}, ":49|:50"},
+		{[]string{"EXPIRE", "missing", "50"}, ":0"},
+		{[]string{"EXPIRE", "session", "9223372037"}, "-ERR invalid expire time in 'expire' command"},
+		{[]string{"SET", "session", "jojo", "PX", "100000"}, "+OK"},
+		{[]string{"TTL", "session"}, ":99|:100"},
+		{[]string{"EXPIRE", "session", "0"}, ":1"},
+		{[]string{"GET", "session"}, "(nil)"},
+		{[]string{"DEL", "book", "author", "missing"}, ":2"},
+		{[]string{"EXISTS", "book"}, ":0"},
+		{[]string{"GET"}, "-ERR wrong number of arguments for 'get' command"},
+		{[]string{"HELLO", "3"}, "-ERR unknown command 'hello'"},
+	} {
+		// the TTLs may be a second short, depending on when the command runs
+		if got := c.do(t, tt.args...); !contains(strings.Split(tt.want, "|"), got) {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+	if got := c.do(t, "QUIT"); got != "+OK" {
+		t.Errorf("QUIT = %q, want +OK", got)
+	}
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Errorf("connection open after QUIT")
+	}
+}
+
+func TestRESPServer_Auth(t *testing.T) {
+	store := newTestStore(t)
+	store.Set("secret:1", "value")
+	srv := NewRESPServerWithOptions(store, RESPOptions{Auth: testAuth(t)})
+	l := listen(t)
+	go srv.Serve(l)
+	defer srv.Close()
+	c := dialRESP(t, "tcp", l.Addr().String())
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"GET", "book:1"}, "-NOAUTH Authentication required."},
+		{[]string{"AUTH", "wrong"}, "-WRONGPASS invalid username-password pair or user is disabled."},
+		{[]string{"AUTH", "writer", "write"}, "+OK"},
+		{[]string{"SET", "book:1", "dune"}, "+OK"},
+		{[]string{"SET", "author:1", "herbert"}, "-NOPERM this user has no permissions to access one of the keys used as arguments"},
+		{[]string{"DEL", "book:1", "secret:1"}, "-NOPERM this user has no permissions to access one of the keys used as arguments"},
+		{[]string{"AUTH", "read"}, "+OK"},
+		{[]string{"GET", "book:1"}, "dune"},
+		{[]string{"GET", "secret:1"}, "-NOPERM this user has no permissions to access one of the keys used as arguments"},
+		{[]string{"DEL", "book:1"}, "-NOPERM this user has no permissions to access one of the keys used as arguments"},
+		{[]string{"SCAN", "0"}, "[0 [book:1]]"},
+	} {
+		if got := c.do(t, tt.args...); got != tt.want {
+			t.Errorf("%v = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+	if got := startRESP(t, store).do(t, "AUTH", "read"); got[0] != '-' {
+		t.Errorf("AUTH without an Auth = %q, want an error", got)
+	}
+}
+
+func TestRESPServer_Scan(t *testing.T) {
+	store := newTestStore(t)
+	for i := 0; i < 25; i++ {
+		store.Set(fmt.Sprintf("book:%02d", i), "value")
+	}
+	store.Set("author:1", "herbert")
+	c := startRESP(t, store)
+
+	var keys []string
+	cursor := "0"
+	for {
+		c.send("SCAN", cursor, "MATCH", "book:*", "COUNT", "10")
+		if line, _ := readLine(c.r); line != "*2" {
+			t.Fatalf("SCAN reply = %q, want an array of 2", line)
+		}
+		cursor = c.read(t)
+		page := strings.Trim(c.read(t), "[]")
+		keys = append(keys, strings.Fields(page)...)
+		if cursor == "0" {
+			break
+		}
+	}
+	if len(keys) != 25 || keys[0] != "book:00" || keys[24] != "book:24" {
+		t.Errorf("SCAN MATCH book:* = %v, want the 25 books", keys)
+	}
+	if got := c.do(t, "SCAN", "0", "MATCH", "*:1", "COUNT", "100"); got != "[0 [author:1]]" {
+		t.Errorf("SCAN MATCH *:1 COUNT 100 = %v, want [0 [author:1]]", got)
+	}
+	if got := c.do(t, "SCAN", "x"); got != "-ERR invalid cursor" {
+		t.Errorf("SCAN x = %v, want an error", got)
+	}
+}
+
+func TestRESPServer_ScanWithDeletes(t *testing.T) {
+	store := newTestStore(t)
+	want := make(map[string]bool)
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("book:%02d", i)
+		store.Set(key, "value")
+		want[key] = true
+	}
+	c := startRESP(t, store)
+
+	seen := make(map[string]bool)
+	cursor := "0"
+	for page := 0; ; page++ {
+		c.send("SCAN", cursor, "COUNT", "3")
+		if line, _ := readLine(c.r); line != "*2" {
+			t.Fatalf("SCAN reply = %q, want an array of 2", line)
+		}
+		cursor = c.read(t)
+		for _, key := range strings.Fields(strings.Trim(c.read(t), "[]")) {
+			seen[key] = true
+		}
+		if cursor == "0" {
+			break
+		}
+		// the keys before the cursor go away, which must not move it
+		deleted := fmt.Sprintf("book:%02d", page)
+		store.Delete(deleted)
+		delete(want, deleted)
+	}
+	for key := range want {
+		if !seen[key] {
+			t.Errorf("SCAN missed %v, which was there for the whole iteration", key)
+		}
+	}
+}
+
+func TestRESPServer_Pipeline(t *testing.T) {
+	c := startRESP(t, newTestStore(t))
+	// the inline commands, pipelined, as telnet or redis-benchmark would send them
+	fmt.Fprint(c.conn, "SET book dune\r\nGET book\nPING\r\n")
+	for _, want := range []string{"+OK", "dune", "+PONG"} {
+		if got := c.read(t); got != want {
+			t.Errorf("reply = %q, want %q", got, want)
+		}
+	}
+	// a null array is skipped, rather than taken for a request
+	fmt.Fprint(c.conn, "*-1\r\nPING\r\n")
+	if got := c.read(t); got != "+PONG" {
+		t.Errorf("reply after a null array = %q, want +PONG", got)
+	}
+	fmt.Fprint(c.conn, "*1\r\n$x\r\n")
+	if got := c.read(t); got != "-ERR protocol error: invalid bulk length" {
+		t.Errorf("reply to a bad request = %q, want a protocol error", got)
+	}
+}
+
+func TestRESPServer_LongLine(t *testing.T) {
+	c := startRESP(t, newTestStore(t))
+	// a line which never ends is not buffered past the limit
+	go fmt.Fprint(c.conn, strings.Repeat("a", maxLineLength+1))
+	if got := c.read(t); got != "-ERR protocol error: too big inline request" {
+		t.Errorf("reply to a long line = %q, want a protocol error", got)
+	}
+	if _, err := c.r.ReadByte(); err == nil {
+		t.Errorf("the connection is still open after a long line")
+	}
+}
+
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, tt := range []struct {
+		pattern, s string
+		want       bool
+	}{
+		{"*", "", true},
+		{"book:*", "book:1", true},
+		{"book:*", "author:1", false},
+		{"b?ok", "book", true},
+		{"b?ok", "bok", false},
+		{"*:1", "book:1", true},
+		{"*:1", "book:12", false},
+		{"book:[0-3]", "book:2", true},
+		{"book:[0-3]", "book:5", false},
+		{"book:[^0-3]", "book:5", true},
+		{"book:[ab]", "book:b", true},
+		{`book\*`, "book*", true},
+		{`book\*`, "books", false},
+		{"h*llo*", "heeello world", true},
+	} {
+		if got := matchGlob(tt.pattern, tt.s); got != tt.want {
+			t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.s, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+// Package server serves a caskdb.DiskStore over the network, in the protocols other
+// stores speak, so that the store can be used from outside of Go with the client
+// libraries there already are for them.
+//
+// The servers serve the connections of any net.Listener, and stop serving them all
+// on Close:
+//
+//	store, _ := caskdb.NewDiskStore("books.db")
+//	srv := server.NewRESPServer(store)
+//	l, _ := net.Listen("tcp", ":6379")
+//	go srv.Serve(l)
+//	defer srv.Close()
+//
+// HTTPHandler is the exception: it is an http.Handler, served by net/http.
+package server
+
+import (
+	"errors"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve once the server is closed.
+var ErrServerClosed = errors.New("server closed")
+
+// connServer serves the connections of the listeners with handle, each on its own
+// goroutine, and keeps track of them so that close can stop them all. It is what the
+// servers of the connection oriented protocols are built on.
+type connServer struct {
+	handle func(conn net.Conn)
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+func newConnServer(handle func(conn net.Conn)) *connServer {
+	return &connServer{
+		handle:    handle,
+		listeners: make(map[net.Listener]struct{}),
+		conns:     make(map[net.Conn]struct{}),
+	}
+}
+
+// serve accepts the connections of the listener until it is closed, and returns
+// ErrServerClosed once the server is. The temporary errors of Accept are retried
+// after a pause, the same as net/http does.
+func (s *connServer) serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else if delay *= 2; delay > time.Second {
+					delay = time.Second
+				}
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		if !s.track(conn) {
+			conn.Close()
+			return ErrServerClosed
+		}
+		go func() {
+			defer s.untrack(conn)
+			// a panic takes down the connection it happened on, rather than the
+			// process, as it does in net/http
+			defer func() {
+				if err := recover(); err != nil {
+					log.Printf("caskdb: panic serving %v: %v\n%s", conn.RemoteAddr(), err, debug.Stack())
+				}
+			}()
+			s.handle(conn)
+		}()
+	}
+}
+
+// track adds the connection to the ones close stops, unless the server is closed.
+func (s *connServer) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+func (s *connServer) untrack(conn net.Conn) {
+	conn.Close()
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+	s.wg.Done()
+}
+
+// close closes the listeners and the connections, and waits for the handlers to
+// return. The store is left open.
+func (s *connServer) close() error {
+	s.mu.Lock()
+	s.closed = true
+	var err error
+	for l := range s.listeners {
+		if cerr := l.Close(); err == nil {
+			err = cerr
+		}
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return err
+}
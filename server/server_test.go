@@ -0,0 +1,64 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestConnServer_close(t *testing.T) {
+	handled := make(chan struct{})
+	s := newConnServer(func(conn net.Conn) {
+		close(handled)
+		// blocks until close closes the connection
+		conn.Read(make([]byte, 1))
+	})
+	l := listen(t)
+	done := make(chan error)
+	go func() { done <- s.serve(l) }()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	<-handled
+	if err := s.close(); err != nil {
+		t.Errorf("close() error = %v", err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrServerClosed) {
+			t.Errorf("serve() error = %v, want %v", err, ErrServerClosed)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("serve() still running after close")
+	}
+	if err := s.serve(listen(t)); !errors.Is(err, ErrServerClosed) {
+		t.Errorf("serve() after close error = %v, want %v", err, ErrServerClosed)
+	}
+}
+
+func TestConnServer_panic(t *testing.T) {
+	s := newConnServer(func(conn net.Conn) {
+		panic("handler bug")
+	})
+	defer s.close()
+	l := listen(t)
+	go s.serve(l)
+
+	// the server goes on serving after a handler panics
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+			t.Errorf("Read() after the handler panicked error = %v, want %v", err, io.EOF)
+		}
+		conn.Close()
+	}
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+)
+
+// TLSOptions are the TLS settings of a listener, see ListenTLS.
+type TLSOptions struct {
+	// CertFile and KeyFile are the PEM files of the certificate of the server, and
+	// of its private key. The certificate file can have the intermediates after it.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile, if set, is a PEM file of the certificate authorities the clients
+	// must have a certificate of, for mutual TLS. The clients without one are turned
+	// away during the handshake.
+	ClientCAFile string
+	// MinVersion is the oldest version of TLS accepted, like tls.VersionTLS13.
+	// Defaults to tls.VersionTLS12.
+	MinVersion uint16
+}
+
+// Config returns the tls.Config of the options, for serving an HTTPHandler or a
+// GRPCHandler with an http.Server of its own. It offers HTTP/2 in the ALPN, which
+// the GRPCHandler needs.
+func (o TLSOptions) Config() (*tls.Config, error) {
+	if o.CertFile == "" || o.KeyFile == "" {
+		return nil, errors.New("tls needs a certificate and a key")
+	}
+	cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   o.MinVersion,
+		NextProtos:   []string{"h2", "http/1.1"},
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	if o.ClientCAFile != "" {
+		pem, err := os.ReadFile(o.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the client CAs: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates in %s", o.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ListenTLS listens on the network address, as net.Listen does, and serves TLS on
+// the connections with the options. All the protocols can be served on the
+// listener: the RESPServer and the MemcachedServer with their Serve, the handlers
+// with http.Serve, which serves the GRPCHandler over HTTP/2. See NewTLSListener to
+// serve TLS on another listener, like the one of ListenUnix.
+func ListenTLS(network, addr string, opts TLSOptions) (net.Listener, error) {
+	config, err := opts.Config()
+	if err != nil {
+		return nil, err
+	}
+	l, err := net.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(l, config), nil
+}
+
+// NewTLSListener returns a listener serving TLS with the options on the connections
+// of the inner listener.
+func NewTLSListener(inner net.Listener, opts TLSOptions) (net.Listener, error) {
+	config, err := opts.Config()
+	if err != nil {
+		return nil, err
+	}
+	return tls.NewListener(inner, config), nil
+}
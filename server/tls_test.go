@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority issuing the certificates of the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate a key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "caskdb test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create the CA: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+// issue returns a certificate of the CA for the loopback address, which can be used
+// by both the servers and the clients.
+func (ca *testCA) issue(t *testing.T, serial int64) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate a key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "caskdb test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create the certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// writePEM writes the certificate and its key to PEM files, and returns their paths.
+func writePEM(t *testing.T, cert tls.Certificate) (string, string) {
+	t.Helper()
+	dir := t.TempDir()
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("failed to marshal the key: %v", err)
+	}
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestListenTLS(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := writePEM(t, ca.issue(t, 2))
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600)
+
+	opts := TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: caFile, MinVersion: tls.VersionTLS13}
+	l, err := ListenTLS("tcp", "127.0.0.1:0", opts)
+	if err != nil {
+		t.Fatalf("ListenTLS() error = %v", err)
+	}
+	srv := NewRESPServer(newTestStore(t))
+	go srv.Serve(l)
+	defer srv.Close()
+
+	clientCert := ca.issue(t, 3)
+	for _, tt := range []struct {
+		name   string
+		config *tls.Config
+		ok     bool
+	}{
+		{"mutual", &tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{clientCert}}, true},
+		{"no client certificate", &tls.Config{RootCAs: ca.pool}, false},
+		{"TLS 1.2", &tls.Config{RootCAs: ca.pool, Certificates: []tls.Certificate{clientCert}, MaxVersion: tls.VersionTLS12}, false},
+	} {
+		conn, err := tls.Dial("tcp", l.Addr().String(), tt.config)
+		if err == nil {
+			// the server turns away a client certificate only after the client is done
+			// with its side of the handshake, so the refusal shows up on the first read
+			conn.Write([]byte("PING\r\n"))
+			var line string
+			line, err = bufio.NewReader(conn).ReadString('\n')
+			if err == nil && line != "+PONG\r\n" {
+				t.Errorf("%v: PING = %q, want +PONG", tt.name, line)
+			}
+			conn.Close()
+		}
+		if (err == nil) != tt.ok {
+			t.Errorf("%v: error = %v, want success %v", tt.name, err, tt.ok)
+		}
+	}
+
+	if _, err := ListenTLS("tcp", "127.0.0.1:0", TLSOptions{CertFile: certFile}); err == nil {
+		t.Errorf("ListenTLS() without a key error = nil, want an error")
+	}
+	if _, err := ListenTLS("tcp", "127.0.0.1:0", TLSOptions{CertFile: certFile, KeyFile: keyFile, ClientCAFile: keyFile}); err == nil {
+		t.Errorf("ListenTLS() with a key for the client CAs error = nil, want an error")
+	}
+}
+
+func TestListenTLS_grpc(t *testing.T) {
+	ca := newTestCA(t)
+	certFile, keyFile := writePEM(t, ca.issue(t, 2))
+	l, err := ListenTLS("tcp", "127.0.0.1:0", TLSOptions{CertFile: certFile, KeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("ListenTLS() error = %v", err)
+	}
+	defer l.Close()
+	go http.Serve(l, NewGRPCHandler(newTestStore(t), GRPCOptions{}))
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{RootCAs: ca.pool},
+		ForceAttemptHTTP2: true,
+	}}
+	var body bytes.Buffer
+	writeMessage(&body, appendBytesField(nil, 1, []byte("book")))
+	req, _ := http.NewRequest("POST", "https://"+l.Addr().String()+grpcService+"Get", &body)
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("Get error = %v", err)
+	}
+	defer resp.Body.Close()
+	if _, err := bufio.NewReader(resp.Body).ReadByte(); err == nil {
+		t.Errorf("Get of a missing key returned a message")
+	}
+	if resp.ProtoMajor != 2 || resp.Trailer.Get("Grpc-Status") != "5" {
+		t.Errorf("Get over HTTP/%d status = %q, want HTTP/2 and 5 (NOT_FOUND)", resp.ProtoMajor, resp.Trailer.Get("Grpc-Status"))
+	}
+}
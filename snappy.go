@@ -0,0 +1,199 @@
+package caskdb
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// errSnappyCorrupt is returned for data which is not a valid snappy block.
+var errSnappyCorrupt = errors.New("corrupt snappy block")
+
+// snappy.go implements the snappy block format, see
+// https://github.com/google/snappy/blob/main/format_description.txt, which is what
+// Snappy compresses the values with. The standard library has no snappy, and the
+// format is simple enough that the store can do without a dependency for it.
+//
+// A block is the length of the uncompressed data as a uvarint, followed by a series
+// of elements, each starting with a tag byte, whose lowest two bits tell its kind: a
+// literal, which is copied as it is, or a copy of the bytes found at some offset back
+// in the output, with a 1, 2 or 4 byte offset. The encoder below goes for the speed
+// over the ratio, as snappy does: it finds the matches by hashing 4 bytes at a time,
+// and takes the first one it finds.
+
+// The encoder works on the input 64 KiB at a time, so that all the offsets fit in
+// a 2 byte copy.
+const (
+	snappyBlockSize = 1 << 16
+	snappyTableBits = 14
+	// snappyMinMatch is the shortest match worth a copy
+	snappyMinMatch = 4
+)
+
+// snappyMaxEncodedLen returns the largest size the snappy block of n bytes can have.
+func snappyMaxEncodedLen(n int) int {
+	return binary.MaxVarintLen32 + n + n/6 + 32
+}
+
+// snappyEncode appends the snappy block of src to dst.
+func snappyEncode(dst []byte, src []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(len(src)))
+	var table [1 << snappyTableBits]int32
+	for len(src) > 0 {
+		block := src
+		if len(block) > snappyBlockSize {
+			block = block[:snappyBlockSize]
+		}
+		src = src[len(block):]
+		for i := range table {
+			table[i] = 0
+		}
+		dst = snappyEncodeBlock(dst, block, &table)
+	}
+	return dst
+}
+
+// snappyEncodeBlock appends the elements of a block of at most snappyBlockSize bytes.
+// The table keeps the last position + 1 of each hash of 4 bytes, 0 meaning none.
+func snappyEncodeBlock(dst []byte, src []byte, table *[1 << snappyTableBits]int32) []byte {
+	lit := 0
+	for s := 0; s+snappyMinMatch <= len(src); {
+		h := snappyHash(binary.LittleEndian.Uint32(src[s:]))
+		candidate := int(table[h]) - 1
+		table[h] = int32(s + 1)
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != binary.LittleEndian.Uint32(src[s:]) {
+			// the longer there is no match, the faster the incompressible data is skipped
+			s += 1 + (s-lit)>>5
+			continue
+		}
+		dst = snappyEmitLiteral(dst, src[lit:s])
+		length := snappyMinMatch
+		for s+length < len(src) && src[s+length] == src[candidate+length] {
+			length++
+		}
+		dst = snappyEmitCopy(dst, s-candidate, length)
+		s += length
+		lit = s
+	}
+	return snappyEmitLiteral(dst, src[lit:])
+}
+
+func snappyHash(v uint32) uint32 {
+	return (v * 0x1e35a7bd) >> (32 - snappyTableBits)
+}
+
+// snappyEmitLiteral appends a literal element of the bytes, if there are any.
+func snappyEmitLiteral(dst []byte, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+	switch n := uint32(len(lit) - 1); {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	case n < 1<<16:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	case n < 1<<24:
+		dst = append(dst, 62<<2, byte(n), byte(n>>8), byte(n>>16))
+	default:
+		dst = append(dst, 63<<2, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	return append(dst, lit...)
+}
+
+// snappyEmitCopy appends the copy elements of length bytes from offset bytes back.
+// A single element copies at most 64 bytes.
+func snappyEmitCopy(dst []byte, offset int, length int) []byte {
+	for length >= 68 {
+		dst = append(dst, 63<<2|2, byte(offset), byte(offset>>8))
+		length -= 64
+	}
+	if length > 64 {
+		// leaves at least 4 bytes for the last one
+		dst = append(dst, 59<<2|2, byte(offset), byte(offset>>8))
+		length -= 60
+	}
+	if length >= 12 || offset >= 2048 {
+		return append(dst, byte(length-1)<<2|2, byte(offset), byte(offset>>8))
+	}
+	return append(dst, byte(offset>>8)<<5|byte(length-4)<<2|1, byte(offset))
+}
+
+// snappyDecodedLen returns the length of the data in the snappy block.
+func snappyDecodedLen(src []byte) (int, int, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 || n > maxValueSize {
+		return 0, 0, errSnappyCorrupt
+	}
+	return int(n), k, nil
+}
+
+// snappyDecode decodes the snappy block.
+func snappyDecode(src []byte) ([]byte, error) {
+	n, s, err := snappyDecodedLen(src)
+	if err != nil {
+		return nil, err
+	}
+	dst := make([]byte, n)
+	d := 0
+	for s < len(src) {
+		tag := src[s]
+		var length, offset int
+		switch tag & 3 {
+		case 0:
+			length = int(tag >> 2)
+			s++
+			if length >= 60 {
+				extra := length - 59
+				if s+extra > len(src) {
+					return nil, errSnappyCorrupt
+				}
+				length = 0
+				for i := extra - 1; i >= 0; i-- {
+					length = length<<8 | int(src[s+i])
+				}
+				s += extra
+			}
+			length++
+			if length > len(src)-s || length > len(dst)-d {
+				return nil, errSnappyCorrupt
+			}
+			d += copy(dst[d:], src[s:s+length])
+			s += length
+			continue
+		case 1:
+			if s+2 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 4 + int(tag>>2)&7
+			offset = int(tag>>5)<<8 | int(src[s+1])
+			s += 2
+		case 2:
+			if s+3 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint16(src[s+1:]))
+			s += 3
+		case 3:
+			if s+5 > len(src) {
+				return nil, errSnappyCorrupt
+			}
+			length = 1 + int(tag>>2)
+			offset = int(binary.LittleEndian.Uint32(src[s+1:]))
+			s += 5
+		}
+		if offset <= 0 || offset > d || length > len(dst)-d {
+			return nil, errSnappyCorrupt
+		}
+		// the copy may overlap with the bytes it writes, which repeats them
+		for i := 0; i < length; i++ {
+			dst[d+i] = dst[d-offset+i]
+		}
+		d += length
+	}
+	if d != len(dst) {
+		return nil, errSnappyCorrupt
+	}
+	return dst, nil
+}
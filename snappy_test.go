@@ -0,0 +1,59 @@
+package caskdb
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func TestSnappy_roundTrip(t *testing.T) {
+	random := make([]byte, 5000)
+	rand.New(rand.NewSource(1)).Read(random)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"short", []byte("abc")},
+		{"text", []byte(strings.Repeat("the quick brown fox jumps over the lazy dog. ", 40))},
+		{"run", bytes.Repeat([]byte{'a'}, 1000)},
+		{"random", random},
+		{"long literal", append(append([]byte{}, random...), random...)},
+		{"over a block", []byte(strings.Repeat("caskdb is a bitcask store; ", 10000))},
+	}
+	for _, tt := range tests {
+		encoded := snappyEncode(nil, tt.data)
+		if len(encoded) > snappyMaxEncodedLen(len(tt.data)) {
+			t.Errorf("%v: snappyEncode() size = %v, want at most %v", tt.name, len(encoded), snappyMaxEncodedLen(len(tt.data)))
+		}
+		decoded, err := snappyDecode(encoded)
+		if err != nil || !bytes.Equal(decoded, tt.data) {
+			t.Errorf("%v: snappyDecode() = %d bytes, %v, want the %d bytes encoded", tt.name, len(decoded), err, len(tt.data))
+		}
+	}
+	text := []byte(strings.Repeat("the quick brown fox jumps over the lazy dog. ", 40))
+	if encoded := snappyEncode(nil, text); len(encoded) > len(text)/10 {
+		t.Errorf("snappyEncode() of a repetitive text = %v bytes, want at most %v", len(encoded), len(text)/10)
+	}
+}
+
+func TestSnappy_decodeCorrupt(t *testing.T) {
+	encoded := snappyEncode(nil, []byte(strings.Repeat("hello world ", 20)))
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"truncated", encoded[:len(encoded)-1]},
+		{"longer", append(append([]byte{}, encoded...), 0)},
+		{"wrong length", append([]byte{0x05}, encoded[1:]...)},
+		// a copy from before the start of the output
+		{"bad offset", []byte{0x04, 0x01, 0x10}},
+	}
+	for _, tt := range tests {
+		if _, err := snappyDecode(tt.data); err != errSnappyCorrupt {
+			t.Errorf("%v: snappyDecode() error = %v, want %v", tt.name, err, errSnappyCorrupt)
+		}
+	}
+}
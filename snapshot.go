@@ -0,0 +1,270 @@
+package caskdb
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The names of the files in a snapshot, see WriteSnapshot. The data files, their
+// compression dictionaries and the value log files are named after their IDs, so
+// that a snapshot can be restored under any file name.
+const (
+	snapshotData       = "data/"
+	snapshotDictionary = "dict/"
+	snapshotValueLog   = "vlog/"
+	snapshotCheckpoint = "checkpoint"
+	snapshotPosition   = "position"
+)
+
+// snapshotFile is a file of the store to go in a snapshot, up to size.
+type snapshotFile struct {
+	name string
+	path string
+	size int64
+}
+
+// WriteSnapshot writes a snapshot of the store to w: a tar archive of its data files,
+// along with their compression dictionaries and the value log files, and of a
+// checkpoint of keyDir, as they are at a single point of the log, whose Position it
+// returns. RestoreSnapshot makes a copy of the store out of it, which opens from the
+// checkpoint without scanning the data files, and can follow the store from the
+// Position on, see ReadLog. That is how a new replica gets started without replaying
+// all the history of the log; Compact the store first to leave out the garbage.
+//
+// The reads and writes carry on while the snapshot is written, since the files are
+// only ever appended to, but the compactions wait until it is done. The files are
+// copied as they are, so the copy needs the same Options.EncryptionKeys.
+func (d *DiskStore) WriteSnapshot(w io.Writer) (Position, error) {
+	s, err := d.beginSnapshot()
+	if err != nil {
+		return Position{}, err
+	}
+	defer s.release()
+	if err := s.writeTo(w); err != nil {
+		return Position{}, err
+	}
+	return s.pos, nil
+}
+
+// storeSnapshot is a snapshot of the store at a point of the log, which is written
+// later on. It holds compactMu until it is released, so that no file of it can be
+// removed in the meantime.
+type storeSnapshot struct {
+	d          *DiskStore
+	files      []snapshotFile
+	checkpoint []byte
+	pos        Position
+	once       sync.Once
+}
+
+// beginSnapshot takes a snapshot of the store, which must be released.
+func (d *DiskStore) beginSnapshot() (*storeSnapshot, error) {
+	d.compactMu.Lock()
+	files, checkpoint, pos, err := d.snapshotFiles()
+	if err != nil {
+		d.compactMu.Unlock()
+		return nil, err
+	}
+	return &storeSnapshot{d: d, files: files, checkpoint: checkpoint, pos: pos}, nil
+}
+
+// writeTo writes the snapshot to w, as a tar archive.
+func (s *storeSnapshot) writeTo(w io.Writer) error {
+	tw := tar.NewWriter(w)
+	modTime := time.Now()
+	for _, sf := range s.files {
+		f, err := os.Open(sf.path)
+		if err != nil {
+			return err
+		}
+		info, err := f.Stat()
+		if err == nil {
+			err = tw.WriteHeader(&tar.Header{Name: sf.name, Mode: int64(info.Mode().Perm()), Size: sf.size, ModTime: modTime})
+		}
+		if err == nil {
+			_, err = io.CopyN(tw, f, sf.size)
+		}
+		f.Close()
+		if err != nil {
+			return fmt.Errorf("snapshot of %s: %w", sf.path, err)
+		}
+	}
+	// the position goes last, so that a snapshot which has it is complete
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{{snapshotCheckpoint, s.checkpoint}, {snapshotPosition, []byte(s.pos.String())}} {
+		if err := tw.WriteHeader(&tar.Header{Name: entry.name, Mode: int64(s.d.opts.FileMode.Perm()), Size: int64(len(entry.data)), ModTime: modTime}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// release lets the compactions run again; it may be called more than once.
+func (s *storeSnapshot) release() {
+	s.once.Do(s.d.compactMu.Unlock)
+}
+
+// snapshotFiles returns the files of the snapshot, the checkpoint of keyDir and the
+// position in the log they are of. The caller must hold compactMu.
+func (d *DiskStore) snapshotFiles() ([]snapshotFile, []byte, Position, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.opts.ReadOnly {
+		if err := d.Failed(); err != nil {
+			return nil, nil, Position{}, err
+		}
+		// the records in the write buffer are copied from the file
+		if err := d.flushBuffer(); err != nil {
+			return nil, nil, Position{}, err
+		}
+	}
+	var files []snapshotFile
+	sizes := make(map[uint32]int64, len(d.readers))
+	for fileID := range d.readers {
+		if d.retired[fileID] {
+			// it may be removed while the snapshot is written, see retireSources
+			continue
+		}
+		size, err := d.logFileEnd(fileID)
+		if err != nil {
+			return nil, nil, Position{}, err
+		}
+		sizes[fileID] = size
+		id := fmt.Sprintf("%06d", fileID)
+		files = append(files, snapshotFile{snapshotData + id, segmentName(d.fileName, fileID), size})
+		if dict, ok := d.dicts[fileID]; ok {
+			files = append(files, snapshotFile{snapshotDictionary + id, dictionaryName(d.fileName, fileID), int64(len(dict))})
+		}
+	}
+	for logID, f := range d.vlogs {
+		size := d.vlogOffset
+		if logID != d.vlogID || d.vlogWriter == nil {
+			info, err := f.Stat()
+			if err != nil {
+				return nil, nil, Position{}, err
+			}
+			size = info.Size()
+		}
+		files = append(files, snapshotFile{snapshotValueLog + fmt.Sprintf("%06d", logID), valueLogName(d.fileName, logID), size})
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].name < files[j].name
+	})
+	var checkpoint bytes.Buffer
+	if err := writeCheckpoint(&checkpoint, d.activeID, sizes, d.keyDir.view()); err != nil {
+		return nil, nil, Position{}, err
+	}
+	return files, checkpoint.Bytes(), Position{FileID: d.activeID, Offset: int64(d.currentOffset)}, nil
+}
+
+// RestoreSnapshot restores the snapshot written by WriteSnapshot as a store at
+// fileName, which must not exist, and returns the Position of the log the snapshot
+// was taken at. The store is then opened with NewDiskStoreWithOptions as usual. On
+// error, the files restored so far are removed.
+func RestoreSnapshot(r io.Reader, fileName string) (pos Position, err error) {
+	if isFileExists(fileName) {
+		return Position{}, fmt.Errorf("restore to %s: %w", fileName, fs.ErrExist)
+	}
+	var restored []string
+	defer func() {
+		if err != nil {
+			for _, path := range restored {
+				os.Remove(path)
+			}
+		}
+	}()
+	complete := false
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return Position{}, err
+		}
+		if h.Name == snapshotPosition {
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				return Position{}, err
+			}
+			if _, err := fmt.Sscanf(string(data), "%d:%d", &pos.FileID, &pos.Offset); err != nil {
+				return Position{}, fmt.Errorf("invalid snapshot position: %w", err)
+			}
+			complete = true
+			continue
+		}
+		path, err := snapshotPath(fileName, h.Name)
+		if err != nil {
+			return Position{}, err
+		}
+		if err := restoreFile(path, os.FileMode(h.Mode).Perm(), tr); err != nil {
+			return Position{}, err
+		}
+		restored = append(restored, path)
+	}
+	if !complete {
+		return Position{}, errors.New("snapshot is incomplete")
+	}
+	if err := syncDir(filepath.Dir(fileName)); err != nil {
+		return Position{}, fmt.Errorf("failed to sync the directory: %w", err)
+	}
+	return pos, nil
+}
+
+// snapshotPath returns the path of the file of the store at fileName which the file
+// of a snapshot is.
+func snapshotPath(fileName string, name string) (string, error) {
+	if name == snapshotCheckpoint {
+		return checkpointName(fileName), nil
+	}
+	for prefix, path := range map[string]func(uint32) string{
+		snapshotData:       func(id uint32) string { return segmentName(fileName, id) },
+		snapshotDictionary: func(id uint32) string { return dictionaryName(fileName, id) },
+		snapshotValueLog:   func(id uint32) string { return valueLogName(fileName, id) },
+	} {
+		if strings.HasPrefix(name, prefix) {
+			n, err := strconv.ParseUint(strings.TrimPrefix(name, prefix), 10, 32)
+			if err != nil {
+				return "", fmt.Errorf("invalid snapshot file %q", name)
+			}
+			return path(uint32(n)), nil
+		}
+	}
+	return "", fmt.Errorf("unknown snapshot file %q", name)
+}
+
+// restoreFile writes the contents of r to a new file at path, and syncs it.
+func restoreFile(path string, mode os.FileMode, r io.Reader) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
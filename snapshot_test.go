@@ -0,0 +1,71 @@
+package caskdb
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDiskStore_WriteSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	opts := Options{Format: FormatV2, MaxSegmentSize: 64, ValueLogThreshold: 1024, MergeOperator: joinOperator}
+	store, err := NewDiskStoreWithOptions(filepath.Join(dir, "test.db"), opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	fillSegments(t, store)
+	big := strings.Repeat("x", 2048)
+	store.Set("big", big)
+	if _, err := store.Compact(); err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	store.Set("k4", "v6")
+
+	var snapshot bytes.Buffer
+	pos, err := store.WriteSnapshot(&snapshot)
+	if err != nil {
+		t.Fatalf("WriteSnapshot() error = %v", err)
+	}
+	if pos != store.LogEnd() {
+		t.Errorf("WriteSnapshot() position = %v, want %v", pos, store.LogEnd())
+	}
+	replicaName := filepath.Join(dir, "replica.db")
+	restored, err := RestoreSnapshot(bytes.NewReader(snapshot.Bytes()), replicaName)
+	if err != nil || restored != pos {
+		t.Fatalf("RestoreSnapshot() = %v, %v, want %v", restored, err, pos)
+	}
+	if !isFileExists(checkpointName(replicaName)) {
+		t.Errorf("RestoreSnapshot() did not restore the checkpoint")
+	}
+	replica, err := NewDiskStoreWithOptions(replicaName, opts)
+	if err != nil {
+		t.Fatalf("failed to open the restored store: %v", err)
+	}
+	defer replica.Close()
+	checkReplica(t, store, replica)
+	if got, _ := replica.Get("big"); got != big {
+		t.Errorf("replica Get(big) = %d bytes, want the value of the value log", len(got))
+	}
+
+	// the replica follows the log from the position of the snapshot on
+	store.Delete("k0")
+	store.Merge("tags", "c")
+	replicate(t, store, replica, pos)
+	checkReplica(t, store, replica)
+
+	if _, err := RestoreSnapshot(bytes.NewReader(snapshot.Bytes()), replicaName); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("RestoreSnapshot() to an existing store error = %v, want %v", err, fs.ErrExist)
+	}
+	// a snapshot cut short is not restored, and leaves nothing behind
+	partialName := filepath.Join(dir, "partial.db")
+	if _, err := RestoreSnapshot(bytes.NewReader(snapshot.Bytes()[:snapshot.Len()-2048]), partialName); err == nil {
+		t.Errorf("RestoreSnapshot() of a partial snapshot error = nil, want an error")
+	}
+	if matches, _ := filepath.Glob(partialName + "*"); len(matches) != 0 {
+		t.Errorf("RestoreSnapshot() of a partial snapshot left %v", matches)
+	}
+}
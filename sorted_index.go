@@ -0,0 +1,89 @@
+package caskdb
+
+import "sort"
+
+// sortedIndex keeps all the keys of keyDir in a sorted slice, so that the keys can be
+// scanned in order without sorting them on every scan. keyDir is a hash table and
+// cannot do that. Inserting a new key or removing one is O(n) because of the shifting,
+// but overwriting an existing key, the common case, does not touch the index at all.
+type sortedIndex struct {
+	keys []string
+}
+
+func newSortedIndex(keyDir *shardedKeyDir) *sortedIndex {
+	keys := make([]string, 0, keyDir.len())
+	keyDir.forEach(func(key string, _ KeyEntry) {
+		keys = append(keys, key)
+	})
+	sort.Strings(keys)
+	return &sortedIndex{keys: keys}
+}
+
+func (s *sortedIndex) insert(key string) {
+	i := sort.SearchStrings(s.keys, key)
+	if i < len(s.keys) && s.keys[i] == key {
+		return
+	}
+	s.keys = append(s.keys, "")
+	copy(s.keys[i+1:], s.keys[i:])
+	s.keys[i] = key
+}
+
+func (s *sortedIndex) remove(key string) {
+	i := sort.SearchStrings(s.keys, key)
+	if i < len(s.keys) && s.keys[i] == key {
+		s.keys = append(s.keys[:i], s.keys[i+1:]...)
+	}
+}
+
+// rangeKeys returns a copy of the keys in [start, end), in order. An empty end means
+// there is no upper bound.
+func (s *sortedIndex) rangeKeys(start string, end string) []string {
+	i := sort.SearchStrings(s.keys, start)
+	j := len(s.keys)
+	if end != "" {
+		j = sort.SearchStrings(s.keys, end)
+	}
+	if i >= j {
+		return nil
+	}
+	keys := make([]string, j-i)
+	copy(keys, s.keys[i:j])
+	return keys
+}
+
+// Range returns an iterator over the keys in [start, end) in key order. An empty end
+// means there is no upper bound, so Range("", "") visits all the keys. The iterator
+// has the same semantics for the concurrent writes as Iterator.
+//
+// With Options.SortedIndex the keys come straight from the sorted index. Without it,
+// Range has to sort all the matching keys of keyDir first.
+func (d *DiskStore) Range(start string, end string) *Iterator {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	return d.newIterator(d.snapshot(d.rangeKeys(start, end)))
+}
+
+// RangeReverse is the same as Range, but visits the keys in descending order, so
+// that the time prefixed keys for example, can be read newest first.
+func (d *DiskStore) RangeReverse(start string, end string) *Iterator {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	keys := d.rangeKeys(start, end)
+	for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+		keys[i], keys[j] = keys[j], keys[i]
+	}
+	return d.newIterator(d.snapshot(keys))
+}
+
+func (d *DiskStore) rangeKeys(start string, end string) []string {
+	if d.sorted != nil {
+		return d.sorted.rangeKeys(start, end)
+	}
+	var keys []string
+	d.keyDir.forEachBetween(start, end, func(key string, _ KeyEntry) {
+		keys = append(keys, key)
+	})
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,88 @@
+package caskdb
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+func Test_sortedIndex(t *testing.T) {
+	keyDir := newShardedKeyDir(newMapIndex)
+	for _, key := range []string{"b", "d"} {
+		keyDir.shard(key).entries.Put(key, KeyEntry{})
+	}
+	s := newSortedIndex(keyDir)
+	s.insert("c")
+	s.insert("a")
+	s.insert("c")
+	s.insert("e")
+	s.remove("d")
+	s.remove("x")
+	if want := []string{"a", "b", "c", "e"}; !reflect.DeepEqual(s.keys, want) {
+		t.Errorf("keys = %v, want %v", s.keys, want)
+	}
+	tests := []struct {
+		start string
+		end   string
+		want  []string
+	}{
+		{"", "", []string{"a", "b", "c", "e"}},
+		{"b", "e", []string{"b", "c"}},
+		{"bb", "", []string{"c", "e"}},
+		{"f", "", nil},
+		{"c", "b", nil},
+	}
+	for _, tt := range tests {
+		if got := s.rangeKeys(tt.start, tt.end); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("rangeKeys(%q, %q) = %v, want %v", tt.start, tt.end, got, tt.want)
+		}
+	}
+}
+
+func TestDiskStore_Range(t *testing.T) {
+	check := func(store *DiskStore, opts Options) {
+		var keys, values []string
+		it := store.Range("2022-01-01", "2022-02-01")
+		for it.Next() {
+			keys = append(keys, it.Key())
+			values = append(values, it.Value())
+		}
+		if want := []string{"2022-01-01", "2022-01-02", "2022-01-04"}; !reflect.DeepEqual(keys, want) {
+			t.Errorf("Range() keys = %v, want %v (options %+v)", keys, want, opts)
+		}
+		if want := []string{"a", "b", "e"}; !reflect.DeepEqual(values, want) {
+			t.Errorf("Range() values = %v, want %v (options %+v)", values, want, opts)
+		}
+
+		keys = nil
+		it = store.RangeReverse("2022-01-02", "")
+		for it.Next() {
+			keys = append(keys, it.Key())
+		}
+		if want := []string{"2022-02-01", "2022-01-04", "2022-01-02"}; !reflect.DeepEqual(keys, want) {
+			t.Errorf("RangeReverse() keys = %v, want %v (options %+v)", keys, want, opts)
+		}
+	}
+	for _, opts := range []Options{{}, {SortedIndex: true}} {
+		store, err := NewDiskStoreWithOptions("test.db", opts)
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		store.Set("2022-01-03", "c")
+		store.Set("2022-01-01", "a")
+		store.Set("2022-02-01", "d")
+		store.Set("2022-01-04", "e")
+		store.Set("2022-01-02", "b")
+		store.Delete("2022-01-03")
+		check(store, opts)
+		store.Close()
+
+		store, err = NewDiskStoreWithOptions("test.db", opts)
+		if err != nil {
+			t.Fatalf("failed to create disk store: %v", err)
+		}
+		check(store, opts)
+		store.Close()
+		os.Remove("test.db")
+	}
+}
@@ -0,0 +1,247 @@
+package caskdb
+
+import (
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// The kinds of the records found by scanKeyDir, as far as keyDir is concerned: a
+// value, a merge operand, or the removal of the key, by a tombstone or an expired
+// record.
+const (
+	scanPut = iota
+	scanOperand
+	scanRemove
+)
+
+// applyFunc receives the records found by scanKeyDir, one by one.
+type applyFunc func(key string, keyEntry KeyEntry, kind int)
+
+// applyRecord applies a record found by scanKeyDir to keyDir.
+func (d *DiskStore) applyRecord(key string, keyEntry KeyEntry, kind int) {
+	switch kind {
+	case scanRemove:
+		d.removeKeyEntry(key)
+	case scanOperand:
+		d.addMergeOperand(key, keyEntry)
+	default:
+		d.putKeyEntry(key, keyEntry)
+	}
+}
+
+// loadFiles loads keyDir from the data files, in the order of fileIDs, and returns
+// the offset where each of them ends. With several files and Options.OpenWorkers, the
+// files are scanned concurrently: each scan sums up what its records do to keyDir
+// in a fileChanges, and those are applied one file after the other, oldest first, so
+// that keyDir comes out the same as with a sequential scan. Each file is applied as
+// soon as the ones before it are, and the scans run at most openLookahead files
+// per worker ahead of it, so that only a few fileChanges are held at a time. A single
+// file is applied as it is scanned.
+func (d *DiskStore) loadFiles(fileIDs []uint32, from map[uint32]int64) ([]int64, error) {
+	if d.opts.OpenProgress != nil {
+		d.progress = &openProgress{fn: d.opts.OpenProgress}
+		for _, fileID := range fileIDs {
+			if info, err := os.Stat(segmentName(d.fileName, fileID)); err == nil && info.Size() > from[fileID] {
+				d.progress.total += info.Size() - from[fileID]
+			}
+		}
+		d.progress.fn(0, d.progress.total)
+		defer func() { d.progress = nil }()
+	}
+	ends := make([]int64, len(fileIDs))
+	if d.opts.OpenWorkers <= 1 || len(fileIDs) == 1 {
+		for i, fileID := range fileIDs {
+			end, err := d.loadKeyDir(fileID, from[fileID], d.applyRecord)
+			if err != nil {
+				return nil, err
+			}
+			ends[i] = end
+		}
+		return ends, nil
+	}
+
+	type scan struct {
+		end     int64
+		changes fileChanges
+		err     error
+	}
+	scans := make([]chan scan, len(fileIDs))
+	for i := range scans {
+		scans[i] = make(chan scan, 1)
+	}
+	// window has a slot for each file being scanned or waiting to be applied
+	window := make(chan struct{}, openLookahead*d.opts.OpenWorkers)
+	next, stop := make(chan int), make(chan struct{})
+	go func() {
+		defer close(next)
+		for i := range fileIDs {
+			select {
+			case window <- struct{}{}:
+			case <-stop:
+				return
+			}
+			next <- i
+		}
+	}()
+	var wg sync.WaitGroup
+	for w := 0; w < d.opts.OpenWorkers && w < len(fileIDs); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				c := make(fileChanges)
+				end, err := d.loadKeyDir(fileIDs[i], from[fileIDs[i]], c.add)
+				scans[i] <- scan{end, c, err}
+			}
+		}()
+	}
+	defer func() {
+		// the scans still running are waited for, since they may truncate their files
+		close(stop)
+		wg.Wait()
+	}()
+	for i := range fileIDs {
+		s := <-scans[i]
+		<-window
+		if s.err != nil {
+			return nil, s.err
+		}
+		d.applyChanges(s.changes)
+		ends[i] = s.end
+	}
+	return ends, nil
+}
+
+// openLookahead is how many files per worker loadFiles scans ahead of the one it
+// applies, so that a slow file does not leave the workers idle.
+const openLookahead = 2
+
+// fileChanges sums up the records of a data file by key: only the net effect of
+// each key's records on keyDir is kept, not every record.
+type fileChanges map[string]*keyChange
+
+// keyChange is the net effect of the records of a key in a data file: if reset, the
+// key is replaced by base, or removed if it has none, and then the operands are
+// merged on top.
+type keyChange struct {
+	reset    bool
+	hasBase  bool
+	base     KeyEntry
+	operands []KeyEntry
+}
+
+func (c fileChanges) add(key string, keyEntry KeyEntry, kind int) {
+	change, ok := c[key]
+	if !ok {
+		change = &keyChange{}
+		c[key] = change
+	}
+	switch kind {
+	case scanOperand:
+		change.operands = append(change.operands, keyEntry)
+	case scanRemove:
+		*change = keyChange{reset: true}
+	default:
+		*change = keyChange{reset: true, hasBase: true, base: keyEntry}
+	}
+}
+
+// applyChanges applies the changes of a data file to keyDir, the same way applying
+// its records one by one would.
+func (d *DiskStore) applyChanges(c fileChanges) {
+	for key, change := range c {
+		switch {
+		case change.reset && change.hasBase:
+			d.putKeyEntry(key, change.base)
+		case change.reset:
+			d.removeKeyEntry(key)
+		}
+		for _, operandEntry := range change.operands {
+			d.addMergeOperand(key, operandEntry)
+		}
+	}
+}
+
+// progressStep is how many bytes the startup scan goes through between the calls to
+// Options.OpenProgress.
+const progressStep = 1 << 20
+
+// openProgress counts the bytes the startup scan went through, for
+// Options.OpenProgress. The scans of the files add to it concurrently, and the calls to
+// fn are serialized.
+type openProgress struct {
+	mu       sync.Mutex
+	fn       func(scanned int64, total int64)
+	total    int64
+	scanned  int64
+	reported int64
+}
+
+// advance adds n scanned bytes, and reports them once there are enough of them since
+// the last report, or the scan is complete. It is a no-op on a nil openProgress.
+func (p *openProgress) advance(n int64) {
+	if p == nil || n <= 0 {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.scanned += n
+	if p.scanned-p.reported >= progressStep || p.scanned >= p.total {
+		p.reported = p.scanned
+		p.fn(p.scanned, p.total)
+	}
+}
+
+// Opening is a store being opened in the background by OpenAsync.
+type Opening struct {
+	done    chan struct{}
+	store   *DiskStore
+	err     error
+	scanned atomic.Int64
+	total   atomic.Int64
+}
+
+// OpenAsync starts opening the store at fileName, as NewDiskStoreWithOptions does, and
+// returns right away, so that a service can start up and report its health while a
+// large store is being loaded. The progress of the scan is available from
+// Opening.Progress, on top of Options.OpenProgress, which is still called.
+//
+// Typical usage example:
+//
+//	opening := caskdb.OpenAsync("books.db", caskdb.Options{})
+//	// ... serve the health checks from opening.Progress() meanwhile
+//	store, err := opening.Wait()
+func OpenAsync(fileName string, opts Options) *Opening {
+	o := &Opening{done: make(chan struct{})}
+	progress := opts.OpenProgress
+	opts.OpenProgress = func(scanned int64, total int64) {
+		o.scanned.Store(scanned)
+		o.total.Store(total)
+		if progress != nil {
+			progress(scanned, total)
+		}
+	}
+	go func() {
+		defer close(o.done)
+		o.store, o.err = NewDiskStoreWithOptions(fileName, opts)
+	}()
+	return o
+}
+
+// Done returns a channel which is closed once the store is open, or failed to open.
+func (o *Opening) Done() <-chan struct{} {
+	return o.done
+}
+
+// Wait waits for the store to be open, and returns it, or the error it failed with.
+func (o *Opening) Wait() (*DiskStore, error) {
+	<-o.done
+	return o.store, o.err
+}
+
+// Progress returns the number of bytes of the data files scanned so far, and the
+// total to scan, which is 0 until the scan starts.
+func (o *Opening) Progress() (scanned int64, total int64) {
+	return o.scanned.Load(), o.total.Load()
+}
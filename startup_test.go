@@ -0,0 +1,145 @@
+package caskdb
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDiskStore_OpenWorkers(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{MaxSegmentSize: 512, MergeOperator: joinOperator, SyncPolicy: SyncNever}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	// the same keys are set, deleted and merged into all over the files
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("k%d", r.Intn(50))
+		switch r.Intn(4) {
+		case 0:
+			store.Delete(key)
+		case 1:
+			store.Merge(key, fmt.Sprint(i))
+		default:
+			store.Set(key, fmt.Sprint(i))
+		}
+	}
+	store.Close()
+
+	load := func(workers int) (map[string]string, map[uint32]int64) {
+		t.Helper()
+		opts.OpenWorkers = workers
+		store, err := NewDiskStoreWithOptions(fileName, opts)
+		if err != nil {
+			t.Fatalf("failed to reopen disk store with %v workers: %v", workers, err)
+		}
+		defer store.Close()
+		values := make(map[string]string)
+		for _, key := range store.Keys() {
+			if values[key], err = store.Get(key); err != nil {
+				t.Fatalf("Get(%v) error = %v", key, err)
+			}
+		}
+		return values, store.live
+	}
+	wantValues, wantLive := load(1)
+	if len(wantLive) < 10 {
+		t.Fatalf("the store has %v data files, want a lot", len(wantLive))
+	}
+	// with 2 workers, the scans wait for the files before them to be applied
+	for _, workers := range []int{2, 8} {
+		gotValues, gotLive := load(workers)
+		if !reflect.DeepEqual(gotValues, wantValues) {
+			t.Errorf("the values loaded by %v workers differ from the sequential load", workers)
+		}
+		if !reflect.DeepEqual(gotLive, wantLive) {
+			t.Errorf("live = %v loaded by %v workers, want %v", gotLive, workers, wantLive)
+		}
+	}
+
+	// a file which cannot be loaded fails the open, whatever the scans ahead of it
+	f, err := os.OpenFile(segmentName(fileName, 3), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("failed to open data file: %v", err)
+	}
+	f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 100)
+	f.Close()
+	opts.OpenWorkers = 2
+	if store, err := NewDiskStoreWithOptions(fileName, opts); err == nil {
+		store.Close()
+		t.Errorf("NewDiskStoreWithOptions() with a corrupt file = nil, want an error")
+	}
+}
+
+func TestDiskStore_OpenProgress(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{MaxSegmentSize: 1 << 20, SyncPolicy: SyncNever}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	value := string(make([]byte, 1000))
+	for i := 0; i < 3000; i++ {
+		store.Set(fmt.Sprint(i), value)
+	}
+	size := store.DiskSize()
+	store.Close()
+
+	var calls [][2]int64
+	opts.OpenProgress = func(scanned int64, total int64) {
+		calls = append(calls, [2]int64{scanned, total})
+	}
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	if len(calls) < 3 {
+		t.Fatalf("OpenProgress was called %v times, want one per MiB", len(calls))
+	}
+	if first := calls[0]; first != [2]int64{0, size} {
+		t.Errorf("the first call = %v, want [0 %v]", first, size)
+	}
+	if last := calls[len(calls)-1]; last != [2]int64{size, size} {
+		t.Errorf("the last call = %v, want [%v %v]", last, size, size)
+	}
+	for i := 1; i < len(calls); i++ {
+		if calls[i][0] < calls[i-1][0] {
+			t.Errorf("the progress went back from %v to %v", calls[i-1][0], calls[i][0])
+		}
+	}
+}
+
+func TestOpenAsync(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	store.Set("name", "jojo")
+	store.Close()
+
+	opening := OpenAsync(fileName, Options{})
+	<-opening.Done()
+	if scanned, total := opening.Progress(); scanned != total || total == 0 {
+		t.Errorf("Progress() = %v, %v after Done, want all of it scanned", scanned, total)
+	}
+	store, err = opening.Wait()
+	if err != nil {
+		t.Fatalf("Wait() error = %v", err)
+	}
+	defer store.Close()
+	if got, err := store.Get("name"); err != nil || got != "jojo" {
+		t.Errorf("Get(name) = %v, %v, want jojo", got, err)
+	}
+
+	// the errors come out of Wait
+	if _, err := OpenAsync(filepath.Join(t.TempDir(), "missing.db"), Options{ReadOnly: true}).Wait(); err == nil {
+		t.Errorf("Wait() = nil for a missing read-only store, want an error")
+	}
+}
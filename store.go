@@ -1,7 +1,13 @@
 package caskdb
 
+import "errors"
+
+// ErrKeyNotFound is returned when the key does not exist in the store
+var ErrKeyNotFound = errors.New("key not found")
+
 type Store interface {
-	Get(key string) string
-	Set(key string, value string)
-	Close() bool
+	Get(key string) (string, error)
+	Set(key string, value string) error
+	Delete(key string) error
+	Close() error
 }
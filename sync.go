@@ -0,0 +1,210 @@
+package caskdb
+
+import (
+	"fmt"
+	"time"
+)
+
+// Sync flushes the writes made so far to the disk with fsync, whatever the
+// SyncPolicy is. With the relaxed policies, it makes a checkpoint: once Sync returns
+// nil, all the earlier writes survive a crash. A failed sync puts the store in the
+// failed state, and a store which has failed before, e.g. in the background flusher
+// of SyncInterval, returns that error, since the writes may be lost already. Sync is
+// a no-op for a read-only store.
+func (d *DiskStore) Sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.writeFileHandle == nil {
+		return nil
+	}
+	if err := d.Failed(); err != nil {
+		return err
+	}
+	if err := d.syncFile(); err != nil {
+		return d.fail(fmt.Errorf("failed to sync to disk: %w", err))
+	}
+	d.dirty = false
+	return nil
+}
+
+// syncFile flushes the write buffer, if any, and syncs the active file. The value log
+// is synced first, since the records of the active file may point to it. Once the
+// records are synced, the pending keyDir updates are made, see deferRecord.
+func (d *DiskStore) syncFile() error {
+	if err := d.syncValueLog(); err != nil {
+		return err
+	}
+	if err := d.flushBuffer(); err != nil {
+		return err
+	}
+	if err := d.writeFileHandle.Sync(); err != nil {
+		return err
+	}
+	d.commitPending()
+	return nil
+}
+
+// bufferWrite appends the data to the write buffer of Options.WriteBufferSize instead
+// of the file, so that the small writes do not each make a syscall, and flushes the
+// buffer once it is full. The records in the buffer cannot be read, so keyDir is not
+// pointed to them until they are flushed, see deferRecord; that happens when the
+// buffer is full, on a sync, which SyncAlways makes on every write or group of
+// writes, at the end of a batch commit, or before a write which reads one of the
+// buffered keys, see execKeys.
+func (d *DiskStore) bufferWrite(data []byte) error {
+	if d.opts.MaxFileSize > 0 && int64(d.currentOffset)+int64(len(data)) > d.opts.MaxFileSize {
+		return ErrFileTooLarge
+	}
+	d.wbuf = append(d.wbuf, data...)
+	d.currentOffset += uint32(len(data))
+	if len(d.wbuf) >= d.opts.WriteBufferSize {
+		return d.flushBuffer()
+	}
+	return nil
+}
+
+// flushBuffer writes the write buffer out to the active file, and makes the pending
+// keyDir updates, unless they wait for the sync of SyncAlways. A failed write puts
+// the store in the failed state, and the records of the buffer never make it to
+// keyDir.
+func (d *DiskStore) flushBuffer() error {
+	if len(d.wbuf) == 0 {
+		return nil
+	}
+	if _, err := d.writeOffset(); err != nil {
+		d.dropPending()
+		return d.fail(err)
+	}
+	if _, err := d.appendFile(d.wbuf); err != nil {
+		d.dropPending()
+		return d.fail(err)
+	}
+	d.wbuf = d.wbuf[:0]
+	if d.opts.SyncPolicy != SyncAlways {
+		d.commitPending()
+	}
+	return nil
+}
+
+// pendingRecord is the keyDir update of a record which is written but cannot be
+// read yet, see deferRecord. kind is one of scanPut, scanOperand and scanRemove.
+type pendingRecord struct {
+	key      string
+	keyEntry KeyEntry
+	kind     int
+}
+
+// deferRecord makes the keyDir update of a record which was just written, once the
+// record can be read: right away if it went to the file, or once the write buffer
+// is flushed if it is in there. With SyncAlways, the records of a group, see
+// runGroup, and the buffered records are made visible once they are synced, so that
+// the reads never see a write which might still be lost. The updates are made in the
+// order of the writes, so an update waits as well while there are others pending
+// before it. The caller must hold mu.
+func (d *DiskStore) deferRecord(key string, keyEntry KeyEntry, kind int) {
+	if len(d.wbuf) == 0 && len(d.pending) == 0 && !(d.opts.SyncPolicy == SyncAlways && d.grouping) {
+		d.applyPending(pendingRecord{key: key, keyEntry: keyEntry, kind: kind})
+		return
+	}
+	if d.pendingKeys == nil {
+		d.pendingKeys = make(map[string]bool)
+	}
+	d.pending = append(d.pending, pendingRecord{key: key, keyEntry: keyEntry, kind: kind})
+	d.pendingKeys[key] = true
+}
+
+// applyPending makes the keyDir update of the record. A merge operand of a key which
+// has expired starts the key over, like Merge does.
+func (d *DiskStore) applyPending(r pendingRecord) {
+	if r.kind == scanOperand {
+		if _, ok := d.lookup(r.key); !ok {
+			// the key might still be around in keyDir, if it has expired
+			d.removeKeyEntry(r.key)
+		}
+	}
+	d.applyRecord(r.key, r.keyEntry, r.kind)
+}
+
+// commitPending makes the pending keyDir updates, once their records can be read.
+func (d *DiskStore) commitPending() {
+	for _, r := range d.pending {
+		d.applyPending(r)
+	}
+	d.dropPending()
+}
+
+// dropPending forgets the pending keyDir updates, when their records are not going
+// to make it to the file after all.
+func (d *DiskStore) dropPending() {
+	d.pending = d.pending[:0]
+	d.pendingKeys = nil
+}
+
+// settlePending makes the pending keyDir updates before a write which reads the
+// keys, by flushing the write buffer, or with SyncAlways, by syncing the records.
+func (d *DiskStore) settlePending() error {
+	if len(d.pending) == 0 {
+		return nil
+	}
+	if err := d.Failed(); err != nil {
+		return err
+	}
+	if d.opts.SyncPolicy != SyncAlways {
+		return d.flushBuffer()
+	}
+	if err := d.syncFile(); err != nil {
+		return d.fail(fmt.Errorf("failed to sync to disk: %w", err))
+	}
+	d.dirty = false
+	return nil
+}
+
+// startFlusher starts the background goroutine of SyncInterval, which syncs the file
+// every interval if anything was written since the last sync. It keeps running until
+// Close.
+func (d *DiskStore) startFlusher(interval time.Duration) {
+	stop, done := make(chan struct{}), make(chan struct{})
+	d.flusherStop, d.flusherDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				d.mu.Lock()
+				d.flush()
+				d.mu.Unlock()
+			}
+		}
+	}()
+}
+
+// flush syncs the file if it is dirty. There is no one to return the error to, so
+// it puts the store in the failed state, which the next write, Sync or Close reports.
+func (d *DiskStore) flush() {
+	if !d.dirty || d.failed.Load() != nil {
+		return
+	}
+	if err := d.syncFile(); err != nil {
+		d.fail(fmt.Errorf("failed to sync to disk: %w", err))
+		return
+	}
+	d.dirty = false
+}
+
+// stopFlusher stops the background flusher and waits for it to exit. It is a no-op
+// if the flusher is not running.
+func (d *DiskStore) stopFlusher() {
+	d.mu.Lock()
+	stop, done := d.flusherStop, d.flusherDone
+	d.flusherStop, d.flusherDone = nil, nil
+	d.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,185 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSyncInterval(t *testing.T) {
+	if got := SyncInterval(time.Second).interval(); got != time.Second {
+		t.Errorf("SyncInterval(1s).interval() = %v, want 1s", got)
+	}
+	if got := SyncInterval(0); got != SyncAlways {
+		t.Errorf("SyncInterval(0) = %v, want SyncAlways", got)
+	}
+	if SyncAlways.interval() != 0 || SyncNever.interval() != 0 {
+		t.Errorf("interval() of SyncAlways and SyncNever should be 0")
+	}
+}
+
+func TestDiskStore_SyncIntervalFlusher(t *testing.T) {
+	store, err := NewDiskStoreWithOptions("test.db", Options{SyncPolicy: SyncInterval(10 * time.Millisecond)})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("name", "jojo")
+
+	isDirty := func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return store.dirty
+	}
+	if !isDirty() {
+		t.Errorf("dirty = false right after Set(), want true")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for isDirty() && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if isDirty() {
+		t.Errorf("background flusher did not sync the file")
+	}
+	if err := store.Close(); err != nil {
+		t.Errorf("Close() = %v, want nil", err)
+	}
+
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if got, err := store.Get("name"); err != nil || got != "jojo" {
+		t.Errorf("Get() = %v, %v, want %v", got, err, "jojo")
+	}
+	store.Close()
+}
+
+func TestDiskStore_Sync(t *testing.T) {
+	store, err := NewDiskStoreWithOptions("test.db", Options{SyncPolicy: SyncNever})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	store.Set("name", "jojo")
+	if !store.dirty {
+		t.Errorf("dirty = false after Set(), want true")
+	}
+	if err := store.Sync(); err != nil {
+		t.Errorf("Sync() = %v, want nil", err)
+	}
+	if store.dirty {
+		t.Errorf("dirty = true after Sync(), want false")
+	}
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions("test.db", Options{ReadOnly: true})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if err := store.Sync(); err != nil {
+		t.Errorf("Sync() on read-only store = %v, want nil", err)
+	}
+	store.Close()
+}
+
+func TestDiskStore_WriteBuffer(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{SyncPolicy: SyncNever, WriteBufferSize: 4096})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	fileSize := func() int64 {
+		t.Helper()
+		info, err := os.Stat(fileName)
+		if err != nil {
+			t.Fatalf("failed to stat the data file: %v", err)
+		}
+		return info.Size()
+	}
+	store.Set("name", "jojo")
+	store.Set("count", "1")
+	if size := fileSize(); size != 0 {
+		t.Errorf("the data file has %v bytes before the flush, want 0", size)
+	}
+	// the buffered records are not visible until they are flushed
+	if _, err := store.Get("name"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() of a buffered key error = %v, want %v", err, ErrKeyNotFound)
+	}
+	// a write which reads a buffered key flushes the buffer first
+	if _, err := store.Increment("count", 1); err != nil {
+		t.Errorf("Increment() error = %v", err)
+	}
+	if size := fileSize(); size == 0 {
+		t.Errorf("the data file is empty after Increment()")
+	}
+	if got, err := store.GetMulti([]string{"name", "count"}); err != nil || got["name"] != "jojo" || got["count"] != "1" {
+		t.Errorf("GetMulti() = %v, %v, want name=jojo count=1", got, err)
+	}
+	if err := store.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if size := fileSize(); size == 0 {
+		t.Errorf("the data file is empty after Sync()")
+	}
+	if got, err := store.Get("count"); err != nil || got != "2" {
+		t.Errorf("Get() after Sync() = %v, %v, want 2", got, err)
+	}
+
+	// a batch goes to the file on commit
+	synced := fileSize()
+	b := NewWriteBatch()
+	b.Set("city", "tokyo")
+	if err := store.Commit(b); err != nil {
+		t.Fatalf("Commit() error = %v", err)
+	}
+	if fileSize() == synced {
+		t.Errorf("the batch was not flushed on Commit()")
+	}
+	store.Set("late", "comer")
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	store, err = NewDiskStore(fileName)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	for key, want := range map[string]string{"name": "jojo", "count": "2", "city": "tokyo", "late": "comer"} {
+		if got, err := store.Get(key); err != nil || got != want {
+			t.Errorf("Get(%v) = %v, %v, want %v", key, got, err, want)
+		}
+	}
+}
+
+func TestDiskStore_WriteBufferReadsPending(t *testing.T) {
+	store, err := NewDiskStoreWithOptions(filepath.Join(t.TempDir(), "test.db"), Options{SyncPolicy: SyncNever, WriteBufferSize: 4096})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	// the writes which read the keys see the buffered records
+	store.Set("gone", "soon")
+	if err := store.Delete("gone"); err != nil {
+		t.Fatalf("Delete() error = %v", err)
+	}
+	store.Set("name", "jojo")
+	if written, err := store.SetIfAbsent("name", "dio"); err != nil || written {
+		t.Errorf("SetIfAbsent() = %v, %v, want false", written, err)
+	}
+	if swapped, err := store.CompareAndSwap("name", "jojo", "jotaro"); err != nil || !swapped {
+		t.Errorf("CompareAndSwap() = %v, %v, want true", swapped, err)
+	}
+	if err := store.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	if _, err := store.Get("gone"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() of a deleted key error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if got, err := store.Get("name"); err != nil || got != "jotaro" {
+		t.Errorf("Get() = %v, %v, want jotaro", got, err)
+	}
+}
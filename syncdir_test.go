@@ -0,0 +1,24 @@
+package caskdb
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func Test_syncDir(t *testing.T) {
+	dir := t.TempDir()
+	if err := createFile(filepath.Join(dir, "test.db"), 0644); err != nil {
+		t.Fatalf("createFile() = %v, want nil", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "test.db")); err != nil {
+		t.Errorf("createFile() did not create the file: %v", err)
+	}
+	if runtime.GOOS == "windows" {
+		return
+	}
+	if err := syncDir(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("syncDir() of a missing directory = nil, want error")
+	}
+}
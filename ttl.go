@@ -0,0 +1,180 @@
+package caskdb
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrInvalidTTL is returned when the given TTL is not positive
+var ErrInvalidTTL = errors.New("ttl must be positive")
+
+// NoTTL is returned by TTL for the keys which never expire
+const NoTTL time.Duration = -1
+
+// expiryAfter returns the unix timestamp at which a key set now with the ttl expires.
+// It is rounded up to the next second, so the key lives for at least the ttl.
+func expiryAfter(ttl time.Duration) uint32 {
+	t := timeNow().Add(ttl)
+	expiry := t.Unix()
+	if t.Nanosecond() > 0 {
+		expiry++
+	}
+	return uint32(expiry)
+}
+
+// SetWithTTL is the same as Set, but the key expires after the ttl: Get returns
+// ErrKeyNotFound for it and it is not loaded when the store is opened again. The
+// expiry has a granularity of one second. Overwriting the key with Set clears the
+// expiry, while the in-place updates like Update, Increment, Append and
+// CompareAndSwap keep it.
+func (d *DiskStore) SetWithTTL(key string, value string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return d.execKeys(nil, func() error {
+		return d.set(key, value, expiryAfter(ttl))
+	})
+}
+
+// SetIfAbsentWithTTL is the same as SetIfAbsent, but the key expires after the ttl,
+// as with SetWithTTL. An expired key counts as absent.
+func (d *DiskStore) SetIfAbsentWithTTL(key string, value string, ttl time.Duration) (bool, error) {
+	if ttl <= 0 {
+		return false, ErrInvalidTTL
+	}
+	return d.setIfAbsent(key, value, expiryAfter(ttl))
+}
+
+// TTL returns the remaining lifetime of the key, or NoTTL if the key never expires.
+// It is answered from keyDir alone.
+func (d *DiskStore) TTL(key string) (time.Duration, error) {
+	s := d.keyDir.shard(key)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keyEntry, ok := d.lookup(key)
+	if !ok {
+		return 0, ErrKeyNotFound
+	}
+	if keyEntry.Expiry == 0 {
+		return NoTTL, nil
+	}
+	return time.Unix(int64(keyEntry.Expiry), 0).Sub(timeNow()), nil
+}
+
+// Persist removes the expiry of the key, so that it never expires. Since the expiry
+// lives in the record header, the record is written again with the same value.
+func (d *DiskStore) Persist(key string) error {
+	return d.exec(func() error {
+		keyEntry, ok := d.lookup(key)
+		if !ok {
+			return ErrKeyNotFound
+		}
+		if keyEntry.Expiry == 0 {
+			return nil
+		}
+		return d.rewriteExpiry(key, 0)
+	})
+}
+
+// Touch sets a new expiry on the key, ttl from now, without the caller having to
+// Set the value again. The record is rewritten with the same value and the new
+// expiry in its header.
+func (d *DiskStore) Touch(key string, ttl time.Duration) error {
+	if ttl <= 0 {
+		return ErrInvalidTTL
+	}
+	return d.exec(func() error {
+		if _, ok := d.lookup(key); !ok {
+			return ErrKeyNotFound
+		}
+		return d.rewriteExpiry(key, expiryAfter(ttl))
+	})
+}
+
+// rewriteExpiry appends a copy of the key's current record, metadata included, with
+// a new expiry.
+func (d *DiskStore) rewriteExpiry(key string, expiry uint32) error {
+	value, err := d.get(key)
+	if err != nil {
+		return err
+	}
+	var meta []byte
+	if keyEntry, ok := d.valueEntry(key); ok {
+		if meta, err = d.readMetadata(keyEntry); err != nil {
+			return err
+		}
+	}
+	timestamp := unixNow()
+	encodedKV, err := d.appendEntry(nil, timestamp, expiry, key, value, meta)
+	if err != nil {
+		return err
+	}
+	return d.writeKV(key, timestamp, expiry, encodedKV)
+}
+
+// SweepExpired drops all the expired keys from keyDir and appends a tombstone for
+// each of them, so that a later compaction can reclaim their space. All the
+// tombstones are written with a single write and fsync. It returns the number of
+// keys swept.
+func (d *DiskStore) SweepExpired() (int, error) {
+	swept := 0
+	err := d.exec(func() error {
+		now := unixNow()
+		var expired []string
+		d.keyDir.forEach(func(key string, keyEntry KeyEntry) {
+			if keyEntry.isExpired(now) {
+				expired = append(expired, key)
+			}
+		})
+		if len(expired) == 0 {
+			return nil
+		}
+		if err := d.writeTombstones(expired); err != nil {
+			return err
+		}
+		swept = len(expired)
+		return nil
+	})
+	return swept, err
+}
+
+// StartExpirySweeper starts a background goroutine which calls SweepExpired every
+// interval, until StopExpirySweeper or Close is called. The errors are not reported;
+// a failed sweep is simply retried at the next tick. Starting an already running
+// sweeper is a no-op.
+func (d *DiskStore) StartExpirySweeper(interval time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.sweeperStop != nil {
+		return
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	d.sweeperStop, d.sweeperDone = stop, done
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				d.SweepExpired()
+			}
+		}
+	}()
+}
+
+// StopExpirySweeper stops the background sweeper and waits for it to exit. It is a
+// no-op if the sweeper is not running.
+func (d *DiskStore) StopExpirySweeper() {
+	d.mu.Lock()
+	stop, done := d.sweeperStop, d.sweeperDone
+	d.sweeperStop, d.sweeperDone = nil, nil
+	d.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
@@ -0,0 +1,297 @@
+package caskdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// travel moves the store's clock by d, and returns a func to restore it
+func travel(d time.Duration) func() {
+	timeNow = func() time.Time {
+		return time.Now().Add(d)
+	}
+	return func() {
+		timeNow = time.Now
+	}
+}
+
+func TestDiskStore_SetWithTTL(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	if err := store.SetWithTTL("session", "jojo", time.Minute); err != nil {
+		t.Fatalf("SetWithTTL() error = %v", err)
+	}
+	store.Set("name", "jojo")
+	if err := store.SetWithTTL("name", "jojo", 0); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("SetWithTTL() error = %v, want %v", err, ErrInvalidTTL)
+	}
+	if got, err := store.Get("session"); err != nil || got != "jojo" {
+		t.Errorf("Get() = %v, %v, want %v", got, err, "jojo")
+	}
+
+	restore := travel(2 * time.Minute)
+	defer restore()
+	if _, err := store.Get("session"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() after expiry error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if store.Has("session") {
+		t.Errorf("Has() after expiry = true, want false")
+	}
+	if keys := store.Keys(); len(keys) != 1 || keys[0] != "name" {
+		t.Errorf("Keys() = %v, want [name]", keys)
+	}
+	restore()
+
+	store.Close()
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if got, err := store.Get("session"); err != nil || got != "jojo" {
+		t.Errorf("Get() after reopen = %v, %v, want %v", got, err, "jojo")
+	}
+	store.Close()
+
+	travel(2 * time.Minute)
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if store.Len() != 1 {
+		t.Errorf("Len() after reopen past expiry = %v, want 1", store.Len())
+	}
+	if _, err := store.Get("session"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() after reopen past expiry error = %v, want %v", err, ErrKeyNotFound)
+	}
+	store.Close()
+}
+
+func TestDiskStore_TTLKeptByUpdates(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.SetWithTTL("counter", "1", time.Minute)
+	store.Increment("counter", 1)
+	store.SetWithTTL("log", "a", time.Minute)
+	store.Append("log", "b")
+	store.SetWithTTL("name", "jojo", time.Minute)
+	store.Set("name", "jojo")
+
+	defer travel(2 * time.Minute)()
+	for _, key := range []string{"counter", "log"} {
+		if store.Has(key) {
+			t.Errorf("Has(%v) after expiry = true, want false", key)
+		}
+	}
+	if !store.Has("name") {
+		t.Errorf("Has() after Set() cleared the expiry = false, want true")
+	}
+	// an expired counter starts over
+	if got, err := store.Increment("counter", 1); err != nil || got != 1 {
+		t.Errorf("Increment() = %v, %v, want 1", got, err)
+	}
+	store.Close()
+}
+
+func TestDiskStore_SweepExpired(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.SetWithTTL("session:1", "jojo", time.Minute)
+	store.SetWithTTL("session:2", "dio", time.Minute)
+	store.SetWithTTL("session:3", "jotaro", time.Hour)
+	store.Set("name", "jojo")
+
+	restore := travel(2 * time.Minute)
+	defer restore()
+	sizeBefore := store.DiskSize()
+	if n, err := store.SweepExpired(); err != nil || n != 2 {
+		t.Errorf("SweepExpired() = %v, %v, want 2, nil", n, err)
+	}
+	if store.Len() != 2 {
+		t.Errorf("Len() = %v, want 2", store.Len())
+	}
+	wantSize := sizeBefore + int64(2*(headerSize+len("session:1")))
+	if store.DiskSize() != wantSize {
+		t.Errorf("DiskSize() = %v, want %v", store.DiskSize(), wantSize)
+	}
+	if n, err := store.SweepExpired(); err != nil || n != 0 {
+		t.Errorf("SweepExpired() = %v, %v, want 0, nil", n, err)
+	}
+	store.Close()
+}
+
+func TestDiskStore_ExpirySweeper(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.SetWithTTL("session", "jojo", time.Minute)
+	defer travel(2 * time.Minute)()
+	store.StartExpirySweeper(time.Millisecond)
+	store.StartExpirySweeper(time.Millisecond)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for store.Len() != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if store.Len() != 0 {
+		t.Errorf("Len() = %v, want 0", store.Len())
+	}
+	store.StopExpirySweeper()
+	store.StopExpirySweeper()
+	if err := store.Close(); err != nil {
+		t.Errorf("Close() error = %v", err)
+	}
+}
+
+func TestDiskStore_TTLAndPersist(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.SetWithTTL("session", "jojo", time.Minute)
+	store.Set("name", "jojo")
+	if ttl, err := store.TTL("session"); err != nil || ttl <= 59*time.Second || ttl > 61*time.Second {
+		t.Errorf("TTL() = %v, %v, want ~1m", ttl, err)
+	}
+	if ttl, err := store.TTL("name"); err != nil || ttl != NoTTL {
+		t.Errorf("TTL() = %v, %v, want %v", ttl, err, NoTTL)
+	}
+	if _, err := store.TTL("some key"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("TTL() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if err := store.Persist("some key"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Persist() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if err := store.Persist("session"); err != nil {
+		t.Fatalf("Persist() error = %v", err)
+	}
+	store.Close()
+
+	defer travel(2 * time.Minute)()
+	store, err = NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	if got, err := store.Get("session"); err != nil || got != "jojo" {
+		t.Errorf("Get() after Persist() = %v, %v, want %v", got, err, "jojo")
+	}
+	if ttl, err := store.TTL("session"); err != nil || ttl != NoTTL {
+		t.Errorf("TTL() = %v, %v, want %v", ttl, err, NoTTL)
+	}
+	store.Close()
+}
+
+func TestDiskStore_Touch(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+
+	store.SetWithTTL("session", "jojo", time.Minute)
+	store.Set("name", "jojo")
+	if err := store.Touch("session", time.Hour); err != nil {
+		t.Fatalf("Touch() error = %v", err)
+	}
+	if err := store.Touch("name", time.Minute); err != nil {
+		t.Fatalf("Touch() error = %v", err)
+	}
+	if err := store.Touch("some key", time.Minute); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Touch() error = %v, want %v", err, ErrKeyNotFound)
+	}
+	if err := store.Touch("name", 0); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("Touch() error = %v, want %v", err, ErrInvalidTTL)
+	}
+
+	defer travel(2 * time.Minute)()
+	if got, err := store.Get("session"); err != nil || got != "jojo" {
+		t.Errorf("Get() after Touch() = %v, %v, want %v", got, err, "jojo")
+	}
+	if store.Has("name") {
+		t.Errorf("Has() after Touch() expired = true, want false")
+	}
+	store.Close()
+}
+
+func TestDiskStore_SetIfAbsentWithTTL(t *testing.T) {
+	store, err := NewDiskStore(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+
+	if ok, err := store.SetIfAbsentWithTTL("lock", "a", time.Minute); err != nil || !ok {
+		t.Errorf("SetIfAbsentWithTTL() = %v, %v, want true", ok, err)
+	}
+	if ok, err := store.SetIfAbsentWithTTL("lock", "b", time.Minute); err != nil || ok {
+		t.Errorf("SetIfAbsentWithTTL() of a taken key = %v, %v, want false", ok, err)
+	}
+	if _, err := store.SetIfAbsentWithTTL("lock", "b", 0); !errors.Is(err, ErrInvalidTTL) {
+		t.Errorf("SetIfAbsentWithTTL() error = %v, want %v", err, ErrInvalidTTL)
+	}
+
+	restore := travel(2 * time.Minute)
+	defer restore()
+	if ok, err := store.SetIfAbsentWithTTL("lock", "b", time.Minute); err != nil || !ok {
+		t.Errorf("SetIfAbsentWithTTL() of an expired key = %v, %v, want true", ok, err)
+	}
+	if got, err := store.Get("lock"); err != nil || got != "b" {
+		t.Errorf("Get() = %v, %v, want b", got, err)
+	}
+}
+
+func TestDiskStore_CompactDropsExpired(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{Format: FormatV2, ValueLogThreshold: 1024, ValueLogFileSize: 2048}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	store.SetWithTTL("session", "jojo", time.Minute)
+	store.SetWithTTL("upload", bigValue(1), time.Minute)
+	store.Set("name", "jojo")
+	// seals the value log file with the expiring value
+	store.Set("avatar", bigValue(2))
+
+	restore := travel(2 * time.Minute)
+	defer restore()
+	stats, err := store.Compact()
+	if err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if stats.RecordsDropped != 2 {
+		t.Errorf("Compact() dropped %v records, want 2", stats.RecordsDropped)
+	}
+	if _, err := os.Stat(valueLogName(fileName, 1)); !os.IsNotExist(err) {
+		t.Errorf("the value log file of the expired value is still there: %v", err)
+	}
+	restore()
+	for key, want := range map[string]string{"name": "jojo", "avatar": bigValue(2)} {
+		if got, err := store.Get(key); err != nil || got != want {
+			t.Errorf("Get(%v) = %v, %v, want %v", key, got, err, want)
+		}
+	}
+	if _, err := store.Get("session"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get(session) error = %v, want %v", err, ErrKeyNotFound)
+	}
+}
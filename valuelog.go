@@ -0,0 +1,472 @@
+package caskdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// With Options.ValueLogThreshold, the values which are at least that big are kept
+// apart from their records, in the value log, in the way of WiscKey: the record in
+// the data file only has a pointer to where the value is. The data files stay small,
+// so that a compaction does not have to copy the big values over and over again to
+// reclaim the space of the small records around them; the value log has a garbage
+// collection of its own instead, see collectValueLogs.
+//
+// The value log is a series of files next to the data files, books.db.vlog.000001,
+// books.db.vlog.000002 and so on, which are appended to in turn, like the data files
+// are with MaxSegmentSize. They are in FormatV2, file header included, and their
+// records are the usual records of the key value pairs, which are compressed with
+// Options.Compression as well. The key is in there so that the garbage collection
+// can tell whether the value is still live.
+
+// errPinnedValue is returned for a value in the value log which cannot be moved, see
+// valuePointsTo.
+var errPinnedValue = errors.New("value is pinned by merge operands")
+
+// valueLogName returns the path of the value log file with the given ID.
+func valueLogName(fileName string, logID uint32) string {
+	return fmt.Sprintf("%s.vlog.%06d", fileName, logID)
+}
+
+// listValueLogs returns the IDs of all the value log files of the store at fileName,
+// in order.
+func listValueLogs(fileName string) ([]uint32, error) {
+	entries, err := os.ReadDir(filepath.Dir(fileName))
+	if err != nil {
+		return nil, err
+	}
+	prefix := filepath.Base(fileName) + ".vlog."
+	var logIDs []uint32
+	for _, entry := range entries {
+		suffix := strings.TrimPrefix(entry.Name(), prefix)
+		if entry.IsDir() || suffix == entry.Name() || len(suffix) < 6 {
+			continue
+		}
+		logID, err := strconv.ParseUint(suffix, 10, 32)
+		if err != nil || logID == 0 {
+			continue
+		}
+		logIDs = append(logIDs, uint32(logID))
+	}
+	sort.Slice(logIDs, func(i, j int) bool {
+		return logIDs[i] < logIDs[j]
+	})
+	return logIDs, nil
+}
+
+// valuePointer is the value of a record whose actual value is in the value log. It
+// is stored as the uvarints of its fields, in order.
+type valuePointer struct {
+	logID  uint32
+	offset int64
+	// size is the size of the record in the value log
+	size uint32
+	// valueSize is the size of the value, once decompressed
+	valueSize uint32
+}
+
+// maxPointerSize is the size of the largest encoded valuePointer.
+const maxPointerSize = 3*binary.MaxVarintLen32 + binary.MaxVarintLen64
+
+func (p valuePointer) append(dst []byte) []byte {
+	dst = binary.AppendUvarint(dst, uint64(p.logID))
+	dst = binary.AppendUvarint(dst, uint64(p.offset))
+	dst = binary.AppendUvarint(dst, uint64(p.size))
+	return binary.AppendUvarint(dst, uint64(p.valueSize))
+}
+
+// decodePointer decodes the valuePointer at the start of data, and returns
+// ErrCorruptRecord if there is none.
+func decodePointer(data []byte) (valuePointer, error) {
+	var fields [4]uint64
+	for i := range fields {
+		v, n := binary.Uvarint(data)
+		if n <= 0 || (i != 1 && v > math.MaxUint32) {
+			return valuePointer{}, ErrCorruptRecord
+		}
+		fields[i] = v
+		data = data[n:]
+	}
+	if fields[1] > math.MaxInt64 {
+		return valuePointer{}, ErrCorruptRecord
+	}
+	return valuePointer{uint32(fields[0]), int64(fields[1]), uint32(fields[2]), uint32(fields[3])}, nil
+}
+
+// separating reports whether a value of the given size goes to the value log. Only
+// FormatV2 has the flag for the pointers, see flagValuePointer.
+func (d *DiskStore) separating(size int) bool {
+	return d.opts.ValueLogThreshold > 0 && d.opts.Format == FormatV2 && size >= d.opts.ValueLogThreshold
+}
+
+// appendEntry encodes the record of the key value pair at the end of dst, with the
+// encoded Metadata meta, as appendKVWith does, but when the value is big enough to go
+// to the value log, it is appended there first, and the record only gets the pointer
+// to it; the metadata stays in the record. The caller must hold mu.
+func (d *DiskStore) appendEntry(dst []byte, timestamp uint32, expiry uint32, key string, value []byte, meta []byte) ([]byte, error) {
+	if !d.separating(len(value)) {
+		return d.appendKVWith(dst, timestamp, expiry, key, value, meta, nil), nil
+	}
+	p, err := d.appendValueLog(timestamp, expiry, key, value)
+	if err != nil {
+		return nil, err
+	}
+	var pointer [maxPointerSize]byte
+	return d.opts.Format.appendPointer(dst, timestamp, expiry, key, p.append(pointer[:0]), meta), nil
+}
+
+// openValueLogs opens the value log files, see open. The appends go to a new file,
+// which the first value to go to the value log starts, so that the one the last
+// store appended to, which may end with a partial record, is sealed as it is.
+func (d *DiskStore) openValueLogs() error {
+	logIDs, err := listValueLogs(d.fileName)
+	if err != nil {
+		return err
+	}
+	for _, logID := range logIDs {
+		f, err := os.Open(valueLogName(d.fileName, logID))
+		if err != nil {
+			return err
+		}
+		d.vlogs[logID] = f
+		if format, err := readFormat(f); err != nil {
+			return fmt.Errorf("value log %d: %w", logID, err)
+		} else if format != FormatV2 {
+			return fmt.Errorf("value log %d: %w: %v", logID, ErrUnknownFormat, format)
+		}
+	}
+	if len(logIDs) > 0 {
+		d.vlogID = logIDs[len(logIDs)-1]
+	}
+	return nil
+}
+
+// appendValueLog appends a record of the key value pair to the value log, which is
+// synced right away with SyncAlways, so that no record in a data file points to a
+// value which may be lost. The caller must hold mu.
+func (d *DiskStore) appendValueLog(timestamp uint32, expiry uint32, key string, value []byte) (valuePointer, error) {
+	if err := d.Failed(); err != nil {
+		return valuePointer{}, err
+	}
+	buf := getBuffer(maxHeaderSize + len(key) + len(value))
+	defer putBuffer(buf)
+	*buf = d.appendKVBytes(*buf, timestamp, expiry, key, value)
+	if err := d.prepareValueLog(len(*buf)); err != nil {
+		return valuePointer{}, err
+	}
+	n, err := d.vlogWriter.Write(*buf)
+	p := valuePointer{d.vlogID, d.vlogOffset, uint32(len(*buf)), uint32(len(value))}
+	d.vlogOffset += int64(n)
+	if err != nil {
+		return valuePointer{}, d.fail(err)
+	}
+	d.vlogDirty = true
+	if d.opts.SyncPolicy == SyncAlways {
+		if err := d.syncValueLog(); err != nil {
+			return valuePointer{}, d.fail(fmt.Errorf("failed to sync to disk: %w", err))
+		}
+	}
+	return p, nil
+}
+
+// prepareValueLog makes vlogWriter ready to append a record of the given size: it
+// starts a new value log file if there is none yet, or the record would take the one
+// being appended to past Options.ValueLogFileSize.
+func (d *DiskStore) prepareValueLog(size int) error {
+	if d.vlogWriter != nil && (d.vlogOffset <= fileHeaderSize || d.vlogOffset+int64(size) <= d.opts.ValueLogFileSize) {
+		return nil
+	}
+	return d.rotateValueLog()
+}
+
+// rotateValueLog seals the value log file being appended to, if any, and starts a new
+// one.
+func (d *DiskStore) rotateValueLog() error {
+	logID := d.vlogID + 1
+	name := valueLogName(d.fileName, logID)
+	if err := createFile(name, d.opts.FileMode); err != nil {
+		return err
+	}
+	reader, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	writer, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		reader.Close()
+		return err
+	}
+	header := FormatV2.fileHeader(d.fileHeaderFlags())
+	if _, err := writer.Write(header); err != nil {
+		reader.Close()
+		writer.Close()
+		return err
+	}
+	if d.vlogWriter != nil {
+		if err := d.syncValueLog(); err != nil {
+			reader.Close()
+			writer.Close()
+			return d.fail(fmt.Errorf("failed to sync to disk: %w", err))
+		}
+		if err := d.vlogWriter.Close(); err != nil {
+			reader.Close()
+			writer.Close()
+			return d.fail(err)
+		}
+	}
+	d.filesMu.Lock()
+	d.vlogs[logID] = reader
+	d.filesMu.Unlock()
+	d.vlogWriter, d.vlogID, d.vlogOffset = writer, logID, int64(len(header))
+	d.vlogDirty = true
+	return nil
+}
+
+// syncValueLog syncs the value log file being appended to, if anything was written to
+// it since the last sync.
+func (d *DiskStore) syncValueLog() error {
+	if !d.vlogDirty {
+		return nil
+	}
+	if err := d.vlogWriter.Sync(); err != nil {
+		return err
+	}
+	d.vlogDirty = false
+	return nil
+}
+
+// readValueLog reads the value the pointer points to from the value log.
+func (d *DiskStore) readValueLog(p valuePointer) ([]byte, error) {
+	record := make([]byte, p.size)
+	d.filesMu.RLock()
+	f, ok := d.vlogs[p.logID]
+	var err error
+	if ok {
+		_, err = f.ReadAt(record, p.offset)
+	}
+	d.filesMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("value log %d: %w", p.logID, ErrCorruptRecord)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := FormatV2.verifyRecord(record); err != nil {
+		return nil, err
+	}
+	return FormatV2.value(record, nil, d.keys.Load())
+}
+
+// recordValue returns the value of a verified record of the data file, which is in
+// the given format: decompressed, and read from the value log if it is there.
+func (d *DiskStore) recordValue(fileID uint32, format Format, record []byte) ([]byte, error) {
+	value, err := format.value(record, d.dictionary(fileID), d.keys.Load())
+	if err != nil {
+		return nil, err
+	}
+	if h, _ := format.decodeHeader(record); !h.pointer() {
+		return value, nil
+	}
+	p, err := decodePointer(value)
+	if err != nil {
+		return nil, err
+	}
+	return d.readValueLog(p)
+}
+
+// carryPointer is carryOver for a record whose value is in the value log. The record
+// is copied over as it is, which is what keeps the compactions cheap, unless the
+// output is in FormatV1, which cannot have the pointers; then the value is read back
+// into it.
+func (d *DiskStore) carryPointer(format Format, record []byte) ([]byte, error) {
+	if d.opts.Format == FormatV2 {
+		return record, nil
+	}
+	p, err := decodePointer(format.decodeValue(record))
+	if err != nil {
+		return nil, err
+	}
+	value, err := d.readValueLog(p)
+	if err != nil {
+		return nil, err
+	}
+	h, _ := format.decodeHeader(record)
+	_, key, _ := format.decodeKVBytes(record)
+	return d.appendKVBytes(nil, h.timestamp, h.expiry, key, value), nil
+}
+
+// collectValueLogs reclaims the space of the stale values in the sealed value log
+// files, as a compaction does for the data files: a file with at least
+// Options.CompactionDeadRatio of garbage has its live values appended to the value
+// log anew, with their records pointed to them, and is removed. With all, every
+// sealed file is, whatever its garbage, which is how RotateEncryptionKey encrypts
+// the values anew. Each value is moved under mu, so the writes go on meanwhile. It
+// returns the number of bytes reclaimed. The caller must hold compactMu.
+func (d *DiskStore) collectValueLogs(all bool) (int64, error) {
+	d.mu.RLock()
+	var logIDs []uint32
+	for logID := range d.vlogs {
+		// the one being appended to is left alone
+		if logID != d.vlogID || d.vlogWriter == nil {
+			logIDs = append(logIDs, logID)
+		}
+	}
+	d.mu.RUnlock()
+	sort.Slice(logIDs, func(i, j int) bool {
+		return logIDs[i] < logIDs[j]
+	})
+	var reclaimed int64
+	for _, logID := range logIDs {
+		n, err := d.collectValueLog(logID, all)
+		if err != nil {
+			return reclaimed, fmt.Errorf("value log %d: %w", logID, err)
+		}
+		reclaimed += n
+	}
+	return reclaimed, nil
+}
+
+// valueLogEntry is a value found in a value log file by collectValueLog.
+type valueLogEntry struct {
+	key     string
+	pointer valuePointer
+}
+
+func (d *DiskStore) collectValueLog(logID uint32, all bool) (int64, error) {
+	var entries []valueLogEntry
+	offset := int64(fileHeaderSize)
+	size, err := forEachRecord(valueLogName(d.fileName, logID), d.compactionLimiter, func(h recordHeader, record []byte) error {
+		key := string(record[h.length : h.length+int(h.keySize)])
+		entries = append(entries, valueLogEntry{key, valuePointer{logID: logID, offset: offset, size: uint32(len(record))}})
+		offset += int64(len(record))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var live int64
+	for _, e := range entries {
+		d.mu.RLock()
+		_, _, ok, err := d.valuePointsTo(e.key, e.pointer)
+		d.mu.RUnlock()
+		if errors.Is(err, errPinnedValue) {
+			return 0, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			live += int64(e.pointer.size)
+		}
+	}
+	if !all && float64(size-fileHeaderSize-live) < d.opts.CompactionDeadRatio*float64(size) {
+		return 0, nil
+	}
+	for _, e := range entries {
+		// a merge started since the values were counted keeps the file for now
+		if err := d.moveValue(e); errors.Is(err, errPinnedValue) {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	// the moved values have to be on the disk before the file they were in is gone
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.dirty || d.vlogDirty {
+		if err := d.syncFile(); err != nil {
+			return 0, d.fail(fmt.Errorf("failed to sync to disk: %w", err))
+		}
+		d.dirty = false
+	}
+	if d.views.Load() > 0 {
+		// an iterator may still read the values from the file; they are all garbage
+		// now, so the next collection removes it
+		return 0, nil
+	}
+	d.filesMu.Lock()
+	d.vlogs[logID].Close()
+	delete(d.vlogs, logID)
+	d.filesMu.Unlock()
+	if err := os.Remove(valueLogName(d.fileName, logID)); err != nil {
+		return 0, err
+	}
+	if err := syncDir(filepath.Dir(d.fileName)); err != nil {
+		return 0, fmt.Errorf("failed to sync the directory: %w", err)
+	}
+	return size - live, nil
+}
+
+// valuePointsTo reports whether the latest record of the key points to the value at
+// the pointer in the value log, and returns its keyDir entry and the encoded
+// Metadata in it if so. An expired key points to nothing, so that its value is
+// dropped, as the compactions drop its record. A key with merge operands pending on
+// top of a value in the value log keeps pointing to it, which collectValueLog cannot
+// move, so it is reported as errPinnedValue. The caller must hold mu.
+func (d *DiskStore) valuePointsTo(key string, p valuePointer) (KeyEntry, []byte, bool, error) {
+	keyEntry, ok := d.keyDir.get(key)
+	if m, merging := d.keyDir.merge(key); merging {
+		if !m.hasBase {
+			return KeyEntry{}, nil, false, nil
+		}
+		keyEntry, ok = m.base, true
+	}
+	if !ok || keyEntry.isExpired(unixNow()) {
+		return KeyEntry{}, nil, false, nil
+	}
+	format := d.fileFormat(keyEntry.FileID)
+	if format != FormatV2 {
+		return KeyEntry{}, nil, false, nil
+	}
+	record := make([]byte, keyEntry.Size)
+	if err := d.readAt(keyEntry.FileID, record, int64(keyEntry.Offset)); err != nil {
+		return KeyEntry{}, nil, false, err
+	}
+	if err := format.verifyRecord(record); err != nil {
+		return KeyEntry{}, nil, false, err
+	}
+	if h, _ := format.decodeHeader(record); !h.pointer() {
+		return KeyEntry{}, nil, false, nil
+	}
+	current, err := decodePointer(format.decodeValue(record))
+	if err != nil {
+		return KeyEntry{}, nil, false, err
+	}
+	if current.logID != p.logID || current.offset != p.offset {
+		return KeyEntry{}, nil, false, nil
+	}
+	if _, merging := d.keyDir.merge(key); merging {
+		return KeyEntry{}, nil, true, errPinnedValue
+	}
+	return keyEntry, format.metadata(record), true, nil
+}
+
+// moveValue appends the value of the entry to the value log anew, and points the
+// key's record to the copy, if the key still points to the value.
+func (d *DiskStore) moveValue(e valueLogEntry) error {
+	return d.exec(func() error {
+		keyEntry, meta, ok, err := d.valuePointsTo(e.key, e.pointer)
+		if err != nil || !ok {
+			return err
+		}
+		value, err := d.readValueLog(e.pointer)
+		if err != nil {
+			return err
+		}
+		p, err := d.appendValueLog(keyEntry.Timestamp, keyEntry.Expiry, e.key, value)
+		if err != nil {
+			return err
+		}
+		var pointer [maxPointerSize]byte
+		record := d.opts.Format.appendPointer(nil, keyEntry.Timestamp, keyEntry.Expiry, e.key, p.append(pointer[:0]), meta)
+		return d.writeKV(e.key, keyEntry.Timestamp, keyEntry.Expiry, record)
+	})
+}
@@ -0,0 +1,128 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func bigValue(i int) string {
+	return strings.Repeat(fmt.Sprintf("value %d;", i), 200)
+}
+
+func TestValuePointer(t *testing.T) {
+	p := valuePointer{logID: 3, offset: 1 << 40, size: 2000, valueSize: 1800}
+	got, err := decodePointer(p.append(nil))
+	if err != nil || got != p {
+		t.Errorf("decodePointer() = %v, %v, want %v", got, err, p)
+	}
+	encoded := p.append(nil)
+	for _, data := range [][]byte{nil, encoded[:len(encoded)-1], {0xff, 0xff, 0xff, 0xff, 0xff, 0x01, 0, 0, 0}} {
+		if _, err := decodePointer(data); err != ErrCorruptRecord {
+			t.Errorf("decodePointer(%v) error = %v, want %v", data, err, ErrCorruptRecord)
+		}
+	}
+}
+
+func TestDiskStore_ValueLog(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{Format: FormatV2, ValueLogThreshold: 1024}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		store.Set(fmt.Sprintf("book:%d", i), bigValue(i))
+	}
+	store.Set("small", "value")
+	store.SetBytes("bytes", []byte(bigValue(100)))
+	if err := store.Sync(); err != nil {
+		t.Fatalf("Sync() error = %v", err)
+	}
+	info, err := os.Stat(fileName)
+	if err != nil {
+		t.Fatalf("failed to stat the data file: %v", err)
+	}
+	if info.Size() > 50*64 {
+		t.Errorf("data file size = %v, want the values out of it", info.Size())
+	}
+	if _, err := os.Stat(valueLogName(fileName, 1)); err != nil {
+		t.Errorf("the value log is missing: %v", err)
+	}
+
+	check := func() {
+		t.Helper()
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("book:%d", i)
+			if got, err := store.Get(key); err != nil || got != bigValue(i) {
+				t.Fatalf("Get(%v) = %v, %v, want %v", key, got, err, bigValue(i))
+			}
+		}
+		if got, err := store.Get("small"); err != nil || got != "value" {
+			t.Errorf("Get(small) = %v, %v, want value", got, err)
+		}
+		if got, err := store.Get("bytes"); err != nil || got != bigValue(100) {
+			t.Errorf("Get(bytes) = %v, %v, want %v", got, err, bigValue(100))
+		}
+		if size, err := store.SizeOf("book:7"); err != nil || size != len(bigValue(7)) {
+			t.Errorf("SizeOf(book:7) = %v, %v, want %v", size, err, len(bigValue(7)))
+		}
+		if got, err := store.GetRange("book:7", 8, 8); err != nil || string(got) != "value 7;" {
+			t.Errorf("GetRange(book:7) = %q, %v, want %q", got, err, "value 7;")
+		}
+		got, err := store.GetMulti([]string{"book:1", "small"})
+		if err != nil || got["book:1"] != bigValue(1) || got["small"] != "value" {
+			t.Errorf("GetMulti() = %v, %v", got, err)
+		}
+	}
+	check()
+	store.Close()
+
+	store, err = NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to reopen disk store: %v", err)
+	}
+	defer store.Close()
+	check()
+}
+
+func TestDiskStore_ValueLogCompact(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	opts := Options{Format: FormatV2, ValueLogThreshold: 1024, ValueLogFileSize: 16 << 10}
+	store, err := NewDiskStoreWithOptions(fileName, opts)
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 20; i++ {
+		store.Set(fmt.Sprintf("book:%d", i), bigValue(i))
+	}
+	// the first files of the value log have only the stale values left
+	for i := 0; i < 20; i++ {
+		store.Set(fmt.Sprintf("book:%d", i), bigValue(i+1))
+	}
+	sizeBefore := store.DiskSize()
+	stats, err := store.Compact()
+	if err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+	if stats.BytesReclaimed <= 0 || store.DiskSize() >= sizeBefore {
+		t.Errorf("Compact() = %+v, DiskSize() = %v, want less than %v", stats, store.DiskSize(), sizeBefore)
+	}
+	if _, err := os.Stat(valueLogName(fileName, 1)); !os.IsNotExist(err) {
+		t.Errorf("the stale value log file is still there: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("book:%d", i)
+		if got, err := store.Get(key); err != nil || got != bigValue(i+1) {
+			t.Fatalf("Get(%v) = %v, %v, want %v", key, got, err, bigValue(i+1))
+		}
+	}
+	// the compaction copied the pointers rather than the values
+	_, meta, _ := store.GetWithMeta("book:3")
+	if meta.Size > 64 {
+		t.Errorf("record size = %v after Compact(), want the pointer only", meta.Size)
+	}
+}
@@ -0,0 +1,186 @@
+package caskdb
+
+import (
+	"fmt"
+	"os"
+)
+
+// writeRequest is a write operation waiting for the writer goroutine to run it.
+type writeRequest struct {
+	op func() error
+	// keys are the keys op reads, if all is not set, see execKeys
+	keys []string
+	all  bool
+	err  error
+	// panicked is the value op panicked with, if it did; it is re-raised in the
+	// goroutine which made the request
+	panicked interface{}
+	done     chan struct{}
+}
+
+// exec runs op on the writer goroutine and returns its error. All the writes which
+// change keys go through here, instead of taking mu themselves: the writer runs them
+// one by one, in the order they arrived, so the records are appended in a predictable
+// order and only one goroutine ever touches the active file and mutates keyDir. The
+// writer holds mu while op runs, which keeps the maintenance done outside of it, like
+// the compaction swap and the flusher, from interleaving with op. The concurrent
+// writes are run in groups which share a single fsync, see runGroup.
+//
+// op may read anything from keyDir, so the keyDir updates still pending before it,
+// see deferRecord, are made first. A read-only store has no writer, and op is run in
+// place under mu. After Close, exec returns os.ErrClosed.
+func (d *DiskStore) exec(op func() error) error {
+	return d.submit(&writeRequest{op: op, all: true})
+}
+
+// execKeys is the same as exec, for an op which reads only the given keys from
+// keyDir, or none of them. The pending keyDir updates are made first only if they
+// touch one of the keys, so that the blind writes, like Set, keep piling up in the
+// write buffer of Options.WriteBufferSize.
+func (d *DiskStore) execKeys(keys []string, op func() error) error {
+	return d.submit(&writeRequest{op: op, keys: keys})
+}
+
+// submit hands the request to the writer goroutine and waits for it to be run.
+func (d *DiskStore) submit(req *writeRequest) error {
+	if d.writes == nil {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return req.op()
+	}
+	req.done = make(chan struct{})
+	select {
+	case d.writes <- req:
+	case <-d.writerDone:
+		return os.ErrClosed
+	}
+	<-req.done
+	if req.panicked != nil {
+		panic(req.panicked)
+	}
+	return req.err
+}
+
+// maxGroupSize caps the number of requests the writer runs as one group, so that a
+// steady stream of writes cannot hold mu forever.
+const maxGroupSize = 128
+
+// startWriter starts the writer goroutine, see exec.
+func (d *DiskStore) startWriter() {
+	d.writes = make(chan *writeRequest)
+	d.writerStop, d.writerDone = make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(d.writerDone)
+		for {
+			select {
+			case <-d.writerStop:
+				return
+			case req := <-d.writes:
+				d.runGroup(d.collectGroup(req))
+			}
+		}
+	}()
+}
+
+// collectGroup returns req along with the requests which are already waiting to be
+// run. While the writer is busy, e.g. syncing the previous group, the concurrent
+// writers pile up on d.writes, and they are all picked up here at once.
+func (d *DiskStore) collectGroup(req *writeRequest) []*writeRequest {
+	group := []*writeRequest{req}
+	for len(group) < maxGroupSize {
+		select {
+		case req := <-d.writes:
+			group = append(group, req)
+		default:
+			return group
+		}
+	}
+	return group
+}
+
+// runGroup runs the requests one by one under mu, in order, and hands their results
+// back. This is a group commit: with SyncAlways, the writes of the group do not sync
+// on their own, the records are synced with a single fsync at the end instead, and
+// none of the writers is acknowledged before that. keyDir is not pointed to the
+// records before the sync either, see deferRecord, so the reads never see a write
+// which is not acknowledged yet; a request which reads a key written earlier in the
+// group syncs the group so far first, see execKeys. If the sync fails, the store is
+// in the failed state, all the requests of the group fail with the error, and their
+// records never make it to keyDir, though like any record which was written, they
+// may be there after a reopen.
+func (d *DiskStore) runGroup(group []*writeRequest) {
+	d.mu.Lock()
+	d.grouping = true
+	for _, req := range group {
+		d.run(req)
+	}
+	d.grouping = false
+	var err error
+	if d.opts.SyncPolicy == SyncAlways && d.dirty {
+		if d.failed.Load() != nil {
+			// a write of the group failed, so the ones before it are not synced
+			err = d.Failed()
+		} else if serr := d.syncFile(); serr != nil {
+			err = d.fail(fmt.Errorf("failed to sync to disk: %w", serr))
+		} else {
+			d.dirty = false
+		}
+	}
+	if d.failed.Load() != nil {
+		d.dropPending()
+	}
+	d.mu.Unlock()
+	for _, req := range group {
+		if err != nil && req.err == nil && req.panicked == nil {
+			req.err = err
+		}
+		close(req.done)
+	}
+}
+
+// run runs a single request of a group. A panic in op is recovered, so that it
+// does not take the writer down, and re-raised by exec in the goroutine which made
+// the request.
+func (d *DiskStore) run(req *writeRequest) {
+	defer func() {
+		req.panicked = recover()
+	}()
+	if d.readsPending(req) {
+		if req.err = d.settlePending(); req.err != nil {
+			return
+		}
+	}
+	req.err = req.op()
+}
+
+// readsPending reports whether the request reads any of the keys whose keyDir
+// updates are pending.
+func (d *DiskStore) readsPending(req *writeRequest) bool {
+	if len(d.pending) == 0 {
+		return false
+	}
+	if req.all {
+		return true
+	}
+	for _, key := range req.keys {
+		if d.pendingKeys[key] {
+			return true
+		}
+	}
+	return false
+}
+
+// stopWriter stops the writer goroutine and waits for it to exit. The requests made
+// afterwards fail with os.ErrClosed.
+func (d *DiskStore) stopWriter() {
+	if d.writes == nil {
+		return
+	}
+	select {
+	case <-d.writerStop:
+		// already stopped
+	default:
+		close(d.writerStop)
+	}
+	<-d.writerDone
+}
@@ -0,0 +1,178 @@
+package caskdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDiskStore_WriterOrder(t *testing.T) {
+	fileName := filepath.Join(t.TempDir(), "test.db")
+	store, err := NewDiskStoreWithOptions(fileName, Options{SyncPolicy: SyncNever})
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer store.Close()
+
+	const writers, writes = 8, 100
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < writes; i++ {
+				if err := store.Set(fmt.Sprintf("writer%d", w), strconv.Itoa(i)); err != nil {
+					t.Errorf("Set() error = %v", err)
+					return
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	// the writes of each goroutine have to be in the file in the order they were made
+	last := make(map[string]int)
+	_, err = forEachRecord(fileName, newRateLimiter(0), func(_ recordHeader, record []byte) error {
+		_, key, value := decodeKV(record)
+		i, _ := strconv.Atoi(value)
+		if prev, ok := last[key]; ok && i != prev+1 {
+			return fmt.Errorf("%s: %d follows %d", key, i, prev)
+		}
+		last[key] = i
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("records out of order: %v", err)
+	}
+	for w := 0; w < writers; w++ {
+		key := fmt.Sprintf("writer%d", w)
+		if got, err := store.Get(key); err != nil || got != strconv.Itoa(writes-1) {
+			t.Errorf("Get(%v) = %v, %v, want %v", key, got, err, writes-1)
+		}
+	}
+}
+
+func TestDiskStore_WriterPanic(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	func() {
+		defer func() {
+			if r := recover(); r != "boom" {
+				t.Errorf("recover() = %v, want boom", r)
+			}
+		}()
+		store.Update("name", func(old string, exists bool) (string, error) {
+			panic("boom")
+		})
+	}()
+	// the writer survives the panic and the lock is released
+	if err := store.Set("name", "jojo"); err != nil {
+		t.Fatalf("Set() after a panic error = %v", err)
+	}
+	if got, err := store.Get("name"); err != nil || got != "jojo" {
+		t.Errorf("Get(name) = %v, %v, want jojo", got, err)
+	}
+}
+
+func TestDiskStore_WriteAfterClose(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	if err := store.Set("name", "jojo"); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Set() after Close() error = %v, want os.ErrClosed", err)
+	}
+	if _, err := store.Increment("count", 1); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Increment() after Close() error = %v, want os.ErrClosed", err)
+	}
+	if err := store.Delete("name"); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("Delete() after Close() error = %v, want os.ErrClosed", err)
+	}
+}
+
+func TestDiskStore_GroupCommit(t *testing.T) {
+	store, err := NewDiskStore("test.db")
+	if err != nil {
+		t.Fatalf("failed to create disk store: %v", err)
+	}
+	defer os.Remove("test.db")
+	defer store.Close()
+
+	newRequest := func(op func() error) *writeRequest {
+		return &writeRequest{op: op, done: make(chan struct{})}
+	}
+	var group []*writeRequest
+	for i := 0; i < 3; i++ {
+		key := fmt.Sprintf("key%d", i)
+		group = append(group, newRequest(func() error {
+			if err := store.set(key, "value", 0); err != nil {
+				return err
+			}
+			if !store.dirty {
+				return errors.New("the write was synced on its own")
+			}
+			if store.Has(key) {
+				return errors.New("the write is visible before the sync")
+			}
+			return nil
+		}))
+	}
+	store.runGroup(group)
+	for i, req := range group {
+		if req.err != nil {
+			t.Errorf("request %d error = %v", i, req.err)
+		}
+	}
+	if store.dirty {
+		t.Errorf("dirty = true after the group, want the group synced")
+	}
+	if got, err := store.Get("key0"); err != nil || got != "value" {
+		t.Errorf("Get() after the group = %v, %v, want value", got, err)
+	}
+
+	// a request which reads a key written earlier in the group sees it
+	group = []*writeRequest{
+		newRequest(func() error { return store.set("city", "tokyo", 0) }),
+		{op: func() error {
+			value, err := store.get("city")
+			if err != nil {
+				return err
+			}
+			return store.set("city", string(value)+"!", 0)
+		}, keys: []string{"city"}, done: make(chan struct{})},
+	}
+	store.runGroup(group)
+	if got, err := store.Get("city"); err != nil || got != "tokyo!" {
+		t.Errorf("Get() after a read-modify-write in the group = %v, %v, want tokyo!", got, err)
+	}
+
+	// a failure in the middle of a group fails the writes before it as well, since
+	// they were never synced
+	group = []*writeRequest{
+		newRequest(func() error { return store.set("name", "jojo", 0) }),
+		newRequest(func() error { return store.fail(errors.New("disk on fire")) }),
+	}
+	store.runGroup(group)
+	if !errors.Is(group[0].err, ErrStoreFailed) {
+		t.Errorf("first request error = %v, want %v", group[0].err, ErrStoreFailed)
+	}
+	if group[1].err == nil || errors.Is(group[1].err, ErrStoreFailed) {
+		t.Errorf("second request error = %v, want its own error", group[1].err)
+	}
+	if _, err := store.Get("name"); !errors.Is(err, ErrKeyNotFound) {
+		t.Errorf("Get() of a write of the failed group error = %v, want %v", err, ErrKeyNotFound)
+	}
+}